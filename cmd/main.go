@@ -2,8 +2,9 @@ package main
 
 import (
 	"fmt"
+	"os"
 
-	framework "../framework"
+	framework "github.com/multiverse-os/vcable/framework"
 )
 
 func main() {
@@ -12,5 +13,8 @@ func main() {
 
 	cable := framework.NewCable()
 
-	cable.Connect()
+	if err := cable.Connect(); err != nil {
+		fmt.Fprintln(os.Stderr, "vcable:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,98 @@
+// Command vcable-extcap is a Wireshark extcap plugin showing the traffic of
+// vcable processes live. Each process exporting a capture, with
+// capture.Export, appears as an interface. Install it in Wireshark's extcap
+// directory, such as ~/.local/lib/wireshark/extcap.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	capture "github.com/multiverse-os/vcable/framework/capture"
+)
+
+func main() {
+	flags := flag.NewFlagSet("vcable-extcap", flag.ContinueOnError)
+	var (
+		interfaces = flags.Bool("extcap-interfaces", false, "list interfaces")
+		dlts       = flags.Bool("extcap-dlts", false, "list link types of an interface")
+		config     = flags.Bool("extcap-config", false, "list configuration options of an interface")
+		capturing  = flags.Bool("capture", false, "capture from an interface")
+		iface      = flags.String("extcap-interface", "", "interface")
+		fifo       = flags.String("fifo", "", "path to write the capture to")
+	)
+	flags.String("extcap-version", "", "Wireshark version")
+	flags.String("extcap-capture-filter", "", "capture filter, unsupported")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	var err error
+	switch {
+	case *interfaces:
+		err = listInterfaces()
+	case *dlts:
+		fmt.Printf("dlt {number=%d}{name=VSOCK}{display=vsock}\n", capture.LinkType)
+	case *config:
+		// There is nothing to configure.
+	case *capturing:
+		err = run(*iface, *fifo)
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "vcable-extcap: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func listInterfaces() error {
+	fmt.Println("extcap {version=1.0}{help=https://github.com/multiverse-os/vcable}")
+	names, err := capture.Interfaces()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fmt.Printf("interface {value=%s}{display=vcable: %s}\n", name, name)
+	}
+	return nil
+}
+
+// run copies the capture of iface into fifo until Wireshark stops it.
+func run(iface, fifo string) error {
+	if iface == "" || fifo == "" {
+		return fmt.Errorf("--capture needs --extcap-interface and --fifo")
+	}
+	conn, err := capture.Open(iface)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	out, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		conn.Close()
+	}()
+	if _, err := io.Copy(out, conn); err != nil && !isClosed(err) {
+		return err
+	}
+	return nil
+}
+
+func isClosed(err error) bool {
+	return errors.Is(err, net.ErrClosed) || errors.Is(err, syscall.EPIPE)
+}
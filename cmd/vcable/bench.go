@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strconv"
+
+	bench "github.com/multiverse-os/vcable/framework/bench"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// benchCommand runs a benchmark server with -listen, and otherwise runs a
+// benchmark against the server at the given context ID.
+func benchCommand(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	listen := flags.Bool("listen", false, "serve benchmarks")
+	iperf3 := flags.Bool("iperf3", false, "serve the iperf3 protocol instead, for iperf3 clients with vsock support")
+	port := flags.Uint("port", bench.Port, "vsock port")
+	options := bench.Options{}
+	flags.DurationVar(&options.Duration, "time", 0, "duration of the run")
+	flags.BoolVar(&options.Reverse, "reverse", false, "have the server send")
+	flags.IntVar(&options.BlockSize, "len", bench.DefaultBlockSize, "size of each write")
+	flags.Parse(args)
+
+	if *listen {
+		l, err := vsock.Listen(uint32(*port))
+		if err != nil {
+			return err
+		}
+		defer l.Close()
+		if *iperf3 {
+			return (&bench.Iperf3{}).Serve(l)
+		}
+		return (&bench.Server{BlockSize: options.BlockSize}).Serve(l)
+	}
+
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: vcable bench [-listen [-iperf3]] [-port port] [-time duration] [-reverse] [cid]")
+	}
+	cid, err := strconv.ParseUint(flags.Arg(0), 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid context ID %q", flags.Arg(0))
+	}
+	var conn net.Conn
+	if conn, err = vsock.Dial(uint32(cid), uint32(*port)); err != nil {
+		return err
+	}
+	result, err := bench.Run(conn, options)
+	if err != nil {
+		return err
+	}
+	fmt.Println(result)
+	return nil
+}
@@ -0,0 +1,92 @@
+// Command vcable is the command line tool of vcable.
+//
+//	vcable doctor    diagnose vsock on this machine
+//	vcable privsep   run the helper opening vsock sockets for unprivileged agents
+//	vcable nocloud   fetch this guest's cloud-init seed from the host; run it
+//	                 before cloud-init-local.service
+//	vcable bench     measure throughput to a vsock peer, or serve benchmarks,
+//	                 optionally to iperf3 clients
+//	vcable mount     browse the files of guests under /vcable, or mount the
+//	                 directory the host shares inside a guest
+//	vcable share     share a directory of the host with guests
+//	vcable listen    listen on a vsock port and dump, or echo, what peers send
+//	vcable dial      dial cid:port and pipe it to stdin and stdout
+//	vcable forward   forward connections between vsock, TCP and Unix sockets
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	cloudinit "github.com/multiverse-os/vcable/framework/cloudinit"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: vcable doctor | privsep [-socket path] [-group name] | nocloud [-dir path] | bench [flags] [cid] | mount [flags] name=cid... | mount -share [flags] | share dir | listen [-echo] [-hex] port | dial cid:port | forward listen target")
+	os.Exit(2)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "doctor":
+		if err := doctorCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "privsep":
+		if err := privsepCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "nocloud":
+		flags := flag.NewFlagSet("nocloud", flag.ExitOnError)
+		dir := flags.String("dir", cloudinit.DefaultSeedDir, "directory to write the seed to")
+		flags.Parse(os.Args[2:])
+		seed, err := cloudinit.Fetch(context.Background())
+		if err == nil {
+			err = seed.Write(*dir)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "bench":
+		if err := benchCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "mount":
+		if err := mountCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "share":
+		if err := shareCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "listen":
+		if err := listenCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "dial":
+		if err := dialCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	case "forward":
+		if err := forwardCommand(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vcable: %v\n", err)
+			os.Exit(1)
+		}
+	default:
+		usage()
+	}
+}
@@ -0,0 +1,85 @@
+//go:build linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+
+	transfer "github.com/multiverse-os/vcable/framework/agent/transfer"
+	guestfs "github.com/multiverse-os/vcable/framework/guestfs"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// mountCommand mounts the files of the guests given as name=cid arguments
+// or, with -share, the directory the host shares, until interrupted.
+func mountCommand(args []string) error {
+	flags := flag.NewFlagSet("mount", flag.ExitOnError)
+	dir := flags.String("dir", guestfs.DefaultMountPoint, "mount point")
+	share := flags.Bool("share", false, "mount the directory the host shares, inside a guest")
+	port := flags.Uint("port", guestfs.SharePort, "host port of the share")
+	allowOther := flags.Bool("allow-other", false, "let other users access the mount")
+	var cache guestfs.Cache
+	flags.DurationVar(&cache.Timeout, "cache", 0, "how long to cache names and attributes, negative for never")
+	flags.BoolVar(&cache.Data, "cache-data", false, "keep file contents cached until they change")
+	flags.Parse(args)
+
+	var fsys guestfs.FS
+	if *share {
+		share := &guestfs.Share{Dial: func() (net.Conn, error) { return vsock.DialHost(uint32(*port)) }}
+		defer share.Close()
+		fsys = share
+	} else {
+		var guests []guestfs.Guest
+		for _, arg := range flags.Args() {
+			name, cid, ok := strings.Cut(arg, "=")
+			id, err := strconv.ParseUint(cid, 10, 32)
+			if !ok || name == "" || strings.Contains(name, "/") || err != nil {
+				return fmt.Errorf("usage: vcable mount [flags] name=cid... | mount -share [flags]")
+			}
+			guests = append(guests, guestfs.Guest{Name: name, ContextID: uint32(id)})
+		}
+		view := &guestfs.View{Guests: func() ([]guestfs.Guest, error) { return guests, nil }}
+		defer view.Close()
+		fsys = view
+	}
+	m := &guestfs.Mount{Dir: *dir, FS: fsys, Cache: cache, AllowOther: *allowOther}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		m.Close()
+	}()
+	return m.Serve()
+}
+
+// shareCommand shares a directory of the host with guests, read only.
+func shareCommand(args []string) error {
+	flags := flag.NewFlagSet("share", flag.ExitOnError)
+	port := flags.Uint("port", guestfs.SharePort, "vsock port")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: vcable share [-port port] dir")
+	}
+
+	l, err := vsock.ListenHost(uint32(*port))
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	service := &transfer.Service{Root: flags.Arg(0), ReadOnly: true}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go service.Serve(conn)
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	bridge "github.com/multiverse-os/vcable/framework/bridge"
+	proxy "github.com/multiverse-os/vcable/framework/proxy"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// listenCommand listens on a vsock port and dumps what each peer sends to
+// stdout, or with -echo sends it back, until interrupted.
+func listenCommand(args []string) error {
+	flags := flag.NewFlagSet("listen", flag.ExitOnError)
+	echo := flags.Bool("echo", false, "send what peers send back to them")
+	dumpHex := flags.Bool("hex", false, "dump traffic as hex")
+	once := flags.Bool("once", false, "exit after the first connection")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: vcable listen [-echo] [-hex] [-once] port")
+	}
+	e, err := proxy.ParseEndpoint("vsock:" + flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	l, err := vsock.Listen(e.Port)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	fmt.Fprintf(os.Stderr, "vcable: listening on %v\n", l.Addr())
+	closeOnSignal(l)
+
+	d := &dumper{w: os.Stdout, hex: *dumpHex}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if *once || isClosed(err) {
+				return nil
+			}
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "vcable: %v connected\n", conn.RemoteAddr())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.serve(conn, *echo)
+			fmt.Fprintf(os.Stderr, "vcable: %v disconnected", conn.RemoteAddr())
+			if err != nil {
+				fmt.Fprintf(os.Stderr, ": %v", err)
+			}
+			fmt.Fprintln(os.Stderr)
+		}()
+		if *once {
+			l.Close()
+		}
+	}
+}
+
+// dumper writes the traffic of connections to w, one read at a time so
+// those of concurrent connections do not interleave.
+type dumper struct {
+	w   io.Writer
+	hex bool
+
+	mutex sync.Mutex
+}
+
+// serve dumps what conn sends until it is done, sending it back if echo
+// is set.
+func (self *dumper) serve(conn net.Conn, echo bool) error {
+	defer conn.Close()
+	b := make([]byte, 32<<10)
+	for {
+		n, err := conn.Read(b)
+		if n > 0 {
+			self.dump(conn.RemoteAddr(), b[:n])
+			if echo {
+				if _, err := conn.Write(b[:n]); err != nil {
+					return err
+				}
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (self *dumper) dump(from net.Addr, b []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.hex {
+		fmt.Fprintf(self.w, "%v, %d bytes:\n%s", from, len(b), hex.Dump(b))
+		return
+	}
+	self.w.Write(b)
+}
+
+// dialCommand dials cid:port and pipes stdin to the connection and the
+// connection to stdout, until the peer is done.
+func dialCommand(args []string) error {
+	flags := flag.NewFlagSet("dial", flag.ExitOnError)
+	timeout := flags.Duration("timeout", 10*time.Second, "how long to wait for the connection")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: vcable dial [-timeout duration] cid:port")
+	}
+	e, err := proxy.ParseEndpoint("vsock:" + flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	conn, err := vsock.DialContext(context.Background(), e.ContextID, e.Port, vsock.WithTimeout(*timeout))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return pipe(conn, os.Stdin, os.Stdout)
+}
+
+// pipe copies in to conn, half-closing it at the end of in, and conn to
+// out until the peer is done.
+func pipe(conn *vsock.Conn, in io.Reader, out io.Writer) error {
+	go func() {
+		if _, err := io.Copy(conn, in); err != nil {
+			conn.Close()
+			return
+		}
+		conn.CloseWrite()
+	}()
+	if _, err := io.Copy(out, conn); err != nil && !isClosed(err) {
+		return err
+	}
+	return nil
+}
+
+// forwardCommand forwards the connections accepted on one endpoint to the
+// other, until interrupted.
+func forwardCommand(args []string) error {
+	flags := flag.NewFlagSet("forward", flag.ExitOnError)
+	maxConns := flags.Int("max-conns", 0, "connections to forward at once, 0 for no limit")
+	idle := flags.Duration("idle", 0, "close connections idle this long, 0 for never")
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		return fmt.Errorf("usage: vcable forward [-max-conns n] [-idle duration] listen target\n" +
+			"endpoints are vsock:cid:port, vsock:port, tcp:host:port or unix:path")
+	}
+	listen, err := proxy.ParseEndpoint(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	target, err := proxy.ParseEndpoint(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+
+	profile := bridge.Default
+	profile.IdleTimeout = *idle
+	var forwarder proxy.Forwarder
+	if err := forwarder.Add(proxy.Forward{
+		Name:     "forward",
+		Listen:   listen,
+		Target:   target,
+		MaxConns: *maxConns,
+		Profile:  profile,
+	}); err != nil {
+		return err
+	}
+	addr, _ := forwarder.Addr("forward")
+	fmt.Fprintf(os.Stderr, "vcable: forwarding %v to %v\n", addr, target)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	// Shutdown forgets the forward, so read its counters first; those of
+	// connections still draining are not counted.
+	stats, _ := forwarder.Stats("forward")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	forwarder.Shutdown(ctx)
+	fmt.Fprintf(os.Stderr, "vcable: forwarded %d connections, %d bytes in, %d bytes out\n", stats.Total, stats.Received, stats.Sent)
+	return nil
+}
+
+// closeOnSignal closes l when interrupted.
+func closeOnSignal(l io.Closer) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		l.Close()
+	}()
+}
+
+func isClosed(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "use of closed network connection")
+}
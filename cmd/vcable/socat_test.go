@@ -0,0 +1,200 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// redirect replaces *f, such as os.Stdin, with a file holding contents
+// until the test ends, and returns it.
+func redirect(t *testing.T, f **os.File, contents string) *os.File {
+	file, err := os.CreateTemp(t.TempDir(), "std")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+	file.Seek(0, io.SeekStart)
+	previous := *f
+	*f = file
+	t.Cleanup(func() {
+		*f = previous
+		file.Close()
+	})
+	return file
+}
+
+func contents(t *testing.T, f *os.File) string {
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// dial dials cid:port from machine, waiting for a command to listen there.
+func dial(t *testing.T, machine *vsocktest.Machine, cid, port uint32) net.Conn {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := machine.Dial(cid, port)
+		if err == nil {
+			return conn
+		}
+		if !errors.Is(err, syscall.ECONNREFUSED) || time.Now().After(deadline) {
+			t.Fatalf("failed to dial %d:%d: %v", cid, port, err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// echo sends "ping" over conn and returns what comes back.
+func echo(t *testing.T, conn net.Conn) string {
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return string(b)
+}
+
+func TestListenCommand(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+	stdout := redirect(t, &os.Stdout, "")
+
+	done := make(chan error, 1)
+	go func() { done <- listenCommand([]string{"-echo", "-once", "1024"}) }()
+	conn := dial(t, network.Machine(3), vsock.Host, 1024)
+	got := echo(t, conn)
+	conn.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	if diff := cmp.Diff([]string{"ping", "ping"}, []string{got, contents(t, stdout)}); diff != "" {
+		t.Fatalf("unexpected echo and dump (-want +got):\n%s", diff)
+	}
+
+	for _, args := range [][]string{nil, {"1024", "1025"}, {"port"}} {
+		if err := listenCommand(args); err == nil {
+			t.Errorf("expected listen %q to fail", args)
+		}
+	}
+}
+
+func TestDumper(t *testing.T) {
+	var b strings.Builder
+	d := &dumper{w: &b, hex: true}
+	d.dump(&vsock.Addr{ContextID: 3, Port: 1024}, []byte("ping"))
+	want := "vm(3):1024, 4 bytes:\n00000000  70 69 6e 67                                       |ping|\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Fatalf("unexpected dump (-want +got):\n%s", diff)
+	}
+}
+
+func TestDialCommand(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	l, err := network.Machine(vsock.Host).Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	restore := network.Machine(3).Install()
+	defer restore()
+
+	// Stdin is sent and the connection half-closed, so the peer finishes
+	// echoing it.
+	redirect(t, &os.Stdin, "ping")
+	stdout := redirect(t, &os.Stdout, "")
+	if err := dialCommand([]string{"2:1024"}); err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	if diff := cmp.Diff("ping", contents(t, stdout)); diff != "" {
+		t.Fatalf("unexpected output (-want +got):\n%s", diff)
+	}
+
+	if err := dialCommand([]string{"2:1025"}); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected the dial to be refused, got %v", err)
+	}
+	if err := dialCommand(nil); err == nil {
+		t.Fatal("expected dial without an address to fail")
+	}
+}
+
+func TestForwardCommand(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	l, err := network.Machine(vsock.Host).Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	// Interrupts are caught here too, so they do not kill the test before
+	// the command waits for them.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt)
+	defer signal.Stop(signals)
+
+	done := make(chan error, 1)
+	go func() { done <- forwardCommand([]string{"vsock:1025", "vsock:2:1024"}) }()
+	conn := dial(t, network.Machine(3), vsock.Host, 1025)
+	if got := echo(t, conn); got != "ping" {
+		t.Fatalf("expected the forwarded echo, got %q", got)
+	}
+	conn.Close()
+
+	tick := time.NewTicker(10 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatalf("forward failed: %v", err)
+			}
+			if err := forwardCommand([]string{"vsock:1025"}); err == nil {
+				t.Fatal("expected forward without a target to fail")
+			}
+			return
+		case <-tick.C:
+		}
+	}
+}
@@ -0,0 +1,32 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+
+	doctor "github.com/multiverse-os/vcable/framework/doctor"
+	privsep "github.com/multiverse-os/vcable/framework/privsep"
+)
+
+// doctorCommand prints the diagnosis of vsock on this machine, failing if
+// any check failed.
+func doctorCommand(args []string) error {
+	if !doctor.Print(os.Stdout, doctor.Run()) {
+		return errors.New("vsock is not usable on this machine")
+	}
+	return nil
+}
+
+// privsepCommand runs the helper opening vsock sockets for unprivileged
+// agents.
+func privsepCommand(args []string) error {
+	flags := flag.NewFlagSet("privsep", flag.ExitOnError)
+	helper := &privsep.Helper{}
+	flags.StringVar(&helper.Path, "socket", privsep.DefaultPath, "path of the helper socket")
+	flags.StringVar(&helper.Group, "group", "", "group allowed to use the helper")
+	flags.Parse(args)
+	return helper.ListenAndServe()
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// The commands below need Linux: the doctor checks its kernel modules and
+// devices, privsep passes descriptors over Unix sockets, and mount and
+// share run on FUSE.
+var errLinuxOnly = errors.New("this command is only supported on linux")
+
+func doctorCommand(args []string) error  { return errLinuxOnly }
+func privsepCommand(args []string) error { return errLinuxOnly }
+func mountCommand(args []string) error   { return errLinuxOnly }
+func shareCommand(args []string) error   { return errLinuxOnly }
@@ -0,0 +1,247 @@
+// Package agent runs the guest side of a vcable: a set of services, each
+// bound to its own vsock port, that the host connects to with a Client.
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	systemd "github.com/multiverse-os/vcable/framework/systemd"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// A Service is a unit of functionality exposed by the agent on a vsock port.
+// Serve is called once per accepted connection and owns the connection until
+// it returns.
+type Service interface {
+	Name() string
+	Port() uint32
+	Serve(conn net.Conn) error
+}
+
+type Agent struct {
+	// Listen opens the listener for a service port. Defaults to vsock.Listen.
+	Listen func(port uint32) (net.Listener, error)
+	// ErrorLog receives service errors. Defaults to a logger on stderr.
+	ErrorLog *log.Logger
+	// Notify reports readiness to systemd once every service is listening,
+	// and feeds its watchdog while the agent is healthy.
+	Notify bool
+	// Healthy, if set, gates the watchdog, e.g. on the state of a cable.
+	Healthy func() bool
+	// Registry resolves the services named to Enable. Defaults to
+	// Default.
+	Registry *Registry
+	// Middleware wraps the handlers of every service, such as to
+	// authenticate, log or rate limit their connections, and
+	// ServiceMiddleware those of the services named, inside it. The first
+	// entry is the outermost; both run before the handshake of versioned
+	// services.
+	Middleware        []vsock.Middleware
+	ServiceMiddleware map[string][]vsock.Middleware
+	// HandshakeTimeout bounds the handshake of versioned services.
+	// Defaults to DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+
+	mutex    sync.Mutex
+	services []Service
+	servers  []*vsock.Server
+	closed   bool
+}
+
+func New(services ...Service) *Agent {
+	return &Agent{
+		services: services,
+	}
+}
+
+func (self *Agent) Register(service Service) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.services = append(self.services, service)
+}
+
+// Enable registers the services named, made by the factories of Registry.
+// Nothing is registered unless every name is known.
+func (self *Agent) Enable(names ...string) error {
+	registry := self.Registry
+	if registry == nil {
+		registry = Default
+	}
+	services := make([]Service, 0, len(names))
+	for _, name := range names {
+		service, err := registry.New(name)
+		if err != nil {
+			return err
+		}
+		services = append(services, service)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.services = append(self.services, services...)
+	return nil
+}
+
+func (self *Agent) Services() []Service {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return append([]Service(nil), self.services...)
+}
+
+// ListenAndServe opens a listener for every registered service and serves
+// connections until Close is called or a listener fails.
+func (self *Agent) ListenAndServe() error {
+	listen := self.Listen
+	if listen == nil {
+		listen = func(port uint32) (net.Listener, error) { return vsock.Listen(port) }
+	}
+
+	self.mutex.Lock()
+	switch {
+	case self.closed:
+		self.mutex.Unlock()
+		return fmt.Errorf("agent: closed")
+	case len(self.services) == 0:
+		self.mutex.Unlock()
+		return fmt.Errorf("agent: no services registered")
+	}
+
+	// Claim every port first, so a collision is reported before anything
+	// listens.
+	services := append([]Service(nil), self.services...)
+	for i, service := range services {
+		if err := vsock.Ports.Claim(service.Port(), "agent: "+service.Name()); err != nil {
+			self.mutex.Unlock()
+			release(services[:i])
+			return fmt.Errorf("agent: %v", err)
+		}
+	}
+	defer release(services)
+
+	var listeners []net.Listener
+	for _, service := range self.services {
+		l, err := listen(service.Port())
+		if err != nil {
+			self.mutex.Unlock()
+			for _, l := range listeners {
+				l.Close()
+			}
+			return fmt.Errorf("agent: %s: %v", service.Name(), err)
+		}
+		listeners = append(listeners, l)
+		self.servers = append(self.servers, &vsock.Server{
+			Handler:    self.handler(service),
+			Middleware: self.middleware(service),
+			ErrorLog:   self.errorLog(),
+		})
+	}
+	servers := self.servers
+	self.mutex.Unlock()
+
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(server *vsock.Server, l net.Listener) {
+			errs <- server.Serve(l)
+		}(servers[i], listeners[i])
+	}
+
+	if self.Notify {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		self.notify(ctx)
+	}
+
+	err := <-errs
+	self.Close()
+	for i := 1; i < len(servers); i++ {
+		<-errs
+	}
+	if err == vsock.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// release gives up the port claims of services.
+func release(services []Service) {
+	for _, service := range services {
+		vsock.Ports.Release(service.Port(), "agent: "+service.Name())
+	}
+}
+
+func (self *Agent) middleware(service Service) []vsock.Middleware {
+	middleware := append([]vsock.Middleware(nil), self.Middleware...)
+	return append(middleware, self.ServiceMiddleware[service.Name()]...)
+}
+
+func (self *Agent) handler(service Service) vsock.Handler {
+	versioned, _ := service.(VersionedService)
+	timeout := self.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	return vsock.HandlerFunc(func(conn net.Conn) {
+		if versioned != nil {
+			agreed, err := serverHandshake(conn, versioned, timeout)
+			if err != nil {
+				self.errorLog().Printf("%s: %s: %v", service.Name(), conn.RemoteAddr(), err)
+				return
+			}
+			conn = agreed
+		}
+		if err := service.Serve(conn); err != nil {
+			self.errorLog().Printf("%s: %s: %v", service.Name(), conn.RemoteAddr(), err)
+		}
+	})
+}
+
+// notify tells systemd the agent is ready and feeds its watchdog until ctx
+// is done.
+func (self *Agent) notify(ctx context.Context) {
+	if _, err := systemd.Ready(); err != nil {
+		self.errorLog().Printf("systemd: %v", err)
+	}
+	go func() {
+		if err := systemd.Watchdog(ctx, self.healthy); err != nil {
+			self.errorLog().Printf("systemd: %v", err)
+		}
+	}()
+}
+
+func (self *Agent) healthy() bool {
+	self.mutex.Lock()
+	closed := self.closed
+	self.mutex.Unlock()
+	if closed {
+		return false
+	}
+	return self.Healthy == nil || self.Healthy()
+}
+
+func (self *Agent) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.Notify && !self.closed {
+		systemd.Stopping()
+	}
+	self.closed = true
+	var err error
+	for _, server := range self.servers {
+		if cerr := server.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (self *Agent) errorLog() *log.Logger {
+	if self.ErrorLog != nil {
+		return self.ErrorLog
+	}
+	return log.New(os.Stderr, "agent: ", log.LstdFlags)
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type echo struct{ port uint32 }
+
+func (self *echo) Name() string { return "echo" }
+func (self *echo) Port() uint32 { return self.port }
+
+func (self *echo) Serve(conn net.Conn) error {
+	defer conn.Close()
+	_, err := conn.Write([]byte("echo"))
+	return err
+}
+
+func TestEnable(t *testing.T) {
+	registry := &Registry{}
+	registry.Register("echo", func() Service { return &echo{port: 5300} })
+
+	agent := &Agent{Registry: registry}
+	if err := agent.Enable("echo", "missing"); err == nil {
+		t.Fatal("expected unknown services to fail")
+	}
+	if len(agent.Services()) != 0 {
+		t.Fatal("expected nothing enabled after a failure")
+	}
+	if err := agent.Enable("echo"); err != nil {
+		t.Fatalf("failed to enable: %v", err)
+	}
+	var ports []uint32
+	for _, service := range agent.Services() {
+		ports = append(ports, service.Port())
+	}
+	if diff := cmp.Diff([]uint32{5300}, ports); diff != "" {
+		t.Errorf("unexpected services (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"echo"}, registry.Names()); diff != "" {
+		t.Errorf("unexpected names (-want +got):\n%s", diff)
+	}
+	if len(Default.Names()) != 0 {
+		t.Error("expected other registries to be unaffected")
+	}
+}
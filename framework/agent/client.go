@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Client is the host side of the agent of a guest.
+type Client struct {
+	// ContextID is the context ID of the guest.
+	ContextID uint32
+	// Dial connects to port of the guest. Defaults to vsock.DialContext.
+	Dial func(ctx context.Context, contextID, port uint32) (net.Conn, error)
+	// HandshakeTimeout bounds the handshake of versioned services.
+	// Defaults to DefaultHandshakeTimeout.
+	HandshakeTimeout time.Duration
+}
+
+// DialPort connects to the service on port, without a handshake, as
+// services which are not versioned expect.
+func (self *Client) DialPort(ctx context.Context, port uint32) (net.Conn, error) {
+	dial := self.Dial
+	if dial == nil {
+		dial = func(ctx context.Context, contextID, port uint32) (net.Conn, error) {
+			return vsock.DialContext(ctx, contextID, port)
+		}
+	}
+	return dial(ctx, self.ContextID, port)
+}
+
+// DialService connects to the versioned service called name on port, and
+// agrees on the highest version from min to max both speak, which
+// VersionOf returns for the connection.
+func (self *Client) DialService(ctx context.Context, name string, port uint32, min, max uint16) (net.Conn, error) {
+	conn, err := self.DialPort(ctx, port)
+	if err != nil {
+		return nil, err
+	}
+	timeout := self.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	handshakeCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	stop := vsock.BindContext(handshakeCtx, conn)
+	versioned, err := clientHandshake(conn, name, min, max)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return versioned, nil
+}
@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// versionEcho answers each connection with the version agreed.
+type versionEcho struct{ echo }
+
+func (self *versionEcho) Name() string               { return "versioned" }
+func (self *versionEcho) Versions() (uint16, uint16) { return 1, 3 }
+
+func (self *versionEcho) Serve(conn net.Conn) error {
+	defer conn.Close()
+	return binary.Write(conn, binary.BigEndian, VersionOf(conn))
+}
+
+func TestClient(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	guest := network.Machine(3)
+	listening := make(chan struct{}, 2)
+	var metrics vsock.ConnMetrics
+	agent := &Agent{
+		Listen: func(port uint32) (net.Listener, error) {
+			l, err := guest.Listen(port)
+			listening <- struct{}{}
+			return l, err
+		},
+		ErrorLog:          log.New(io.Discard, "", 0),
+		ServiceMiddleware: map[string][]vsock.Middleware{"versioned": {vsock.Metrics(&metrics)}},
+	}
+	agent.Register(&echo{port: 5301})
+	agent.Register(&versionEcho{echo{port: 5302}})
+	served := make(chan error, 1)
+	go func() { served <- agent.ListenAndServe() }()
+	<-listening
+	<-listening
+
+	host := network.Machine(vsock.Host)
+	client := &Client{ContextID: 3, Dial: host.DialContext}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.DialPort(ctx, 5301)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || string(b) != "echo" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+
+	conn, err = client.DialService(ctx, "versioned", 5302, 2, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(uint16(3), VersionOf(conn)); diff != "" {
+		t.Fatalf("unexpected version agreed (-want +got):\n%s", diff)
+	}
+	var version uint16
+	if err := binary.Read(conn, binary.BigEndian, &version); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if version != 3 {
+		t.Fatalf("service saw version %d, want 3", version)
+	}
+
+	if _, err := client.DialService(ctx, "versioned", 5302, 4, 5); err == nil {
+		t.Fatal("expected a client speaking no version of the service to be refused")
+	}
+	if _, err := client.DialService(ctx, "clipboard", 5302, 1, 1); err == nil {
+		t.Fatal("expected a client asking for another service to be refused")
+	}
+	// Only the connections to the versioned service are counted.
+	if diff := cmp.Diff(int64(3), atomic.LoadInt64(&metrics.Total)); diff != "" {
+		t.Fatalf("unexpected connections counted (-want +got):\n%s", diff)
+	}
+
+	agent.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+}
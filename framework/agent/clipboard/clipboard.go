@@ -0,0 +1,464 @@
+// Package clipboard shares the clipboard between host and guest.
+//
+// Each side sends its clipboard whenever it changes, as a JSON line, and
+// takes on the clipboard the other side sends. On connecting, each side
+// announces the MIME types it takes and the largest contents of each, and
+// the other only sends what fits; a peer announcing nothing takes plain
+// text. For desktops already using SPICE, VDAgent speaks the vdagent
+// protocol instead.
+package clipboard
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the clipboard service listens on.
+const Port = vsock.PortClipboard
+
+// DefaultInterval is how often the local clipboard is checked for changes.
+const DefaultInterval = 500 * time.Millisecond
+
+// MaxSize bounds the text shared, in either direction.
+const MaxSize = 1 << 20
+
+// MaxImageSize bounds the images shared by default.
+const MaxImageSize = 16 << 20
+
+// A Format is a MIME type shared, with the largest contents of that type
+// shared.
+type Format struct {
+	Type    string `json:"type"`
+	MaxSize int    `json:"max_size"`
+}
+
+// DefaultFormats are shared when no others are given, in order of
+// preference.
+var DefaultFormats = []Format{
+	{"text/plain", MaxSize},
+	{"text/html", MaxSize},
+	{"image/png", MaxImageSize},
+}
+
+// textFormats is what peers which announce nothing take.
+var textFormats = []Format{{"text/plain", MaxSize}}
+
+// Content is the clipboard in one MIME type.
+type Content struct {
+	Type string `json:"type"`
+	Data []byte `json:"data"`
+}
+
+// A Clipboard reads and replaces the text of a clipboard.
+type Clipboard interface {
+	Get() ([]byte, error)
+	Set(text []byte) error
+}
+
+// A MIMEClipboard holds its contents in several MIME types at once, such
+// as the markup of a web page along with its text. Clipboards which are
+// not only share text.
+type MIMEClipboard interface {
+	Clipboard
+	// Types lists the types the clipboard holds.
+	Types() ([]string, error)
+	// GetType returns the contents as mimeType.
+	GetType(mimeType string) ([]byte, error)
+	// SetContents replaces the clipboard with contents, each the same
+	// thing in another type.
+	SetContents(contents []Content) error
+}
+
+// System is the clipboard of the local desktop session, driven through
+// wl-copy and wl-paste under Wayland, or xclip under X11. Both hold a
+// single type at a time, so SetContents keeps plain text if given, and
+// otherwise the first type.
+type System struct{}
+
+func (System) Get() ([]byte, error) { return System{}.GetType("text/plain") }
+
+func (System) Set(text []byte) error {
+	return System{}.SetContents([]Content{{"text/plain", text}})
+}
+
+func (System) Types() ([]string, error) {
+	var cmd *exec.Cmd
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmd = exec.Command("wl-paste", "--list-types")
+	} else {
+		cmd = exec.Command("xclip", "-selection", "clipboard", "-target", "TARGETS", "-out")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, nil
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func (System) GetType(mimeType string) ([]byte, error) {
+	var cmd *exec.Cmd
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmd = exec.Command("wl-paste", "--no-newline", "--type", mimeType)
+	} else {
+		cmd = exec.Command("xclip", "-selection", "clipboard", "-target", mimeType, "-out")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		// Both tools fail on an empty clipboard.
+		return nil, nil
+	}
+	return out, nil
+}
+
+func (System) SetContents(contents []Content) error {
+	if len(contents) == 0 {
+		return nil
+	}
+	content := contents[0]
+	for _, c := range contents {
+		if c.Type == "text/plain" {
+			content = c
+		}
+	}
+	var cmd *exec.Cmd
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		cmd = exec.Command("wl-copy", "--type", content.Type)
+	} else {
+		cmd = exec.Command("xclip", "-selection", "clipboard", "-target", content.Type, "-in")
+	}
+	cmd.Stdin = bytes.NewReader(content.Data)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("clipboard: %s: %v: %s", cmd.Path, err, out)
+	}
+	return nil
+}
+
+// message is a line of the protocol. The first a side sends announces
+// Formats; later ones carry Contents, or Text to peers which announced
+// nothing.
+type message struct {
+	Formats  []Format  `json:"formats,omitempty"`
+	Contents []Content `json:"contents,omitempty"`
+	Text     []byte    `json:"text,omitempty"`
+}
+
+// Service is the agent side of the clipboard service.
+type Service struct {
+	// Clipboard defaults to System.
+	Clipboard Clipboard
+	// Interval defaults to DefaultInterval.
+	Interval time.Duration
+	// Formats defaults to DefaultFormats.
+	Formats []Format
+}
+
+func (self *Service) Name() string { return "clipboard" }
+func (self *Service) Port() uint32 { return Port }
+
+func (self *Service) Serve(conn net.Conn) error {
+	clipboard := self.Clipboard
+	if clipboard == nil {
+		clipboard = System{}
+	}
+	return Sync(conn, clipboard, self.Interval, self.Formats)
+}
+
+// Sync shares clipboard with the peer on conn until conn fails, in formats,
+// or DefaultFormats if nil. Both ends of a clipboard connection run it.
+func Sync(conn net.Conn, clipboard Clipboard, interval time.Duration, formats []Format) error {
+	defer conn.Close()
+	if formats == nil {
+		formats = DefaultFormats
+	}
+	w := newWatcher(clipboard, interval, formats)
+	defer w.stop()
+
+	var writeMutex sync.Mutex
+	write := func(m message) error {
+		b, err := json.Marshal(m)
+		if err != nil {
+			return err
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		_, err = conn.Write(append(b, '\n'))
+		return err
+	}
+	go func() {
+		err := write(message{Formats: formats})
+		if err == nil {
+			err = w.watch(func(contents []Content) error {
+				if w.legacy() {
+					return write(message{Text: contents[0].Data})
+				}
+				return write(message{Contents: contents})
+			})
+		}
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	// JSON encodes contents in base64.
+	max := 4096
+	for _, f := range formats {
+		max += 2 * f.MaxSize
+	}
+	r := bufio.NewReaderSize(conn, 64*1024)
+	for {
+		line, err := readLine(r, max)
+		if err != nil {
+			return err
+		}
+		var m message
+		if err := json.Unmarshal(line, &m); err != nil {
+			return fmt.Errorf("clipboard: %v", err)
+		}
+		switch {
+		case m.Formats != nil:
+			w.negotiate(m.Formats)
+		case m.Contents != nil:
+			err = w.set(m.Contents)
+		case m.Text != nil:
+			err = w.set([]Content{{"text/plain", m.Text}})
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watcher polls a clipboard for changes, ignoring those it made itself.
+type watcher struct {
+	clipboard Clipboard
+	interval  time.Duration
+	formats   []Format
+
+	done chan struct{}
+	once sync.Once
+
+	mutex sync.Mutex
+	// shared is what both sides take, textFormats until the peer announces
+	// its formats.
+	shared    []Format
+	announced bool
+	last      []Content
+}
+
+func newWatcher(clipboard Clipboard, interval time.Duration, formats []Format) *watcher {
+	return &watcher{
+		clipboard: clipboard,
+		interval:  interval,
+		formats:   formats,
+		shared:    intersect(formats, textFormats),
+		done:      make(chan struct{}),
+	}
+}
+
+// negotiate settles on the formats both sides take, and has the clipboard
+// sent again in them.
+func (self *watcher) negotiate(peer []Format) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.shared = intersect(self.formats, peer)
+	self.announced = true
+	self.last = nil
+}
+
+// legacy reports whether the peer announced no formats, and so takes
+// only text.
+func (self *watcher) legacy() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return !self.announced
+}
+
+// watch calls changed with the contents of the clipboard whenever they
+// change, until stop is called or changed fails.
+func (self *watcher) watch(changed func(contents []Content) error) error {
+	interval := self.interval
+	if interval == 0 {
+		interval = DefaultInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		self.mutex.Lock()
+		shared := self.shared
+		self.mutex.Unlock()
+		contents, err := self.read(shared)
+		if err == nil {
+			self.mutex.Lock()
+			fresh := !equal(contents, self.last)
+			if fresh {
+				self.last = contents
+			}
+			self.mutex.Unlock()
+			if fresh && len(contents) > 0 {
+				if err := changed(contents); err != nil {
+					return err
+				}
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return nil
+		}
+	}
+}
+
+// read returns the contents of the clipboard in formats, leaving out those
+// too large.
+func (self *watcher) read(formats []Format) ([]Content, error) {
+	mime, ok := self.clipboard.(MIMEClipboard)
+	if !ok {
+		text, err := self.clipboard.Get()
+		if err != nil {
+			return nil, err
+		}
+		if len(text) == 0 || !fits(formats, "text/plain", len(text)) {
+			return nil, nil
+		}
+		return []Content{{"text/plain", text}}, nil
+	}
+
+	types, err := mime.Types()
+	if err != nil {
+		return nil, err
+	}
+	var contents []Content
+	for _, f := range formats {
+		if !contains(types, f.Type) {
+			continue
+		}
+		data, err := mime.GetType(f.Type)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > 0 && len(data) <= f.MaxSize {
+			contents = append(contents, Content{f.Type, data})
+		}
+	}
+	return contents, nil
+}
+
+// set replaces the clipboard with contents from the peer. Types not taken
+// are dropped, and contents too large refused.
+func (self *watcher) set(contents []Content) error {
+	var taken []Content
+	for _, c := range contents {
+		for _, f := range self.formats {
+			if c.Type != f.Type {
+				continue
+			}
+			if len(c.Data) > f.MaxSize {
+				return fmt.Errorf("clipboard: %d bytes of %s exceeds the maximum of %d", len(c.Data), c.Type, f.MaxSize)
+			}
+			taken = append(taken, c)
+		}
+	}
+	if len(taken) == 0 {
+		return nil
+	}
+
+	var err error
+	if mime, ok := self.clipboard.(MIMEClipboard); ok {
+		err = mime.SetContents(taken)
+	} else if taken[0].Type == "text/plain" {
+		err = self.clipboard.Set(taken[0].Data)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The clipboard may not hold every type given, so remember what it
+	// holds now, lest it be sent back as a change.
+	self.mutex.Lock()
+	shared := self.shared
+	self.mutex.Unlock()
+	now, err := self.read(shared)
+	if err != nil {
+		now = taken
+	}
+	self.mutex.Lock()
+	self.last = now
+	self.mutex.Unlock()
+	return nil
+}
+
+func (self *watcher) stop() {
+	self.once.Do(func() { close(self.done) })
+}
+
+// intersect returns the formats of ours the peer takes too, in our order,
+// limited to the smaller size of the two.
+func intersect(ours, peer []Format) []Format {
+	var shared []Format
+	for _, f := range ours {
+		for _, p := range peer {
+			if f.Type == p.Type {
+				if p.MaxSize < f.MaxSize {
+					f.MaxSize = p.MaxSize
+				}
+				shared = append(shared, f)
+				break
+			}
+		}
+	}
+	return shared
+}
+
+func fits(formats []Format, mimeType string, size int) bool {
+	for _, f := range formats {
+		if f.Type == mimeType {
+			return size <= f.MaxSize
+		}
+	}
+	return false
+}
+
+func contains(types []string, mimeType string) bool {
+	for _, t := range types {
+		if t == mimeType {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(a, b []Content) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || !bytes.Equal(a[i].Data, b[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return nil, fmt.Errorf("clipboard: message too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
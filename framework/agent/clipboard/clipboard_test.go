@@ -0,0 +1,115 @@
+package clipboard
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// mimeMemory is a clipboard holding any number of types.
+type mimeMemory struct {
+	mutex    sync.Mutex
+	contents []Content
+	set      chan []Content
+}
+
+func (self *mimeMemory) Get() ([]byte, error) { return self.GetType("text/plain") }
+
+func (self *mimeMemory) Set(text []byte) error {
+	return self.SetContents([]Content{{"text/plain", text}})
+}
+
+func (self *mimeMemory) Types() ([]string, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	var types []string
+	for _, c := range self.contents {
+		types = append(types, c.Type)
+	}
+	return types, nil
+}
+
+func (self *mimeMemory) GetType(mimeType string) ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, c := range self.contents {
+		if c.Type == mimeType {
+			return c.Data, nil
+		}
+	}
+	return nil, nil
+}
+
+func (self *mimeMemory) SetContents(contents []Content) error {
+	self.mutex.Lock()
+	self.contents = contents
+	self.mutex.Unlock()
+	self.set <- contents
+	return nil
+}
+
+func TestSyncFormats(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n")
+	for _, test := range []struct {
+		name    string
+		formats []Format
+		want    []Content
+	}{
+		{
+			name: "all",
+			want: []Content{{"text/plain", []byte("text")}, {"image/png", png}},
+		},
+		{
+			name:    "capped",
+			formats: []Format{{"text/plain", MaxSize}, {"image/png", 4}},
+			want:    []Content{{"text/plain", []byte("text")}},
+		},
+		{
+			name:    "images only",
+			formats: []Format{{"image/png", MaxImageSize}},
+			want:    []Content{{"image/png", png}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			source := &mimeMemory{contents: []Content{{"image/png", png}, {"text/plain", []byte("text")}}}
+			target := &mimeMemory{set: make(chan []Content, 4)}
+			go Sync(a, source, time.Millisecond, nil)
+			go Sync(b, target, time.Millisecond, test.formats)
+			defer a.Close()
+
+			// The first contents may arrive before the formats were
+			// negotiated, as plain text.
+			timeout := time.After(5 * time.Second)
+			var got []Content
+			for cmp.Diff(test.want, got) != "" {
+				select {
+				case got = <-target.set:
+				case <-timeout:
+					t.Fatalf("unexpected contents (-want +got):\n%s", cmp.Diff(test.want, got))
+				}
+			}
+		})
+	}
+}
+
+func TestSyncText(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	source := &mimeMemory{contents: []Content{{"text/html", []byte("<b>text</b>")}, {"text/plain", []byte("text")}}}
+	target := &memory{set: make(chan []byte, 4)}
+	go Sync(a, source, time.Millisecond, nil)
+	go Sync(b, target, time.Millisecond, nil)
+
+	select {
+	case text := <-target.set:
+		if diff := cmp.Diff("text", string(text)); diff != "" {
+			t.Fatalf("unexpected clipboard (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clipboard was not set")
+	}
+}
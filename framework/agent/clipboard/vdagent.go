@@ -0,0 +1,239 @@
+package clipboard
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultVDAgentPath is the virtio-serial channel SPICE uses for its agent.
+const DefaultVDAgentPath = "/dev/virtio-ports/com.redhat.spice.0"
+
+// vdagent protocol constants, from spice-protocol's vd_agent.h.
+const (
+	vdProtocol = 1
+
+	// Chunks are addressed to the client or to the server itself.
+	vdClientPort = 1
+
+	vdMaxChunk = 2048
+
+	vdAnnounceCapabilities = 6
+	vdClipboard            = 4
+	vdClipboardGrab        = 7
+	vdClipboardRequest     = 8
+	vdClipboardRelease     = 9
+
+	vdCapClipboardByDemand  = 5
+	vdCapClipboardSelection = 6
+
+	vdClipboardNone     = 0
+	vdClipboardUTF8Text = 1
+
+	vdSelectionClipboard = 0
+
+	// vdChunkHeader is port and size; vdMessageHeader is protocol, type,
+	// opaque and size.
+	vdChunkHeader   = 8
+	vdMessageHeader = 20
+)
+
+// VDAgent shares the clipboard with SPICE clients by speaking the protocol
+// of spice-vdagent, for desktops already using SPICE tooling. It is the
+// guest side, and replaces spice-vdagent for clipboard purposes.
+type VDAgent struct {
+	// Clipboard defaults to System.
+	Clipboard Clipboard
+	// Interval defaults to DefaultInterval.
+	Interval time.Duration
+
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	selection  bool // whether the client announced selection support
+}
+
+// ServeSerial serves the virtio-serial channel at path, or at
+// DefaultVDAgentPath if path is empty.
+func (self *VDAgent) ServeSerial(path string) error {
+	if path == "" {
+		path = DefaultVDAgentPath
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return self.Serve(f)
+}
+
+// Serve speaks the vdagent protocol on rw until it fails.
+func (self *VDAgent) Serve(rw io.ReadWriter) error {
+	clipboard := self.Clipboard
+	if clipboard == nil {
+		clipboard = System{}
+	}
+	w := newWatcher(clipboard, self.Interval, textFormats)
+	defer w.stop()
+
+	if err := self.announce(rw, true); err != nil {
+		return err
+	}
+	// Clipboard contents are sent on demand: announce them, and send them
+	// once requested. A failed write also fails the read below.
+	go w.watch(func([]Content) error {
+		return self.clipboardMessage(rw, vdClipboardGrab, le32(vdClipboardUTF8Text))
+	})
+
+	for {
+		kind, data, err := readVDMessage(rw)
+		if err != nil {
+			return err
+		}
+		if err := self.handle(rw, w, kind, data); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *VDAgent) handle(rw io.ReadWriter, w *watcher, kind uint32, data []byte) error {
+	if kind == vdAnnounceCapabilities {
+		if len(data) < 8 {
+			return fmt.Errorf("clipboard: short vdagent capabilities")
+		}
+		caps := binary.LittleEndian.Uint32(data[4:8])
+		self.mutex.Lock()
+		self.selection = caps&(1<<vdCapClipboardSelection) != 0
+		self.mutex.Unlock()
+		if binary.LittleEndian.Uint32(data[0:4]) != 0 {
+			return self.announce(rw, false)
+		}
+		return nil
+	}
+
+	switch kind {
+	case vdClipboard, vdClipboardGrab, vdClipboardRequest, vdClipboardRelease:
+	default:
+		return nil
+	}
+	if self.selections() {
+		if len(data) < 4 {
+			return fmt.Errorf("clipboard: short vdagent message")
+		}
+		if data[0] != vdSelectionClipboard {
+			return nil
+		}
+		data = data[4:]
+	}
+
+	switch kind {
+	case vdClipboardGrab:
+		for ; len(data) >= 4; data = data[4:] {
+			if binary.LittleEndian.Uint32(data) == vdClipboardUTF8Text {
+				return self.clipboardMessage(rw, vdClipboardRequest, le32(vdClipboardUTF8Text))
+			}
+		}
+	case vdClipboard:
+		if len(data) >= 4 && binary.LittleEndian.Uint32(data) == vdClipboardUTF8Text {
+			return w.set([]Content{{"text/plain", data[4:]}})
+		}
+	case vdClipboardRequest:
+		if len(data) >= 4 && binary.LittleEndian.Uint32(data) == vdClipboardUTF8Text {
+			if text, err := w.clipboard.Get(); err == nil && len(text) <= MaxSize {
+				return self.clipboardMessage(rw, vdClipboard, append(le32(vdClipboardUTF8Text), text...))
+			}
+		}
+		return self.clipboardMessage(rw, vdClipboard, le32(vdClipboardNone))
+	}
+	return nil
+}
+
+func (self *VDAgent) selections() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.selection
+}
+
+func (self *VDAgent) announce(w io.Writer, request bool) error {
+	var data [8]byte
+	if request {
+		binary.LittleEndian.PutUint32(data[0:4], 1)
+	}
+	binary.LittleEndian.PutUint32(data[4:8], 1<<vdCapClipboardByDemand|1<<vdCapClipboardSelection)
+	return self.write(w, vdAnnounceCapabilities, data[:])
+}
+
+// clipboardMessage writes a clipboard message, prefixed with the selection
+// if the client supports selections.
+func (self *VDAgent) clipboardMessage(w io.Writer, kind uint32, data []byte) error {
+	if self.selections() {
+		data = append([]byte{vdSelectionClipboard, 0, 0, 0}, data...)
+	}
+	return self.write(w, kind, data)
+}
+
+// write sends a message to the client, split into chunks.
+func (self *VDAgent) write(w io.Writer, kind uint32, data []byte) error {
+	message := make([]byte, vdMessageHeader, vdMessageHeader+len(data))
+	binary.LittleEndian.PutUint32(message[0:4], vdProtocol)
+	binary.LittleEndian.PutUint32(message[4:8], kind)
+	binary.LittleEndian.PutUint32(message[16:20], uint32(len(data)))
+	message = append(message, data...)
+
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	for len(message) > 0 {
+		n := len(message)
+		if n > vdMaxChunk {
+			n = vdMaxChunk
+		}
+		chunk := make([]byte, vdChunkHeader, vdChunkHeader+n)
+		binary.LittleEndian.PutUint32(chunk[0:4], vdClientPort)
+		binary.LittleEndian.PutUint32(chunk[4:8], uint32(n))
+		if _, err := w.Write(append(chunk, message[:n]...)); err != nil {
+			return err
+		}
+		message = message[n:]
+	}
+	return nil
+}
+
+// readVDMessage reads a message from its chunks.
+func readVDMessage(r io.Reader) (uint32, []byte, error) {
+	var message []byte
+	for {
+		var header [vdChunkHeader]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return 0, nil, err
+		}
+		size := binary.LittleEndian.Uint32(header[4:8])
+		if size > vdMaxChunk {
+			return 0, nil, fmt.Errorf("clipboard: vdagent chunk of %d bytes", size)
+		}
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return 0, nil, err
+		}
+		message = append(message, chunk...)
+
+		if len(message) < vdMessageHeader {
+			continue
+		}
+		if protocol := binary.LittleEndian.Uint32(message[0:4]); protocol != vdProtocol {
+			return 0, nil, fmt.Errorf("clipboard: vdagent protocol %d", protocol)
+		}
+		length := binary.LittleEndian.Uint32(message[16:20])
+		if length > 2*MaxSize {
+			return 0, nil, fmt.Errorf("clipboard: vdagent message of %d bytes", length)
+		}
+		if uint32(len(message)-vdMessageHeader) >= length {
+			return binary.LittleEndian.Uint32(message[4:8]), message[vdMessageHeader : vdMessageHeader+length], nil
+		}
+	}
+}
+
+func le32(v uint32) []byte {
+	return binary.LittleEndian.AppendUint32(nil, v)
+}
@@ -0,0 +1,90 @@
+package clipboard
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type memory struct {
+	mutex sync.Mutex
+	text  []byte
+	set   chan []byte
+}
+
+func (self *memory) Get() ([]byte, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.text, nil
+}
+
+func (self *memory) Set(text []byte) error {
+	self.mutex.Lock()
+	self.text = text
+	self.mutex.Unlock()
+	self.set <- text
+	return nil
+}
+
+func TestVDAgentClipboard(t *testing.T) {
+	client, guest := net.Pipe()
+	defer client.Close()
+	clipboard := &memory{text: []byte("from guest"), set: make(chan []byte, 1)}
+	agent := &VDAgent{Clipboard: clipboard, Interval: time.Millisecond}
+	go agent.Serve(guest)
+
+	// client is a SPICE client: it only handles its side of the protocol.
+	spice := &VDAgent{}
+	expect := func(kind uint32) []byte {
+		t.Helper()
+		for {
+			got, data, err := readVDMessage(client)
+			if err != nil {
+				t.Fatalf("failed to read: %v", err)
+			}
+			if got == kind {
+				return data
+			}
+		}
+	}
+
+	data := expect(vdAnnounceCapabilities)
+	if diff := cmp.Diff(uint32(1), binary.LittleEndian.Uint32(data)); diff != "" {
+		t.Fatalf("expected a capabilities request (-want +got):\n%s", diff)
+	}
+	if err := spice.announce(client, false); err != nil {
+		t.Fatalf("failed to announce: %v", err)
+	}
+	spice.selection = true
+
+	// The guest announces its clipboard, and sends it on request.
+	expect(vdClipboardGrab)
+	if err := spice.clipboardMessage(client, vdClipboardRequest, le32(vdClipboardUTF8Text)); err != nil {
+		t.Fatalf("failed to request: %v", err)
+	}
+	data = expect(vdClipboard)
+	if diff := cmp.Diff("from guest", string(data[8:])); diff != "" {
+		t.Fatalf("unexpected clipboard (-want +got):\n%s", diff)
+	}
+
+	// The client grabs the clipboard, and the guest asks for it.
+	if err := spice.clipboardMessage(client, vdClipboardGrab, le32(vdClipboardUTF8Text)); err != nil {
+		t.Fatalf("failed to grab: %v", err)
+	}
+	expect(vdClipboardRequest)
+	if err := spice.clipboardMessage(client, vdClipboard, append(le32(vdClipboardUTF8Text), "from client"...)); err != nil {
+		t.Fatalf("failed to send clipboard: %v", err)
+	}
+	select {
+	case text := <-clipboard.set:
+		if diff := cmp.Diff("from client", string(text)); diff != "" {
+			t.Fatalf("unexpected clipboard (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("clipboard was not set")
+	}
+}
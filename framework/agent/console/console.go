@@ -0,0 +1,211 @@
+// Package console forwards the guest kernel log to the host from as early in
+// boot as /dev/vsock exists, before networking or syslog are available.
+//
+// Unlike the other agent services the guest dials out: the forwarder waits
+// for the vsock device, connects to the host and replays the kernel ring
+// buffer from its first record, then follows new records as they are logged.
+package console
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the host vsock port console records are sent to.
+const Port = vsock.PortConsole
+
+// Record is a single kernel log message as read from /dev/kmsg.
+type Record struct {
+	Sequence uint64 `json:"seq"`
+	Facility int    `json:"facility"`
+	Priority int    `json:"priority"`
+	// Uptime is the time since boot at which the message was logged.
+	Uptime  time.Duration     `json:"uptime"`
+	Message string            `json:"message"`
+	Fields  map[string]string `json:"fields,omitempty"`
+}
+
+// Forwarder is the guest side. It survives host restarts by reconnecting and
+// resuming after the last record it sent.
+type Forwarder struct {
+	// Source is the kernel log device. Defaults to /dev/kmsg.
+	Source string
+	// Dial connects to the host. Defaults to vsock.Dial(vsock.Host, Port).
+	Dial func() (net.Conn, error)
+	// Retry is the delay between attempts to find the device or reach the
+	// host. Defaults to 100ms so that early boot messages are not missed.
+	Retry time.Duration
+
+	last uint64
+	sent bool
+}
+
+// Run forwards records until done is closed.
+func (self *Forwarder) Run(done <-chan struct{}) error {
+	for {
+		conn, err := self.connect(done)
+		if err != nil {
+			return err
+		}
+
+		err = self.forward(conn, done)
+		conn.Close()
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+		if os.IsNotExist(err) || os.IsPermission(err) {
+			return err
+		}
+		time.Sleep(self.retry())
+	}
+}
+
+func (self *Forwarder) connect(done <-chan struct{}) (net.Conn, error) {
+	dial := self.Dial
+	if dial == nil {
+		dial = func() (net.Conn, error) {
+			if _, err := vsock.ContextID(); err != nil {
+				return nil, err
+			}
+			return vsock.Dial(vsock.Host, Port)
+		}
+	}
+
+	for {
+		conn, err := dial()
+		if err == nil {
+			return conn, nil
+		}
+		select {
+		case <-done:
+			return nil, fmt.Errorf("console: stopped before host was reachable: %v", err)
+		case <-time.After(self.retry()):
+		}
+	}
+}
+
+func (self *Forwarder) forward(conn net.Conn, done <-chan struct{}) error {
+	source := self.Source
+	if source == "" {
+		source = "/dev/kmsg"
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+			f.Close()
+		case <-stop:
+		}
+	}()
+
+	encoder := json.NewEncoder(conn)
+	buf := make([]byte, 8192)
+	for {
+		n, err := f.Read(buf)
+		if err != nil {
+			// EPIPE means records were overwritten before we read them;
+			// the next read continues with the oldest remaining one.
+			if perr, ok := err.(*os.PathError); ok && perr.Err == syscall.EPIPE {
+				continue
+			}
+			return err
+		}
+
+		record, err := Parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		if self.sent && record.Sequence <= self.last {
+			continue
+		}
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+		self.last, self.sent = record.Sequence, true
+	}
+}
+
+func (self *Forwarder) retry() time.Duration {
+	if self.Retry == 0 {
+		return 100 * time.Millisecond
+	}
+	return self.Retry
+}
+
+// Parse decodes one /dev/kmsg record of the form
+// "prefix,seq,usec,flags[,...];message\n KEY=value\n".
+func Parse(b []byte) (Record, error) {
+	var record Record
+
+	semi := bytes.IndexByte(b, ';')
+	if semi < 0 {
+		return record, fmt.Errorf("console: malformed record %q", b)
+	}
+	header := bytes.Split(b[:semi], []byte(","))
+	if len(header) < 3 {
+		return record, fmt.Errorf("console: malformed record header %q", b[:semi])
+	}
+
+	prefix, err := strconv.Atoi(string(header[0]))
+	if err != nil {
+		return record, fmt.Errorf("console: malformed record prefix: %v", err)
+	}
+	record.Facility, record.Priority = prefix>>3, prefix&7
+
+	if record.Sequence, err = strconv.ParseUint(string(header[1]), 10, 64); err != nil {
+		return record, fmt.Errorf("console: malformed record sequence: %v", err)
+	}
+	usec, err := strconv.ParseInt(string(header[2]), 10, 64)
+	if err != nil {
+		return record, fmt.Errorf("console: malformed record timestamp: %v", err)
+	}
+	record.Uptime = time.Duration(usec) * time.Microsecond
+
+	lines := bytes.Split(bytes.TrimRight(b[semi+1:], "\n"), []byte("\n"))
+	record.Message = string(lines[0])
+	for _, line := range lines[1:] {
+		kv := bytes.SplitN(bytes.TrimPrefix(line, []byte(" ")), []byte("="), 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if record.Fields == nil {
+			record.Fields = make(map[string]string)
+		}
+		record.Fields[string(kv[0])] = string(kv[1])
+	}
+
+	return record, nil
+}
+
+// Reader is the host side, decoding records sent by a Forwarder.
+type Reader struct {
+	decoder *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{decoder: json.NewDecoder(r)}
+}
+
+func (self *Reader) Next() (Record, error) {
+	var record Record
+	err := self.decoder.Decode(&record)
+	return record, err
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package console
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestParse(t *testing.T) {
+	got, err := Parse([]byte("30,1024,5000000,-;systemd[1]: Started agent.\n SUBSYSTEM=virtio\n DEVICE=+virtio:vsock\n"))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	want := Record{
+		Sequence: 1024,
+		Facility: 3,
+		Priority: 6,
+		Uptime:   5 * time.Second,
+		Message:  "systemd[1]: Started agent.",
+		Fields:   map[string]string{"SUBSYSTEM": "virtio", "DEVICE": "+virtio:vsock"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected record (-want +got):\n%s", diff)
+	}
+
+	for _, b := range []string{"no separator", "6,1;short header", "x,1,2;bad prefix"} {
+		if _, err := Parse([]byte(b)); err == nil {
+			t.Errorf("expected %q to be refused", b)
+		}
+	}
+}
+
+// kmsg writes records to the FIFO the forwarder reads as its kernel log,
+// one per read as /dev/kmsg returns them.
+type kmsg struct {
+	t *testing.T
+	f *os.File
+}
+
+func openKmsg(t *testing.T, path string) *kmsg {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	return &kmsg{t: t, f: f}
+}
+
+// log writes the record seq and waits for the forwarder to read it.
+func (self *kmsg) log(seq uint64) {
+	fmt.Fprintf(self.f, "6,%d,%d,-;message %d\n", seq, seq*1000, seq)
+	for {
+		n, err := unix.IoctlGetInt(int(self.f.Fd()), unix.TIOCINQ)
+		if err != nil {
+			self.t.Errorf("failed to query log: %v", err)
+			return
+		}
+		if n == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "kmsg")
+	if err := unix.Mkfifo(source, 0600); err != nil {
+		t.Fatalf("failed to create log: %v", err)
+	}
+	hosts := make(chan net.Conn)
+	forwarder := &Forwarder{
+		Source: source,
+		Dial: func() (net.Conn, error) {
+			host, guest := net.Pipe()
+			hosts <- host
+			return guest, nil
+		},
+		Retry: time.Millisecond,
+	}
+	done := make(chan struct{})
+	stopped := make(chan error, 1)
+	go func() { stopped <- forwarder.Run(done) }()
+
+	next := func(r *Reader) uint64 {
+		record, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read record: %v", err)
+		}
+		return record.Sequence
+	}
+
+	host := <-hosts
+	log := openKmsg(t, source)
+	r := NewReader(host)
+	var got []uint64
+	for _, seq := range []uint64{1, 2} {
+		log.log(seq)
+		got = append(got, next(r))
+	}
+
+	// The host going away loses the record being sent; once reconnected the
+	// ring buffer is replayed, and only what the host missed is sent.
+	host.Close()
+	log.log(3)
+	log.f.Close()
+	host = <-hosts
+	log = openKmsg(t, source)
+	defer log.f.Close()
+	r = NewReader(host)
+	log.log(2)
+	log.log(3)
+	got = append(got, next(r))
+	if diff := cmp.Diff([]uint64{1, 2, 3}, got); diff != "" {
+		t.Fatalf("unexpected records (-want +got):\n%s", diff)
+	}
+
+	close(done)
+	if err := <-stopped; err != nil {
+		t.Fatalf("Run() = %v, want nil", err)
+	}
+}
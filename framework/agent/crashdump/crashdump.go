@@ -0,0 +1,406 @@
+// Package crashdump ships guest core dumps and kernel crash logs to the host
+// so post-mortem data survives the destruction of the VM.
+//
+// The guest offers each dump with a header, the host answers with the
+// offset it already holds, and the guest streams the remainder in chunks.
+// An interrupted upload therefore resumes where it stopped on the next
+// connection.
+package crashdump
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the crash dump service listens on.
+const Port = vsock.PortCrashdump
+
+const chunkSize = 64 * 1024
+
+type Kind string
+
+const (
+	KindCore   Kind = "core"
+	KindKernel Kind = "kernel"
+)
+
+// DefaultSources are the locations systemd-coredump, kdump and pstore write
+// to on common distributions.
+var DefaultSources = []Source{
+	{Dir: "/var/lib/systemd/coredump", Kind: KindCore},
+	{Dir: "/var/crash", Kind: KindKernel},
+	{Dir: "/sys/fs/pstore", Kind: KindKernel},
+}
+
+type Source struct {
+	Dir  string
+	Kind Kind
+}
+
+type Header struct {
+	Name    string    `json:"name"`
+	Kind    Kind      `json:"kind"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+type reply struct {
+	Offset int64 `json:"offset"`
+}
+
+type ack struct {
+	Done bool `json:"done"`
+}
+
+// Service is the guest side of the channel. It offers every dump found in
+// Sources that has not been acknowledged, then keeps the connection open
+// and offers new dumps as they appear, until the host hangs up.
+type Service struct {
+	Sources []Source
+	// StateDir records acknowledged uploads so they are not sent twice.
+	// Defaults to /var/lib/vcable/crashdump.
+	StateDir string
+	// Interval is how often Sources are rescanned. Defaults to 5s.
+	Interval time.Duration
+}
+
+func (self *Service) Name() string { return "crashdump" }
+func (self *Service) Port() uint32 { return Port }
+
+func (self *Service) Serve(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	for {
+		dumps, err := self.Pending()
+		if err != nil {
+			return err
+		}
+		for _, dump := range dumps {
+			if err := self.upload(conn, r, dump); err != nil {
+				return err
+			}
+		}
+		if err := idle(conn, r, self.interval()); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+// idle waits for d between scans, returning io.EOF if the host hangs up
+// meanwhile. The host sends nothing unprompted, so a read returning before
+// the deadline means it is gone.
+func idle(conn net.Conn, r *bufio.Reader, d time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(d))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := r.Peek(1)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return nil
+	}
+	if err == nil {
+		return fmt.Errorf("crashdump: unexpected data from host")
+	}
+	return err
+}
+
+type Dump struct {
+	Header
+	Path string
+}
+
+// Pending lists dumps that have not yet been acknowledged by the host.
+func (self *Service) Pending() ([]Dump, error) {
+	sources := self.Sources
+	if len(sources) == 0 {
+		sources = DefaultSources
+	}
+
+	var dumps []Dump
+	for _, source := range sources {
+		entries, err := os.ReadDir(source.Dir)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil || !info.Mode().IsRegular() {
+				continue
+			}
+			name := string(source.Kind) + "-" + entry.Name()
+			if self.acknowledged(name, info.Size()) {
+				continue
+			}
+			dumps = append(dumps, Dump{
+				Header: Header{
+					Name:    name,
+					Kind:    source.Kind,
+					Size:    info.Size(),
+					ModTime: info.ModTime(),
+				},
+				Path: filepath.Join(source.Dir, entry.Name()),
+			})
+		}
+	}
+
+	sort.Slice(dumps, func(i, j int) bool { return dumps[i].ModTime.Before(dumps[j].ModTime) })
+	return dumps, nil
+}
+
+func (self *Service) upload(conn net.Conn, r *bufio.Reader, d Dump) error {
+	f, err := os.Open(d.Path)
+	if err != nil {
+		// The dump may have been rotated away since it was listed.
+		return nil
+	}
+	defer f.Close()
+
+	if err := writeJSON(conn, d.Header); err != nil {
+		return err
+	}
+	var rep reply
+	if err := readJSON(r, &rep); err != nil {
+		return err
+	}
+	if rep.Offset < 0 || rep.Offset > d.Size {
+		return fmt.Errorf("crashdump: host requested invalid offset %d for %s", rep.Offset, d.Name)
+	}
+	if _, err := f.Seek(rep.Offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := writeChunks(conn, io.LimitReader(f, d.Size-rep.Offset)); err != nil {
+		return err
+	}
+
+	var a ack
+	if err := readJSON(r, &a); err != nil {
+		return err
+	}
+	if a.Done {
+		return self.acknowledge(d.Name, d.Size)
+	}
+	return nil
+}
+
+func (self *Service) stateDir() string {
+	if self.StateDir == "" {
+		return "/var/lib/vcable/crashdump"
+	}
+	return self.StateDir
+}
+
+func (self *Service) acknowledged(name string, size int64) bool {
+	b, err := os.ReadFile(filepath.Join(self.stateDir(), name))
+	return err == nil && strings.TrimSpace(string(b)) == fmt.Sprint(size)
+}
+
+func (self *Service) acknowledge(name string, size int64) error {
+	if err := os.MkdirAll(self.stateDir(), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(self.stateDir(), name), []byte(fmt.Sprintln(size)), 0600)
+}
+
+func (self *Service) interval() time.Duration {
+	if self.Interval == 0 {
+		return 5 * time.Second
+	}
+	return self.Interval
+}
+
+// Collector is the host side of the channel. Dumps are written to Dir,
+// with in-progress uploads kept as <name>.partial until complete.
+type Collector struct {
+	Dir string
+	// Received is called after a dump has been stored completely.
+	Received func(header Header, path string)
+}
+
+// Receive stores dumps offered on conn until the guest disconnects.
+func (self *Collector) Receive(conn net.Conn) error {
+	if err := os.MkdirAll(self.Dir, 0700); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		var header Header
+		if err := readJSON(r, &header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if err := self.receive(conn, r, header); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *Collector) receive(conn net.Conn, r *bufio.Reader, header Header) error {
+	name := filepath.Base(header.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return fmt.Errorf("crashdump: invalid dump name %q", header.Name)
+	}
+	path := filepath.Join(self.Dir, name)
+
+	var offset int64
+	if info, err := os.Stat(path); err == nil && info.Size() == header.Size {
+		offset = header.Size
+	} else if info, err := os.Stat(path + ".partial"); err == nil && info.Size() <= header.Size {
+		offset = info.Size()
+	}
+
+	if err := writeJSON(conn, reply{Offset: offset}); err != nil {
+		return err
+	}
+	if offset == header.Size {
+		if err := drainChunks(r); err != nil {
+			return err
+		}
+		return writeJSON(conn, ack{Done: true})
+	}
+
+	f, err := os.OpenFile(path+".partial", os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := readChunks(r, f); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if info, err := os.Stat(path + ".partial"); err != nil {
+		return err
+	} else if info.Size() != header.Size {
+		return writeJSON(conn, ack{Done: false})
+	}
+	if err := os.Rename(path+".partial", path); err != nil {
+		return err
+	}
+	if self.Received != nil {
+		self.Received(header, path)
+	}
+	return writeJSON(conn, ack{Done: true})
+}
+
+// writeChunks sends r as length-prefixed chunks terminated by an empty one.
+func writeChunks(w io.Writer, r io.Reader) error {
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := r.Read(buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, werr := w.Write(buf[:4+n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	binary.BigEndian.PutUint32(buf, 0)
+	_, err := w.Write(buf[:4])
+	return err
+}
+
+// readChunks writes chunks to w as they arrive, syncing each one so a
+// partial file never claims more than was durably stored.
+func readChunks(r io.Reader, w *os.File) error {
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n == 0 {
+			return nil
+		}
+		if n > chunkSize {
+			return fmt.Errorf("crashdump: chunk of %d bytes exceeds limit", n)
+		}
+		if _, err := io.CopyN(w, r, int64(n)); err != nil {
+			return err
+		}
+		if err := w.Sync(); err != nil {
+			return err
+		}
+	}
+}
+
+func drainChunks(r io.Reader) error {
+	var length [4]byte
+	for {
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint32(length[:])
+		if n == 0 {
+			return nil
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(n)); err != nil {
+			return err
+		}
+	}
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// maxMessage bounds the headers and replies read from the peer.
+const maxMessage = 64 << 10
+
+func readJSON(r *bufio.Reader, v interface{}) error {
+	var line []byte
+	var err error
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxMessage {
+			return fmt.Errorf("crashdump: message exceeds the maximum of %d bytes", maxMessage)
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return io.EOF
+		}
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
@@ -0,0 +1,98 @@
+package crashdump
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadResumesPartial(t *testing.T) {
+	var (
+		source = t.TempDir()
+		state  = t.TempDir()
+		dest   = t.TempDir()
+	)
+
+	data := bytes.Repeat([]byte("core"), 50000)
+	if err := os.WriteFile(filepath.Join(source, "app.1234"), data, 0600); err != nil {
+		t.Fatalf("failed to write dump: %v", err)
+	}
+	// Simulate an upload that was interrupted halfway through.
+	if err := os.WriteFile(filepath.Join(dest, "core-app.1234.partial"), data[:len(data)/2], 0600); err != nil {
+		t.Fatalf("failed to write partial dump: %v", err)
+	}
+
+	service := &Service{
+		Sources:  []Source{{Dir: source, Kind: KindCore}},
+		StateDir: state,
+	}
+	dumps, err := service.Pending()
+	if err != nil {
+		t.Fatalf("failed to list dumps: %v", err)
+	}
+	if len(dumps) != 1 {
+		t.Fatalf("expected 1 pending dump, got %d", len(dumps))
+	}
+
+	guest, host := net.Pipe()
+	done := make(chan error)
+	go func() {
+		done <- (&Collector{Dir: dest}).Receive(host)
+	}()
+
+	if err := service.upload(guest, bufio.NewReader(guest), dumps[0]); err != nil {
+		t.Fatalf("failed to upload: %v", err)
+	}
+	guest.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dest, "core-app.1234"))
+	if err != nil {
+		t.Fatalf("failed to read received dump: %v", err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatalf("received dump differs from source (%d != %d bytes)", len(data), len(got))
+	}
+
+	if dumps, _ := service.Pending(); len(dumps) != 0 {
+		t.Fatalf("expected dump to be acknowledged, but %d are pending", len(dumps))
+	}
+}
+
+func TestServeHostHangsUp(t *testing.T) {
+	service := &Service{
+		Sources:  []Source{{Dir: t.TempDir(), Kind: KindCore}},
+		StateDir: t.TempDir(),
+		Interval: time.Hour,
+	}
+	guest, host := net.Pipe()
+	done := make(chan error, 1)
+	go func() { done <- service.Serve(guest) }()
+
+	// With nothing pending, the service notices the host leaving without
+	// waiting for its next scan.
+	host.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Serve() = %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Serve to return once the host hung up")
+	}
+}
+
+func TestReadJSONLimit(t *testing.T) {
+	var h Header
+	line := `{"name":"` + strings.Repeat("x", maxMessage) + `"}` + "\n"
+	if err := readJSON(bufio.NewReader(strings.NewReader(line)), &h); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("expected an over-long header to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,133 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// A VersionedService speaks several versions of its protocol. Before Serve
+// is called, the agent and the client agree on the highest version both
+// speak with a handshake, which also checks the client reached the service
+// it meant to; VersionOf tells Serve which version was agreed.
+type VersionedService interface {
+	Service
+	// Versions returns the oldest and newest versions the service speaks.
+	Versions() (min, max uint16)
+}
+
+// DefaultHandshakeTimeout bounds the handshake of a versioned service,
+// unless the agent or client sets another.
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// handshakeVersion is the version of the handshake itself:
+//
+//	client: handshake version, oldest and newest versions, name length, name
+//	agent:  status, version agreed, reason length, reason
+//
+// Versions are big-endian uint16, lengths single bytes.
+const handshakeVersion = 1
+
+const (
+	statusOK byte = iota
+	statusUnknownService
+	statusUnsupportedVersion
+)
+
+// VersionOf returns the version of the protocol agreed on conn by the
+// handshake of a versioned service, or 0 if there was none.
+func VersionOf(conn net.Conn) uint16 {
+	if versioned, ok := conn.(*versionedConn); ok {
+		return versioned.version
+	}
+	return 0
+}
+
+type versionedConn struct {
+	net.Conn
+	version uint16
+}
+
+// CloseWrite half-closes the connection, if it supports it.
+func (self *versionedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("agent: %T cannot half-close", self.Conn)
+}
+
+// serverHandshake agrees on a version with the client of service on conn.
+func serverHandshake(conn net.Conn, service VersionedService, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	var head [6]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+	if head[0] != handshakeVersion {
+		return nil, fmt.Errorf("handshake: unsupported handshake version %d", head[0])
+	}
+	clientMin, clientMax := binary.BigEndian.Uint16(head[1:]), binary.BigEndian.Uint16(head[3:])
+	name := make([]byte, head[5])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+
+	min, max := service.Versions()
+	if string(name) != service.Name() {
+		reason := fmt.Sprintf("port %d serves %s", service.Port(), service.Name())
+		writeReply(conn, statusUnknownService, 0, reason)
+		return nil, fmt.Errorf("handshake: client asked for %q", name)
+	}
+	if clientMax < clientMin || clientMax < min || clientMin > max {
+		reason := fmt.Sprintf("%s speaks versions %d to %d", service.Name(), min, max)
+		writeReply(conn, statusUnsupportedVersion, 0, reason)
+		return nil, fmt.Errorf("handshake: client speaks versions %d to %d", clientMin, clientMax)
+	}
+	version := max
+	if clientMax < version {
+		version = clientMax
+	}
+	if err := writeReply(conn, statusOK, version, ""); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+	return &versionedConn{Conn: conn, version: version}, nil
+}
+
+func writeReply(w io.Writer, status byte, version uint16, reason string) error {
+	if len(reason) > 255 {
+		reason = reason[:255]
+	}
+	b := []byte{status, 0, 0, byte(len(reason))}
+	binary.BigEndian.PutUint16(b[1:], version)
+	_, err := w.Write(append(b, reason...))
+	return err
+}
+
+// clientHandshake agrees on a version from min to max with the service
+// called name on conn.
+func clientHandshake(conn net.Conn, name string, min, max uint16) (net.Conn, error) {
+	if len(name) > 255 {
+		return nil, fmt.Errorf("agent: service name of %d bytes exceeds 255", len(name))
+	}
+	b := []byte{handshakeVersion, 0, 0, 0, 0, byte(len(name))}
+	binary.BigEndian.PutUint16(b[1:], min)
+	binary.BigEndian.PutUint16(b[3:], max)
+	if _, err := conn.Write(append(b, name...)); err != nil {
+		return nil, fmt.Errorf("agent: %s: handshake: %v", name, err)
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, fmt.Errorf("agent: %s: handshake: %v", name, err)
+	}
+	if head[0] != statusOK {
+		reason := make([]byte, head[3])
+		io.ReadFull(conn, reason)
+		return nil, fmt.Errorf("agent: %s: refused: %s", name, reason)
+	}
+	return &versionedConn{Conn: conn, version: binary.BigEndian.Uint16(head[1:])}, nil
+}
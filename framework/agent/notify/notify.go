@@ -0,0 +1,203 @@
+// Package notify lets guest applications raise desktop notifications that
+// the host forwards to its own notification daemon, for desktop VMs whose
+// guests have no access to the host session bus.
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the host vsock port notifications are sent to.
+const Port = vsock.PortNotify
+
+const (
+	maxTitle = 256
+	maxBody  = 4096
+	// maxLine bounds a message on the wire, leaving room for the escaping
+	// of a title and body which are truncated afterwards.
+	maxLine = 64 << 10
+)
+
+type Urgency string
+
+const (
+	Low      Urgency = "low"
+	Normal   Urgency = "normal"
+	Critical Urgency = "critical"
+)
+
+type Notification struct {
+	AppName string        `json:"app_name,omitempty"`
+	Title   string        `json:"title"`
+	Body    string        `json:"body,omitempty"`
+	Icon    string        `json:"icon,omitempty"`
+	Urgency Urgency       `json:"urgency,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+type result struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Send delivers a notification from the guest to the host.
+func Send(n Notification) error {
+	conn, err := vsock.Dial(vsock.Host, Port)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return SendConn(conn, n)
+}
+
+// SendConn delivers a notification over an established connection and
+// waits for the host to accept it.
+func SendConn(conn net.Conn, n Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return err
+	}
+
+	line, err := readLine(bufio.NewReader(conn), maxLine)
+	if err != nil {
+		return err
+	}
+	var r result
+	if err := json.Unmarshal(line, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return fmt.Errorf("notify: host: %s", r.Error)
+	}
+	return nil
+}
+
+// Server is the host side. Every notification is attributed to the guest it
+// came from, so a guest cannot impersonate a host application.
+type Server struct {
+	// Deliver shows the notification on the host. Defaults to notify-send.
+	Deliver func(from net.Addr, n Notification) error
+	// Backoff spaces retries after temporary accept errors, such as
+	// EMFILE. Defaults to exponential backoff from 5ms to 1s.
+	Backoff vsock.Backoff
+}
+
+func (self *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := vsock.AcceptWith(l, vsock.AcceptOptions{Backoff: self.Backoff})
+		if err != nil {
+			return err
+		}
+		go self.ServeConn(conn)
+	}
+}
+
+func (self *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	encoder := json.NewEncoder(conn)
+	for {
+		line, err := readLine(r, maxLine)
+		if err != nil {
+			if err != io.EOF {
+				encoder.Encode(result{Error: err.Error()})
+			}
+			return
+		}
+
+		var n Notification
+		if err := json.Unmarshal(line, &n); err != nil {
+			encoder.Encode(result{Error: err.Error()})
+			return
+		}
+
+		deliver := self.Deliver
+		if deliver == nil {
+			deliver = NotifySend
+		}
+
+		var res result
+		if err := deliver(conn.RemoteAddr(), sanitize(conn.RemoteAddr(), n)); err != nil {
+			res.Error = err.Error()
+		}
+		if err := encoder.Encode(res); err != nil {
+			return
+		}
+	}
+}
+
+// readLine reads a line of at most max bytes from r.
+func readLine(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max {
+			return nil, fmt.Errorf("notify: message too long")
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func sanitize(from net.Addr, n Notification) Notification {
+	app := "vm"
+	if from != nil {
+		app = from.String()
+	}
+	if n.AppName != "" {
+		app += ": " + n.AppName
+	}
+	n.AppName = app
+
+	if len(n.Title) > maxTitle {
+		n.Title = n.Title[:maxTitle]
+	}
+	if len(n.Body) > maxBody {
+		n.Body = n.Body[:maxBody]
+	}
+	switch n.Urgency {
+	case Low, Normal, Critical:
+	default:
+		n.Urgency = Normal
+	}
+	// Icons are names from the host theme only; guest paths mean nothing
+	// on the host and could probe its filesystem.
+	if len(n.Icon) > 0 && (n.Icon[0] == '/' || n.Icon[0] == '.') {
+		n.Icon = ""
+	}
+	return n
+}
+
+// NotifySend delivers a notification through the notify-send utility.
+func NotifySend(from net.Addr, n Notification) error {
+	args := []string{"--app-name", n.AppName, "--urgency", string(n.Urgency)}
+	if n.Icon != "" {
+		args = append(args, "--icon", n.Icon)
+	}
+	if n.Timeout > 0 {
+		args = append(args, "--expire-time", strconv.FormatInt(n.Timeout.Milliseconds(), 10))
+	}
+	args = append(args, "--", n.Title)
+	if n.Body != "" {
+		args = append(args, n.Body)
+	}
+
+	if out, err := exec.Command("notify-send", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("notify-send: %v: %s", err, out)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+//go:build linux
+
+package notify
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+func TestSend(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	l, err := network.Machine(vsock.Host).Listen(Port)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	restore := network.Machine(3).Install()
+	defer restore()
+
+	var (
+		delivered []Notification
+		senders   []string
+	)
+	server := &Server{Deliver: func(from net.Addr, n Notification) error {
+		if n.Title == "refused" {
+			return errors.New("no notification daemon")
+		}
+		delivered = append(delivered, n)
+		senders = append(senders, from.String())
+		return nil
+	}}
+	go server.Serve(l)
+
+	err = Send(Notification{
+		AppName: "editor",
+		Title:   strings.Repeat("t", maxTitle+1),
+		Body:    "saved",
+		Icon:    "/etc/shadow",
+		Urgency: "urgent",
+	})
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	// Notifications are attributed to their guest, and stripped of what
+	// the host should not trust.
+	want := []Notification{{
+		AppName: senders[0] + ": editor",
+		Title:   strings.Repeat("t", maxTitle),
+		Body:    "saved",
+		Urgency: Normal,
+	}}
+	if diff := cmp.Diff(want, delivered); diff != "" {
+		t.Fatalf("unexpected notifications (-want +got):\n%s", diff)
+	}
+	if !strings.HasPrefix(senders[0], "vm(3):") {
+		t.Fatalf("expected the notification to come from the guest, got %s", senders[0])
+	}
+
+	if err := Send(Notification{Title: "refused"}); err == nil || !strings.Contains(err.Error(), "no notification daemon") {
+		t.Fatalf("expected the failure of the host, got %v", err)
+	}
+}
+
+func TestServeConnTooLong(t *testing.T) {
+	host, guest := net.Pipe()
+	defer guest.Close()
+	delivered := false
+	server := &Server{Deliver: func(net.Addr, Notification) error {
+		delivered = true
+		return nil
+	}}
+	go server.ServeConn(host)
+
+	go guest.Write([]byte(`{"title":"` + strings.Repeat("t", 2*maxLine)))
+	// The reply is itself bounded, so a host cannot exhaust the guest.
+	line, err := readLine(bufio.NewReader(guest), maxLine)
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+	if !strings.Contains(string(line), "message too long") || delivered {
+		t.Fatalf("expected the line to be refused, got %s", line)
+	}
+	if _, err := readLine(bufio.NewReader(strings.NewReader(strings.Repeat("x", maxLine+1))), maxLine); err == nil {
+		t.Fatal("expected an over-long reply to be refused")
+	}
+}
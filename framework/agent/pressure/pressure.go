@@ -0,0 +1,259 @@
+// Package pressure streams kernel pressure stall information (PSI) and OOM
+// kill events from a guest to the host, so host schedulers can rebalance
+// before a guest starts to thrash. Windows has neither, so its stream stays
+// silent.
+package pressure
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the pressure service listens on.
+const Port = vsock.PortPressure
+
+type Resource string
+
+const (
+	CPU    Resource = "cpu"
+	Memory Resource = "memory"
+	IO     Resource = "io"
+)
+
+type Kind string
+
+const (
+	// KindPressure events are raised when a PSI trigger fires, or on every
+	// sample when triggers are unavailable.
+	KindPressure Kind = "pressure"
+	// KindOOM events are raised when the kernel OOM killer has run.
+	KindOOM Kind = "oom"
+)
+
+// Stall is one line of a /proc/pressure file.
+type Stall struct {
+	Avg10  float64 `json:"avg10"`
+	Avg60  float64 `json:"avg60"`
+	Avg300 float64 `json:"avg300"`
+	// Total is the absolute stall time in microseconds.
+	Total uint64 `json:"total"`
+}
+
+type Pressure struct {
+	Some Stall  `json:"some"`
+	Full *Stall `json:"full,omitempty"`
+}
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Kind     Kind      `json:"kind"`
+	Resource Resource  `json:"resource,omitempty"`
+	Pressure *Pressure `json:"pressure,omitempty"`
+	// OOMKills is the number of processes killed since the previous event.
+	OOMKills uint64 `json:"oom_kills,omitempty"`
+}
+
+// Service is the guest side of the pressure stream. Each connection
+// receives newline-delimited JSON events until it is closed.
+type Service struct {
+	// Root is the procfs mount point. Defaults to /proc.
+	Root string
+	// Resources to watch. Defaults to cpu, memory and io.
+	Resources []Resource
+	// Threshold is the stall time within Window that fires a trigger.
+	// Defaults to 150ms.
+	Threshold time.Duration
+	// Window is the PSI trigger window. Unprivileged triggers require a
+	// multiple of 2s. Defaults to 2s.
+	Window time.Duration
+	// Interval bounds how long OOM kills can go unreported, and is the
+	// sampling period when triggers are unavailable. Defaults to 1s.
+	Interval time.Duration
+}
+
+func (self *Service) Name() string { return "pressure" }
+func (self *Service) Port() uint32 { return Port }
+
+func (self *Service) Serve(conn net.Conn) error {
+	closed := make(chan struct{})
+	go func() {
+		// The host never sends anything; a read returning means it hung up.
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+
+	encoder := json.NewEncoder(conn)
+	return self.Watch(closed, func(event Event) error {
+		return encoder.Encode(event)
+	})
+}
+
+// Watch calls fn for every event until done is closed or fn returns an
+// error.
+func (self *Service) Watch(done <-chan struct{}, fn func(Event) error) error {
+	triggers := self.openTriggers()
+	defer closeTriggers(triggers)
+
+	oomKills, _ := self.oomKills()
+	interval := self.interval()
+	for {
+		select {
+		case <-done:
+			return nil
+		default:
+		}
+
+		fired, err := poll(triggers, interval)
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		if len(triggers) == 0 {
+			fired = self.resources()
+		}
+		for _, resource := range fired {
+			p, err := self.Read(resource)
+			if err != nil {
+				continue
+			}
+			if err := fn(Event{Time: now, Kind: KindPressure, Resource: resource, Pressure: p}); err != nil {
+				return err
+			}
+		}
+
+		if n, err := self.oomKills(); err == nil && n > oomKills {
+			if err := fn(Event{Time: now, Kind: KindOOM, Resource: Memory, OOMKills: n - oomKills}); err != nil {
+				return err
+			}
+			oomKills = n
+		}
+	}
+}
+
+// Read samples the current pressure of a resource.
+func (self *Service) Read(resource Resource) (*Pressure, error) {
+	b, err := os.ReadFile(filepath.Join(self.root(), "pressure", string(resource)))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(bytes.NewReader(b))
+}
+
+func (self *Service) oomKills() (uint64, error) {
+	f, err := os.Open(filepath.Join(self.root(), "vmstat"))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			return strconv.ParseUint(fields[1], 10, 64)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	return 0, fmt.Errorf("pressure: oom_kill counter not found in vmstat")
+}
+
+func (self *Service) root() string {
+	if self.Root == "" {
+		return "/proc"
+	}
+	return self.Root
+}
+
+func (self *Service) resources() []Resource {
+	if len(self.Resources) == 0 {
+		return []Resource{CPU, Memory, IO}
+	}
+	return self.Resources
+}
+
+func (self *Service) interval() time.Duration {
+	if self.Interval == 0 {
+		return time.Second
+	}
+	return self.Interval
+}
+
+// Parse reads the contents of a /proc/pressure file.
+func Parse(r io.Reader) (*Pressure, error) {
+	var p Pressure
+	var some bool
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		var stall Stall
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("pressure: malformed field %q", field)
+			}
+
+			var err error
+			switch kv[0] {
+			case "avg10":
+				stall.Avg10, err = strconv.ParseFloat(kv[1], 64)
+			case "avg60":
+				stall.Avg60, err = strconv.ParseFloat(kv[1], 64)
+			case "avg300":
+				stall.Avg300, err = strconv.ParseFloat(kv[1], 64)
+			case "total":
+				stall.Total, err = strconv.ParseUint(kv[1], 10, 64)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("pressure: malformed field %q: %v", field, err)
+			}
+		}
+
+		switch fields[0] {
+		case "some":
+			p.Some, some = stall, true
+		case "full":
+			p.Full = &stall
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !some {
+		return nil, fmt.Errorf("pressure: missing \"some\" line")
+	}
+	return &p, nil
+}
+
+// Reader is the host side of the pressure stream.
+type Reader struct {
+	decoder *json.Decoder
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{decoder: json.NewDecoder(r)}
+}
+
+// Next blocks until the guest sends the next event.
+func (self *Reader) Next() (Event, error) {
+	var event Event
+	err := self.decoder.Decode(&event)
+	return event, err
+}
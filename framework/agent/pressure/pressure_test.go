@@ -0,0 +1,33 @@
+package pressure
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParse(t *testing.T) {
+	const input = `some avg10=1.50 avg60=0.25 avg300=0.00 total=123456
+full avg10=0.10 avg60=0.00 avg300=0.00 total=42
+`
+
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	want := &Pressure{
+		Some: Stall{Avg10: 1.5, Avg60: 0.25, Total: 123456},
+		Full: &Stall{Avg10: 0.1, Total: 42},
+	}
+	if diff := cmp.Diff(want, p); diff != "" {
+		t.Fatalf("unexpected pressure (-want +got):\n%s", diff)
+	}
+}
+
+func TestParseMissingSome(t *testing.T) {
+	if _, err := Parse(strings.NewReader("full avg10=0.00 avg60=0.00 avg300=0.00 total=0\n")); err == nil {
+		t.Fatal("expected an error, but none occurred")
+	}
+}
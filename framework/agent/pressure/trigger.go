@@ -0,0 +1,80 @@
+//go:build !windows
+
+package pressure
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type trigger struct {
+	fd       int
+	resource Resource
+}
+
+func (self *Service) openTriggers() []trigger {
+	threshold, window := self.Threshold, self.Window
+	if threshold == 0 {
+		threshold = 150 * time.Millisecond
+	}
+	if window == 0 {
+		window = 2 * time.Second
+	}
+	spec := fmt.Sprintf("some %d %d", threshold.Microseconds(), window.Microseconds())
+
+	var triggers []trigger
+	for _, resource := range self.resources() {
+		path := filepath.Join(self.root(), "pressure", string(resource))
+		fd, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+		if err != nil {
+			continue
+		}
+		if _, err := unix.Write(fd, []byte(spec)); err != nil {
+			unix.Close(fd)
+			continue
+		}
+		triggers = append(triggers, trigger{fd: fd, resource: resource})
+	}
+	return triggers
+}
+
+func poll(triggers []trigger, timeout time.Duration) ([]Resource, error) {
+	if len(triggers) == 0 {
+		time.Sleep(timeout)
+		return nil, nil
+	}
+
+	fds := make([]unix.PollFd, len(triggers))
+	for i, t := range triggers {
+		fds[i] = unix.PollFd{Fd: int32(t.fd), Events: unix.POLLPRI}
+	}
+
+	_, err := unix.Poll(fds, int(timeout.Milliseconds()))
+	switch err {
+	case nil:
+	case unix.EINTR:
+		return nil, nil
+	default:
+		return nil, err
+	}
+
+	var fired []Resource
+	for i, fd := range fds {
+		if fd.Revents&unix.POLLERR != 0 {
+			return nil, fmt.Errorf("pressure: %s trigger is no longer valid", triggers[i].resource)
+		}
+		if fd.Revents&unix.POLLPRI != 0 {
+			fired = append(fired, triggers[i].resource)
+		}
+	}
+	return fired, nil
+}
+
+func closeTriggers(triggers []trigger) {
+	for _, t := range triggers {
+		unix.Close(t.fd)
+	}
+}
@@ -0,0 +1,15 @@
+package pressure
+
+import "time"
+
+// Windows has no pressure stall information, so no trigger ever fires.
+type trigger struct{}
+
+func (self *Service) openTriggers() []trigger { return nil }
+
+func closeTriggers([]trigger) {}
+
+func poll(triggers []trigger, timeout time.Duration) ([]Resource, error) {
+	time.Sleep(timeout)
+	return nil, nil
+}
@@ -0,0 +1,419 @@
+// Package qga serves the qemu-guest-agent protocol from the vcable agent, so
+// orchestration written against QGA can drive guests running vcable instead.
+//
+// Commands are JSON objects of the form {"execute": name, "arguments": {...}}
+// answered by {"return": ...} or {"error": {"class": ..., "desc": ...}}. The
+// service runs as an agent service on a vsock port, or on the virtio-serial
+// channel QEMU exposes to its guest agent.
+package qga
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the QGA service listens on.
+const Port = vsock.PortQGA
+
+// Version is reported by guest-info.
+const Version = "vcable"
+
+// Error classes, as defined by QMP.
+const (
+	GenericError    = "GenericError"
+	CommandNotFound = "CommandNotFound"
+)
+
+// delimiter precedes the reply to guest-sync-delimited, and may be sent by
+// clients to flush the parser.
+const delimiter = 0xff
+
+type request struct {
+	Execute   string          `json:"execute"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+	ID        json.RawMessage `json:"id,omitempty"`
+}
+
+type response struct {
+	Return interface{}     `json:"return,omitempty"`
+	Error  *Error          `json:"error,omitempty"`
+	ID     json.RawMessage `json:"id,omitempty"`
+}
+
+// Error is a failed command.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (self *Error) Error() string { return self.Desc }
+
+// Command implements a QGA command. args holds the raw arguments, if any;
+// the result is encoded as the "return" member.
+type Command func(args json.RawMessage) (interface{}, error)
+
+// Service serves QGA commands: guest-ping, guest-sync, guest-info,
+// guest-get-time, guest-exec, guest-exec-status and the guest-fsfreeze
+// family, plus any registered with Handle.
+type Service struct {
+	// Mounts returns the mount points guest-fsfreeze-freeze freezes.
+	// Defaults to every mounted block device filesystem. Windows guests
+	// freeze none: their filesystems are frozen through VSS.
+	Mounts func() ([]string, error)
+
+	mutex     sync.Mutex
+	commands  map[string]Command
+	processes map[int]*process
+	frozen    []*os.File
+}
+
+func (self *Service) Name() string { return "qga" }
+func (self *Service) Port() uint32 { return Port }
+
+// Handle registers or replaces a command.
+func (self *Service) Handle(name string, command Command) {
+	self.init()
+	self.mutex.Lock()
+	self.commands[name] = command
+	self.mutex.Unlock()
+}
+
+// Serve answers commands on conn until it is closed.
+func (self *Service) Serve(conn net.Conn) error {
+	return self.ServeStream(conn)
+}
+
+// ServeSerial serves commands on the virtio-serial channel at path, or at
+// DefaultSerialPath if path is empty.
+func (self *Service) ServeSerial(path string) error {
+	if path == "" {
+		path = DefaultSerialPath
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return self.ServeStream(f)
+}
+
+// ServeStream answers commands read from rw.
+func (self *Service) ServeStream(rw io.ReadWriter) error {
+	self.init()
+	decoder := json.NewDecoder(&skipDelimiters{r: rw})
+	for {
+		var req request
+		if err := decoder.Decode(&req); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			if _, ok := err.(*json.SyntaxError); ok {
+				// Start over past the garbage, as QGA does.
+				decoder = json.NewDecoder(&skipDelimiters{r: rw})
+				if werr := writeResponse(rw, response{Error: &Error{Class: GenericError, Desc: err.Error()}}); werr != nil {
+					return werr
+				}
+				continue
+			}
+			return err
+		}
+		if req.Execute == "guest-sync-delimited" {
+			if _, err := rw.Write([]byte{delimiter}); err != nil {
+				return err
+			}
+		}
+		if err := writeResponse(rw, self.execute(req)); err != nil {
+			return err
+		}
+	}
+}
+
+func (self *Service) execute(req request) response {
+	self.mutex.Lock()
+	command, ok := self.commands[req.Execute]
+	self.mutex.Unlock()
+	if !ok {
+		return response{ID: req.ID, Error: &Error{Class: CommandNotFound, Desc: fmt.Sprintf("The command %s has not been found", req.Execute)}}
+	}
+
+	result, err := command(req.Arguments)
+	if err != nil {
+		qerr, ok := err.(*Error)
+		if !ok {
+			qerr = &Error{Class: GenericError, Desc: err.Error()}
+		}
+		return response{ID: req.ID, Error: qerr}
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	return response{ID: req.ID, Return: result}
+}
+
+func (self *Service) init() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.commands != nil {
+		return
+	}
+	self.processes = make(map[int]*process)
+	self.commands = map[string]Command{
+		"guest-ping":            func(json.RawMessage) (interface{}, error) { return nil, nil },
+		"guest-sync":            guestSync,
+		"guest-sync-delimited":  guestSync,
+		"guest-info":            self.info,
+		"guest-get-time":        func(json.RawMessage) (interface{}, error) { return time.Now().UnixNano(), nil },
+		"guest-exec":            self.exec,
+		"guest-exec-status":     self.execStatus,
+		"guest-fsfreeze-status": self.freezeStatus,
+		"guest-fsfreeze-freeze": self.freeze,
+		"guest-fsfreeze-thaw":   self.thaw,
+	}
+}
+
+func guestSync(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		ID *int64 `json:"id"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if a.ID == nil {
+		return nil, &Error{Class: GenericError, Desc: "Parameter 'id' is missing"}
+	}
+	return *a.ID, nil
+}
+
+type commandInfo struct {
+	Name            string `json:"name"`
+	Enabled         bool   `json:"enabled"`
+	SuccessResponse bool   `json:"success-response"`
+}
+
+func (self *Service) info(json.RawMessage) (interface{}, error) {
+	self.mutex.Lock()
+	names := make([]string, 0, len(self.commands))
+	for name := range self.commands {
+		names = append(names, name)
+	}
+	self.mutex.Unlock()
+	sort.Strings(names)
+
+	commands := make([]commandInfo, len(names))
+	for i, name := range names {
+		commands[i] = commandInfo{Name: name, Enabled: true, SuccessResponse: true}
+	}
+	return struct {
+		Version  string        `json:"version"`
+		Commands []commandInfo `json:"supported_commands"`
+	}{Version, commands}, nil
+}
+
+// process is a command started by guest-exec.
+type process struct {
+	done     chan struct{}
+	stdout   bytes.Buffer
+	stderr   bytes.Buffer
+	exitCode int
+	signal   int
+}
+
+func (self *Service) exec(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		Path          string   `json:"path"`
+		Arg           []string `json:"arg"`
+		Env           []string `json:"env"`
+		InputData     []byte   `json:"input-data"`
+		CaptureOutput bool     `json:"capture-output"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Path == "" {
+		return nil, &Error{Class: GenericError, Desc: "Parameter 'path' is missing"}
+	}
+
+	p := &process{done: make(chan struct{})}
+	cmd := command(a.Path, a.Arg)
+	if a.Env != nil {
+		cmd.Env = a.Env
+	}
+	if a.InputData != nil {
+		cmd.Stdin = bytes.NewReader(a.InputData)
+	}
+	if a.CaptureOutput {
+		cmd.Stdout, cmd.Stderr = &p.stdout, &p.stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	pid := cmd.Process.Pid
+	self.mutex.Lock()
+	self.processes[pid] = p
+	self.mutex.Unlock()
+
+	go func() {
+		cmd.Wait()
+		if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			p.signal = int(status.Signal())
+		} else {
+			p.exitCode = cmd.ProcessState.ExitCode()
+		}
+		close(p.done)
+	}()
+	return struct {
+		PID int `json:"pid"`
+	}{pid}, nil
+}
+
+type execStatus struct {
+	Exited   bool   `json:"exited"`
+	ExitCode *int   `json:"exitcode,omitempty"`
+	Signal   *int   `json:"signal,omitempty"`
+	OutData  []byte `json:"out-data,omitempty"`
+	ErrData  []byte `json:"err-data,omitempty"`
+}
+
+func (self *Service) execStatus(args json.RawMessage) (interface{}, error) {
+	var a struct {
+		PID int `json:"pid"`
+	}
+	if err := unmarshal(args, &a); err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	p, ok := self.processes[a.PID]
+	self.mutex.Unlock()
+	if !ok {
+		return nil, &Error{Class: GenericError, Desc: "Invalid parameter 'pid'"}
+	}
+
+	select {
+	case <-p.done:
+	default:
+		return execStatus{}, nil
+	}
+	// Like QGA, report a finished process once.
+	self.mutex.Lock()
+	delete(self.processes, a.PID)
+	self.mutex.Unlock()
+
+	status := execStatus{Exited: true, OutData: p.stdout.Bytes(), ErrData: p.stderr.Bytes()}
+	if p.signal != 0 {
+		status.Signal = &p.signal
+	} else {
+		status.ExitCode = &p.exitCode
+	}
+	return status, nil
+}
+
+func (self *Service) freezeStatus(json.RawMessage) (interface{}, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.frozen != nil {
+		return "frozen", nil
+	}
+	return "thawed", nil
+}
+
+func (self *Service) freeze(json.RawMessage) (interface{}, error) {
+	mounts := self.Mounts
+	if mounts == nil {
+		mounts = blockMounts
+	}
+	points, err := mounts()
+	if err != nil {
+		return nil, err
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.frozen != nil {
+		return nil, &Error{Class: GenericError, Desc: "Filesystems are already frozen"}
+	}
+	frozen := []*os.File{}
+	for _, point := range points {
+		f, err := freeze(point)
+		if err != nil {
+			thaw(frozen)
+			return nil, fmt.Errorf("failed to freeze %s: %v", point, err)
+		}
+		if f != nil {
+			frozen = append(frozen, f)
+		}
+	}
+	self.frozen = frozen
+	return len(frozen), nil
+}
+
+func (self *Service) thaw(json.RawMessage) (interface{}, error) {
+	self.mutex.Lock()
+	frozen := self.frozen
+	self.frozen = nil
+	self.mutex.Unlock()
+	return thaw(frozen), nil
+}
+
+// thaw thaws filesystems in the reverse order they were frozen in, returning
+// how many were thawed.
+func thaw(frozen []*os.File) int {
+	n := 0
+	for i := len(frozen) - 1; i >= 0; i-- {
+		if thawFile(frozen[i]) == nil {
+			n++
+		}
+		frozen[i].Close()
+	}
+	return n
+}
+
+func unmarshal(args json.RawMessage, v interface{}) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(args, v); err != nil {
+		return &Error{Class: GenericError, Desc: err.Error()}
+	}
+	return nil
+}
+
+func writeResponse(w io.Writer, r response) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// skipDelimiters drops the 0xff bytes clients send to resynchronise.
+type skipDelimiters struct {
+	r io.Reader
+}
+
+func (self *skipDelimiters) Read(b []byte) (int, error) {
+	for {
+		n, err := self.r.Read(b)
+		kept := 0
+		for _, c := range b[:n] {
+			if c != delimiter {
+				b[kept] = c
+				kept++
+			}
+		}
+		if kept > 0 || err != nil {
+			return kept, err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package qga
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommands(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	service := &Service{}
+	go service.Serve(server)
+
+	r := bufio.NewReader(client)
+	call := func(req string) map[string]interface{} {
+		t.Helper()
+		go client.Write([]byte(req))
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		var resp map[string]interface{}
+		if err := json.Unmarshal(line, &resp); err != nil {
+			t.Fatalf("failed to decode %q: %v", line, err)
+		}
+		return resp
+	}
+
+	if diff := cmp.Diff(map[string]interface{}{"return": map[string]interface{}{}}, call(`{"execute":"guest-ping"}`)); diff != "" {
+		t.Errorf("unexpected guest-ping response (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]interface{}{"return": 42.0}, call("\xff"+`{"execute":"guest-sync","arguments":{"id":42}}`)); diff != "" {
+		t.Errorf("unexpected guest-sync response (-want +got):\n%s", diff)
+	}
+	missing := call(`{"execute":"guest-missing","id":"a"}`)
+	if diff := cmp.Diff("CommandNotFound", missing["error"].(map[string]interface{})["class"]); diff != "" {
+		t.Errorf("unexpected error class (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff("a", missing["id"]); diff != "" {
+		t.Errorf("unexpected id (-want +got):\n%s", diff)
+	}
+
+	started := call(`{"execute":"guest-exec","arguments":{"path":"/bin/sh","arg":["-c","cat; exit 3"],"input-data":"aGVsbG8=","capture-output":true}}`)
+	pid := started["return"].(map[string]interface{})["pid"]
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := json.Marshal(map[string]interface{}{"execute": "guest-exec-status", "arguments": map[string]interface{}{"pid": pid}})
+		status := call(string(b))["return"].(map[string]interface{})
+		if status["exited"] == true {
+			want := map[string]interface{}{"exited": true, "exitcode": 3.0, "out-data": "aGVsbG8="}
+			if diff := cmp.Diff(want, status); diff != "" {
+				t.Fatalf("unexpected exec status (-want +got):\n%s", diff)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("process did not exit")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSyncDelimited(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go (&Service{}).Serve(server)
+
+	go client.Write([]byte(`{"execute":"guest-sync-delimited","arguments":{"id":7}}`))
+	line, err := bufio.NewReader(client).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if diff := cmp.Diff("\xff{\"return\":7}\n", string(line)); diff != "" {
+		t.Fatalf("unexpected response (-want +got):\n%s", diff)
+	}
+}
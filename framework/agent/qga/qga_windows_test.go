@@ -0,0 +1,26 @@
+package qga
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestCommand(t *testing.T) {
+	t.Setenv("ComSpec", `C:\Windows\System32\cmd.exe`)
+
+	cmd := command("C:/Program Files/app.exe", []string{"a b", `say "hi"`})
+	want := []string{`C:\Program Files\app.exe`, "a b", `say "hi"`}
+	if diff := cmp.Diff(want[0], cmd.Path); diff != "" {
+		t.Fatalf("unexpected path (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(want[1:], cmd.Args[1:]); diff != "" {
+		t.Fatalf("unexpected arguments (-want +got):\n%s", diff)
+	}
+
+	cmd = command("C:/scripts/run.bat", []string{"a b", "x & del *"})
+	line := `C:\Windows\System32\cmd.exe /d /c C:\scripts\run.bat ^"a b^" ^"x ^& del *^"`
+	if diff := cmp.Diff(line, cmd.SysProcAttr.CmdLine); diff != "" {
+		t.Fatalf("unexpected command line (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,92 @@
+//go:build !windows
+
+package qga
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// DefaultSerialPath is the virtio-serial channel QEMU names for its guest
+// agent.
+const DefaultSerialPath = "/dev/virtio-ports/org.qemu.guest_agent.0"
+
+// command returns the process guest-exec runs.
+func command(path string, args []string) *exec.Cmd {
+	return exec.Command(path, args...)
+}
+
+// The FIFREEZE and FITHAW ioctls.
+const (
+	fiFreeze = 0xc0045877
+	fiThaw   = 0xc0045878
+)
+
+// freeze freezes the filesystem mounted at point, returning the open mount
+// point which thawFile needs, or nil if it cannot be frozen.
+func freeze(point string) (*os.File, error) {
+	f, err := os.Open(point)
+	if err != nil {
+		return nil, err
+	}
+	if err := unix.IoctlSetInt(int(f.Fd()), fiFreeze, 0); err != nil {
+		f.Close()
+		switch err {
+		case unix.EOPNOTSUPP, unix.ENOTTY:
+			return nil, nil
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+func thawFile(f *os.File) error {
+	return unix.IoctlSetInt(int(f.Fd()), fiThaw, 0)
+}
+
+// blockMounts returns the mount points of filesystems on block devices,
+// once each, from /proc/self/mounts.
+func blockMounts() ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		points  []string
+		devices = make(map[string]bool)
+	)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") || devices[fields[0]] {
+			continue
+		}
+		devices[fields[0]] = true
+		points = append(points, unescape(fields[1]))
+	}
+	return points, scanner.Err()
+}
+
+// unescape decodes the octal escapes of /proc/self/mounts.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			c := (s[i+1]-'0')<<6 | (s[i+2]-'0')<<3 | (s[i+3] - '0')
+			b.WriteByte(c)
+			i += 3
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
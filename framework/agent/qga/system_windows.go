@@ -0,0 +1,61 @@
+package qga
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// DefaultSerialPath is the virtio-serial channel QEMU names for its guest
+// agent, as the virtio-win serial driver exposes it.
+const DefaultSerialPath = `\\.\Global\org.qemu.guest_agent.0`
+
+// command returns the process guest-exec runs. Hosts often write paths with
+// forward slashes, which are converted. Arguments are quoted as
+// CommandLineToArgvW splits them, except for batch files: those run through
+// cmd.exe, which has its own quoting, so its metacharacters are escaped too
+// and arguments cannot inject commands.
+func command(path string, args []string) *exec.Cmd {
+	path = filepath.FromSlash(path)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".bat", ".cmd":
+	default:
+		return exec.Command(path, args...)
+	}
+
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = `C:\Windows\System32\cmd.exe`
+	}
+	line := []string{syscall.EscapeArg(shell), "/d", "/c", cmdQuote(path)}
+	for _, arg := range args {
+		line = append(line, cmdQuote(arg))
+	}
+	cmd := exec.Command(shell)
+	cmd.SysProcAttr = &syscall.SysProcAttr{CmdLine: strings.Join(line, " ")}
+	return cmd
+}
+
+// cmdQuote quotes s for the batch file cmd.exe runs, escaping with a caret
+// every character cmd.exe would otherwise interpret, quotes included.
+func cmdQuote(s string) string {
+	var b strings.Builder
+	for _, c := range syscall.EscapeArg(s) {
+		if strings.ContainsRune(`()%!^"<>&|`, c) {
+			b.WriteByte('^')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// freeze leaves the filesystem at point as it is: Windows freezes
+// filesystems through VSS, which the service does not drive.
+func freeze(point string) (*os.File, error) { return nil, nil }
+
+func thawFile(f *os.File) error { return nil }
+
+// blockMounts returns no mount points, as none can be frozen.
+func blockMounts() ([]string, error) { return nil, nil }
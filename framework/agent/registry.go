@@ -0,0 +1,59 @@
+package agent
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// A Factory makes a service with its default configuration.
+type Factory func() Service
+
+// Registry maps service names to factories, so agents can enable services
+// by name, including those of other modules which register themselves when
+// linked in. Agents use Default unless given another.
+type Registry struct {
+	mutex     sync.RWMutex
+	factories map[string]Factory
+}
+
+// Default is the registry of the process.
+var Default = &Registry{}
+
+// Register makes the service factory makes available under name,
+// replacing any registered under the same name.
+func (self *Registry) Register(name string, factory Factory) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.factories == nil {
+		self.factories = make(map[string]Factory)
+	}
+	self.factories[name] = factory
+}
+
+// New makes the service registered under name.
+func (self *Registry) New(name string) (Service, error) {
+	self.mutex.RLock()
+	factory, ok := self.factories[name]
+	self.mutex.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("agent: unknown service %q", name)
+	}
+	return factory(), nil
+}
+
+// Names returns the names of the registered services, sorted.
+func (self *Registry) Names() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	names := make([]string, 0, len(self.factories))
+	for name := range self.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register registers a service factory with Default, typically from the
+// init function of the package providing the service.
+func Register(name string, factory Factory) { Default.Register(name, factory) }
@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// A portable BLAKE3 hasher with the default 32-byte output. Transfers
+// are hashed at link speed, which this keeps up with, without adding a
+// dependency to the module.
+
+const (
+	blake3Size       = 32
+	blake3BlockSize  = 64
+	blake3ChunkSize  = 1024
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, x, y uint32) {
+	s[a] += s[b] + x
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + y
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for round := 0; round < 7; round++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	for i := 0; i < 8; i++ {
+		s[i] ^= s[i+8]
+		s[i+8] ^= cv[i]
+	}
+	return s
+}
+
+// blake3Output is a compression not yet done, as the root flag is only
+// known once the input has ended.
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (self *blake3Output) chainingValue() (cv [8]uint32) {
+	s := blake3Compress(&self.cv, &self.block, self.counter, self.blockLen, self.flags)
+	copy(cv[:], s[:8])
+	return cv
+}
+
+func (self *blake3Output) root() (sum [blake3Size]byte) {
+	s := blake3Compress(&self.cv, &self.block, 0, self.blockLen, self.flags|blake3Root)
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(sum[4*i:], s[i])
+	}
+	return sum
+}
+
+func blake3Words(b []byte) (block [16]uint32) {
+	var padded [blake3BlockSize]byte
+	copy(padded[:], b)
+	for i := range block {
+		block[i] = binary.LittleEndian.Uint32(padded[4*i:])
+	}
+	return block
+}
+
+func blake3ParentOutput(left, right [8]uint32) blake3Output {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return blake3Output{cv: blake3IV, block: block, blockLen: blake3BlockSize, flags: blake3Parent}
+}
+
+type blake3Chunk struct {
+	cv         [8]uint32
+	counter    uint64
+	block      [blake3BlockSize]byte
+	blockLen   int
+	compressed int
+}
+
+func (self *blake3Chunk) len() int { return blake3BlockSize*self.compressed + self.blockLen }
+
+func (self *blake3Chunk) startFlag() uint32 {
+	if self.compressed == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (self *blake3Chunk) write(b []byte) {
+	for len(b) > 0 {
+		// The last block is held back, it is compressed with the end flag.
+		if self.blockLen == blake3BlockSize {
+			block := blake3Words(self.block[:])
+			s := blake3Compress(&self.cv, &block, self.counter, blake3BlockSize, self.startFlag())
+			copy(self.cv[:], s[:8])
+			self.compressed++
+			self.blockLen = 0
+		}
+		n := copy(self.block[self.blockLen:], b)
+		self.blockLen += n
+		b = b[n:]
+	}
+}
+
+func (self *blake3Chunk) output() blake3Output {
+	return blake3Output{
+		cv:       self.cv,
+		block:    blake3Words(self.block[:self.blockLen]),
+		counter:  self.counter,
+		blockLen: uint32(self.blockLen),
+		flags:    self.startFlag() | blake3ChunkEnd,
+	}
+}
+
+// blake3Hasher implements hash.Hash.
+type blake3Hasher struct {
+	chunk blake3Chunk
+	stack [][8]uint32
+}
+
+var _ hash.Hash = &blake3Hasher{}
+
+func newBlake3() *blake3Hasher {
+	h := &blake3Hasher{}
+	h.Reset()
+	return h
+}
+
+func (self *blake3Hasher) Reset() {
+	self.chunk = blake3Chunk{cv: blake3IV}
+	self.stack = self.stack[:0]
+}
+
+func (self *blake3Hasher) Size() int      { return blake3Size }
+func (self *blake3Hasher) BlockSize() int { return blake3BlockSize }
+
+func (self *blake3Hasher) Write(b []byte) (int, error) {
+	n := len(b)
+	for len(b) > 0 {
+		if self.chunk.len() == blake3ChunkSize {
+			out := self.chunk.output()
+			cv := out.chainingValue()
+			total := self.chunk.counter + 1
+			// Merge completed subtrees, one per trailing zero bit of the
+			// number of chunks.
+			for total&1 == 0 {
+				parent := blake3ParentOutput(self.stack[len(self.stack)-1], cv)
+				self.stack = self.stack[:len(self.stack)-1]
+				cv = parent.chainingValue()
+				total >>= 1
+			}
+			self.stack = append(self.stack, cv)
+			self.chunk = blake3Chunk{cv: blake3IV, counter: self.chunk.counter + 1}
+		}
+		want := blake3ChunkSize - self.chunk.len()
+		if want > len(b) {
+			want = len(b)
+		}
+		self.chunk.write(b[:want])
+		b = b[want:]
+	}
+	return n, nil
+}
+
+func (self *blake3Hasher) Sum(b []byte) []byte {
+	out := self.chunk.output()
+	for i := len(self.stack) - 1; i >= 0; i-- {
+		out = blake3ParentOutput(self.stack[i], out.chainingValue())
+	}
+	sum := out.root()
+	return append(b, sum[:]...)
+}
@@ -0,0 +1,42 @@
+package transfer
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBlake3(t *testing.T) {
+	// Vectors from the BLAKE3 reference, whose inputs repeat 0..250.
+	tests := []struct {
+		size int
+		sum  string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+		{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085"},
+	}
+	for _, tt := range tests {
+		input := make([]byte, tt.size)
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+		// Write in uneven pieces to cross block and chunk boundaries.
+		h := newBlake3()
+		for b := input; len(b) > 0; {
+			n := 100
+			if n > len(b) {
+				n = len(b)
+			}
+			h.Write(b[:n])
+			b = b[n:]
+		}
+		if diff := cmp.Diff(tt.sum, hex.EncodeToString(h.Sum(nil))); diff != "" {
+			t.Fatalf("unexpected hash of %d bytes (-want +got):\n%s", tt.size, diff)
+		}
+	}
+}
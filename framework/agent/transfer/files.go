@@ -0,0 +1,189 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// maxRead bounds the bytes of a single read request.
+const maxRead = 1 << 20
+
+func entryOf(name string, info os.FileInfo) Entry {
+	entry := Entry{Name: name, Dir: info.IsDir(), Mode: info.Mode().Perm(), ModTime: info.ModTime()}
+	if !entry.Dir {
+		entry.Size = info.Size()
+	}
+	return entry
+}
+
+// serveFiles serves the requests browsing the files under Root.
+func (self *Service) serveFiles(conn net.Conn, path string, header Header) error {
+	switch header.Op {
+	case opStat:
+		info, err := os.Stat(path)
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+		return writeJSON(conn, entryOf(filepath.Base(path), info))
+	case opReadDir:
+		dirents, err := os.ReadDir(path)
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		var entries []Entry
+		for _, d := range dirents {
+			// Symbolic links are shown as what they lead to, if that
+			// is under Root.
+			target, err := self.follow(d.Name(), filepath.Join(path, d.Name()))
+			if err != nil {
+				continue
+			}
+			info, err := os.Stat(target)
+			if err != nil || !(info.IsDir() || info.Mode().IsRegular()) {
+				continue
+			}
+			entries = append(entries, entryOf(d.Name(), info))
+		}
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+		return writeJSON(conn, listing{Entries: entries})
+	case opRead:
+		f, _, err := openRegular(path)
+		if err == nil && (header.Offset < 0 || header.Size < 0) {
+			f.Close()
+			err = fmt.Errorf("invalid range")
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		defer f.Close()
+		size := header.Size
+		if size > maxRead {
+			size = maxRead
+		}
+		b := make([]byte, size)
+		n, err := f.ReadAt(b, header.Offset)
+		if err != nil && err != io.EOF {
+			return writeJSON(conn, errorReply(err))
+		}
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+		if err := writeJSON(conn, Header{Size: int64(n)}); err != nil {
+			return err
+		}
+		_, err = conn.Write(b[:n])
+		return err
+	}
+	return nil
+}
+
+// Client browses the files of a transfer service over a single
+// connection. Requests are made one at a time; a Client is safe for
+// concurrent use. Once a request fails in a way which leaves the
+// connection unusable, every later one fails too.
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+
+	mutex sync.Mutex
+	err   error
+}
+
+func NewClient(conn net.Conn) *Client {
+	return &Client{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (self *Client) Close() error { return self.conn.Close() }
+
+// Err returns the error which made the connection unusable, if any.
+func (self *Client) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+// Stat describes the file or directory name.
+func (self *Client) Stat(ctx context.Context, name string) (Entry, error) {
+	var entry Entry
+	err := self.do(ctx, Header{Op: opStat, Name: name}, func() error {
+		return readJSON(self.r, &entry)
+	})
+	return entry, err
+}
+
+// ReadDir lists the directory name. The names of the entries are their
+// base names.
+func (self *Client) ReadDir(ctx context.Context, name string) ([]Entry, error) {
+	var entries listing
+	err := self.do(ctx, Header{Op: opReadDir, Name: name}, func() error {
+		return readJSON(self.r, &entries)
+	})
+	return entries.Entries, err
+}
+
+// ReadAt reads from the file name at offset, as io.ReaderAt does, though
+// it reads at most 1MiB at a time.
+func (self *Client) ReadAt(ctx context.Context, name string, b []byte, offset int64) (int, error) {
+	var n int
+	err := self.do(ctx, Header{Op: opRead, Name: name, Offset: offset, Size: int64(len(b))}, func() error {
+		var header Header
+		if err := readJSON(self.r, &header); err != nil {
+			return err
+		}
+		if header.Size < 0 || header.Size > int64(len(b)) {
+			return fmt.Errorf("transfer: read returned %d bytes for %d", header.Size, len(b))
+		}
+		var err error
+		n, err = io.ReadFull(self.r, b[:header.Size])
+		return err
+	})
+	if err == nil && n < len(b) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// do makes the request header, then reads what follows a successful reply
+// with read.
+func (self *Client) do(ctx context.Context, header Header, read func() error) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err != nil {
+		return self.err
+	}
+	stop := vsock.BindContext(ctx, self.conn)
+	defer stop()
+
+	fail := func(err error) error {
+		self.err = contextError(ctx, err)
+		self.conn.Close()
+		return self.err
+	}
+	if err := writeHeader(self.conn, header); err != nil {
+		return fail(err)
+	}
+	var rep reply
+	if err := readJSON(self.r, &rep); err != nil {
+		return fail(err)
+	}
+	if err := rep.err(); err != nil {
+		return err
+	}
+	if err := read(); err != nil {
+		return fail(err)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClient(t *testing.T) {
+	root := t.TempDir()
+	writeTree(t, root, map[string]string{
+		"etc/motd":     "hello, world",
+		"etc/hostname": "guest",
+	})
+	outside := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(outside, []byte("secret"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "etc", "escape")); err != nil {
+		t.Fatalf("failed to create symbolic link: %v", err)
+	}
+	if err := os.Symlink("motd", filepath.Join(root, "etc", "issue")); err != nil {
+		t.Fatalf("failed to create symbolic link: %v", err)
+	}
+	client := NewClient(serve(t, &Service{Root: root}))
+	ctx := context.Background()
+
+	entry, err := client.Stat(ctx, "etc/motd")
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	if diff := cmp.Diff(Entry{Name: "motd", Mode: 0644, Size: 12}, Entry{Name: entry.Name, Mode: entry.Mode, Size: entry.Size}); diff != "" {
+		t.Fatalf("unexpected entry (-want +got):\n%s", diff)
+	}
+	if _, err := client.Stat(ctx, "etc/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected a missing file, got %v", err)
+	}
+	if _, err := client.Stat(ctx, "etc/escape"); err == nil {
+		t.Fatalf("expected a link out of the root to be refused")
+	}
+
+	entries, err := client.ReadDir(ctx, "etc")
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if diff := cmp.Diff([]string{"hostname", "issue", "motd"}, names); diff != "" {
+		t.Fatalf("unexpected entries (-want +got):\n%s", diff)
+	}
+
+	b := make([]byte, 8)
+	n, err := client.ReadAt(ctx, "etc/issue", b, 7)
+	if err != io.EOF {
+		t.Fatalf("expected a short read to end the file, got %v", err)
+	}
+	if diff := cmp.Diff("world", string(b[:n])); diff != "" {
+		t.Fatalf("unexpected read (-want +got):\n%s", diff)
+	}
+	if _, err := client.ReadAt(ctx, "etc/escape", b, 0); err == nil {
+		t.Fatalf("expected reading through a link out of the root to be refused")
+	}
+	if err := client.Err(); err != nil {
+		t.Fatalf("connection broken: %v", err)
+	}
+}
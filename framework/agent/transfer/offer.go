@@ -0,0 +1,201 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// File describes a file offered to a peer.
+type File struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// Hash is the BLAKE3 hash of the contents, hex encoded.
+	Hash string `json:"blake3"`
+}
+
+type offer struct {
+	Files []File `json:"files"`
+}
+
+// Offer offers the files at paths to the service at the other end of conn,
+// under their base names, as a desktop does when files are dropped on a
+// window of the other side. The service accepts or declines each before
+// anything is sent; Offer then sends those accepted, and returns them.
+func Offer(ctx context.Context, conn net.Conn, paths []string, options Options) ([]File, error) {
+	files := make([]File, len(paths))
+	for i, path := range paths {
+		file, err := describe(path)
+		if err != nil {
+			return nil, err
+		}
+		files[i] = file
+	}
+
+	r := bufio.NewReader(conn)
+	stop := vsock.BindContext(ctx, conn)
+	err := writeJSON(conn, Header{Op: opOffer})
+	if err == nil {
+		err = writeJSON(conn, offer{Files: files})
+	}
+	var rep reply
+	if err == nil {
+		err = readJSON(r, &rep)
+	}
+	stop()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	if err := rep.err(); err != nil {
+		return nil, err
+	}
+
+	var accepted []File
+	for _, i := range rep.Accepted {
+		if i < 0 || i >= len(files) {
+			return nil, fmt.Errorf("transfer: accepted unknown file %d", i)
+		}
+		accepted = append(accepted, files[i])
+	}
+	for i, file := range accepted {
+		if err := sendOffered(ctx, conn, r, paths[rep.Accepted[i]], file, options); err != nil {
+			return nil, err
+		}
+	}
+	return accepted, nil
+}
+
+// describe hashes the regular file at path.
+func describe(path string) (File, error) {
+	f, info, err := openRegular(path)
+	if err != nil {
+		return File{}, fmt.Errorf("transfer: %s: %v", path, err)
+	}
+	defer f.Close()
+	h := newBlake3()
+	if _, err := io.Copy(h, f); err != nil {
+		return File{}, err
+	}
+	return File{Name: filepath.Base(path), Size: info.Size(), Hash: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func sendOffered(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, file File, options Options) error {
+	f, info, err := openRegular(path)
+	if err != nil {
+		return fmt.Errorf("transfer: %s: %v", path, err)
+	}
+	defer f.Close()
+	if info.Size() != file.Size {
+		return fmt.Errorf("transfer: %s changed size since it was offered", path)
+	}
+	header := Header{Name: file.Name, Mode: info.Mode().Perm(), Size: file.Size, ModTime: info.ModTime(), Hash: file.Hash}
+	stop := vsock.BindContext(ctx, conn)
+	err = writeHeader(conn, header)
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if err := send(ctx, conn, f, header, options); err != nil {
+		return err
+	}
+	stop = vsock.BindContext(ctx, conn)
+	defer stop()
+	return readReply(ctx, r)
+}
+
+// receiveOffer asks Offered about the files offered on conn, unless
+// refused is set, and stores those accepted as they arrive.
+func (self *Service) receiveOffer(ctx context.Context, conn net.Conn, r *bufio.Reader, refused error, progress func(Progress)) error {
+	var o offer
+	stop := vsock.BindContext(ctx, conn)
+	err := readJSON(r, &o)
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if refused != nil {
+		return writeJSON(conn, errorReply(refused))
+	}
+
+	seen := make(map[string]bool)
+	paths := make([]string, len(o.Files))
+	for i, file := range o.Files {
+		path, err := self.resolve(file.Name)
+		if err == nil && (seen[path] || filepath.Clean(file.Name) == ".") {
+			err = fmt.Errorf("invalid name %q", file.Name)
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		seen[path] = true
+		paths[i] = path
+	}
+
+	peer := conn.RemoteAddr()
+	var indexes []int
+	if self.Offered != nil && len(o.Files) > 0 {
+		indexes = self.Offered(peer, o.Files)
+	}
+	var accepted []File
+	var reservations []*reservation
+	defer func() {
+		for _, reserved := range reservations {
+			reserved.done()
+		}
+	}()
+	taken := make(map[int]bool)
+	for _, i := range indexes {
+		if i < 0 || i >= len(o.Files) || taken[i] {
+			return writeJSON(conn, errorReply(fmt.Errorf("invalid decision on file %d", i)))
+		}
+		taken[i] = true
+		reserved, err := self.admit(peer, paths[i], o.Files[i].Size)
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		reservations = append(reservations, reserved)
+		accepted = append(accepted, o.Files[i])
+	}
+	if err := writeJSON(conn, reply{Accepted: indexes}); err != nil {
+		return err
+	}
+
+	for n, i := range indexes {
+		var header Header
+		stop := vsock.BindContext(ctx, conn)
+		err := readJSON(r, &header)
+		stop()
+		if err != nil {
+			return contextError(ctx, err)
+		}
+		file := o.Files[i]
+		if header.Name != file.Name || header.Size != file.Size {
+			err := fmt.Errorf("transfer: expected %s, %d bytes, got %s, %d bytes", file.Name, file.Size, header.Name, header.Size)
+			writeJSON(conn, errorReply(err))
+			return err
+		}
+		header.Hash = file.Hash
+		if err := receive(ctx, conn, r, paths[i], header, progress); err == ErrMismatch {
+			// The peer stops at the first failure, and carries on with
+			// its next request.
+			return writeJSON(conn, errorReply(err))
+		} else if err != nil {
+			writeJSON(conn, errorReply(err))
+			return err
+		}
+		reservations[n].keep()
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+	}
+	if self.Delivered != nil && len(accepted) > 0 {
+		self.Delivered(peer, accepted)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package transfer
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestOffer(t *testing.T) {
+	var (
+		root  = t.TempDir()
+		local = t.TempDir()
+	)
+	var paths []string
+	for _, name := range []string{"a.txt", "b.png", "c.iso"} {
+		path := filepath.Join(local, name)
+		if err := os.WriteFile(path, []byte("contents of "+name), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+		paths = append(paths, path)
+	}
+
+	var offered, delivered []File
+	conn := serve(t, &Service{
+		Root: root,
+		Offered: func(_ net.Addr, files []File) []int {
+			offered = files
+			return []int{0, 1}
+		},
+		Delivered: func(_ net.Addr, files []File) { delivered = files },
+	})
+	accepted, err := Offer(context.Background(), conn, paths, Options{})
+	if err != nil {
+		t.Fatalf("failed to offer: %v", err)
+	}
+	if diff := cmp.Diff(offered[:2], accepted); diff != "" {
+		t.Errorf("unexpected files accepted (-want +got):\n%s", diff)
+	}
+	h := newBlake3()
+	h.Write([]byte("contents of a.txt"))
+	want := File{Name: "a.txt", Size: 17, Hash: hex.EncodeToString(h.Sum(nil))}
+	if diff := cmp.Diff(want, offered[0]); diff != "" {
+		t.Errorf("unexpected offer (-want +got):\n%s", diff)
+	}
+
+	// The connection carries on with other requests.
+	entries, err := NewClient(conn).ReadDir(context.Background(), ".")
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	if diff := cmp.Diff([]string{"a.txt", "b.png"}, names); diff != "" {
+		t.Errorf("unexpected files stored (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(accepted, delivered); diff != "" {
+		t.Errorf("unexpected files delivered (-want +got):\n%s", diff)
+	}
+}
+
+func TestOfferDeclined(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for _, service := range []*Service{
+		{Root: root},
+		{Root: root, Offered: func(net.Addr, []File) []int { return nil }},
+	} {
+		accepted, err := Offer(context.Background(), serve(t, service), []string{path}, Options{})
+		if err != nil {
+			t.Fatalf("failed to offer: %v", err)
+		}
+		if len(accepted) != 0 {
+			t.Errorf("expected the offer to be declined, got %v", accepted)
+		}
+	}
+	if _, err := Offer(context.Background(), serve(t, &Service{Root: root, ReadOnly: true}), []string{path}, Options{}); err == nil {
+		t.Error("expected a read only service to refuse offers")
+	}
+	if _, err := os.Stat(filepath.Join(root, "file")); err == nil {
+		t.Error("expected nothing to be stored")
+	}
+}
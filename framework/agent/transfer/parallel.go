@@ -0,0 +1,325 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	mux "github.com/multiverse-os/vcable/framework/mux"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"golang.org/x/sync/errgroup"
+)
+
+// A striped transfer moves one file over several mux streams at once, to
+// fill links a single stream cannot. A control stream announces the file
+// and is given an ID; stripe streams then name that ID and carry pieces of
+// the file, each a JSON line with its offset and size followed by the raw
+// bytes. Once every stripe stream is acknowledged, the hash of the whole
+// file is sent on the control stream, and the service checks it against
+// the reassembled file.
+
+const (
+	// DefaultStreams is the default number of streams of a striped transfer.
+	DefaultStreams = 4
+	// DefaultStripeSize is the default size of the pieces of a striped
+	// transfer.
+	DefaultStripeSize = 4 << 20
+)
+
+type stripe struct {
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// SendParallel is Send striping the file across streams of session.
+func SendParallel(ctx context.Context, session *mux.Session, path, name string, options Options) error {
+	streams, stripeSize := options.Streams, options.StripeSize
+	if streams <= 0 {
+		streams = DefaultStreams
+	}
+	if stripeSize <= 0 {
+		stripeSize = DefaultStripeSize
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("transfer: %s is not a regular file", path)
+	}
+	size := info.Size()
+
+	control, err := session.Open()
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+	r := bufio.NewReader(control)
+	header := Header{Op: opPutStriped, Name: name, Mode: info.Mode().Perm(), Size: size, ModTime: info.ModTime()}
+	var rep reply
+	stop := vsock.BindContext(ctx, control)
+	err = writeHeader(control, header)
+	if err == nil {
+		err = readJSON(r, &rep)
+	}
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	if err := rep.err(); err != nil {
+		return err
+	}
+
+	m := newMeter(name, size, options.Progress)
+	h := newBlake3()
+	var next int64 // index of the next stripe to send
+	group, groupCtx := errgroup.WithContext(ctx)
+	group.Go(func() error {
+		_, err := io.Copy(h, io.NewSectionReader(f, 0, size))
+		return err
+	})
+	for i := 0; i < streams; i++ {
+		group.Go(func() error {
+			return sendStripes(groupCtx, session, f, rep.ID, size, stripeSize, &next, m, options.ChunkSize)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return contextError(ctx, err)
+	}
+
+	stop = vsock.BindContext(ctx, control)
+	defer stop()
+	if err := writeJSON(control, trailer{Hash: hex.EncodeToString(h.Sum(nil))}); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := readReply(ctx, r); err != nil {
+		return err
+	}
+	m.done()
+	return nil
+}
+
+// sendStripes opens a stripe stream and sends stripes on it until there
+// are none left.
+func sendStripes(ctx context.Context, session *mux.Session, f *os.File, id string, size, stripeSize int64, next *int64, m *meter, chunkSize int) error {
+	conn, err := session.Open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	stop := vsock.BindContext(ctx, conn)
+	err = writeJSON(conn, Header{Op: opStripe, ID: id})
+	stop()
+	if err != nil {
+		return err
+	}
+	for {
+		offset := (atomic.AddInt64(next, 1) - 1) * stripeSize
+		if offset >= size {
+			break
+		}
+		piece := stripe{Offset: offset, Size: size - offset}
+		if piece.Size > stripeSize {
+			piece.Size = stripeSize
+		}
+		stop := vsock.BindContext(ctx, conn)
+		err := writeJSON(conn, piece)
+		stop()
+		if err != nil {
+			return err
+		}
+		var last int64
+		n, err := vsock.CopyChunked(ctx, conn, io.NewSectionReader(f, piece.Offset, piece.Size), piece.Size, vsock.ChunkOptions{
+			ChunkSize: chunkSize,
+			Progress: func(written, total int64) error {
+				m.add(written - last)
+				last = written
+				return nil
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if n != piece.Size {
+			return fmt.Errorf("transfer: file changed size while being sent")
+		}
+	}
+	if err := conn.CloseWrite(); err != nil {
+		return err
+	}
+	stop = vsock.BindContext(ctx, conn)
+	defer stop()
+	return readReply(ctx, r)
+}
+
+// ServeSession serves the streams of session until it is closed, or ctx
+// is cancelled. Striped transfers need the service to be reached this
+// way.
+func (self *Service) ServeSession(ctx context.Context, session *mux.Session) error {
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-session.Done():
+		}
+	}()
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		go self.ServeContext(ctx, stream)
+	}
+}
+
+// stripedFile is a striped transfer being received.
+type stripedFile struct {
+	file  *os.File
+	size  int64
+	meter *meter
+
+	mutex   sync.Mutex
+	written int64
+}
+
+// receiveStriped serves the control stream of a striped transfer.
+func (self *Service) receiveStriped(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, header Header, reserved *reservation, progress func(Progress)) error {
+	fail := func(err error) error {
+		return writeJSON(conn, errorReply(err))
+	}
+	if header.Size < 0 {
+		return fail(fmt.Errorf("invalid size %d", header.Size))
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".part*")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	if err := tmp.Truncate(header.Size); err != nil {
+		return fail(err)
+	}
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fail(err)
+	}
+	id := hex.EncodeToString(b[:])
+	file := &stripedFile{file: tmp, size: header.Size, meter: newMeter(header.Name, header.Size, progress)}
+	self.mutex.Lock()
+	if self.striped == nil {
+		self.striped = make(map[string]*stripedFile)
+	}
+	self.striped[id] = file
+	self.mutex.Unlock()
+	defer func() {
+		self.mutex.Lock()
+		delete(self.striped, id)
+		self.mutex.Unlock()
+	}()
+	if err := writeJSON(conn, reply{ID: id}); err != nil {
+		return err
+	}
+
+	// The trailer is sent once all stripes were acknowledged.
+	var end trailer
+	stop := vsock.BindContext(ctx, conn)
+	err = readJSON(r, &end)
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	file.mutex.Lock()
+	written := file.written
+	file.mutex.Unlock()
+	if written != header.Size {
+		return fail(fmt.Errorf("received %d of %d bytes", written, header.Size))
+	}
+	h := newBlake3()
+	if _, err := io.Copy(h, io.NewSectionReader(tmp, 0, header.Size)); err != nil {
+		return fail(err)
+	}
+	if end.Hash != hex.EncodeToString(h.Sum(nil)) {
+		return fail(ErrMismatch)
+	}
+
+	mode := header.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := tmp.Sync(); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fail(err)
+	}
+	if !header.ModTime.IsZero() {
+		os.Chtimes(tmp.Name(), header.ModTime, header.ModTime)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fail(err)
+	}
+	reserved.keep()
+	file.meter.done()
+	return writeJSON(conn, reply{})
+}
+
+// receiveStripes serves a stripe stream, writing its stripes into the
+// striped transfer named id.
+func (self *Service) receiveStripes(ctx context.Context, conn net.Conn, r *bufio.Reader, id string) error {
+	self.mutex.Lock()
+	file := self.striped[id]
+	self.mutex.Unlock()
+	if file == nil {
+		writeJSON(conn, reply{Error: "unknown transfer"})
+		return fmt.Errorf("transfer: unknown striped transfer %q", id)
+	}
+
+	stop := vsock.BindContext(ctx, conn)
+	defer stop()
+	for {
+		var piece stripe
+		err := readJSON(r, &piece)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return contextError(ctx, err)
+		}
+		if piece.Offset < 0 || piece.Size < 0 || piece.Offset+piece.Size > file.size {
+			writeJSON(conn, reply{Error: "stripe out of range"})
+			return fmt.Errorf("transfer: stripe out of range")
+		}
+		w := &meteredWriter{w: io.NewOffsetWriter(file.file, piece.Offset), meter: file.meter}
+		n, err := io.CopyN(w, r, piece.Size)
+		file.mutex.Lock()
+		file.written += n
+		file.mutex.Unlock()
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	return writeJSON(conn, reply{})
+}
@@ -0,0 +1,53 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	mux "github.com/multiverse-os/vcable/framework/mux"
+)
+
+func TestSendParallel(t *testing.T) {
+	var (
+		root  = t.TempDir()
+		local = t.TempDir()
+	)
+	client, server := net.Pipe()
+	session := mux.Client(client)
+	defer session.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go (&Service{Root: root}).ServeSession(ctx, mux.Server(server))
+
+	for _, size := range []int{0, 1, 3<<20 + 12345} {
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i * 7)
+		}
+		if err := os.WriteFile(filepath.Join(local, "in"), data, 0600); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+
+		var final Progress
+		options := Options{Streams: 3, StripeSize: 256 << 10, Progress: func(p Progress) { final = p }}
+		if err := SendParallel(ctx, session, filepath.Join(local, "in"), "file", options); err != nil {
+			t.Fatalf("failed to send %d bytes: %v", size, err)
+		}
+		final.Rate = 0
+		if diff := cmp.Diff(Progress{Name: "file", Bytes: int64(size), Total: int64(size), Done: true}, final); diff != "" {
+			t.Fatalf("unexpected final progress (-want +got):\n%s", diff)
+		}
+		got, err := os.ReadFile(filepath.Join(root, "file"))
+		if err != nil {
+			t.Fatalf("failed to read stored file: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("stored file of %d bytes differs", size)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package transfer
+
+import (
+	"sync"
+	"time"
+)
+
+// Progress reports how far a transfer has come.
+type Progress struct {
+	Name  string
+	Bytes int64
+	// Total is the size of the transfer, or -1 if unknown.
+	Total int64
+	// Rate is the average over the last few seconds, in bytes per second.
+	Rate float64
+	// ETA is the estimated time left, or zero if unknown.
+	ETA  time.Duration
+	Done bool
+}
+
+// progressInterval bounds how often progress is reported.
+const progressInterval = 100 * time.Millisecond
+
+// meter tracks the progress of one transfer and reports it, at most every
+// progressInterval, and once more when done.
+type meter struct {
+	name   string
+	total  int64
+	report func(Progress)
+
+	mutex    sync.Mutex
+	bytes    int64
+	last     time.Time
+	rate     float64
+	window   time.Time // start of the current rate window
+	windowed int64     // bytes at the start of the window
+}
+
+func newMeter(name string, total int64, report func(Progress)) *meter {
+	now := time.Now()
+	return &meter{name: name, total: total, report: report, window: now}
+}
+
+// add counts n more bytes.
+func (self *meter) add(n int64) {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	self.bytes += n
+	now := time.Now()
+	if elapsed := now.Sub(self.window); elapsed >= time.Second {
+		// Smooth the rate across windows.
+		current := float64(self.bytes-self.windowed) / elapsed.Seconds()
+		if self.rate == 0 {
+			self.rate = current
+		} else {
+			self.rate = 0.7*self.rate + 0.3*current
+		}
+		self.window, self.windowed = now, self.bytes
+	}
+	if now.Sub(self.last) < progressInterval {
+		self.mutex.Unlock()
+		return
+	}
+	self.last = now
+	// Reports are made under the lock, so they arrive in order even when
+	// several streams feed the meter.
+	self.emit(self.progress(false))
+	self.mutex.Unlock()
+}
+
+// done reports the final progress.
+func (self *meter) done() {
+	if self == nil {
+		return
+	}
+	self.mutex.Lock()
+	self.emit(self.progress(true))
+	self.mutex.Unlock()
+}
+
+// progress snapshots the meter. The caller holds mutex.
+func (self *meter) progress(done bool) Progress {
+	p := Progress{Name: self.name, Bytes: self.bytes, Total: self.total, Rate: self.rate, Done: done}
+	if p.Rate == 0 {
+		if elapsed := time.Since(self.window); elapsed > 0 {
+			p.Rate = float64(self.bytes-self.windowed) / elapsed.Seconds()
+		}
+	}
+	if !done && self.total >= 0 && p.Rate > 0 {
+		p.ETA = time.Duration(float64(self.total-self.bytes) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+func (self *meter) emit(p Progress) {
+	if self.report != nil {
+		self.report(p)
+	}
+}
+
+// meteredWriter counts the bytes written through it.
+type meteredWriter struct {
+	w     interface{ Write([]byte) (int, error) }
+	meter *meter
+}
+
+func (self *meteredWriter) Write(b []byte) (int, error) {
+	n, err := self.w.Write(b)
+	self.meter.add(int64(n))
+	return n, err
+}
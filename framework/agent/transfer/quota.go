@@ -0,0 +1,146 @@
+package transfer
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// QuotaError is returned when a transfer would exceed the quota of its
+// sender.
+type QuotaError struct {
+	Key   string `json:"key"`
+	Limit int64  `json:"limit"`
+	Used  int64  `json:"used"`
+	Need  int64  `json:"need"`
+}
+
+func (self *QuotaError) Error() string {
+	return fmt.Sprintf("transfer: quota of %s exceeded: %d of %d bytes used, %d more needed", self.Key, self.Used, self.Limit, self.Need)
+}
+
+// SpaceError is returned when the destination of a transfer lacks the
+// space for it.
+type SpaceError struct {
+	Free int64 `json:"free"`
+	Need int64 `json:"need"`
+}
+
+func (self *SpaceError) Error() string {
+	return fmt.Sprintf("transfer: not enough space: %d bytes free, %d needed", self.Free, self.Need)
+}
+
+// Quota limits the bytes peers may store through a service. Bytes are
+// reserved when a transfer starts and given back if it fails.
+type Quota struct {
+	// Key groups the peers sharing a quota. Defaults to the context ID of
+	// the peer, giving each guest its own.
+	Key func(peer net.Addr) string
+	// Limit returns the quota of key in bytes, or a negative number for
+	// none.
+	Limit func(key string) int64
+
+	mutex sync.Mutex
+	used  map[string]int64
+}
+
+func (self *Quota) key(peer net.Addr) string {
+	if self.Key != nil {
+		return self.Key(peer)
+	}
+	if addr, ok := peer.(*vsock.Addr); ok {
+		return strconv.FormatUint(uint64(addr.ContextID), 10)
+	}
+	return peer.String()
+}
+
+// Used returns the bytes key has used.
+func (self *Quota) Used(key string) int64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.used[key]
+}
+
+// Reset forgets what key has used.
+func (self *Quota) Reset(key string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	delete(self.used, key)
+}
+
+// reserve charges n bytes to the quota of peer. Calling release gives them
+// back. A nil Quota allows everything.
+func (self *Quota) reserve(peer net.Addr, n int64) (release func(), err error) {
+	if self == nil {
+		return func() {}, nil
+	}
+	key := self.key(peer)
+	limit := int64(-1)
+	if self.Limit != nil {
+		limit = self.Limit(key)
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	used := self.used[key]
+	if limit >= 0 && used+n > limit {
+		return nil, &QuotaError{Key: key, Limit: limit, Used: used, Need: n}
+	}
+	if self.used == nil {
+		self.used = make(map[string]int64)
+	}
+	self.used[key] = used + n
+	return func() {
+		self.mutex.Lock()
+		self.used[key] -= n
+		self.mutex.Unlock()
+	}, nil
+}
+
+// preflight checks that dir has the space for n more bytes, besides the
+// minimum of free bytes to be left.
+func preflight(dir string, n, minFree int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return err
+	}
+	if n+minFree > free {
+		return &SpaceError{Free: free, Need: n + minFree}
+	}
+	return nil
+}
+
+// reservation holds the quota charged for a transfer until it is kept.
+type reservation struct {
+	release func()
+	kept    bool
+}
+
+// keep makes the charge permanent, once the transfer succeeded.
+func (self *reservation) keep() { self.kept = true }
+
+// done gives the charge back unless it was kept.
+func (self *reservation) done() {
+	if !self.kept {
+		self.release()
+	}
+}
+
+// admit checks that a file of size bytes fits at path, and charges it to
+// the quota of peer.
+func (self *Service) admit(peer net.Addr, path string, size int64) (*reservation, error) {
+	if size < 0 {
+		return nil, fmt.Errorf("invalid size %d", size)
+	}
+	if err := preflight(filepath.Dir(path), size, self.MinFree); err != nil {
+		return nil, err
+	}
+	release, err := self.Quota.reserve(peer, size)
+	if err != nil {
+		return nil, err
+	}
+	return &reservation{release: release}, nil
+}
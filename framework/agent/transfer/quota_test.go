@@ -0,0 +1,90 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestQuota(t *testing.T) {
+	quota := &Quota{Limit: func(key string) int64 {
+		if key == "3" {
+			return 10
+		}
+		return -1
+	}}
+	guest := &vsock.Addr{ContextID: 3}
+
+	release, err := quota.reserve(guest, 8)
+	if err != nil {
+		t.Fatalf("failed to reserve: %v", err)
+	}
+	var quotaErr *QuotaError
+	if _, err := quota.reserve(guest, 3); !errors.As(err, &quotaErr) {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+	if diff := cmp.Diff(&QuotaError{Key: "3", Limit: 10, Used: 8, Need: 3}, quotaErr); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+	if _, err := quota.reserve(&vsock.Addr{ContextID: 4}, 1<<40); err != nil {
+		t.Fatalf("failed to reserve without a limit: %v", err)
+	}
+
+	release()
+	if diff := cmp.Diff(int64(0), quota.Used("3")); diff != "" {
+		t.Fatalf("unexpected usage after release (-want +got):\n%s", diff)
+	}
+}
+
+func TestServiceQuota(t *testing.T) {
+	var (
+		root  = t.TempDir()
+		local = filepath.Join(t.TempDir(), "in")
+	)
+	if err := os.WriteFile(local, []byte("12345678"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	quota := &Quota{
+		Key:   func(net.Addr) string { return "tenant" },
+		Limit: func(string) int64 { return 10 },
+	}
+	conn := serve(t, &Service{Root: root, Quota: quota})
+
+	if err := Send(context.Background(), conn, local, "first", Options{}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	var quotaErr *QuotaError
+	if err := Send(context.Background(), conn, local, "second", Options{}); !errors.As(err, &quotaErr) {
+		t.Fatalf("expected a quota error, got %v", err)
+	}
+	if diff := cmp.Diff(&QuotaError{Key: "tenant", Limit: 10, Used: 8, Need: 8}, quotaErr); diff != "" {
+		t.Fatalf("unexpected error (-want +got):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(root, "second")); !os.IsNotExist(err) {
+		t.Fatalf("refused file was stored")
+	}
+}
+
+func TestServiceSpace(t *testing.T) {
+	root := t.TempDir()
+	local := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(local, []byte("data"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	conn := serve(t, &Service{Root: root, MinFree: math.MaxInt64 / 2})
+
+	var spaceErr *SpaceError
+	if err := Send(context.Background(), conn, local, "file", Options{}); !errors.As(err, &spaceErr) {
+		t.Fatalf("expected a space error, got %v", err)
+	}
+	if spaceErr.Need <= spaceErr.Free {
+		t.Fatalf("unexpected error: %+v", spaceErr)
+	}
+}
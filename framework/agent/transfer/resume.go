@@ -0,0 +1,142 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// SendFile sends the file at path over conn, under its base name, to
+// ReceiveFile or a Service. The transfer is resumable: if it is
+// interrupted, sending the file again continues where it stopped.
+func SendFile(conn net.Conn, path string) error {
+	return Send(context.Background(), conn, path, filepath.Base(path), Options{Resume: true})
+}
+
+// ReceiveFile receives a file sent over conn by SendFile or Send, stores it
+// in dir under the name it was sent with, and returns its path.
+func ReceiveFile(conn net.Conn, dir string) (string, error) {
+	r := bufio.NewReader(conn)
+	var header Header
+	if err := readJSON(r, &header); err != nil {
+		return "", err
+	}
+	if header.Op != opPut {
+		err := fmt.Errorf("expected a file, got a %q request", header.Op)
+		writeJSON(conn, errorReply(err))
+		return "", fmt.Errorf("transfer: %v", err)
+	}
+	service := &Service{Root: dir}
+	path, err := service.resolve(header.Name)
+	var reserved *reservation
+	if err == nil {
+		reserved, err = service.admit(conn.RemoteAddr(), path, header.Size)
+	}
+	if err != nil {
+		writeJSON(conn, errorReply(err))
+		return "", fmt.Errorf("transfer: %v", err)
+	}
+	defer reserved.done()
+	stored, err := service.put(context.Background(), conn, r, path, header, reserved, nil)
+	if err != nil {
+		return "", err
+	}
+	if stored != nil {
+		return "", stored
+	}
+	return path, nil
+}
+
+// put stores the file header describes at path, replying to the peer. It
+// returns why the file was not stored, which the peer was told, and the
+// error the connection cannot carry on after, if any.
+func (self *Service) put(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, header Header, reserved *reservation, progress func(Progress)) (stored, err error) {
+	if header.Resume {
+		return self.putResumable(ctx, conn, r, path, header, reserved, progress)
+	}
+	if err := writeJSON(conn, reply{}); err != nil {
+		return nil, err
+	}
+	if err := receive(ctx, conn, r, path, header, progress); err == ErrMismatch {
+		// The whole file was read, the connection can carry on.
+		return err, writeJSON(conn, errorReply(err))
+	} else if err != nil {
+		// The rest of the file may still be in flight; the connection
+		// cannot be reused.
+		writeJSON(conn, errorReply(err))
+		return err, err
+	}
+	reserved.keep()
+	return nil, writeJSON(conn, reply{})
+}
+
+// putResumable is put keeping what arrives in the partial file of path,
+// and continuing from what it already holds.
+func (self *Service) putResumable(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, header Header, reserved *reservation, progress func(Progress)) (stored, err error) {
+	f, offset, h, err := openPartial(path, header)
+	if err != nil {
+		return err, writeJSON(conn, errorReply(err))
+	}
+	defer f.Close()
+	if err := writeJSON(conn, reply{Offset: offset}); err != nil {
+		return nil, err
+	}
+	switch err := receiveInto(ctx, conn, r, f, h, offset, path, header, progress); {
+	case err == ErrMismatch:
+		// What was kept is no part of the file.
+		os.Remove(f.Name())
+		return err, writeJSON(conn, errorReply(err))
+	case err != nil:
+		// Kept for the next attempt, dated as the file it is part of.
+		f.Close()
+		os.Chtimes(f.Name(), header.ModTime, header.ModTime)
+		writeJSON(conn, errorReply(err))
+		return err, err
+	}
+	reserved.keep()
+	return nil, writeJSON(conn, reply{})
+}
+
+// partialPath is where a resumable put to path keeps what arrived.
+func partialPath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".resume")
+}
+
+// openPartial opens the partial file of a resumable put to path, returning
+// how much of the file header describes it holds, hashed, positioned after
+// it. Its contents are only trusted if it is dated as the file; otherwise
+// the put starts over.
+func openPartial(path string, header Header) (*os.File, int64, hash.Hash, error) {
+	f, err := os.OpenFile(partialPath(path), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	offset := info.Size()
+	if header.ModTime.IsZero() || !info.ModTime().Equal(header.ModTime) || offset > header.Size {
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, 0, nil, err
+		}
+	}
+	h := newBlake3()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, offset)); err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, offset, h, nil
+}
@@ -0,0 +1,112 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// countingConn counts the bytes written to it.
+type countingConn struct {
+	net.Conn
+	written int
+}
+
+func (self *countingConn) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	self.written += n
+	return n, err
+}
+
+func TestSendReceiveFile(t *testing.T) {
+	local, dir := t.TempDir(), t.TempDir()
+	data := bytes.Repeat([]byte("vcable"), 10000)
+	path := filepath.Join(local, "log.txt")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	type result struct {
+		path string
+		err  error
+	}
+	done := make(chan result)
+	go func() {
+		path, err := ReceiveFile(server, dir)
+		done <- result{path, err}
+	}()
+	if err := SendFile(client, path); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("failed to receive: %v", res.err)
+	}
+	if diff := cmp.Diff(filepath.Join(dir, "log.txt"), res.path); diff != "" {
+		t.Fatalf("unexpected path (-want +got):\n%s", diff)
+	}
+	got, err := os.ReadFile(res.path)
+	if err != nil {
+		t.Fatalf("failed to read received file: %v", err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("received file differs")
+	}
+}
+
+func TestResume(t *testing.T) {
+	local, root := t.TempDir(), t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	path := filepath.Join(local, "in")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+	// What an interrupted attempt left behind.
+	partial := partialPath(filepath.Join(root, "file"))
+	keep := func(b []byte) {
+		if err := os.WriteFile(partial, b, 0600); err != nil {
+			t.Fatalf("failed to write partial file: %v", err)
+		}
+		os.Chtimes(partial, info.ModTime(), info.ModTime())
+	}
+	keep(data[:len(data)/2])
+
+	conn := &countingConn{Conn: serve(t, &Service{Root: root})}
+	if err := Send(context.Background(), conn, path, "file", Options{Resume: true}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if conn.written >= len(data)/2+1024 {
+		t.Errorf("sent %d bytes resuming half of %d", conn.written, len(data))
+	}
+	got, err := os.ReadFile(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatalf("failed to read stored file: %v", err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Fatal("stored file differs")
+	}
+	if _, err := os.Stat(partial); !os.IsNotExist(err) {
+		t.Errorf("expected the partial file to be gone, got %v", err)
+	}
+
+	// A partial file not holding the start of the file is discarded once
+	// the hash shows it, and the next attempt starts over.
+	keep(bytes.Repeat([]byte("x"), 100))
+	if err := Send(context.Background(), conn, path, "file", Options{Resume: true}); err != ErrMismatch {
+		t.Fatalf("expected ErrMismatch, got %v", err)
+	}
+	if err := Send(context.Background(), conn, path, "file", Options{Resume: true}); err != nil {
+		t.Fatalf("failed to send again: %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package transfer
+
+import "golang.org/x/sys/unix"
+
+// freeSpace returns the bytes available to unprivileged users in the
+// filesystem holding dir.
+func freeSpace(dir string) (int64, error) {
+	var stat unix.Statfs_t
+	if err := unix.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,233 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Entry describes a file or directory of a tree.
+type Entry struct {
+	// Name is the slash separated path relative to the root of the tree.
+	Name    string      `json:"name"`
+	Dir     bool        `json:"dir,omitempty"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime time.Time   `json:"mod_time"`
+}
+
+type listing struct {
+	Entries []Entry `json:"entries"`
+}
+
+// list walks the tree at dir, parents before their children. Only regular
+// files and directories are listed, and symbolic links are not followed.
+// A missing dir lists as empty.
+func list(dir string) ([]Entry, error) {
+	var entries []Entry
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if name == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if name == dir {
+			if !d.IsDir() {
+				return fmt.Errorf("not a directory")
+			}
+			return nil
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entryOf(filepath.ToSlash(rel), info))
+		return nil
+	})
+	return entries, err
+}
+
+func dirMode(mode os.FileMode) os.FileMode {
+	if mode.Perm() == 0 {
+		return 0755
+	}
+	return mode.Perm()
+}
+
+// SyncOptions configures Sync.
+type SyncOptions struct {
+	Options
+	// Include, if not empty, limits the files synced to those matching one
+	// of its patterns. Exclude leaves out the files and directories
+	// matching one of its patterns. Patterns are path.Match patterns,
+	// tried on both the slash separated path relative to the synced
+	// directory and the base name.
+	Include []string
+	Exclude []string
+	// Delete removes what is not in the source from the destination.
+	// Excluded files and directories are kept.
+	Delete bool
+}
+
+// SyncResult counts what Sync did.
+type SyncResult struct {
+	Sent    int
+	Skipped int
+	Deleted int
+	// Bytes is the size of the files sent.
+	Bytes int64
+}
+
+// Sync makes the directory name under the root of the service at the other
+// end of conn a copy of the local directory dir. Files of the same size
+// and modification time on both sides are skipped. The parent of name must
+// exist.
+func Sync(ctx context.Context, conn net.Conn, dir, name string, options SyncOptions) (SyncResult, error) {
+	var result SyncResult
+	for _, pattern := range append(options.Include, options.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return result, fmt.Errorf("transfer: invalid pattern %q", pattern)
+		}
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return result, err
+	} else if !info.IsDir() {
+		return result, fmt.Errorf("transfer: %s is not a directory", dir)
+	}
+	local, err := list(dir)
+	if err != nil {
+		return result, err
+	}
+	local = options.filter(local)
+
+	r := bufio.NewReader(conn)
+	if err := request(ctx, conn, r, Header{Op: opMkdir, Name: name}); err != nil {
+		return result, err
+	}
+	if err := request(ctx, conn, r, Header{Op: opList, Name: name}); err != nil {
+		return result, err
+	}
+	var remote listing
+	stop := vsock.BindContext(ctx, conn)
+	err = readJSON(r, &remote)
+	stop()
+	if err != nil {
+		return result, contextError(ctx, err)
+	}
+	remote.Entries = options.filter(remote.Entries)
+
+	sources := make(map[string]Entry, len(local))
+	for _, entry := range local {
+		sources[entry.Name] = entry
+	}
+	// Remove what is gone from the source, and what changed between file
+	// and directory, which is always in the way.
+	existing := make(map[string]Entry, len(remote.Entries))
+	var removed []string
+	for _, entry := range remote.Entries {
+		if under(entry.Name, removed) {
+			continue
+		}
+		source, ok := sources[entry.Name]
+		if ok && source.Dir == entry.Dir {
+			existing[entry.Name] = entry
+			continue
+		}
+		if !ok && !options.Delete {
+			continue
+		}
+		if err := request(ctx, conn, r, Header{Op: opRemove, Name: path.Join(name, entry.Name)}); err != nil {
+			return result, err
+		}
+		result.Deleted++
+		if entry.Dir {
+			removed = append(removed, entry.Name+"/")
+		}
+	}
+
+	for _, entry := range local {
+		target, ok := existing[entry.Name]
+		if entry.Dir {
+			if !ok {
+				if err := request(ctx, conn, r, Header{Op: opMkdir, Name: path.Join(name, entry.Name), Mode: entry.Mode}); err != nil {
+					return result, err
+				}
+			}
+			continue
+		}
+		if ok && target.Size == entry.Size && target.ModTime.Equal(entry.ModTime) {
+			result.Skipped++
+			continue
+		}
+		source := filepath.Join(dir, filepath.FromSlash(entry.Name))
+		if err := sendFile(ctx, conn, r, source, path.Join(name, entry.Name), options.Options); err != nil {
+			return result, err
+		}
+		result.Sent++
+		result.Bytes += entry.Size
+	}
+	return result, nil
+}
+
+// filter drops the entries options leave out, with everything below
+// excluded directories.
+func (self *SyncOptions) filter(entries []Entry) []Entry {
+	var kept []Entry
+	var excluded []string
+	for _, entry := range entries {
+		if under(entry.Name, excluded) {
+			continue
+		}
+		if matchAny(self.Exclude, entry.Name) {
+			if entry.Dir {
+				excluded = append(excluded, entry.Name+"/")
+			}
+			continue
+		}
+		if !entry.Dir && len(self.Include) > 0 && !matchAny(self.Include, entry.Name) {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	return kept
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// under reports whether name is below one of dirs, each ending in a slash.
+func under(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if strings.HasPrefix(name, dir) {
+			return true
+		}
+	}
+	return false
+}
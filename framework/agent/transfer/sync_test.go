@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("failed to write file: %v", err)
+		}
+	}
+}
+
+func readTree(t *testing.T, root string) map[string]string {
+	t.Helper()
+	entries, err := list(root)
+	if err != nil {
+		t.Fatalf("failed to list tree: %v", err)
+	}
+	files := make(map[string]string)
+	for _, entry := range entries {
+		if entry.Dir {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(entry.Name)))
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		files[entry.Name] = string(data)
+	}
+	return files
+}
+
+func TestSync(t *testing.T) {
+	var (
+		local = t.TempDir()
+		root  = t.TempDir()
+	)
+	writeTree(t, local, map[string]string{
+		"a/b.txt":    "b",
+		"a/c.log":    "c",
+		"d.txt":      "d",
+		"same.txt":   "same",
+		"skip/x.txt": "x",
+	})
+	writeTree(t, filepath.Join(root, "dst"), map[string]string{
+		"stale.txt":     "stale",
+		"old/gone.txt":  "gone",
+		"kept.log":      "kept",
+		"d.txt":         "old d",
+		"same.txt":      "same",
+		"a/b.txt/inner": "was a directory",
+	})
+	// Give same.txt matching modification times on both sides.
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, path := range []string{filepath.Join(local, "same.txt"), filepath.Join(root, "dst", "same.txt")} {
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("failed to set modification time: %v", err)
+		}
+	}
+
+	conn := serve(t, &Service{Root: root})
+	options := SyncOptions{Exclude: []string{"*.log", "skip"}, Delete: true}
+	result, err := Sync(context.Background(), conn, local, "dst", options)
+	if err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if diff := cmp.Diff(SyncResult{Sent: 2, Skipped: 1, Deleted: 3, Bytes: 2}, result); diff != "" {
+		t.Fatalf("unexpected result (-want +got):\n%s", diff)
+	}
+	want := map[string]string{
+		"a/b.txt":  "b",
+		"d.txt":    "d",
+		"same.txt": "same",
+		"kept.log": "kept",
+	}
+	if diff := cmp.Diff(want, readTree(t, filepath.Join(root, "dst"))); diff != "" {
+		t.Fatalf("unexpected tree (-want +got):\n%s", diff)
+	}
+
+	// Nothing is sent again.
+	result, err = Sync(context.Background(), conn, local, "dst", options)
+	if err != nil {
+		t.Fatalf("failed to sync again: %v", err)
+	}
+	if diff := cmp.Diff(SyncResult{Skipped: 3}, result); diff != "" {
+		t.Fatalf("unexpected result of the second sync (-want +got):\n%s", diff)
+	}
+}
+
+func TestSyncFilter(t *testing.T) {
+	options := SyncOptions{Include: []string{"*.go"}, Exclude: []string{"vendor", "*_test.go"}}
+	entries := []Entry{
+		{Name: "cmd", Dir: true},
+		{Name: "cmd/main.go"},
+		{Name: "cmd/main_test.go"},
+		{Name: "README"},
+		{Name: "vendor", Dir: true},
+		{Name: "vendor/dep.go"},
+	}
+	var got []string
+	for _, entry := range options.filter(entries) {
+		got = append(got, entry.Name)
+	}
+	sort.Strings(got)
+	if diff := cmp.Diff([]string{"cmd", "cmd/main.go"}, got); diff != "" {
+		t.Fatalf("unexpected entries (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,400 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// A tar transfer streams a directory as a tar archive, which the service
+// unpacks as it arrives. Its length is not known up front, so the archive
+// is sent in frames, each a 32-bit big endian length and that many bytes,
+// ending with an empty frame and then the trailer.
+
+// Compression names how a tar transfer is compressed.
+const (
+	CompressNone = ""
+	CompressGzip = "gzip"
+)
+
+// maxFrame bounds the length of a frame of a tar transfer.
+const maxFrame = 1 << 20
+
+// TarOptions configures SendTar.
+type TarOptions struct {
+	Options
+	// Compression is CompressNone or CompressGzip.
+	Compression string
+}
+
+// SendTar streams the local directory dir to the service at the other end
+// of conn, which unpacks it as the directory name, replacing any there
+// was. The directory only appears once it is complete and verified.
+func SendTar(ctx context.Context, conn net.Conn, dir, name string, options TarOptions) error {
+	switch options.Compression {
+	case CompressNone, CompressGzip:
+	default:
+		return fmt.Errorf("transfer: unknown compression %q", options.Compression)
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("transfer: %s is not a directory", dir)
+	}
+	// The service is told the unpacked size, to check it has room.
+	entries, err := list(dir)
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+
+	r := bufio.NewReader(conn)
+	if err := request(ctx, conn, r, Header{Op: opPutTar, Name: name, Size: size, Compression: options.Compression}); err != nil {
+		return err
+	}
+
+	stop := vsock.BindContext(ctx, conn)
+	defer stop()
+	m := newMeter(name, -1, options.Progress)
+	h := newBlake3()
+	frames := &frameWriter{w: conn}
+	bw := bufio.NewWriterSize(io.MultiWriter(frames, h, &meteredWriter{w: io.Discard, meter: m}), maxFrame)
+	var w io.Writer = bw
+	var zw *gzip.Writer
+	if options.Compression == CompressGzip {
+		zw = gzip.NewWriter(bw)
+		w = zw
+	}
+	if err := writeTar(w, dir); err != nil {
+		// The service cannot tell a broken archive from a complete one
+		// by its frames, so the connection is given up.
+		conn.Close()
+		return contextError(ctx, err)
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return contextError(ctx, err)
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := frames.Close(); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := writeJSON(conn, trailer{Hash: hex.EncodeToString(h.Sum(nil))}); err != nil {
+		return contextError(ctx, err)
+	}
+	if err := readReply(ctx, r); err != nil {
+		return err
+	}
+	m.done()
+	return nil
+}
+
+// writeTar writes the tree at dir as a tar archive to w. Regular files,
+// directories and symbolic links are archived, anything else is left out.
+func writeTar(w io.Writer, dir string) error {
+	tw := tar.NewWriter(w)
+	err := filepath.WalkDir(dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dir {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			if link, err = os.Readlink(name); err != nil {
+				return err
+			}
+		case d.IsDir(), d.Type().IsRegular():
+		default:
+			return nil
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.CopyN(tw, f, header.Size)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// receiveTar serves a tar transfer, unpacking it at path. Failing to
+// unpack leaves the connection usable and is reported to the peer; only
+// the returned errors end the connection.
+func (self *Service) receiveTar(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, header Header, reserved *reservation, progress func(Progress)) error {
+	fail := func(err error) error {
+		return writeJSON(conn, errorReply(err))
+	}
+	switch header.Compression {
+	case CompressNone, CompressGzip:
+	default:
+		return fail(fmt.Errorf("unknown compression %q", header.Compression))
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(path), "."+filepath.Base(path)+".part*")
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(tmp)
+	if err := writeJSON(conn, reply{}); err != nil {
+		return err
+	}
+
+	stop := vsock.BindContext(ctx, conn)
+	defer stop()
+	m := newMeter(header.Name, -1, progress)
+	h := newBlake3()
+	frames := &frameReader{r: r}
+	stream := io.TeeReader(frames, io.MultiWriter(h, &meteredWriter{w: io.Discard, meter: m}))
+	unpacked := unpackTar(stream, tmp, header.Compression, header.Size)
+	// Read the archive to its end whatever happened to unpacking it.
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return contextError(ctx, err)
+	}
+	var end trailer
+	if err := readJSON(r, &end); err != nil {
+		return contextError(ctx, err)
+	}
+	if unpacked != nil {
+		return fail(unpacked)
+	}
+	if end.Hash != hex.EncodeToString(h.Sum(nil)) {
+		return fail(ErrMismatch)
+	}
+
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return fail(err)
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fail(err)
+	}
+	reserved.keep()
+	m.done()
+	return writeJSON(conn, reply{})
+}
+
+// unpackTar unpacks the archive read from r into dir. Entries may not
+// reach outside dir, whether by their name or through symbolic links
+// unpacked before them, and the files may not hold more than size bytes
+// together.
+func unpackTar(r io.Reader, dir, compression string, size int64) error {
+	if compression == CompressGzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := filepath.FromSlash(strings.TrimSuffix(header.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid name %q in archive", header.Name)
+		}
+		target := filepath.Join(dir, name)
+		if err := parent(dir, target); err != nil {
+			return fmt.Errorf("invalid name %q in archive: %v", header.Name, err)
+		}
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := within(dir, target); err != nil {
+				return fmt.Errorf("invalid name %q in archive: %v", header.Name, err)
+			}
+			if err := os.Chmod(target, dirMode(mode)|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if size -= header.Size; size < 0 {
+				return fmt.Errorf("archive larger than announced")
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			continue
+		default:
+			continue
+		}
+		os.Chtimes(target, header.ModTime, header.ModTime)
+	}
+}
+
+// parent creates the missing directories above target, after checking the
+// existing ones lead no further than root.
+func parent(root, target string) error {
+	existing := filepath.Dir(target)
+	for existing != root {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		existing = filepath.Dir(existing)
+	}
+	if err := within(root, existing); err != nil {
+		return err
+	}
+	return os.MkdirAll(filepath.Dir(target), 0755)
+}
+
+// within checks that dir, once symbolic links are resolved, is root or
+// below it.
+func within(root, dir string) error {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return fmt.Errorf("%s is outside %s", dir, root)
+	}
+	return nil
+}
+
+// frameWriter cuts what is written to it into frames.
+type frameWriter struct {
+	w io.Writer
+}
+
+func (self *frameWriter) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxFrame {
+			chunk = chunk[:maxFrame]
+		}
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(chunk)))
+		if _, err := self.w.Write(length[:]); err != nil {
+			return n, err
+		}
+		written, err := self.w.Write(chunk)
+		n += written
+		if err != nil {
+			return n, err
+		}
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close writes the empty frame ending the stream.
+func (self *frameWriter) Close() error {
+	_, err := self.w.Write(make([]byte, 4))
+	return err
+}
+
+// frameReader reads the frames written by a frameWriter, returning io.EOF
+// after the empty frame.
+type frameReader struct {
+	r    *bufio.Reader
+	left uint32
+	done bool
+}
+
+func (self *frameReader) Read(b []byte) (int, error) {
+	if self.done {
+		return 0, io.EOF
+	}
+	if self.left == 0 {
+		var length [4]byte
+		if _, err := io.ReadFull(self.r, length[:]); err != nil {
+			return 0, unexpected(err)
+		}
+		self.left = binary.BigEndian.Uint32(length[:])
+		if self.left == 0 {
+			self.done = true
+			return 0, io.EOF
+		}
+		if self.left > maxFrame {
+			return 0, fmt.Errorf("transfer: frame of %d bytes is too long", self.left)
+		}
+	}
+	if uint32(len(b)) > self.left {
+		b = b[:self.left]
+	}
+	n, err := self.r.Read(b)
+	self.left -= uint32(n)
+	return n, unexpected(err)
+}
+
+// unexpected turns io.EOF into io.ErrUnexpectedEOF, as the end of the
+// stream is marked by a frame.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
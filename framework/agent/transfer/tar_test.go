@@ -0,0 +1,104 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSendTar(t *testing.T) {
+	var (
+		local = t.TempDir()
+		root  = t.TempDir()
+	)
+	files := map[string]string{
+		"etc/motd":          "hello",
+		"etc/app/conf.json": "{}",
+		"bin/run":           string(bytes.Repeat([]byte("#"), 3<<20)),
+	}
+	writeTree(t, local, files)
+	if err := os.Symlink("etc/motd", filepath.Join(local, "motd")); err != nil {
+		t.Fatalf("failed to create symbolic link: %v", err)
+	}
+	writeTree(t, filepath.Join(root, "dst"), map[string]string{"old": "replaced"})
+
+	conn := serve(t, &Service{Root: root})
+	for _, compression := range []string{CompressNone, CompressGzip} {
+		var final Progress
+		options := TarOptions{Compression: compression, Options: Options{Progress: func(p Progress) { final = p }}}
+		if err := SendTar(context.Background(), conn, local, "dst", options); err != nil {
+			t.Fatalf("failed to send %q tar: %v", compression, err)
+		}
+		if !final.Done || final.Bytes == 0 {
+			t.Fatalf("unexpected final progress: %+v", final)
+		}
+		if diff := cmp.Diff(files, readTree(t, filepath.Join(root, "dst"))); diff != "" {
+			t.Fatalf("unexpected tree (-want +got):\n%s", diff)
+		}
+		link, err := os.Readlink(filepath.Join(root, "dst", "motd"))
+		if err != nil {
+			t.Fatalf("failed to read symbolic link: %v", err)
+		}
+		if diff := cmp.Diff("etc/motd", link); diff != "" {
+			t.Fatalf("unexpected link (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestUnpackTarEscape(t *testing.T) {
+	outside := t.TempDir()
+	tests := map[string][]tar.Header{
+		"dot dot": {
+			{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"absolute": {
+			{Name: "/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"through link": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"through link directory": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/sub/escape", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"link as directory": {
+			{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outside},
+			{Name: "link/", Typeflag: tar.TypeDir, Mode: 0777},
+		},
+	}
+	for name, headers := range tests {
+		t.Run(name, func(t *testing.T) {
+			var b bytes.Buffer
+			tw := tar.NewWriter(&b)
+			for _, header := range headers {
+				if err := tw.WriteHeader(&header); err != nil {
+					t.Fatalf("failed to write header: %v", err)
+				}
+			}
+			tw.Close()
+			if err := unpackTar(&b, t.TempDir(), CompressNone, 1<<20); err == nil {
+				t.Fatalf("expected the archive to be refused")
+			}
+			entries, err := os.ReadDir(outside)
+			if err != nil {
+				t.Fatalf("failed to read directory: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("archive escaped: %v", entries)
+			}
+			info, err := os.Stat(outside)
+			if err != nil {
+				t.Fatalf("failed to stat directory: %v", err)
+			}
+			if info.Mode().Perm() == 0777 {
+				t.Fatalf("archive changed the mode of %s", outside)
+			}
+		})
+	}
+}
@@ -0,0 +1,616 @@
+// Package transfer moves files between host and guest.
+//
+// Each request on a connection is a JSON header line, answered by a JSON
+// reply line; file contents follow as raw bytes, their length given by the
+// header, and then a trailer line with their BLAKE3 hash, which the
+// receiving side checks against its own before accepting the file. A put
+// sends a file to the service, a get fetches one from it. A resumable put
+// is answered with the offset the service already holds of the file from
+// an interrupted attempt, and only the rest follows. An offer lists
+// files with their sizes and hashes, and sends those the service accepts.
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the transfer service listens on.
+const Port = vsock.PortTransfer
+
+const (
+	opPut        = "put"
+	opGet        = "get"
+	opPutStriped = "put-striped"
+	opStripe     = "stripe"
+	opList       = "list"
+	opMkdir      = "mkdir"
+	opRemove     = "remove"
+	opPutTar     = "put-tar"
+	opStat       = "stat"
+	opReadDir    = "readdir"
+	opRead       = "read"
+	opOffer      = "offer"
+)
+
+// Header describes a file.
+type Header struct {
+	Op      string      `json:"op,omitempty"`
+	Name    string      `json:"name"`
+	Mode    os.FileMode `json:"mode,omitempty"`
+	Size    int64       `json:"size"`
+	ModTime time.Time   `json:"mod_time,omitempty"`
+	// ID names the striped transfer a stripe stream belongs to.
+	ID string `json:"id,omitempty"`
+	// Compression is the compression of a tar transfer.
+	Compression string `json:"compression,omitempty"`
+	// Offset is where a read starts.
+	Offset int64 `json:"offset,omitempty"`
+	// Hash, if set, is the BLAKE3 hash the contents must have, hex
+	// encoded.
+	Hash string `json:"blake3,omitempty"`
+	// Resume asks for a resumable put.
+	Resume bool `json:"resume,omitempty"`
+}
+
+type reply struct {
+	Error    string      `json:"error,omitempty"`
+	NotExist bool        `json:"not_exist,omitempty"`
+	Mismatch bool        `json:"mismatch,omitempty"`
+	Quota    *QuotaError `json:"quota,omitempty"`
+	Space    *SpaceError `json:"space,omitempty"`
+	ID       string      `json:"id,omitempty"`
+	// Accepted lists the indexes of the offered files accepted.
+	Accepted []int `json:"accepted,omitempty"`
+	// Offset is where a resumable put continues.
+	Offset int64 `json:"offset,omitempty"`
+}
+
+// trailer follows the contents of a file.
+type trailer struct {
+	Hash string `json:"blake3"`
+}
+
+// ErrMismatch is returned when a file arrived with a content hash other
+// than the one it was sent with. The file is not stored.
+var ErrMismatch = errors.New("transfer: content hash mismatch")
+
+// Options configures a transfer.
+type Options struct {
+	// ChunkSize is the size of the writes a file is sent in. Defaults to
+	// vsock.DefaultChunkSize.
+	ChunkSize int
+	// Progress, if set, receives progress reports.
+	Progress func(Progress)
+	// Streams is the number of streams SendParallel stripes a file
+	// across. Defaults to DefaultStreams.
+	Streams int
+	// StripeSize is the size of the pieces SendParallel cuts a file
+	// into. Defaults to DefaultStripeSize.
+	StripeSize int64
+	// Resume makes Send resumable: the service keeps what arrived if the
+	// transfer is interrupted, and a later Send of the same file, unchanged,
+	// continues from there.
+	Resume bool
+}
+
+// Send sends the file at path to the service at the other end of conn,
+// which stores it as name. Cancelling ctx aborts the transfer, and the
+// service discards what it received.
+func Send(ctx context.Context, conn net.Conn, path, name string, options Options) error {
+	return sendFile(ctx, conn, bufio.NewReader(conn), path, name, options)
+}
+
+func sendFile(ctx context.Context, conn net.Conn, r *bufio.Reader, path, name string, options Options) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("transfer: %s is not a regular file", path)
+	}
+
+	header := Header{Op: opPut, Name: name, Mode: info.Mode().Perm(), Size: info.Size(), ModTime: info.ModTime(), Resume: options.Resume}
+	rep, err := requestReply(ctx, conn, r, header)
+	if err != nil {
+		return err
+	}
+	if rep.Offset < 0 || rep.Offset > header.Size {
+		conn.Close()
+		return fmt.Errorf("transfer: %s: invalid offset %d", name, rep.Offset)
+	}
+	if err := sendFrom(ctx, conn, f, header, rep.Offset, options); err != nil {
+		return err
+	}
+	stop := vsock.BindContext(ctx, conn)
+	defer stop()
+	return readReply(ctx, r)
+}
+
+// Fetch fetches the file called name from the service at the other end of
+// conn and stores it at path. Cancelling ctx aborts the transfer, leaving
+// nothing at path.
+func Fetch(ctx context.Context, conn net.Conn, name, path string, options Options) error {
+	r := bufio.NewReader(conn)
+	if err := request(ctx, conn, r, Header{Op: opGet, Name: name}); err != nil {
+		return err
+	}
+	var header Header
+	stop := vsock.BindContext(ctx, conn)
+	err := readJSON(r, &header)
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	return receive(ctx, conn, r, path, header, options.Progress)
+}
+
+// request sends header and waits for the service to accept it.
+func request(ctx context.Context, conn net.Conn, r *bufio.Reader, header Header) error {
+	_, err := requestReply(ctx, conn, r, header)
+	return err
+}
+
+// requestReply is request returning the reply accepting header.
+func requestReply(ctx context.Context, conn net.Conn, r *bufio.Reader, header Header) (reply, error) {
+	stop := vsock.BindContext(ctx, conn)
+	defer stop()
+	if err := writeHeader(conn, header); err != nil {
+		return reply{}, contextError(ctx, err)
+	}
+	var rep reply
+	if err := readJSON(r, &rep); err != nil {
+		return reply{}, contextError(ctx, err)
+	}
+	return rep, rep.err()
+}
+
+func readReply(ctx context.Context, r *bufio.Reader) error {
+	var rep reply
+	if err := readJSON(r, &rep); err != nil {
+		return contextError(ctx, err)
+	}
+	return rep.err()
+}
+
+// err returns the error reported by the reply.
+func (self *reply) err() error {
+	switch {
+	case self.Mismatch:
+		return ErrMismatch
+	case self.NotExist:
+		return fmt.Errorf("transfer: %w", fs.ErrNotExist)
+	case self.Quota != nil:
+		return self.Quota
+	case self.Space != nil:
+		return self.Space
+	case self.Error != "":
+		return fmt.Errorf("transfer: %s", self.Error)
+	}
+	return nil
+}
+
+// send streams the contents of f described by header, and their hash.
+func send(ctx context.Context, conn net.Conn, f io.Reader, header Header, options Options) error {
+	return sendFrom(ctx, conn, f, header, 0, options)
+}
+
+// sendFrom is send leaving out the first offset bytes, which the peer
+// already has; they are still read, for the hash.
+func sendFrom(ctx context.Context, conn net.Conn, f io.Reader, header Header, offset int64, options Options) error {
+	m := newMeter(header.Name, header.Size, options.Progress)
+	h := newBlake3()
+	if offset > 0 {
+		if _, err := io.CopyN(h, f, offset); err != nil {
+			conn.Close()
+			return fmt.Errorf("transfer: %s changed size while being sent", header.Name)
+		}
+		m.add(offset)
+	}
+	size := header.Size - offset
+	var last int64
+	n, err := vsock.CopyChunked(ctx, conn, io.TeeReader(io.LimitReader(f, size), h), size, vsock.ChunkOptions{
+		ChunkSize: options.ChunkSize,
+		Progress: func(written, total int64) error {
+			m.add(written - last)
+			last = written
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if n != size {
+		// The file shrank; the peer cannot tell where it ends.
+		conn.Close()
+		return fmt.Errorf("transfer: %s changed size while being sent", header.Name)
+	}
+	stop := vsock.BindContext(ctx, conn)
+	err = writeJSON(conn, trailer{Hash: hex.EncodeToString(h.Sum(nil))})
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	m.done()
+	return nil
+}
+
+// receive stores the contents described by header at path, through a
+// temporary file so an interrupted or corrupted transfer leaves nothing
+// behind.
+func receive(ctx context.Context, conn net.Conn, r *bufio.Reader, path string, header Header, progress func(Progress)) error {
+	if header.Size < 0 {
+		return fmt.Errorf("transfer: invalid size %d", header.Size)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".part*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	return receiveInto(ctx, conn, r, tmp, newBlake3(), 0, path, header, progress)
+}
+
+// receiveInto writes the contents described by header to f, which holds
+// the first offset bytes of them already, hashed into h, and moves it to
+// path if they arrive intact.
+func receiveInto(ctx context.Context, conn net.Conn, r *bufio.Reader, f *os.File, h hash.Hash, offset int64, path string, header Header, progress func(Progress)) error {
+	mode := header.Mode.Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	m := newMeter(header.Name, header.Size, progress)
+	if offset > 0 {
+		m.add(offset)
+	}
+	var end trailer
+	stop := vsock.BindContext(ctx, conn)
+	_, err := io.CopyN(&meteredWriter{w: io.MultiWriter(f, h), meter: m}, r, header.Size-offset)
+	if err == nil {
+		err = readJSON(r, &end)
+	}
+	stop()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if end.Hash != sum || header.Hash != "" && header.Hash != sum {
+		return ErrMismatch
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if !header.ModTime.IsZero() {
+		os.Chtimes(f.Name(), header.ModTime, header.ModTime)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	m.done()
+	return nil
+}
+
+// contextError prefers the error of ctx, which explains an I/O failure
+// caused by its cancellation.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Service stores and serves files under Root.
+type Service struct {
+	Root string
+	// ReadOnly refuses puts.
+	ReadOnly bool
+	// Progress, if set, receives progress reports of every transfer.
+	Progress func(peer net.Addr, p Progress)
+	// Quota, if set, limits the bytes peers may store.
+	Quota *Quota
+	// MinFree is the space in bytes to leave free on the filesystem of
+	// Root. Files are refused before they are sent if they would not fit.
+	MinFree int64
+	// Offered decides which of the files a peer offers to accept,
+	// returning their indexes. Offers are declined if it is nil.
+	Offered func(peer net.Addr, files []File) []int
+	// Delivered, if set, is told of the accepted files of an offer once
+	// they are all stored.
+	Delivered func(peer net.Addr, files []File)
+
+	mutex   sync.Mutex
+	striped map[string]*stripedFile
+}
+
+func (self *Service) Name() string { return "transfer" }
+func (self *Service) Port() uint32 { return Port }
+
+func (self *Service) Serve(conn net.Conn) error {
+	return self.ServeContext(context.Background(), conn)
+}
+
+// ServeContext serves requests on conn until it is closed, or ctx is
+// cancelled, aborting the transfer in progress.
+func (self *Service) ServeContext(ctx context.Context, conn net.Conn) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		var header Header
+		stop := vsock.BindContext(ctx, conn)
+		err := readJSON(r, &header)
+		stop()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return contextError(ctx, err)
+		}
+		if err := self.handle(ctx, conn, r, header); err != nil {
+			return err
+		}
+	}
+}
+
+// handle serves one request. Errors the peer is told about are not
+// returned, so the connection can carry on.
+func (self *Service) handle(ctx context.Context, conn net.Conn, r *bufio.Reader, header Header) error {
+	var progress func(Progress)
+	if self.Progress != nil {
+		peer := conn.RemoteAddr()
+		progress = func(p Progress) { self.Progress(peer, p) }
+	}
+
+	if header.Op == opStripe {
+		return self.receiveStripes(ctx, conn, r, header.ID)
+	}
+	path, err := self.resolve(header.Name)
+	if err == nil && self.ReadOnly {
+		switch header.Op {
+		case opPut, opPutStriped, opPutTar, opMkdir, opRemove:
+			err = fmt.Errorf("read only")
+		}
+	}
+	var reserved *reservation
+	if err == nil {
+		switch header.Op {
+		case opPut, opPutStriped, opPutTar:
+			if reserved, err = self.admit(conn.RemoteAddr(), path, header.Size); err == nil {
+				defer reserved.done()
+			}
+		}
+	}
+	switch header.Op {
+	case opPut:
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		_, err := self.put(ctx, conn, r, path, header, reserved, progress)
+		return err
+	case opPutStriped:
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		return self.receiveStriped(ctx, conn, r, path, header, reserved, progress)
+	case opPutTar:
+		if err == nil && filepath.Clean(header.Name) == "." {
+			err = fmt.Errorf("cannot replace the root directory")
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		return self.receiveTar(ctx, conn, r, path, header, reserved, progress)
+	case opGet:
+		var f *os.File
+		var info os.FileInfo
+		if err == nil {
+			if path, err = self.follow(header.Name, path); err == nil {
+				f, info, err = openRegular(path)
+			}
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		defer f.Close()
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+		out := Header{Name: header.Name, Mode: info.Mode().Perm(), Size: info.Size(), ModTime: info.ModTime()}
+		if err := writeJSON(conn, out); err != nil {
+			return err
+		}
+		return send(ctx, conn, f, out, Options{Progress: progress})
+	case opList:
+		var entries []Entry
+		if err == nil {
+			entries, err = list(path)
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		if err := writeJSON(conn, reply{}); err != nil {
+			return err
+		}
+		return writeJSON(conn, listing{Entries: entries})
+	case opOffer:
+		// Offers name their files in the offer rather than the header.
+		var refused error
+		if self.ReadOnly {
+			refused = fmt.Errorf("read only")
+		}
+		return self.receiveOffer(ctx, conn, r, refused, progress)
+	case opStat, opReadDir, opRead:
+		if err == nil {
+			path, err = self.follow(header.Name, path)
+		}
+		if err != nil {
+			return writeJSON(conn, errorReply(err))
+		}
+		return self.serveFiles(conn, path, header)
+	case opMkdir:
+		if err == nil {
+			err = os.MkdirAll(path, dirMode(header.Mode))
+		}
+		return writeReply(conn, err)
+	case opRemove:
+		if err == nil && filepath.Clean(header.Name) == "." {
+			err = fmt.Errorf("cannot remove the root directory")
+		}
+		if err == nil {
+			err = os.RemoveAll(path)
+		}
+		return writeReply(conn, err)
+	}
+	return writeJSON(conn, reply{Error: fmt.Sprintf("unknown operation %q", header.Op)})
+}
+
+// follow resolves the symbolic link path, which name resolved to, if it is
+// one, as long as it leads to Root or below.
+func (self *Service) follow(name, path string) (string, error) {
+	target, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", errors.Unwrap(err)
+	}
+	if err := within(self.Root, target); err != nil {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return target, nil
+}
+
+// resolve maps a name from the peer to a path under Root, refusing any
+// which would escape it.
+func (self *Service) resolve(name string) (string, error) {
+	if self.Root == "" {
+		return "", fmt.Errorf("no root directory")
+	}
+	name = filepath.FromSlash(name)
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	path := filepath.Join(self.Root, name)
+	// A symbolic link along the way must not lead out of Root either.
+	root, err := filepath.EvalSymlinks(self.Root)
+	if err != nil {
+		return "", err
+	}
+	if filepath.Clean(name) == "." {
+		return root, nil
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if err != nil {
+		return "", errors.Unwrap(err)
+	}
+	if dir != root && !strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid name %q", name)
+	}
+	return filepath.Join(dir, filepath.Base(path)), nil
+}
+
+func openRegular(path string) (*os.File, os.FileInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if !info.Mode().IsRegular() {
+		f.Close()
+		return nil, nil, fmt.Errorf("not a regular file")
+	}
+	return f, info, nil
+}
+
+// errorReply is the reply reporting err, keeping what a client can act on.
+func errorReply(err error) reply {
+	rep := reply{Error: err.Error(), NotExist: errors.Is(err, fs.ErrNotExist), Mismatch: err == ErrMismatch}
+	var quota *QuotaError
+	if errors.As(err, &quota) {
+		rep.Quota = quota
+	}
+	var space *SpaceError
+	if errors.As(err, &space) {
+		rep.Space = space
+	}
+	return rep
+}
+
+// writeReply replies with err, which may be nil.
+func writeReply(w io.Writer, err error) error {
+	if err != nil {
+		return writeJSON(w, errorReply(err))
+	}
+	return writeJSON(w, reply{})
+}
+
+// writeHeader writes a request. Names are slash-separated on the wire,
+// whatever the systems at either end, so those given in the form of this
+// one are converted.
+func writeHeader(w io.Writer, header Header) error {
+	header.Name = filepath.ToSlash(header.Name)
+	return writeJSON(w, header)
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// maxMessage bounds the JSON messages read from the peer, such as headers,
+// replies and directory listings, so neither end can exhaust the memory of
+// the other.
+const maxMessage = 16 << 20
+
+func readJSON(r *bufio.Reader, v interface{}) error {
+	var line []byte
+	var err error
+	for {
+		var chunk []byte
+		chunk, err = r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxMessage {
+			return fmt.Errorf("transfer: message exceeds the maximum of %d bytes", maxMessage)
+		}
+		if err != bufio.ErrBufferFull {
+			break
+		}
+	}
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return io.EOF
+		}
+		return err
+	}
+	return json.Unmarshal(line, v)
+}
@@ -0,0 +1,208 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func serve(t *testing.T, service *Service) net.Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	go service.Serve(server)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestSendFetch(t *testing.T) {
+	var (
+		root  = t.TempDir()
+		local = t.TempDir()
+	)
+	data := bytes.Repeat([]byte("vcable"), 100000)
+	if err := os.WriteFile(filepath.Join(local, "in"), data, 0640); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var served []Progress
+	conn := serve(t, &Service{Root: root, Progress: func(_ net.Addr, p Progress) {
+		mutex.Lock()
+		served = append(served, p)
+		mutex.Unlock()
+	}})
+
+	var sent []Progress
+	options := Options{ChunkSize: 4096, Progress: func(p Progress) { sent = append(sent, p) }}
+	if err := Send(context.Background(), conn, filepath.Join(local, "in"), "file", options); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if len(sent) == 0 || !sent[len(sent)-1].Done || sent[len(sent)-1].Bytes != int64(len(data)) {
+		t.Fatalf("unexpected final progress: %+v", sent)
+	}
+
+	got, err := os.ReadFile(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatalf("failed to read stored file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("stored file differs")
+	}
+
+	if err := Fetch(context.Background(), conn, "file", filepath.Join(local, "out"), Options{}); err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	got, err = os.ReadFile(filepath.Join(local, "out"))
+	if err != nil {
+		t.Fatalf("failed to read fetched file: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("fetched file differs")
+	}
+	info, err := os.Stat(filepath.Join(local, "out"))
+	if err != nil {
+		t.Fatalf("failed to stat fetched file: %v", err)
+	}
+	if diff := cmp.Diff(os.FileMode(0640), info.Mode().Perm()); diff != "" {
+		t.Fatalf("unexpected mode (-want +got):\n%s", diff)
+	}
+
+	// The service finishes sending the fetched file independently.
+	finished := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var done int
+		for _, p := range served {
+			if p.Done {
+				done++
+			}
+		}
+		return done
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for finished() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if diff := cmp.Diff(2, finished()); diff != "" {
+		t.Fatalf("unexpected number of finished transfers on the service (-want +got):\n%s", diff)
+	}
+}
+
+func TestServiceRefuses(t *testing.T) {
+	root := t.TempDir()
+	local := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(local, []byte("data"), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	conn := serve(t, &Service{Root: root, ReadOnly: true})
+
+	if err := Send(context.Background(), conn, local, "file", Options{}); err == nil {
+		t.Fatalf("expected a read only service to refuse a put")
+	}
+	for _, name := range []string{"../escape", "/etc/passwd", "missing"} {
+		if err := Fetch(context.Background(), conn, name, filepath.Join(t.TempDir(), "out"), Options{}); err == nil {
+			t.Fatalf("expected fetching %q to fail", name)
+		}
+	}
+}
+
+func TestSendCancel(t *testing.T) {
+	root := t.TempDir()
+	local := filepath.Join(t.TempDir(), "in")
+	if err := os.WriteFile(local, make([]byte, 1<<20), 0600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	conn := serve(t, &Service{Root: root})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	options := Options{ChunkSize: 1024, Progress: func(p Progress) {
+		if p.Bytes > 0 {
+			cancel()
+		}
+	}}
+	if err := Send(ctx, conn, local, "file", options); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the send to be cancelled, got %v", err)
+	}
+
+	// The service discards the partial file.
+	conn.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatalf("failed to read root: %v", err)
+		}
+		if len(entries) == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("partial file left behind: %v", entries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPutMismatch(t *testing.T) {
+	root := t.TempDir()
+	conn := serve(t, &Service{Root: root})
+	r := bufio.NewReader(conn)
+
+	put := func(data []byte, sum []byte) error {
+		if err := writeJSON(conn, Header{Op: opPut, Name: "file", Size: int64(len(data))}); err != nil {
+			t.Fatalf("failed to write header: %v", err)
+		}
+		if err := readReply(context.Background(), r); err != nil {
+			t.Fatalf("put refused: %v", err)
+		}
+		conn.Write(data)
+		writeJSON(conn, trailer{Hash: hex.EncodeToString(sum)})
+		return readReply(context.Background(), r)
+	}
+
+	h := newBlake3()
+	h.Write([]byte("good"))
+	if err := put([]byte("evil"), h.Sum(nil)); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("expected a mismatch, got %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Fatalf("corrupted file stored: %v", entries)
+	}
+
+	// The connection survives the mismatch.
+	if err := put([]byte("good"), h.Sum(nil)); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "file"))
+	if err != nil {
+		t.Fatalf("failed to read stored file: %v", err)
+	}
+	if diff := cmp.Diff("good", string(got)); diff != "" {
+		t.Fatalf("unexpected file (-want +got):\n%s", diff)
+	}
+}
+
+func TestReadJSONLimit(t *testing.T) {
+	var header Header
+	line := `{"name":"` + strings.Repeat("x", maxMessage) + `"}` + "\n"
+	if err := readJSON(bufio.NewReader(strings.NewReader(line)), &header); err == nil || !strings.Contains(err.Error(), "exceeds the maximum") {
+		t.Fatalf("expected an over-long header to be refused, got %v", err)
+	}
+	if err := readJSON(bufio.NewReader(strings.NewReader(`{"name":"a"}`+"\n")), &header); err != nil || header.Name != "a" {
+		t.Fatalf("readJSON() = %v, %q, want the header", err, header.Name)
+	}
+	if err := readJSON(bufio.NewReader(strings.NewReader("")), &header); err != io.EOF {
+		t.Fatalf("expected io.EOF at the end, got %v", err)
+	}
+}
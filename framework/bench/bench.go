@@ -0,0 +1,184 @@
+// Package bench measures the throughput of vsock paths.
+//
+// A client connects, names a direction and a duration, and data flows one
+// way for that long. Upload results are reported by the server, which saw
+// the bytes arrive; download results are measured by the client.
+package bench
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the vsock port the bench server listens on by default.
+const Port = vsock.PortBench
+
+// DefaultBlockSize is the size of the writes data is sent in.
+const DefaultBlockSize = 128 * 1024
+
+const (
+	upload   byte = 'u'
+	download byte = 'd'
+)
+
+// Options configures a benchmark run.
+type Options struct {
+	Duration time.Duration
+	// Reverse has the server send, rather than the client.
+	Reverse   bool
+	BlockSize int
+}
+
+// Result is the outcome of a benchmark run.
+type Result struct {
+	Bytes    uint64
+	Duration time.Duration
+}
+
+// BitsPerSecond returns the measured throughput.
+func (self Result) BitsPerSecond() float64 {
+	if self.Duration <= 0 {
+		return 0
+	}
+	return float64(self.Bytes) * 8 / self.Duration.Seconds()
+}
+
+func (self Result) String() string {
+	return fmt.Sprintf("%d bytes in %v, %.2f Gbit/s", self.Bytes, self.Duration.Round(time.Millisecond), self.BitsPerSecond()/1e9)
+}
+
+// Run benchmarks the path to the server at the other end of conn, which it
+// closes.
+func Run(conn net.Conn, options Options) (Result, error) {
+	defer conn.Close()
+	if options.Duration <= 0 {
+		options.Duration = 10 * time.Second
+	}
+
+	var header [9]byte
+	header[0] = upload
+	if options.Reverse {
+		header[0] = download
+	}
+	binary.BigEndian.PutUint64(header[1:], uint64(options.Duration))
+	if _, err := conn.Write(header[:]); err != nil {
+		return Result{}, err
+	}
+
+	if options.Reverse {
+		return sink(conn)
+	}
+	if _, err := source(conn, options.Duration, options.BlockSize); err != nil {
+		return Result{}, err
+	}
+	// The server reports what it received once the data ends.
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	var report [16]byte
+	if _, err := io.ReadFull(conn, report[:]); err != nil {
+		return Result{}, err
+	}
+	return Result{
+		Bytes:    binary.BigEndian.Uint64(report[0:8]),
+		Duration: time.Duration(binary.BigEndian.Uint64(report[8:16])),
+	}, nil
+}
+
+// Server answers benchmark runs.
+type Server struct {
+	BlockSize int
+	// Backoff spaces retries after temporary accept errors, such as
+	// EMFILE. Defaults to exponential backoff from 5ms to 1s.
+	Backoff vsock.Backoff
+}
+
+func (self *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := vsock.AcceptWith(l, vsock.AcceptOptions{Backoff: self.Backoff})
+		if err != nil {
+			return err
+		}
+		go self.ServeConn(conn)
+	}
+}
+
+func (self *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+
+	var header [9]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	duration := time.Duration(binary.BigEndian.Uint64(header[1:]))
+	if duration <= 0 || duration > time.Hour {
+		return fmt.Errorf("bench: invalid duration %v", duration)
+	}
+
+	switch header[0] {
+	case upload:
+		result, err := sink(conn)
+		if err != nil {
+			return err
+		}
+		var report [16]byte
+		binary.BigEndian.PutUint64(report[0:8], result.Bytes)
+		binary.BigEndian.PutUint64(report[8:16], uint64(result.Duration))
+		_, err = conn.Write(report[:])
+		return err
+	case download:
+		_, err := source(conn, duration, self.BlockSize)
+		return err
+	}
+	return fmt.Errorf("bench: unknown direction %q", header[0])
+}
+
+// source writes to w for duration.
+func source(w io.Writer, duration time.Duration, blockSize int) (Result, error) {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	block := make([]byte, blockSize)
+	start := time.Now()
+	deadline := start.Add(duration)
+	var sent uint64
+	for time.Now().Before(deadline) {
+		n, err := w.Write(block)
+		sent += uint64(n)
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	return Result{Bytes: sent, Duration: time.Since(start)}, nil
+}
+
+// sink reads from r until it ends, timing from the first byte.
+func sink(r io.Reader) (Result, error) {
+	block := make([]byte, DefaultBlockSize)
+	var (
+		start    time.Time
+		received uint64
+	)
+	for {
+		n, err := r.Read(block)
+		if n > 0 && start.IsZero() {
+			start = time.Now()
+		}
+		received += uint64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Result{}, err
+		}
+	}
+	if start.IsZero() {
+		return Result{}, nil
+	}
+	return Result{Bytes: received, Duration: time.Since(start)}, nil
+}
@@ -0,0 +1,182 @@
+package bench
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func listen(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return l
+}
+
+func TestRun(t *testing.T) {
+	l := listen(t)
+	defer l.Close()
+	go (&Server{}).Serve(l)
+
+	for _, reverse := range []bool{false, true} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		result, err := Run(conn, Options{Duration: 50 * time.Millisecond, Reverse: reverse})
+		if err != nil {
+			t.Fatalf("reverse %v: failed to run: %v", reverse, err)
+		}
+		if result.Bytes == 0 || result.Duration <= 0 {
+			t.Fatalf("reverse %v: unexpected result %v", reverse, result)
+		}
+	}
+}
+
+// iperfClient plays the client side of an iperf3 test.
+func iperfClient(t *testing.T, addr string, params iperfParams) iperfResults {
+	cookie := strings.Repeat("c", iperfCookieSize-1) + "\x00"
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		if _, err := io.WriteString(conn, cookie); err != nil {
+			t.Fatalf("failed to send cookie: %v", err)
+		}
+		return conn
+	}
+	expect := func(conn net.Conn, want byte) {
+		t.Helper()
+		state, err := readState(conn)
+		if err != nil {
+			t.Fatalf("failed to read state: %v", err)
+		}
+		if diff := cmp.Diff(want, state); diff != "" {
+			t.Fatalf("unexpected state (-want +got):\n%s", diff)
+		}
+	}
+
+	control := dial()
+	defer control.Close()
+	expect(control, iperfParamExchange)
+	if err := writeJSON(control, params); err != nil {
+		t.Fatalf("failed to send parameters: %v", err)
+	}
+	expect(control, iperfCreateStreams)
+	var streams []net.Conn
+	for i := 0; i < params.Parallel; i++ {
+		streams = append(streams, dial())
+	}
+	expect(control, iperfTestStart)
+	expect(control, iperfTestRunning)
+
+	block := make([]byte, 1024)
+	for _, conn := range streams {
+		if params.Reverse {
+			io.ReadFull(conn, block)
+		} else {
+			conn.Write(block)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+	writeState(control, iperfTestEnd)
+	expect(control, iperfExchangeResults)
+	if err := writeJSON(control, json.RawMessage(`{"streams":[]}`)); err != nil {
+		t.Fatalf("failed to send results: %v", err)
+	}
+	var results iperfResults
+	if err := readJSON(control, &results); err != nil {
+		t.Fatalf("failed to read results: %v", err)
+	}
+	expect(control, iperfDisplayResults)
+	writeState(control, iperfDone)
+	for _, conn := range streams {
+		conn.Close()
+	}
+	return results
+}
+
+func TestIperf3(t *testing.T) {
+	l := listen(t)
+	defer l.Close()
+	server := &Iperf3{}
+	go server.Serve(l)
+
+	results := iperfClient(t, l.Addr().String(), iperfParams{TCP: true, Parallel: 2})
+	var ids []int
+	for _, stream := range results.Streams {
+		ids = append(ids, stream.ID)
+		if stream.Bytes < 1024 {
+			t.Errorf("stream %d received %d bytes", stream.ID, stream.Bytes)
+		}
+	}
+	if diff := cmp.Diff([]int{1, 3}, ids); diff != "" {
+		t.Fatalf("unexpected stream ids (-want +got):\n%s", diff)
+	}
+
+	// The server finishes the first test after the client does.
+	for running := true; running; {
+		server.mutex.Lock()
+		running = server.test != nil
+		server.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	results = iperfClient(t, l.Addr().String(), iperfParams{TCP: true, Parallel: 1, Reverse: true, Len: 1024})
+	if len(results.Streams) != 1 || results.Streams[0].Bytes < 1024 {
+		t.Fatalf("unexpected reverse results %+v", results)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails Accept with temporary errors a number of times,
+// then as closed.
+type failingListener struct {
+	net.Listener
+	failures int
+}
+
+func (self *failingListener) Accept() (net.Conn, error) {
+	if self.failures > 0 {
+		self.failures--
+		return nil, temporaryError{}
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeBacksOff(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		serve func(net.Listener, func(int) time.Duration) error
+	}{
+		{"bench", func(l net.Listener, backoff func(int) time.Duration) error {
+			return (&Server{Backoff: backoff}).Serve(l)
+		}},
+		{"iperf3", func(l net.Listener, backoff func(int) time.Duration) error {
+			return (&Iperf3{Backoff: backoff}).Serve(l)
+		}},
+	} {
+		var attempts []int
+		err := tt.serve(&failingListener{failures: 3}, func(attempt int) time.Duration {
+			attempts = append(attempts, attempt)
+			return time.Millisecond
+		})
+		if err != net.ErrClosed {
+			t.Fatalf("%s: Serve() = %v, want net.ErrClosed", tt.name, err)
+		}
+		if diff := cmp.Diff([]int{1, 2, 3}, attempts); diff != "" {
+			t.Fatalf("%s: unexpected retries (-want +got):\n%s", tt.name, diff)
+		}
+	}
+}
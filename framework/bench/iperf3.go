@@ -0,0 +1,300 @@
+package bench
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// iperf3 test states, sent as single signed bytes on the control connection.
+const (
+	iperfTestStart       = 1
+	iperfTestRunning     = 2
+	iperfTestEnd         = 4
+	iperfParamExchange   = 9
+	iperfCreateStreams   = 10
+	iperfExchangeResults = 13
+	iperfDisplayResults  = 14
+	iperfDone            = 16
+	iperfAccessDenied    = 0xff // -1
+)
+
+const (
+	iperfCookieSize = 37
+	iperfMaxJSON    = 64 * 1024
+)
+
+// Iperf3 serves the iperf3 control protocol, so iperf3 clients built with
+// vsock support, and the tooling around them, can test vsock paths. It runs
+// one test at a time over TCP-style streams, in either direction; UDP and
+// bidirectional tests are refused.
+type Iperf3 struct {
+	// Backoff spaces retries after temporary accept errors, such as
+	// EMFILE. Defaults to exponential backoff from 5ms to 1s.
+	Backoff vsock.Backoff
+
+	mutex sync.Mutex
+	test  *iperfTest
+}
+
+type iperfTest struct {
+	cookie    string
+	accepting bool
+	streams   chan net.Conn
+}
+
+type iperfParams struct {
+	TCP           bool `json:"tcp"`
+	UDP           bool `json:"udp"`
+	Parallel      int  `json:"parallel"`
+	Reverse       bool `json:"reverse"`
+	Bidirectional bool `json:"bidirectional"`
+	Len           int  `json:"len"`
+}
+
+type iperfStreamResult struct {
+	ID            int     `json:"id"`
+	Bytes         uint64  `json:"bytes"`
+	Retransmits   int     `json:"retransmits"`
+	Jitter        float64 `json:"jitter"`
+	Errors        int     `json:"errors"`
+	OmittedErrors int     `json:"omitted_errors"`
+	Packets       int     `json:"packets"`
+	StartTime     float64 `json:"start_time"`
+	EndTime       float64 `json:"end_time"`
+}
+
+type iperfResults struct {
+	CPUUtilTotal         float64             `json:"cpu_util_total"`
+	CPUUtilUser          float64             `json:"cpu_util_user"`
+	CPUUtilSystem        float64             `json:"cpu_util_system"`
+	SenderHasRetransmits int                 `json:"sender_has_retransmits"`
+	Streams              []iperfStreamResult `json:"streams"`
+}
+
+// Serve accepts control and data connections of tests on l.
+func (self *Iperf3) Serve(l net.Listener) error {
+	for {
+		conn, err := vsock.AcceptWith(l, vsock.AcceptOptions{Backoff: self.Backoff})
+		if err != nil {
+			return err
+		}
+		go self.handle(conn)
+	}
+}
+
+// handle reads the cookie every connection starts with, and either starts a
+// test or joins the streams of the running one.
+func (self *Iperf3) handle(conn net.Conn) {
+	cookie := make([]byte, iperfCookieSize)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, cookie); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	self.mutex.Lock()
+	test := self.test
+	switch {
+	case test == nil:
+		test = &iperfTest{cookie: string(cookie), streams: make(chan net.Conn, 128)}
+		self.test = test
+		self.mutex.Unlock()
+		self.run(test, conn)
+		self.mutex.Lock()
+		self.test = nil
+		self.mutex.Unlock()
+	case test.accepting && test.cookie == string(cookie):
+		self.mutex.Unlock()
+		select {
+		case test.streams <- conn:
+		default:
+			conn.Close()
+		}
+	default:
+		self.mutex.Unlock()
+		conn.Write([]byte{iperfAccessDenied})
+		conn.Close()
+	}
+}
+
+func (self *Iperf3) run(test *iperfTest, control net.Conn) error {
+	defer control.Close()
+	var streams []net.Conn
+	defer func() {
+		for _, conn := range streams {
+			conn.Close()
+		}
+	}()
+
+	if err := writeState(control, iperfParamExchange); err != nil {
+		return err
+	}
+	var params iperfParams
+	if err := readJSON(control, &params); err != nil {
+		return err
+	}
+	if params.UDP || params.Bidirectional {
+		writeState(control, iperfAccessDenied)
+		return fmt.Errorf("bench: unsupported iperf3 test")
+	}
+	if params.Parallel <= 0 {
+		params.Parallel = 1
+	}
+	if params.Len <= 0 {
+		params.Len = DefaultBlockSize
+	}
+
+	self.mutex.Lock()
+	test.accepting = true
+	self.mutex.Unlock()
+	if err := writeState(control, iperfCreateStreams); err != nil {
+		return err
+	}
+	timeout := time.After(10 * time.Second)
+	for len(streams) < params.Parallel {
+		select {
+		case conn := <-test.streams:
+			streams = append(streams, conn)
+		case <-timeout:
+			return fmt.Errorf("bench: iperf3 client opened %d of %d streams", len(streams), params.Parallel)
+		}
+	}
+	self.mutex.Lock()
+	test.accepting = false
+	self.mutex.Unlock()
+
+	if err := writeState(control, iperfTestStart); err != nil {
+		return err
+	}
+	if err := writeState(control, iperfTestRunning); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	counts := make([]uint64, len(streams))
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, conn := range streams {
+		wg.Add(1)
+		go func(conn net.Conn, count *uint64) {
+			defer wg.Done()
+			block := make([]byte, params.Len)
+			for {
+				var (
+					n   int
+					err error
+				)
+				if params.Reverse {
+					n, err = conn.Write(block)
+				} else {
+					n, err = conn.Read(block)
+				}
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				atomic.AddUint64(count, uint64(n))
+				if err != nil {
+					return
+				}
+			}
+		}(conn, &counts[i])
+	}
+
+	// The client ends the test once its time is up.
+	state, err := readState(control)
+	elapsed := time.Since(start)
+	close(stop)
+	for _, conn := range streams {
+		conn.SetDeadline(time.Now())
+	}
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+	if state != iperfTestEnd {
+		return fmt.Errorf("bench: unexpected iperf3 state %d", int8(state))
+	}
+
+	results := iperfResults{Streams: make([]iperfStreamResult, len(streams))}
+	for i := range streams {
+		results.Streams[i] = iperfStreamResult{
+			ID:          iperfStreamID(i),
+			Bytes:       atomic.LoadUint64(&counts[i]),
+			Retransmits: -1,
+			EndTime:     elapsed.Seconds(),
+		}
+	}
+	if err := writeState(control, iperfExchangeResults); err != nil {
+		return err
+	}
+	var theirs json.RawMessage
+	if err := readJSON(control, &theirs); err != nil {
+		return err
+	}
+	if err := writeJSON(control, results); err != nil {
+		return err
+	}
+	if err := writeState(control, iperfDisplayResults); err != nil {
+		return err
+	}
+	// The client answers with IPERF_DONE, or just goes away.
+	readState(control)
+	return nil
+}
+
+// iperfStreamID numbers streams as iperf3 does: 1, then 3, 4 and so on.
+func iperfStreamID(i int) int {
+	if i == 0 {
+		return 1
+	}
+	return i + 2
+}
+
+func writeState(w io.Writer, state byte) error {
+	_, err := w.Write([]byte{state})
+	return err
+}
+
+func readState(r io.Reader) (byte, error) {
+	var state [1]byte
+	_, err := io.ReadFull(r, state[:])
+	return state[0], err
+}
+
+// JSON messages are prefixed with their length.
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(b)))
+	_, err = w.Write(append(message, b...))
+	return err
+}
+
+func readJSON(r io.Reader, v interface{}) error {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > iperfMaxJSON {
+		return fmt.Errorf("bench: iperf3 message of %d bytes", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
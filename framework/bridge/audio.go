@@ -0,0 +1,95 @@
+package bridge
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+const (
+	// PulsePort is the host vsock port a PulseAudio server is exposed on,
+	// matching the native protocol's TCP port.
+	PulsePort = vsock.PortPulse
+	// PipeWirePort is the host vsock port a PipeWire server is exposed on.
+	PipeWirePort = vsock.PortPipeWire
+)
+
+// Audio is the profile for audio server sockets. Buffers are kept small so
+// that at most a few milliseconds of samples can queue in the kernel, and
+// the traffic is marked interactive so it is not stuck behind bulk
+// transfers sharing the cable.
+var Audio = Profile{
+	Name:         "audio",
+	BufferSize:   4 * 1024,
+	Priority:     6,
+	SocketBuffer: 32 * 1024,
+}
+
+// PulseSocket returns the path of the current PulseAudio native socket.
+func PulseSocket() (string, error) {
+	if server := os.Getenv("PULSE_SERVER"); server != "" {
+		if path := strings.TrimPrefix(server, "unix:"); filepath.IsAbs(path) {
+			return path, nil
+		}
+		return "", fmt.Errorf("bridge: PULSE_SERVER %q is not a local socket", server)
+	}
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		return "", fmt.Errorf("bridge: XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(runtime, "pulse", "native"), nil
+}
+
+// PipeWireSocket returns the path of the current PipeWire socket.
+func PipeWireSocket() (string, error) {
+	remote := os.Getenv("PIPEWIRE_REMOTE")
+	if remote == "" {
+		remote = "pipewire-0"
+	}
+	if filepath.IsAbs(remote) {
+		return remote, nil
+	}
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		return "", fmt.Errorf("bridge: XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(runtime, remote), nil
+}
+
+// HostPulse exposes the host PulseAudio server (or pipewire-pulse) to
+// guests on a vsock port. The ContextIDs of config, which may be nil,
+// restrict which guests may play and record.
+func HostPulse(port uint32, config *vsock.ListenConfig) (*Bridge, error) {
+	path, err := PulseSocket()
+	if err != nil {
+		return nil, err
+	}
+	return hostUnix(port, config, path, Audio)
+}
+
+// GuestPulse creates a PulseAudio socket at path inside the guest that is
+// bridged to the host server. Guest clients must have shared memory
+// disabled (enable-shm = no in client.conf), as memfd pools cannot cross
+// the cable.
+func GuestPulse(path string, port uint32) (*Bridge, error) {
+	return guestUnix(path, port, Audio)
+}
+
+// HostPipeWire exposes the host PipeWire server to guests on a vsock port,
+// listening with config as HostPulse does.
+func HostPipeWire(port uint32, config *vsock.ListenConfig) (*Bridge, error) {
+	path, err := PipeWireSocket()
+	if err != nil {
+		return nil, err
+	}
+	return hostUnix(port, config, path, Audio)
+}
+
+// GuestPipeWire creates a PipeWire socket at path inside the guest that is
+// bridged to the host server.
+func GuestPipeWire(path string, port uint32) (*Bridge, error) {
+	return guestUnix(path, port, Audio)
+}
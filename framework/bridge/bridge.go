@@ -0,0 +1,278 @@
+// Package bridge joins stream sockets on one side of a cable to stream
+// sockets on the other, for forwarding host services such as display or
+// audio servers into guests that have no network.
+package bridge
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Profile tunes how a bridge copies data between its two ends.
+type Profile struct {
+	Name string
+	// BufferSize is the size of the copy buffer in each direction, when
+	// an IdleTimeout is set; otherwise the data is relayed with vsock.Relay.
+	BufferSize int
+	// IdleTimeout closes a bridged connection after no data has moved in
+	// either direction for this long. Zero disables it.
+	IdleTimeout time.Duration
+	// Priority sets SO_PRIORITY on both ends, so the kernel queues this
+	// traffic ahead of bulk transfers. Zero leaves the default.
+	Priority int
+	// SocketBuffer sets SO_SNDBUF and SO_RCVBUF on both ends. Small
+	// buffers bound how much data can queue up, and so the added latency.
+	// Zero leaves the default. Both are applied on linux only.
+	SocketBuffer int
+}
+
+var Default = Profile{
+	Name:       "default",
+	BufferSize: 32 * 1024,
+}
+
+// Bridge accepts connections on Listener and joins each one to a
+// connection opened by Dial.
+type Bridge struct {
+	Listener net.Listener
+	Dial     func() (net.Conn, error)
+	Profile  Profile
+	// Authenticate runs on each accepted connection before Dial, so that
+	// nothing is opened on behalf of a peer it refuses. Returning an error
+	// drops the connection.
+	Authenticate func(client net.Conn) error
+	// Prepare runs after both ends are connected and before data is
+	// copied. It may consume or rewrite the start of either stream, for
+	// instance to replace credentials. Returning an error drops the
+	// connection.
+	Prepare func(client, server net.Conn) error
+	// Pipe replaces Join for protocols that must be inspected in flight.
+	Pipe func(client, server net.Conn) error
+	// Wrap may replace the accepted connection before it is used, for
+	// example to filter ancillary data on Unix sockets.
+	Wrap func(net.Conn) net.Conn
+	// Backoff spaces retries after temporary accept errors, such as
+	// EMFILE. Defaults to exponential backoff from 5ms to 1s.
+	Backoff  vsock.Backoff
+	ErrorLog *log.Logger
+
+	mutex  sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func (self *Bridge) Serve() error {
+	for {
+		client, err := vsock.AcceptWith(self.Listener, vsock.AcceptOptions{Backoff: self.Backoff})
+		if err != nil {
+			if self.isClosed() {
+				return nil
+			}
+			return err
+		}
+		if self.Wrap != nil {
+			client = self.Wrap(client)
+		}
+		go self.handle(client)
+	}
+}
+
+func (self *Bridge) handle(client net.Conn) {
+	defer client.Close()
+	if !self.track(client, true) {
+		return
+	}
+	defer self.track(client, false)
+
+	if self.Authenticate != nil {
+		if err := self.Authenticate(client); err != nil {
+			self.logf("%s: %v", client.RemoteAddr(), err)
+			return
+		}
+	}
+
+	server, err := self.Dial()
+	if err != nil {
+		self.logf("dial: %v", err)
+		return
+	}
+	defer server.Close()
+	if !self.track(server, true) {
+		return
+	}
+	defer self.track(server, false)
+
+	self.Profile.tune(client)
+	self.Profile.tune(server)
+
+	if self.Prepare != nil {
+		if err := self.Prepare(client, server); err != nil {
+			self.logf("%s: %v", client.RemoteAddr(), err)
+			return
+		}
+	}
+
+	pipe := self.Pipe
+	if pipe == nil {
+		pipe = func(client, server net.Conn) error { return Join(client, server, self.Profile) }
+	}
+	if err := pipe(client, server); err != nil {
+		self.logf("%s: %v", client.RemoteAddr(), err)
+	}
+}
+
+// Close stops accepting and closes every bridged connection.
+func (self *Bridge) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	for conn := range self.conns {
+		conn.Close()
+	}
+	self.conns = nil
+	self.mutex.Unlock()
+
+	return self.Listener.Close()
+}
+
+func (self *Bridge) track(conn net.Conn, add bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !add {
+		delete(self.conns, conn)
+		return true
+	}
+	if self.closed {
+		return false
+	}
+	if self.conns == nil {
+		self.conns = make(map[net.Conn]struct{})
+	}
+	self.conns[conn] = struct{}{}
+	return true
+}
+
+func (self *Bridge) isClosed() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.closed
+}
+
+func (self *Bridge) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.New(os.Stderr, "bridge: ", log.LstdFlags).Printf(format, args...)
+}
+
+// tune applies the socket options of the profile. Options a transport does
+// not support are ignored; they are hints, not requirements.
+func (self Profile) tune(conn net.Conn) {
+	if self.Priority == 0 && self.SocketBuffer == 0 {
+		return
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	rc.Control(self.setsockopt)
+}
+
+// Join copies data in both directions until either side is done, then
+// closes both. Half-closes are propagated where the connections support it.
+func Join(a, b net.Conn, profile Profile) error {
+	size := profile.BufferSize
+	if size <= 0 {
+		size = Default.BufferSize
+	}
+
+	var idle *idleTimer
+	if profile.IdleTimeout > 0 {
+		idle = newIdleTimer(profile.IdleTimeout, func() {
+			a.Close()
+			b.Close()
+		})
+		defer idle.stop()
+	}
+
+	errs := make(chan error, 2)
+	pipe := func(dst, src net.Conn) {
+		var err error
+		if idle == nil {
+			// Nothing watches the data, so it may be spliced.
+			_, err = vsock.Relay(dst, src)
+		} else {
+			_, err = io.CopyBuffer(&activity{Writer: dst, idle: idle}, src, make([]byte, size))
+		}
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			dst.Close()
+		}
+		errs <- err
+	}
+	go pipe(a, b)
+	go pipe(b, a)
+
+	err := <-errs
+	if err != nil {
+		// The other direction may be blocked reading; unblock it.
+		a.Close()
+		b.Close()
+	}
+	if err2 := <-errs; err == nil {
+		err = err2
+	}
+	a.Close()
+	b.Close()
+	if isClosedErr(err) {
+		return nil
+	}
+	return err
+}
+
+type activity struct {
+	io.Writer
+	idle *idleTimer
+}
+
+func (self *activity) Write(b []byte) (int, error) {
+	if self.idle != nil {
+		self.idle.reset()
+	}
+	return self.Writer.Write(b)
+}
+
+type idleTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, fn func()) *idleTimer {
+	return &idleTimer{timeout: timeout, timer: time.AfterFunc(timeout, fn)}
+}
+
+func (self *idleTimer) reset() { self.timer.Reset(self.timeout) }
+func (self *idleTimer) stop()  { self.timer.Stop() }
+
+func isClosedErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if nerr, ok := err.(*net.OpError); ok {
+		err = nerr.Err
+	}
+	return err == net.ErrClosed || err == io.EOF || strings.Contains(err.Error(), "use of closed")
+}
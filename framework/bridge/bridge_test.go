@@ -0,0 +1,279 @@
+//go:build linux
+
+package bridge
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+	"golang.org/x/sys/unix"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails Accept with temporary errors a number of times,
+// then as closed.
+type failingListener struct {
+	net.Listener
+	failures int
+}
+
+func (self *failingListener) Accept() (net.Conn, error) {
+	if self.failures > 0 {
+		self.failures--
+		return nil, temporaryError{}
+	}
+	return nil, net.ErrClosed
+}
+
+func TestServeBacksOff(t *testing.T) {
+	var attempts []int
+	b := &Bridge{
+		Listener: &failingListener{failures: 3},
+		Backoff: func(attempt int) time.Duration {
+			attempts = append(attempts, attempt)
+			return time.Millisecond
+		},
+	}
+	if err := b.Serve(); err != net.ErrClosed {
+		t.Fatalf("Serve() = %v, want net.ErrClosed", err)
+	}
+	if diff := cmp.Diff([]int{1, 2, 3}, attempts); diff != "" {
+		t.Fatalf("unexpected retries (-want +got):\n%s", diff)
+	}
+}
+
+func TestAudioSockets(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "/run/user/1000")
+	t.Setenv("PULSE_SERVER", "")
+	t.Setenv("PIPEWIRE_REMOTE", "")
+	pulse, _ := PulseSocket()
+	pipewire, _ := PipeWireSocket()
+	if diff := cmp.Diff([]string{"/run/user/1000/pulse/native", "/run/user/1000/pipewire-0"}, []string{pulse, pipewire}); diff != "" {
+		t.Fatalf("unexpected sockets (-want +got):\n%s", diff)
+	}
+
+	t.Setenv("PULSE_SERVER", "unix:/tmp/pulse.sock")
+	t.Setenv("PIPEWIRE_REMOTE", "/tmp/pipewire.sock")
+	pulse, _ = PulseSocket()
+	pipewire, _ = PipeWireSocket()
+	if diff := cmp.Diff([]string{"/tmp/pulse.sock", "/tmp/pipewire.sock"}, []string{pulse, pipewire}); diff != "" {
+		t.Fatalf("unexpected sockets (-want +got):\n%s", diff)
+	}
+	t.Setenv("PULSE_SERVER", "tcp:localhost:4713")
+	if _, err := PulseSocket(); err == nil {
+		t.Fatal("expected a remote PulseAudio server to be refused")
+	}
+}
+
+func TestAudioTune(t *testing.T) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "audio.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	c, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	Audio.tune(c)
+	rc, _ := c.(*net.UnixConn).SyscallConn()
+	var priority, sndbuf int
+	rc.Control(func(fd uintptr) {
+		priority, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY)
+		sndbuf, _ = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF)
+	})
+	// The kernel doubles buffer sizes to account for its overhead.
+	if diff := cmp.Diff([]int{Audio.Priority, 2 * Audio.SocketBuffer}, []int{priority, sndbuf}); diff != "" {
+		t.Fatalf("unexpected socket options (-want +got):\n%s", diff)
+	}
+}
+
+func TestGuestPulse(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	host, err := network.Machine(vsock.Host).Listen(PulsePort)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer host.Close()
+	go func() {
+		for {
+			c, err := host.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	restore := network.Machine(3).Install()
+	defer restore()
+
+	path := filepath.Join(t.TempDir(), "native")
+	b, err := GuestPulse(path, PulsePort)
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	go b.Serve()
+	defer b.Close()
+
+	c, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// A client passing a descriptor, as for a memfd pool, gets its data
+	// through but the descriptor goes no further than the bridge.
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	if _, _, err := c.WriteMsgUnix([]byte("samples"), unix.UnixRights(int(w.Fd())), nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	w.Close()
+	echo := make([]byte, len("samples"))
+	if _, err := io.ReadFull(c, echo); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("samples", string(echo)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the bridge to close the descriptor passed, read %d: %v", n, err)
+	}
+}
+
+func TestScrubNotSpliced(t *testing.T) {
+	dir := t.TempDir()
+	unixPair := func(name string) (*net.UnixConn, *net.UnixConn) {
+		l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, name), Net: "unix"})
+		if err != nil {
+			t.Fatalf("failed to listen: %v", err)
+		}
+		defer l.Close()
+		c, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		s, err := l.AcceptUnix()
+		if err != nil {
+			t.Fatalf("failed to accept: %v", err)
+		}
+		t.Cleanup(func() { c.Close(); s.Close() })
+		return c, s
+	}
+	client, accepted := unixPair("client")
+	server, peer := unixPair("server")
+
+	warned := make(chan string, 1)
+	conn := scrub(accepted, func(format string, args ...interface{}) {
+		warned <- format
+	})
+	if _, ok := conn.(syscall.Conn); ok {
+		t.Fatal("expected the scrubbed connection to hide its descriptor from vsock.Relay")
+	}
+	// Without an idle timeout Join relays, which splices connections that
+	// expose their descriptors, past Read.
+	go Join(conn, server, Profile{})
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+	defer r.Close()
+	if _, _, err := client.WriteMsgUnix([]byte("frame"), unix.UnixRights(int(w.Fd())), nil); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	w.Close()
+	peer.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len("frame"))
+	if _, err := io.ReadFull(peer, got); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("frame", string(got)); diff != "" {
+		t.Fatalf("unexpected data (-want +got):\n%s", diff)
+	}
+	select {
+	case <-warned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a warning about the descriptor dropped")
+	}
+	r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the bridge to close the descriptor passed, read %d: %v", n, err)
+	}
+}
+
+func TestHostWaylandContextIDs(t *testing.T) {
+	runtime := t.TempDir()
+	t.Setenv("XDG_RUNTIME_DIR", runtime)
+	t.Setenv("WAYLAND_DISPLAY", "wayland-test")
+	compositor, err := net.Listen("unix", filepath.Join(runtime, "wayland-test"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer compositor.Close()
+	go func() {
+		for {
+			c, err := compositor.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+	b, err := HostWayland(WaylandPort, &vsock.ListenConfig{ContextIDs: vsock.CIDRanges{{Min: 3, Max: 3}}})
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	go b.Serve()
+	defer b.Close()
+
+	echo := func(cid uint32) error {
+		c, err := network.Machine(cid).Dial(vsock.Host, WaylandPort)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := c.Write([]byte("hello")); err != nil {
+			return err
+		}
+		_, err = io.ReadFull(c, make([]byte, len("hello")))
+		return err
+	}
+	if err := echo(3); err != nil {
+		t.Fatalf("expected guest 3 to reach the compositor: %v", err)
+	}
+	if err := echo(4); err == nil {
+		t.Fatal("expected guest 4 to be refused")
+	}
+}
@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// ContainerPort is the vsock port a container runtime API is exposed on,
+// matching Docker's unencrypted TCP port.
+const ContainerPort = vsock.PortContainer
+
+const (
+	containerAuth  = "VCABLE-AUTH "
+	containerToken = 32
+	// minContainerToken is the shortest token accepted.
+	minContainerToken = 16
+)
+
+// containerAuthTimeout bounds how long a peer may take to authenticate.
+var containerAuthTimeout = 10 * time.Second
+
+// DockerSocket returns the path of the Docker API socket.
+func DockerSocket() (string, error) {
+	if host := os.Getenv("DOCKER_HOST"); host != "" {
+		if path := strings.TrimPrefix(host, "unix://"); path != host {
+			return path, nil
+		}
+		return "", fmt.Errorf("bridge: DOCKER_HOST %q is not a local socket", host)
+	}
+	return "/var/run/docker.sock", nil
+}
+
+// PodmanSocket returns the path of the Podman API socket, preferring the
+// rootless socket of the current user.
+func PodmanSocket() (string, error) {
+	if runtime := os.Getenv("XDG_RUNTIME_DIR"); runtime != "" && os.Getuid() != 0 {
+		return filepath.Join(runtime, "podman", "podman.sock"), nil
+	}
+	return "/run/podman/podman.sock", nil
+}
+
+// GenerateToken writes a new random token to path, readable only by the
+// current user. Both sides of a container bridge must share it.
+func GenerateToken(path string) ([]byte, error) {
+	token := make([]byte, containerToken)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(token)+"\n"), 0600); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func LoadToken(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	token, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, fmt.Errorf("bridge: %s: %v", path, err)
+	}
+	if len(token) < minContainerToken {
+		return nil, fmt.Errorf("bridge: %s: token too short", path)
+	}
+	return token, nil
+}
+
+// ContainerHost exposes the runtime API socket at path to peers accepted on
+// l. Peers must present token before the socket is even dialed: access to
+// the runtime is equivalent to root on its machine.
+func ContainerHost(l net.Listener, path string, token []byte) (*Bridge, error) {
+	if len(token) < minContainerToken {
+		return nil, fmt.Errorf("bridge: container API token of %d bytes is too short", len(token))
+	}
+	return &Bridge{
+		Listener: l,
+		Dial:     func() (net.Conn, error) { return net.Dial("unix", path) },
+		Profile:  Default,
+		Authenticate: func(client net.Conn) error {
+			client.SetReadDeadline(time.Now().Add(containerAuthTimeout))
+			line, err := readLine(client, len(containerAuth)+2*containerToken+64)
+			client.SetReadDeadline(time.Time{})
+			if err != nil {
+				return fmt.Errorf("bridge: container API authentication: %v", err)
+			}
+			presented, err := hex.DecodeString(strings.TrimPrefix(line, containerAuth))
+			if !strings.HasPrefix(line, containerAuth) || err != nil ||
+				subtle.ConstantTimeCompare(presented, token) != 1 {
+				io.WriteString(client, "DENIED\n")
+				return fmt.Errorf("bridge: container API authentication failed")
+			}
+			_, err = io.WriteString(client, "OK\n")
+			return err
+		},
+	}, nil
+}
+
+// ContainerSocket creates a runtime API socket at path for local clients,
+// such as `docker -H unix://<path>`, relayed to a runtime exposed by
+// ContainerHost on the other side of the cable. Only the current user may
+// connect to it.
+func ContainerSocket(path string, dial func() (net.Conn, error), token []byte) (*Bridge, error) {
+	if len(token) < minContainerToken {
+		return nil, fmt.Errorf("bridge: container API token of %d bytes is too short", len(token))
+	}
+	l, err := listenPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Bridge{
+		Listener: l,
+		Dial:     dial,
+		Profile:  Default,
+		Prepare: func(client, server net.Conn) error {
+			if _, err := io.WriteString(server, containerAuth+hex.EncodeToString(token)+"\n"); err != nil {
+				return err
+			}
+			line, err := readLine(server, 64)
+			if err == nil && line == "OK" {
+				return nil
+			}
+			// Answer in HTTP so the runtime client shows a useful error.
+			const body = "vcable: container API authentication failed\n"
+			fmt.Fprintf(client, "HTTP/1.1 401 Unauthorized\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", len(body), body)
+			return fmt.Errorf("bridge: container API authentication failed: %q", line)
+		},
+	}, nil
+}
+
+// readLine reads up to a newline one byte at a time, so nothing after the
+// line is consumed from the connection.
+func readLine(r io.Reader, max int) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for len(line) <= max {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+	return "", fmt.Errorf("bridge: line exceeds %d bytes", max)
+}
@@ -0,0 +1,158 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// runtime serves a fake container runtime API at a socket in dir, which
+// greets every connection, and counts the connections.
+func runtime(t *testing.T, dir string) (string, *int64) {
+	path := filepath.Join(dir, "runtime.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	var dialed int64
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&dialed, 1)
+			io.WriteString(c, "runtime\n")
+			c.Close()
+		}
+	}()
+	return path, &dialed
+}
+
+func TestContainerHostToken(t *testing.T) {
+	for _, token := range [][]byte{nil, {}, []byte("short")} {
+		if _, err := ContainerHost(nil, "runtime.sock", token); err == nil {
+			t.Fatalf("expected a token of %d bytes to be refused", len(token))
+		}
+		if _, err := ContainerSocket("container.sock", nil, token); err == nil {
+			t.Fatalf("expected a token of %d bytes to be refused", len(token))
+		}
+	}
+}
+
+func TestContainerHostAuthenticate(t *testing.T) {
+	defer func(timeout time.Duration) { containerAuthTimeout = timeout }(containerAuthTimeout)
+	containerAuthTimeout = 50 * time.Millisecond
+
+	dir := t.TempDir()
+	path, dialed := runtime(t, dir)
+	token := bytes.Repeat([]byte{0x5a}, containerToken)
+	l, err := net.Listen("unix", filepath.Join(dir, "host.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	host, err := ContainerHost(l, path, token)
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	host.ErrorLog = log.New(io.Discard, "", 0)
+	go host.Serve()
+	defer host.Close()
+
+	// session sends line, unless empty, and returns all the host answers.
+	session := func(line string) string {
+		c, err := net.Dial("unix", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		if line != "" {
+			io.WriteString(c, line)
+		}
+		b, _ := io.ReadAll(c)
+		return string(b)
+	}
+
+	wrong := hex.EncodeToString(bytes.Repeat([]byte{0xa5}, containerToken))
+	tests := map[string]string{
+		"wrong token":       containerAuth + wrong + "\n",
+		"empty token":       containerAuth + "\n",
+		"missing auth line": "GET /_ping HTTP/1.1\r\n",
+	}
+	for name, line := range tests {
+		if diff := cmp.Diff("DENIED\n", session(line)); diff != "" {
+			t.Fatalf("%s: unexpected answer (-want +got):\n%s", name, diff)
+		}
+	}
+	// A silent peer is dropped once the authentication times out.
+	if diff := cmp.Diff("", session("")); diff != "" {
+		t.Fatalf("silent peer: unexpected answer (-want +got):\n%s", diff)
+	}
+	if n := atomic.LoadInt64(dialed); n != 0 {
+		t.Fatalf("runtime dialed %d times for peers that did not authenticate", n)
+	}
+
+	if diff := cmp.Diff("OK\nruntime\n", session(containerAuth+hex.EncodeToString(token)+"\n")); diff != "" {
+		t.Fatalf("unexpected answer (-want +got):\n%s", diff)
+	}
+}
+
+func TestContainerSocket(t *testing.T) {
+	dir := t.TempDir()
+	path, _ := runtime(t, dir)
+	token := bytes.Repeat([]byte{0x5a}, containerToken)
+	l, err := net.Listen("unix", filepath.Join(dir, "host.sock"))
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	host, err := ContainerHost(l, path, token)
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	go host.Serve()
+	defer host.Close()
+
+	socket := filepath.Join(dir, "container.sock")
+	guest, err := ContainerSocket(socket, func() (net.Conn, error) {
+		return net.Dial("unix", l.Addr().String())
+	}, token)
+	if err != nil {
+		t.Fatalf("failed to create bridge: %v", err)
+	}
+	go guest.Serve()
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if diff := cmp.Diff(os.ModeSocket|0600, info.Mode()); diff != "" {
+		t.Fatalf("unexpected socket mode (-want +got):\n%s", diff)
+	}
+
+	c, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	b, _ := io.ReadAll(c)
+	c.Close()
+	if diff := cmp.Diff("runtime\n", string(b)); diff != "" {
+		t.Fatalf("unexpected answer (-want +got):\n%s", diff)
+	}
+
+	guest.Close()
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Fatalf("expected Close to remove the socket, got %v", err)
+	}
+}
@@ -0,0 +1,593 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// DBusPort is the vsock port a filtered D-Bus bus is exposed on.
+const DBusPort = vsock.PortDBus
+
+const (
+	dbusMethodCall   = 1
+	dbusMethodReturn = 2
+	dbusError        = 3
+	dbusSignal       = 4
+
+	dbusNoReplyExpected = 0x1
+
+	dbusFieldPath        = 1
+	dbusFieldInterface   = 2
+	dbusFieldMember      = 3
+	dbusFieldErrorName   = 4
+	dbusFieldReplySerial = 5
+	dbusFieldDestination = 6
+	dbusFieldSender      = 7
+	dbusFieldSignature   = 8
+	dbusFieldUnixFDs     = 9
+
+	dbusMaxMessage = 128 << 20
+	dbusMaxLine    = 16 << 10
+
+	dbusBusName      = "org.freedesktop.DBus"
+	dbusAccessDenied = "org.freedesktop.DBus.Error.AccessDenied"
+)
+
+// DBusRule matches messages by their header fields. Empty fields match
+// anything, and a Path ending in "/*" matches that subtree.
+type DBusRule struct {
+	Destination string `json:"destination,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Interface   string `json:"interface,omitempty"`
+	Member      string `json:"member,omitempty"`
+}
+
+func (self DBusRule) match(m *dbusMessage) bool {
+	if self.Destination != "" && self.Destination != m.destination {
+		return false
+	}
+	if self.Interface != "" && self.Interface != m.iface {
+		return false
+	}
+	if self.Member != "" && self.Member != m.member {
+		return false
+	}
+	if strings.HasSuffix(self.Path, "/*") {
+		prefix := strings.TrimSuffix(self.Path, "*")
+		return m.path == strings.TrimSuffix(prefix, "/") || strings.HasPrefix(m.path, prefix)
+	}
+	return self.Path == "" || self.Path == m.path
+}
+
+// DBusPolicy is the allowlist a D-Bus bridge enforces. The client is the
+// side of the bridge without the bus: guests when a host bus is exposed,
+// the host when a guest bus is exposed. Anything not listed is denied.
+type DBusPolicy struct {
+	// Calls are the methods the client may call on the bus.
+	Calls []DBusRule `json:"calls"`
+	// Exports are the methods bus peers may call on objects the client
+	// exports.
+	Exports []DBusRule `json:"exports"`
+	// Signals are the signals delivered in either direction.
+	Signals []DBusRule `json:"signals"`
+}
+
+func LoadDBusPolicy(path string) (*DBusPolicy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy DBusPolicy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("bridge: %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+func matchAny(rules []DBusRule, m *dbusMessage) bool {
+	for _, rule := range rules {
+		if rule.match(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// SessionBus returns the path of the current session bus socket.
+func SessionBus() (string, error) {
+	if address := os.Getenv("DBUS_SESSION_BUS_ADDRESS"); address != "" {
+		for _, entry := range strings.Split(address, ";") {
+			if !strings.HasPrefix(entry, "unix:") {
+				continue
+			}
+			for _, kv := range strings.Split(strings.TrimPrefix(entry, "unix:"), ",") {
+				if path := strings.TrimPrefix(kv, "path="); path != kv {
+					return path, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("bridge: no unix path in DBUS_SESSION_BUS_ADDRESS %q", address)
+	}
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		return "", fmt.Errorf("bridge: XDG_RUNTIME_DIR is not set")
+	}
+	return runtime + "/bus", nil
+}
+
+// HostDBus exposes the host session bus to guests on a vsock port,
+// filtered by policy.
+func HostDBus(port uint32, policy *DBusPolicy) (*Bridge, error) {
+	bus, err := SessionBus()
+	if err != nil {
+		return nil, err
+	}
+	l, err := vsock.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return ServeDBus(l, bus, policy), nil
+}
+
+// ServeDBus exposes the bus at path to clients accepted on l, filtered by
+// policy. Run in a guest it exposes the guest bus to the host.
+func ServeDBus(l net.Listener, path string, policy *DBusPolicy) *Bridge {
+	return &Bridge{
+		Listener: l,
+		Dial:     func() (net.Conn, error) { return net.Dial("unix", path) },
+		Profile:  Default,
+		Pipe: func(client, bus net.Conn) error {
+			return FilterDBus(client, bus, policy)
+		},
+	}
+}
+
+// DBusSocket creates a bus socket at path for local applications, bridged
+// to a filtered bus on the other side of the cable.
+func DBusSocket(path string, dial func() (net.Conn, error)) (*Bridge, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &Bridge{
+		Listener: l,
+		Dial:     dial,
+		Profile:  Default,
+	}, nil
+}
+
+// FilterDBus authenticates to the bus as this process, accepts the client's
+// authentication in its place, then relays only the messages policy allows.
+// Denied method calls are answered with an AccessDenied error. File
+// descriptor passing is refused, as descriptors cannot cross a cable.
+func FilterDBus(client, bus net.Conn, policy *DBusPolicy) error {
+	defer client.Close()
+	defer bus.Close()
+
+	br := bufio.NewReader(bus)
+	guid, err := dbusAuthenticate(bus, br)
+	if err != nil {
+		return err
+	}
+	cr := bufio.NewReader(client)
+	if err := dbusAccept(client, cr, guid); err != nil {
+		return err
+	}
+
+	f := &dbusFilter{
+		policy:   policy,
+		client:   &lockedWriter{w: client},
+		bus:      &lockedWriter{w: bus},
+		toBus:    make(map[uint32]struct{}),
+		toClient: make(map[string]struct{}),
+		serial:   1 << 31,
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- f.fromClient(cr); client.Close(); bus.Close() }()
+	go func() { errs <- f.fromBus(br); client.Close(); bus.Close() }()
+
+	err = <-errs
+	<-errs
+	if isClosedErr(err) {
+		return nil
+	}
+	return err
+}
+
+type lockedWriter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+func (self *lockedWriter) Write(b []byte) (int, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.w.Write(b)
+}
+
+type dbusFilter struct {
+	policy *DBusPolicy
+	client io.Writer
+	bus    io.Writer
+
+	mutex sync.Mutex
+	// toBus holds the serials of calls the client is awaiting replies to,
+	// toClient the sender and serial of calls made on the client.
+	toBus    map[uint32]struct{}
+	toClient map[string]struct{}
+	serial   uint32
+}
+
+func (self *dbusFilter) fromClient(r *bufio.Reader) error {
+	for {
+		m, err := readDBusMessage(r)
+		if err != nil {
+			return err
+		}
+
+		var allowed bool
+		switch m.typ {
+		case dbusMethodCall:
+			allowed = m.unixFDs == 0 && (dbusBusMethod(m) || matchAny(self.policy.Calls, m))
+			if allowed && m.flags&dbusNoReplyExpected == 0 {
+				self.mutex.Lock()
+				self.toBus[m.serial] = struct{}{}
+				self.mutex.Unlock()
+			}
+			if !allowed && m.flags&dbusNoReplyExpected == 0 {
+				if _, err := self.client.Write(self.denied(m, "")); err != nil {
+					return err
+				}
+			}
+		case dbusMethodReturn, dbusError:
+			key := m.destination + "/" + strconv.FormatUint(uint64(m.replySerial), 10)
+			self.mutex.Lock()
+			_, allowed = self.toClient[key]
+			delete(self.toClient, key)
+			self.mutex.Unlock()
+		case dbusSignal:
+			allowed = m.unixFDs == 0 && matchAny(self.policy.Signals, m)
+		}
+
+		if allowed {
+			if _, err := self.bus.Write(m.raw); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (self *dbusFilter) fromBus(r *bufio.Reader) error {
+	for {
+		m, err := readDBusMessage(r)
+		if err != nil {
+			return err
+		}
+
+		var allowed bool
+		switch m.typ {
+		case dbusMethodCall:
+			allowed = m.unixFDs == 0 && matchAny(self.policy.Exports, m)
+			if allowed && m.flags&dbusNoReplyExpected == 0 {
+				self.mutex.Lock()
+				self.toClient[m.sender+"/"+strconv.FormatUint(uint64(m.serial), 10)] = struct{}{}
+				self.mutex.Unlock()
+			}
+			if !allowed && m.flags&dbusNoReplyExpected == 0 {
+				if _, err := self.bus.Write(self.denied(m, m.sender)); err != nil {
+					return err
+				}
+			}
+		case dbusMethodReturn, dbusError:
+			self.mutex.Lock()
+			_, allowed = self.toBus[m.replySerial]
+			delete(self.toBus, m.replySerial)
+			self.mutex.Unlock()
+			allowed = allowed && m.unixFDs == 0
+		case dbusSignal:
+			allowed = m.unixFDs == 0 && (dbusBusSignal(m) || matchAny(self.policy.Signals, m))
+		}
+
+		if allowed {
+			if _, err := self.client.Write(m.raw); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (self *dbusFilter) denied(m *dbusMessage, destination string) []byte {
+	self.mutex.Lock()
+	self.serial++
+	serial := self.serial
+	self.mutex.Unlock()
+
+	reason := fmt.Sprintf("%s.%s on %s is not allowed across the cable", m.iface, m.member, m.path)
+	return dbusErrorMessage(serial, m.serial, destination, dbusAccessDenied, reason)
+}
+
+// dbusBusMethod reports whether m is one of the message bus methods every
+// client needs to connect and subscribe to the signals policy lets through.
+func dbusBusMethod(m *dbusMessage) bool {
+	if m.destination != dbusBusName || (m.iface != "" && m.iface != dbusBusName) {
+		return false
+	}
+	switch m.member {
+	case "Hello", "AddMatch", "RemoveMatch", "GetNameOwner":
+		return true
+	}
+	return false
+}
+
+// dbusBusSignal reports whether m is a signal the bus sends about the
+// client's own names.
+func dbusBusSignal(m *dbusMessage) bool {
+	return m.sender == dbusBusName && (m.member == "NameAcquired" || m.member == "NameLost")
+}
+
+// dbusAuthenticate performs the SASL handshake with the bus as the current
+// user, and returns the bus GUID.
+func dbusAuthenticate(bus io.Writer, r *bufio.Reader) (string, error) {
+	uid := hex.EncodeToString([]byte(strconv.Itoa(os.Getuid())))
+	if _, err := io.WriteString(bus, "\x00AUTH EXTERNAL "+uid+"\r\n"); err != nil {
+		return "", err
+	}
+	line, err := dbusReadLine(r)
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		return "", fmt.Errorf("bridge: bus rejected authentication: %q", line)
+	}
+	if _, err := io.WriteString(bus, "BEGIN\r\n"); err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(line, "OK "), nil
+}
+
+// dbusAccept performs the server side of the SASL handshake. Any EXTERNAL
+// or ANONYMOUS identity is accepted: the client is authenticated by the
+// cable it arrived on, and its claimed identity means nothing to this bus.
+func dbusAccept(client io.Writer, r *bufio.Reader, guid string) error {
+	nul, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if nul != 0 {
+		return fmt.Errorf("bridge: D-Bus client did not send credentials byte")
+	}
+
+	const rejected = "REJECTED EXTERNAL ANONYMOUS"
+	var authed, data bool
+	for i := 0; i < 64; i++ {
+		line, err := dbusReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		var reply string
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			reply = "ERROR"
+		case fields[0] == "AUTH" && len(fields) == 2 && fields[1] == "EXTERNAL":
+			reply, data = "DATA", true
+		case fields[0] == "AUTH" && len(fields) == 3 && (fields[1] == "EXTERNAL" || fields[1] == "ANONYMOUS"),
+			fields[0] == "AUTH" && len(fields) == 2 && fields[1] == "ANONYMOUS",
+			fields[0] == "DATA" && data:
+			reply, authed = "OK "+guid, true
+		case fields[0] == "AUTH", fields[0] == "CANCEL":
+			reply, data = rejected, false
+		case fields[0] == "NEGOTIATE_UNIX_FD":
+			reply = `ERROR "file descriptors cannot cross the cable"`
+		case fields[0] == "BEGIN" && authed:
+			return nil
+		default:
+			reply = "ERROR"
+		}
+		if _, err := io.WriteString(client, reply+"\r\n"); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("bridge: D-Bus client did not complete authentication")
+}
+
+func dbusReadLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, prefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > dbusMaxLine {
+			return "", fmt.Errorf("bridge: D-Bus authentication line too long")
+		}
+		if !prefix {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+	}
+}
+
+type dbusMessage struct {
+	raw    []byte
+	typ    byte
+	flags  byte
+	serial uint32
+
+	path        string
+	iface       string
+	member      string
+	errorName   string
+	destination string
+	sender      string
+	signature   string
+	replySerial uint32
+	unixFDs     uint32
+}
+
+func readDBusMessage(r io.Reader) (*dbusMessage, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'l':
+		order = binary.LittleEndian
+	case 'B':
+		order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("bridge: invalid D-Bus byte order %#x", header[0])
+	}
+
+	bodyLen, fieldsLen := order.Uint32(header[4:]), order.Uint32(header[12:])
+	total := uint64(align(16+int(fieldsLen), 8)) + uint64(bodyLen)
+	if fieldsLen > dbusMaxMessage || total > dbusMaxMessage {
+		return nil, fmt.Errorf("bridge: D-Bus message of %d bytes exceeds limit", total)
+	}
+
+	raw := make([]byte, total)
+	copy(raw, header)
+	if _, err := io.ReadFull(r, raw[16:]); err != nil {
+		return nil, err
+	}
+
+	m := &dbusMessage{
+		raw:    raw,
+		typ:    header[1],
+		flags:  header[2],
+		serial: order.Uint32(header[8:]),
+	}
+	if err := m.parseFields(order, 16+int(fieldsLen)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (self *dbusMessage) parseFields(order binary.ByteOrder, end int) error {
+	raw := self.raw
+	short := fmt.Errorf("bridge: truncated D-Bus header field")
+
+	for pos := 16; ; {
+		pos = align(pos, 8)
+		if pos >= end {
+			return nil
+		}
+		if pos+2 > end {
+			return short
+		}
+		code, sigLen := raw[pos], int(raw[pos+1])
+		if pos+2+sigLen+1 > end {
+			return short
+		}
+		signature := string(raw[pos+2 : pos+2+sigLen])
+		pos += 2 + sigLen + 1
+
+		switch signature {
+		case "s", "o":
+			pos = align(pos, 4)
+			if pos+4 > end {
+				return short
+			}
+			n := int(order.Uint32(raw[pos:]))
+			if n < 0 || pos+4+n+1 > end {
+				return short
+			}
+			value := string(raw[pos+4 : pos+4+n])
+			pos += 4 + n + 1
+			switch code {
+			case dbusFieldPath:
+				self.path = value
+			case dbusFieldInterface:
+				self.iface = value
+			case dbusFieldMember:
+				self.member = value
+			case dbusFieldErrorName:
+				self.errorName = value
+			case dbusFieldDestination:
+				self.destination = value
+			case dbusFieldSender:
+				self.sender = value
+			}
+		case "g":
+			if pos+1 > end {
+				return short
+			}
+			n := int(raw[pos])
+			if pos+1+n+1 > end {
+				return short
+			}
+			if code == dbusFieldSignature {
+				self.signature = string(raw[pos+1 : pos+1+n])
+			}
+			pos += 1 + n + 1
+		case "u":
+			pos = align(pos, 4)
+			if pos+4 > end {
+				return short
+			}
+			value := order.Uint32(raw[pos:])
+			pos += 4
+			switch code {
+			case dbusFieldReplySerial:
+				self.replySerial = value
+			case dbusFieldUnixFDs:
+				self.unixFDs = value
+			}
+		default:
+			return fmt.Errorf("bridge: unsupported D-Bus header field type %q", signature)
+		}
+	}
+}
+
+// dbusErrorMessage encodes an error reply carrying a single string.
+func dbusErrorMessage(serial, replySerial uint32, destination, name, text string) []byte {
+	order := binary.LittleEndian
+	b := []byte{'l', dbusError, dbusNoReplyExpected, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	order.PutUint32(b[8:], serial)
+
+	field := func(code byte, signature byte) {
+		b = append(b, make([]byte, align(len(b), 8)-len(b))...)
+		b = append(b, code, 1, signature, 0)
+	}
+	str := func(s string) {
+		b = append(b, make([]byte, align(len(b), 4)-len(b))...)
+		b = order.AppendUint32(b, uint32(len(s)))
+		b = append(append(b, s...), 0)
+	}
+
+	field(dbusFieldErrorName, 's')
+	str(name)
+	field(dbusFieldReplySerial, 'u')
+	b = order.AppendUint32(b, replySerial)
+	if destination != "" {
+		field(dbusFieldDestination, 's')
+		str(destination)
+	}
+	field(dbusFieldSignature, 'g')
+	b = append(b, 1, 's', 0)
+	order.PutUint32(b[12:], uint32(len(b)-16))
+
+	b = append(b, make([]byte, align(len(b), 8)-len(b))...)
+	body := len(b)
+	str(text)
+	order.PutUint32(b[4:], uint32(len(b)-body))
+	return b
+}
+
+func align(n, to int) int { return (n + to - 1) &^ (to - 1) }
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDBusErrorMessageRoundTrip(t *testing.T) {
+	raw := dbusErrorMessage(7, 3, ":1.42", dbusAccessDenied, "denied")
+
+	m, err := readDBusMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("failed to read message: %v", err)
+	}
+
+	got := []interface{}{m.typ, m.serial, m.replySerial, m.destination, m.errorName, m.signature}
+	want := []interface{}{byte(dbusError), uint32(7), uint32(3), ":1.42", dbusAccessDenied, "s"}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected message fields (-want +got):\n%s", diff)
+	}
+}
+
+func TestDBusRuleMatch(t *testing.T) {
+	m := &dbusMessage{
+		destination: "org.freedesktop.Notifications",
+		path:        "/org/freedesktop/Notifications",
+		iface:       "org.freedesktop.Notifications",
+		member:      "Notify",
+	}
+
+	tests := []struct {
+		rule DBusRule
+		want bool
+	}{
+		{rule: DBusRule{}, want: true},
+		{rule: DBusRule{Destination: "org.freedesktop.Notifications"}, want: true},
+		{rule: DBusRule{Path: "/org/freedesktop/*"}, want: true},
+		{rule: DBusRule{Path: "/org/freedesktop/Notifications/*"}, want: true},
+		{rule: DBusRule{Path: "/org/gnome/*"}, want: false},
+		{rule: DBusRule{Interface: "org.freedesktop.Notifications", Member: "CloseNotification"}, want: false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.rule.match(m); got != tt.want {
+			t.Fatalf("%+v: want match %t, got %t", tt.rule, tt.want, got)
+		}
+	}
+}
+
+func TestFilterDBusDeniesCall(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	bus, busEnd := net.Pipe()
+	defer client.Close()
+	defer bus.Close()
+
+	policy := &DBusPolicy{
+		Calls: []DBusRule{{Destination: "org.example.Allowed"}},
+	}
+	go FilterDBus(clientEnd, busEnd, policy)
+
+	// Fake bus: accept authentication, then echo nothing.
+	go func() {
+		r := bufio.NewReader(bus)
+		r.ReadString('\n')
+		io.WriteString(bus, "OK 0123456789abcdef0123456789abcdef\r\n")
+		r.ReadString('\n')
+		io.Copy(io.Discard, r)
+	}()
+
+	r := bufio.NewReader(client)
+	io.WriteString(client, "\x00AUTH EXTERNAL 31303030\r\n")
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "OK ") {
+		t.Fatalf("unexpected authentication reply: %q", line)
+	}
+	io.WriteString(client, "BEGIN\r\n")
+
+	if _, err := client.Write(testDBusCall(5, "org.example.Denied", "/", "org.example.Denied", "Do")); err != nil {
+		t.Fatalf("failed to write call: %v", err)
+	}
+
+	m, err := readDBusMessage(r)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if m.typ != dbusError || m.replySerial != 5 || m.errorName != dbusAccessDenied {
+		t.Fatalf("expected AccessDenied reply to serial 5, got type %d reply %d %q", m.typ, m.replySerial, m.errorName)
+	}
+}
+
+func testDBusCall(serial uint32, destination, path, iface, member string) []byte {
+	order := binary.LittleEndian
+	b := []byte{'l', dbusMethodCall, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	order.PutUint32(b[8:], serial)
+
+	field := func(code, signature byte, value string) {
+		b = append(b, make([]byte, align(len(b), 8)-len(b))...)
+		b = append(b, code, 1, signature, 0)
+		b = append(b, make([]byte, align(len(b), 4)-len(b))...)
+		b = order.AppendUint32(b, uint32(len(value)))
+		b = append(append(b, value...), 0)
+	}
+	field(dbusFieldPath, 'o', path)
+	field(dbusFieldInterface, 's', iface)
+	field(dbusFieldMember, 's', member)
+	field(dbusFieldDestination, 's', destination)
+	order.PutUint32(b[12:], uint32(len(b)-16))
+	return append(b, make([]byte, align(len(b), 8)-len(b))...)
+}
@@ -0,0 +1,230 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+const (
+	// WaylandPort is the host vsock port a Wayland compositor is exposed on.
+	WaylandPort = vsock.PortWayland
+	// X11Port is the host vsock port of X display :0; display :n is exposed
+	// on X11Port+n, mirroring the X11 TCP convention.
+	X11Port = vsock.PortX11
+
+	x11Auth = "MIT-MAGIC-COOKIE-1"
+)
+
+// Display is the profile for interactive display protocols: small requests
+// that must not be held back, and generous buffers for image uploads.
+var Display = Profile{
+	Name:       "display",
+	BufferSize: 256 * 1024,
+}
+
+// DisplayEnv lists environment variables that steer common toolkits away
+// from shared memory transports, which require passing file descriptors and
+// so cannot cross a cable. Wayland has no such fallback: clients that need
+// wl_shm buffers must be run through a protocol-aware proxy like waypipe.
+var DisplayEnv = []string{
+	"QT_X11_NO_MITSHM=1",
+	"_X11_NO_MITSHM=1",
+	"_MITSHM=0",
+}
+
+// WaylandSocket returns the path of the current Wayland compositor socket.
+func WaylandSocket() (string, error) {
+	display := os.Getenv("WAYLAND_DISPLAY")
+	if display == "" {
+		display = "wayland-0"
+	}
+	if filepath.IsAbs(display) {
+		return display, nil
+	}
+	runtime := os.Getenv("XDG_RUNTIME_DIR")
+	if runtime == "" {
+		return "", fmt.Errorf("bridge: XDG_RUNTIME_DIR is not set")
+	}
+	return filepath.Join(runtime, display), nil
+}
+
+// X11Display parses a display name such as ":0" or ":1.0" into its number.
+func X11Display(display string) (int, error) {
+	if display == "" {
+		display = os.Getenv("DISPLAY")
+	}
+	i := strings.LastIndexByte(display, ':')
+	if i < 0 {
+		return 0, fmt.Errorf("bridge: invalid X11 display %q", display)
+	}
+	if i > 0 && display[:i] != "unix" {
+		return 0, fmt.Errorf("bridge: X11 display %q is not local", display)
+	}
+	number := display[i+1:]
+	if dot := strings.IndexByte(number, '.'); dot >= 0 {
+		number = number[:dot]
+	}
+	n, err := strconv.Atoi(number)
+	if err != nil {
+		return 0, fmt.Errorf("bridge: invalid X11 display %q", display)
+	}
+	return n, nil
+}
+
+func X11Socket(display int) string { return fmt.Sprintf("/tmp/.X11-unix/X%d", display) }
+
+// HostWayland exposes the host compositor to guests on a vsock port. The
+// ContextIDs of config, which may be nil, restrict which guests may use it.
+func HostWayland(port uint32, config *vsock.ListenConfig) (*Bridge, error) {
+	path, err := WaylandSocket()
+	if err != nil {
+		return nil, err
+	}
+	return hostUnix(port, config, path, Display)
+}
+
+// GuestWayland creates a Wayland socket at path inside the guest that is
+// bridged to the host compositor.
+func GuestWayland(path string, port uint32) (*Bridge, error) {
+	return guestUnix(path, port, Display)
+}
+
+// HostX11 exposes an X display to guests on a vsock port. Whatever
+// credentials a guest client presents are discarded and replaced with the
+// host's cookie for the display, so guest credentials never reach the
+// server and host credentials never reach the guest. As every guest allowed
+// to connect gets the display, set the ContextIDs of config to those that
+// may; a nil config admits all.
+func HostX11(port uint32, config *vsock.ListenConfig, display int, xauthority string) (*Bridge, error) {
+	cookie, err := ReadXauthority(xauthority, display)
+	if err != nil {
+		return nil, err
+	}
+	l, err := listen(port, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Bridge{
+		Listener: l,
+		Dial:     func() (net.Conn, error) { return net.Dial("unix", X11Socket(display)) },
+		Profile:  Display,
+		Prepare: func(client, server net.Conn) error {
+			return RewriteX11Setup(server, client, cookie)
+		},
+	}, nil
+}
+
+// GuestX11 creates the socket for X display :display inside the guest,
+// bridged to the host.
+func GuestX11(display int, port uint32) (*Bridge, error) {
+	if err := os.MkdirAll("/tmp/.X11-unix", 01777); err != nil {
+		return nil, err
+	}
+	return guestUnix(X11Socket(display), port, Display)
+}
+
+// RewriteX11Setup reads the connection setup request sent by an X11 client
+// and forwards it to the server with its authorization replaced by an
+// MIT-MAGIC-COOKIE-1 cookie, or with no authorization if cookie is nil.
+func RewriteX11Setup(server io.Writer, client io.Reader, cookie []byte) error {
+	var header [12]byte
+	if _, err := io.ReadFull(client, header[:]); err != nil {
+		return err
+	}
+
+	var order binary.ByteOrder
+	switch header[0] {
+	case 'B':
+		order = binary.BigEndian
+	case 'l':
+		order = binary.LittleEndian
+	default:
+		return fmt.Errorf("bridge: invalid X11 byte order %#x", header[0])
+	}
+
+	nameLen, dataLen := int(order.Uint16(header[6:])), int(order.Uint16(header[8:]))
+	if _, err := io.CopyN(io.Discard, client, int64(pad(nameLen)+pad(dataLen))); err != nil {
+		return err
+	}
+
+	name := []byte(x11Auth)
+	if cookie == nil {
+		name = nil
+	}
+	order.PutUint16(header[6:], uint16(len(name)))
+	order.PutUint16(header[8:], uint16(len(cookie)))
+
+	setup := make([]byte, 0, len(header)+pad(len(name))+pad(len(cookie)))
+	setup = append(setup, header[:]...)
+	setup = append(setup, name...)
+	setup = append(setup, make([]byte, pad(len(name))-len(name))...)
+	setup = append(setup, cookie...)
+	setup = append(setup, make([]byte, pad(len(cookie))-len(cookie))...)
+
+	_, err := server.Write(setup)
+	return err
+}
+
+func pad(n int) int { return (n + 3) &^ 3 }
+
+// ReadXauthority returns the MIT-MAGIC-COOKIE-1 for a local display from an
+// Xauthority file. An empty path uses $XAUTHORITY or ~/.Xauthority. A
+// missing file or entry yields a nil cookie, for servers without access
+// control.
+func ReadXauthority(path string, display int) ([]byte, error) {
+	if path == "" {
+		path = os.Getenv("XAUTHORITY")
+	}
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(home, ".Xauthority")
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	number := strconv.Itoa(display)
+	for {
+		var family uint16
+		if err := binary.Read(r, binary.BigEndian, &family); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		var fields [4][]byte
+		for i := range fields {
+			var length uint16
+			if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+				return nil, fmt.Errorf("bridge: truncated Xauthority entry: %v", err)
+			}
+			fields[i] = make([]byte, length)
+			if _, err := io.ReadFull(r, fields[i]); err != nil {
+				return nil, fmt.Errorf("bridge: truncated Xauthority entry: %v", err)
+			}
+		}
+
+		// fields: address, display number, auth name, auth data.
+		if string(fields[1]) == number && string(fields[2]) == x11Auth {
+			return fields[3], nil
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package bridge
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRewriteX11Setup(t *testing.T) {
+	// Little-endian setup request for protocol 11.0 carrying a guest
+	// credential that must not reach the server.
+	client := []byte{
+		'l', 0, 11, 0, 0, 0, 18, 0, 5, 0, 0, 0,
+	}
+	client = append(client, []byte("MIT-MAGIC-COOKIE-1\x00\x00")...)
+	client = append(client, []byte("guest\x00\x00\x00")...)
+
+	cookie := []byte("0123456789abcdef")
+
+	var server bytes.Buffer
+	if err := RewriteX11Setup(&server, bytes.NewReader(client), cookie); err != nil {
+		t.Fatalf("failed to rewrite setup: %v", err)
+	}
+
+	want := []byte{
+		'l', 0, 11, 0, 0, 0, 18, 0, 16, 0, 0, 0,
+	}
+	want = append(want, []byte("MIT-MAGIC-COOKIE-1\x00\x00")...)
+	want = append(want, cookie...)
+
+	if diff := cmp.Diff(want, server.Bytes()); diff != "" {
+		t.Fatalf("unexpected setup request (-want +got):\n%s", diff)
+	}
+}
+
+func TestX11Display(t *testing.T) {
+	tests := []struct {
+		display string
+		want    int
+		ok      bool
+	}{
+		{display: ":0", want: 0, ok: true},
+		{display: ":1.0", want: 1, ok: true},
+		{display: "unix:2", want: 2, ok: true},
+		{display: "remote:0"},
+		{display: "0"},
+	}
+
+	for _, tt := range tests {
+		got, err := X11Display(tt.display)
+		if tt.ok != (err == nil) {
+			t.Fatalf("%q: unexpected error: %v", tt.display, err)
+		}
+		if got != tt.want {
+			t.Fatalf("%q: want display %d, got %d", tt.display, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package bridge
+
+import (
+	"log"
+	"net"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// scrub wraps the Unix socket conn in a scrubConn.
+func scrub(conn net.Conn, logf func(format string, args ...interface{})) net.Conn {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return conn
+	}
+	return &scrubConn{Conn: uc, uc: uc, logf: logf}
+}
+
+// scrubConn reads from a Unix socket and closes any file descriptors the
+// client passes, which cannot be forwarded over a cable and would otherwise
+// leak into the bridge process. It hides the socket's SyscallConn, so
+// vsock.Relay copies through Read rather than splicing past it.
+type scrubConn struct {
+	net.Conn
+	uc     *net.UnixConn
+	logf   func(format string, args ...interface{})
+	warned sync.Once
+}
+
+func (self *scrubConn) CloseWrite() error { return self.uc.CloseWrite() }
+
+func (self *scrubConn) Read(b []byte) (int, error) {
+	oob := make([]byte, unix.CmsgSpace(64*4))
+	n, oobn, _, _, err := self.uc.ReadMsgUnix(b, oob)
+	if oobn > 0 {
+		self.scrub(oob[:oobn])
+	}
+	return n, err
+}
+
+func (self *scrubConn) scrub(oob []byte) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		self.warned.Do(func() {
+			logf := self.logf
+			if logf == nil {
+				logf = log.Printf
+			}
+			logf("%s: client passed file descriptors, which cannot cross the cable and were dropped", self.RemoteAddr())
+		})
+	}
+}
@@ -0,0 +1,13 @@
+package bridge
+
+import "golang.org/x/sys/unix"
+
+func (self Profile) setsockopt(fd uintptr) {
+	if self.Priority != 0 {
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PRIORITY, self.Priority)
+	}
+	if self.SocketBuffer != 0 {
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, self.SocketBuffer)
+		unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, self.SocketBuffer)
+	}
+}
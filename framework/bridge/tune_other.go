@@ -0,0 +1,7 @@
+//go:build !linux
+
+package bridge
+
+// setsockopt leaves the socket alone: SO_PRIORITY and the buffer sizes of
+// the profile are tuned on linux only.
+func (self Profile) setsockopt(fd uintptr) {}
@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// hostUnix exposes the Unix socket at path to guests on a vsock port.
+func hostUnix(port uint32, config *vsock.ListenConfig, path string, profile Profile) (*Bridge, error) {
+	l, err := listen(port, config)
+	if err != nil {
+		return nil, err
+	}
+	return &Bridge{
+		Listener: l,
+		Dial:     func() (net.Conn, error) { return net.Dial("unix", path) },
+		Profile:  profile,
+	}, nil
+}
+
+// listen listens on a vsock port of the host with config, which may be nil
+// to accept every guest.
+func listen(port uint32, config *vsock.ListenConfig) (net.Listener, error) {
+	if config == nil {
+		config = &vsock.ListenConfig{}
+	}
+	l, err := config.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// guestUnix creates a Unix socket at path inside the guest that is bridged
+// to a host vsock port.
+func guestUnix(path string, port uint32, profile Profile) (*Bridge, error) {
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bridge{
+		Listener: l,
+		Dial:     func() (net.Conn, error) { return vsock.Dial(vsock.Host, port) },
+		Profile:  profile,
+	}
+	b.Wrap = func(conn net.Conn) net.Conn { return scrub(conn, b.logf) }
+	return b, nil
+}
+
+// listenPrivate listens on a Unix socket at path that only the current user
+// may connect to. The socket is bound in a private directory and moved into
+// place, so it is never reachable with looser permissions.
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".vcable")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is unlinked at path, not where it was bound.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	os.Remove(path)
+	if err := os.Rename(bound, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return &unlinkListener{UnixListener: l, path: path}, nil
+}
+
+// unlinkListener removes its socket when closed.
+type unlinkListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (self *unlinkListener) Close() error {
+	os.Remove(self.path)
+	return self.UnixListener.Close()
+}
@@ -0,0 +1,536 @@
+// Package vcable links host and guest with cables: persistent, multiplexed
+// connections over vsock that reconnect on their own and route streams to
+// named services.
+package vcable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	journal "github.com/multiverse-os/vcable/framework/journal"
+	mux "github.com/multiverse-os/vcable/framework/mux"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// DefaultPort is the vsock port cables connect on unless configured
+// otherwise.
+const DefaultPort = vsock.PortCable
+
+const maxServiceName = 255
+
+// Stream header kinds, the first byte of every stream a cable opens.
+const (
+	streamPlain byte = iota
+	streamResumable
+	streamResume
+)
+
+// Replies to a stream header naming a service.
+const (
+	serviceOK byte = iota
+	serviceUnknown
+)
+
+// ErrCableClosed is returned by operations on a closed cable.
+var ErrCableClosed = errors.New("vcable: cable closed")
+
+// State is the connection state of a cable.
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	StateClosed
+)
+
+func (self State) String() string {
+	switch self {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateClosed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// Cable is a persistent link between two endpoints. One end dials, with
+// Connect, and redials with backoff whenever the link drops; the other end
+// accepts links with Serve. Either end opens streams to the services the
+// other has registered with Handle.
+type Cable struct {
+	// Dial opens the underlying connection. Defaults to the host's
+	// DefaultPort, as seen from a guest.
+	Dial func() (net.Conn, error)
+	// KeepAlive is the interval between pings on an idle link; a ping left
+	// unanswered for as long closes the link. Defaults to 15s, negative
+	// disables keepalive.
+	KeepAlive time.Duration
+	// MinBackoff and MaxBackoff bound the delay between redials. Default to
+	// 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// OnState, if set, is called on every state change.
+	OnState func(State)
+	// OnTransportChange, if set, is called when the cable reconnects over
+	// a different transport than before.
+	OnTransportChange func(from, to string)
+	// Metadata tags the cable in its logs, and is attached to its streams
+	// together with the name of their service.
+	Metadata vsock.Metadata
+	ErrorLog *log.Logger
+	// Journal, if set, records the state and transport changes and errors
+	// of the cable.
+	Journal *journal.Journal
+
+	mutex     sync.Mutex
+	handlers  map[string]vsock.Handler
+	session   *mux.Session
+	state     State
+	connected chan struct{}
+	transport string
+	resumes   map[resumeToken]*resumableConn
+	done      chan struct{}
+}
+
+// NewCable returns a cable with the defaults, dialing the host.
+func NewCable() *Cable {
+	return &Cable{}
+}
+
+// Handle registers handler to serve the streams the peer opens to service.
+func (self *Cable) Handle(service string, handler vsock.Handler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.handlers == nil {
+		self.handlers = make(map[string]vsock.Handler)
+	}
+	self.handlers[service] = handler
+}
+
+// Connect dials the peer and keeps the link up until Close, redialing when
+// it drops. It returns the error of the first dial, in which case the cable
+// is not maintained.
+func (self *Cable) Connect() error {
+	if !self.init() {
+		return ErrCableClosed
+	}
+	self.setState(StateConnecting)
+	conn, err := self.dial()
+	if err != nil {
+		self.setState(StateDisconnected)
+		return err
+	}
+	session := self.muxConfig().Client(conn)
+	if _, ok := self.attach(session); !ok {
+		return ErrCableClosed
+	}
+	go self.maintain(session)
+	return nil
+}
+
+// Serve accepts links on l, the most recent replacing any earlier one, until
+// the cable is closed.
+func (self *Cable) Serve(l net.Listener) error {
+	if !self.init() {
+		return ErrCableClosed
+	}
+	go func() {
+		<-self.done
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if self.State() == StateClosed {
+				return ErrCableClosed
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+
+		session := self.muxConfig().Server(conn)
+		old, ok := self.attach(session)
+		if !ok {
+			continue
+		}
+		if old != nil {
+			old.Close()
+		}
+		go func() {
+			self.run(session)
+			self.detach(session)
+		}()
+	}
+}
+
+// OpenStream opens a stream to service on the peer, waiting for the link if
+// it is being re-established.
+func (self *Cable) OpenStream(service string) (net.Conn, error) {
+	return self.OpenStreamContext(context.Background(), service)
+}
+
+// OpenStreamContext is OpenStream bounded by ctx. The deadline and
+// cancellation of ctx also bound all I/O on the stream until it is closed.
+func (self *Cable) OpenStreamContext(ctx context.Context, service string) (net.Conn, error) {
+	if len(service) == 0 || len(service) > maxServiceName {
+		return nil, fmt.Errorf("vcable: invalid service name %q", service)
+	}
+
+	session, err := self.SessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	conn := vsock.ContextConn(ctx, self.tag(stream, service))
+
+	if _, err := conn.Write(streamHeader(streamPlain, service)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if reply[0] != serviceOK {
+		conn.Close()
+		return nil, fmt.Errorf("vcable: peer has no service %q", service)
+	}
+	return conn, nil
+}
+
+// streamHeader returns the header opening a stream of kind to service.
+func streamHeader(kind byte, service string) []byte {
+	return append([]byte{kind, byte(len(service))}, service...)
+}
+
+// Session waits for the link to be up and returns its session.
+func (self *Cable) Session() (*mux.Session, error) {
+	return self.SessionContext(context.Background())
+}
+
+// SessionContext is Session giving up when ctx is done.
+func (self *Cable) SessionContext(ctx context.Context) (*mux.Session, error) {
+	if !self.init() {
+		return nil, ErrCableClosed
+	}
+	for {
+		self.mutex.Lock()
+		session, connected, done := self.session, self.connected, self.done
+		self.mutex.Unlock()
+		if session != nil {
+			return session, nil
+		}
+		select {
+		case <-connected:
+		case <-done:
+			return nil, ErrCableClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Transport returns the name of the transport of the current link, as
+// chosen by Dial, or "" if unknown.
+func (self *Cable) Transport() string {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.transport
+}
+
+func (self *Cable) setTransport(name string) {
+	self.mutex.Lock()
+	from := self.transport
+	self.transport = name
+	callback := self.OnTransportChange
+	self.mutex.Unlock()
+
+	if from != name && self.Journal != nil {
+		self.Journal.Recordf(journal.KindTransport, self.Metadata, "%s", name)
+	}
+	if callback != nil && from != "" && from != name {
+		callback(from, name)
+	}
+}
+
+// State returns the current state of the cable.
+func (self *Cable) State() State {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.state
+}
+
+// Close tears the link down for good.
+func (self *Cable) Close() error {
+	self.init()
+	self.mutex.Lock()
+	if self.state == StateClosed {
+		self.mutex.Unlock()
+		return nil
+	}
+	close(self.done)
+	self.state = StateClosed
+	session, callback := self.session, self.OnState
+	self.session = nil
+	self.mutex.Unlock()
+
+	if callback != nil {
+		callback(StateClosed)
+	}
+	if session != nil {
+		return session.Close()
+	}
+	return nil
+}
+
+// init prepares the channels of the cable, reporting false once it is
+// closed.
+func (self *Cable) init() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.done == nil {
+		self.done = make(chan struct{})
+		self.connected = make(chan struct{})
+	}
+	return self.state != StateClosed
+}
+
+func (self *Cable) dial() (net.Conn, error) {
+	if self.Dial != nil {
+		return self.Dial()
+	}
+	return vsock.DialHost(DefaultPort)
+}
+
+// maintain serves session and redials whenever it ends.
+func (self *Cable) maintain(session *mux.Session) {
+	for {
+		self.run(session)
+		if !self.detach(session) {
+			return
+		}
+
+		self.setState(StateConnecting)
+		conn, err := self.redial()
+		if err != nil {
+			return
+		}
+		session = self.muxConfig().Client(conn)
+		if _, ok := self.attach(session); !ok {
+			return
+		}
+	}
+}
+
+func (self *Cable) redial() (net.Conn, error) {
+	min, max := self.MinBackoff, self.MaxBackoff
+	if min <= 0 {
+		min = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+
+	delay := min
+	for {
+		conn, err := self.dial()
+		if err == nil {
+			return conn, nil
+		}
+		self.logf("vcable: dial failed: %v; retrying in %v", err, delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-self.done:
+			timer.Stop()
+			return nil, ErrCableClosed
+		}
+		if delay *= 2; delay > max {
+			delay = max
+		}
+	}
+}
+
+// run accepts the streams of session and keeps it alive until it ends.
+func (self *Cable) run(session *mux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			if err == mux.ErrKeepAliveTimeout {
+				self.logf("vcable: keepalive timed out, closing link to %v", session.RemoteAddr())
+			}
+			return
+		}
+		go self.route(stream)
+	}
+}
+
+// muxConfig returns the configuration of the sessions of the cable, which
+// keep the link alive.
+func (self *Cable) muxConfig() *mux.Config {
+	interval := self.KeepAlive
+	if interval == 0 {
+		interval = 15 * time.Second
+	}
+	if interval < 0 {
+		interval = 0
+	}
+	return &mux.Config{KeepAlive: interval}
+}
+
+// route reads the header of stream and hands it to the handler of its
+// service, or to the resumable stream it continues.
+func (self *Cable) route(stream *mux.Stream) {
+	var header [2]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		stream.Close()
+		return
+	}
+	kind, name := header[0], make([]byte, header[1])
+	if _, err := io.ReadFull(stream, name); err != nil {
+		stream.Close()
+		return
+	}
+	service := string(name)
+
+	switch kind {
+	case streamPlain, streamResumable:
+		var token resumeToken
+		if kind == streamResumable {
+			if _, err := io.ReadFull(stream, token[:]); err != nil {
+				stream.Close()
+				return
+			}
+		}
+
+		self.mutex.Lock()
+		handler, ok := self.handlers[service]
+		self.mutex.Unlock()
+		if !ok {
+			stream.Write([]byte{serviceUnknown})
+			stream.Close()
+			return
+		}
+		if _, err := stream.Write([]byte{serviceOK}); err != nil {
+			stream.Close()
+			return
+		}
+
+		var conn net.Conn = stream
+		if kind == streamResumable {
+			conn = self.resumable(stream, service, token, false)
+		}
+		defer conn.Close()
+		handler.ServeVsock(self.tag(conn, service))
+	case streamResume:
+		self.resume(stream)
+	default:
+		stream.Close()
+	}
+}
+
+// tag attaches the metadata of the cable and service to stream.
+func (self *Cable) tag(stream net.Conn, service string) net.Conn {
+	return vsock.WithMetadata(stream, self.Metadata.Merge(vsock.Metadata{"service": service}))
+}
+
+// attach makes session the current one, returning the one it replaces. It
+// closes session instead, reporting false, if the cable was closed first.
+func (self *Cable) attach(session *mux.Session) (*mux.Session, bool) {
+	self.mutex.Lock()
+	if self.state == StateClosed {
+		self.mutex.Unlock()
+		session.Close()
+		return nil, false
+	}
+	old := self.session
+	self.session = session
+	close(self.connected)
+	self.connected = make(chan struct{})
+	self.mutex.Unlock()
+
+	self.setState(StateConnected)
+	return old, true
+}
+
+// detach forgets session if it is still the current one, reporting whether
+// the cable remains open.
+func (self *Cable) detach(session *mux.Session) bool {
+	self.mutex.Lock()
+	if self.state == StateClosed {
+		self.mutex.Unlock()
+		return false
+	}
+	current := self.session == session
+	if current {
+		self.session = nil
+	}
+	self.mutex.Unlock()
+
+	session.Close()
+	if current {
+		self.setState(StateDisconnected)
+	}
+	return true
+}
+
+func (self *Cable) setState(state State) {
+	self.mutex.Lock()
+	if self.state == state || (self.state == StateClosed && state != StateClosed) {
+		self.mutex.Unlock()
+		return
+	}
+	from := self.state
+	self.state = state
+	callback := self.OnState
+	self.mutex.Unlock()
+
+	if self.Journal != nil {
+		switch {
+		case state == StateConnected:
+			self.Journal.Recordf(journal.KindConnect, self.Metadata, "")
+		case state == StateClosed:
+			self.Journal.Recordf(journal.KindClose, self.Metadata, "")
+		case from == StateConnected:
+			self.Journal.Recordf(journal.KindDisconnect, self.Metadata, "")
+		}
+	}
+	if callback != nil {
+		callback(state)
+	}
+}
+
+func (self *Cable) logf(format string, args ...interface{}) {
+	if self.Journal != nil {
+		self.Journal.Recordf(journal.KindError, self.Metadata, format, args...)
+	}
+	if len(self.Metadata) > 0 {
+		format += " [%s]"
+		args = append(args, self.Metadata.String())
+	}
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.New(os.Stderr, "", log.LstdFlags).Printf(format, args...)
+}
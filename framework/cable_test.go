@@ -0,0 +1,136 @@
+package vcable
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestCableRoutesStreams(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := NewCable()
+	server.Handle("echo", vsock.HandlerFunc(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	}))
+	go server.Serve(l)
+	defer server.Close()
+
+	client := NewCable()
+	client.Dial = func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	stream, err := client.OpenStream("echo")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if _, err := stream.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, 5)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if string(b) != "hello" {
+		t.Fatalf("unexpected echo: %q", b)
+	}
+
+	if _, err := client.OpenStream("missing"); err == nil {
+		t.Fatal("expected an error opening an unknown service")
+	}
+}
+
+func TestResumableStreamSurvivesReconnect(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	server := NewCable()
+	server.Handle("echo", vsock.HandlerFunc(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	}))
+	go server.Serve(l)
+	defer server.Close()
+
+	client := NewCable()
+	client.MinBackoff = time.Millisecond
+	client.Dial = func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	stream, err := client.OpenResumable(context.Background(), "echo")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+
+	echo := func(msg string) {
+		if _, err := stream.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(stream, b); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if diff := cmp.Diff(msg, string(b)); diff != "" {
+			t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+		}
+	}
+
+	echo("before")
+	session, _ := client.Session()
+	session.Close()
+	echo("after")
+
+	// Data a write timed out on is not sent again when the stream resumes.
+	stream.SetWriteDeadline(time.Now())
+	if n, err := stream.Write([]byte("timed out")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write() past the deadline = %d, %v, want 0, os.ErrDeadlineExceeded", n, err)
+	}
+	stream.SetWriteDeadline(time.Time{})
+	session, _ = client.Session()
+	session.Close()
+	echo("resumed")
+}
+
+func TestCableClosedWhileDialing(t *testing.T) {
+	drained := make(chan error, 1)
+	cable := NewCable()
+	cable.Dial = func() (net.Conn, error) {
+		// Close races the dial, and wins.
+		cable.Close()
+		conn, peer := net.Pipe()
+		go func() {
+			peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err := io.Copy(io.Discard, peer)
+			drained <- err
+		}()
+		return conn, nil
+	}
+	if err := cable.Connect(); err != ErrCableClosed {
+		t.Fatalf("Connect() = %v, want ErrCableClosed", err)
+	}
+	if diff := cmp.Diff(StateClosed, cable.State()); diff != "" {
+		t.Fatalf("unexpected state (-want +got):\n%s", diff)
+	}
+	// The link dialed is torn down rather than left attached.
+	if err := <-drained; err != nil {
+		t.Fatalf("expected the link to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,287 @@
+// Package capture taps vsock traffic for debugging. Captures are in pcap
+// format with the link type of the Linux vsockmon device, which Wireshark
+// dissects, and are exported live on a Unix socket per process for the
+// vcable-extcap Wireshark plugin to read.
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// LinkType is LINKTYPE_VSOCK, the pcap link type of vsockmon.
+const LinkType = 271
+
+// Operations of a vsockmon header.
+const (
+	opConnect    = 1
+	opDisconnect = 2
+	opPayload    = 4
+)
+
+const (
+	headerSize = 32
+	snapLen    = 65535
+	// sinkBacklog is how many packets a slow consumer may fall behind by
+	// before packets are dropped for it.
+	sinkBacklog = 1024
+)
+
+// WriteHeader writes the pcap file header.
+func WriteHeader(w io.Writer) error {
+	var header [24]byte
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], snapLen)
+	binary.LittleEndian.PutUint32(header[20:24], LinkType)
+	_, err := w.Write(header[:])
+	return err
+}
+
+// packet returns a pcap record of a vsockmon packet.
+func packet(t time.Time, op uint16, src, dst *vsock.Addr, payload []byte) []byte {
+	size := headerSize + len(payload)
+	b := make([]byte, 16, 16+size)
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(b[8:12], uint32(size))
+	binary.LittleEndian.PutUint32(b[12:16], uint32(size))
+
+	b = binary.LittleEndian.AppendUint64(b, uint64(src.ContextID))
+	b = binary.LittleEndian.AppendUint64(b, uint64(dst.ContextID))
+	b = binary.LittleEndian.AppendUint32(b, src.Port)
+	b = binary.LittleEndian.AppendUint32(b, dst.Port)
+	b = binary.LittleEndian.AppendUint16(b, op)
+	// No transport header follows.
+	b = append(b, 0, 0, 0, 0, 0, 0)
+	return append(b, payload...)
+}
+
+// Tap records the traffic of the connections it wraps to every attached
+// consumer. While nothing is attached it costs little.
+type Tap struct {
+	mutex sync.Mutex
+	sinks map[chan []byte]struct{}
+}
+
+// Attach writes the capture to w from now on, until detach is called or a
+// write fails. Packets are dropped rather than stall traffic if w falls
+// behind.
+func (self *Tap) Attach(w io.Writer) (detach func()) {
+	packets := make(chan []byte, sinkBacklog)
+	self.mutex.Lock()
+	if self.sinks == nil {
+		self.sinks = make(map[chan []byte]struct{})
+	}
+	self.sinks[packets] = struct{}{}
+	self.mutex.Unlock()
+
+	var once sync.Once
+	detach = func() {
+		once.Do(func() {
+			self.mutex.Lock()
+			delete(self.sinks, packets)
+			self.mutex.Unlock()
+			close(packets)
+		})
+	}
+	go func() {
+		err := WriteHeader(w)
+		for p := range packets {
+			if err == nil {
+				_, err = w.Write(p)
+			}
+			if err != nil {
+				// Discard what is still queued.
+				detach()
+			}
+		}
+	}()
+	return detach
+}
+
+func (self *Tap) attached() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.sinks) > 0
+}
+
+func (self *Tap) record(op uint16, src, dst *vsock.Addr, payload []byte) {
+	if !self.attached() {
+		return
+	}
+	now := time.Now()
+	for {
+		chunk := payload
+		if len(chunk) > snapLen-headerSize {
+			chunk = chunk[:snapLen-headerSize]
+		}
+		p := packet(now, op, src, dst, chunk)
+		self.mutex.Lock()
+		for sink := range self.sinks {
+			select {
+			case sink <- p:
+			default:
+			}
+		}
+		self.mutex.Unlock()
+		payload = payload[len(chunk):]
+		if len(payload) == 0 {
+			return
+		}
+	}
+}
+
+// Conn returns conn with its traffic recorded.
+func (self *Tap) Conn(conn net.Conn) net.Conn {
+	c := &tappedConn{Conn: conn, tap: self, local: addrOf(conn.LocalAddr()), remote: addrOf(conn.RemoteAddr())}
+	self.record(opConnect, c.remote, c.local, nil)
+	return c
+}
+
+// Middleware records the traffic of accepted connections.
+func (self *Tap) Middleware() vsock.Middleware {
+	return func(next vsock.Handler) vsock.Handler {
+		return vsock.HandlerFunc(func(conn net.Conn) {
+			next.ServeVsock(self.Conn(conn))
+		})
+	}
+}
+
+// Dial records the traffic of dialed connections.
+func (self *Tap) Dial() vsock.DialMiddleware {
+	return func(next vsock.DialFunc) vsock.DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			conn, err := next(contextID, port)
+			if err != nil {
+				return nil, err
+			}
+			return self.Conn(conn), nil
+		}
+	}
+}
+
+func addrOf(addr net.Addr) *vsock.Addr {
+	if a, ok := addr.(*vsock.Addr); ok {
+		return a
+	}
+	return &vsock.Addr{}
+}
+
+type tappedConn struct {
+	net.Conn
+	tap           *Tap
+	local, remote *vsock.Addr
+	once          sync.Once
+}
+
+func (self *tappedConn) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	if n > 0 {
+		self.tap.record(opPayload, self.remote, self.local, b[:n])
+	}
+	return n, err
+}
+
+func (self *tappedConn) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	if n > 0 {
+		self.tap.record(opPayload, self.local, self.remote, b[:n])
+	}
+	return n, err
+}
+
+func (self *tappedConn) Close() error {
+	self.once.Do(func() { self.tap.record(opDisconnect, self.local, self.remote, nil) })
+	return self.Conn.Close()
+}
+
+func (self *tappedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// Dir is where processes export their captures.
+func Dir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "vcable", "capture")
+	}
+	return filepath.Join(os.TempDir(), "vcable-capture-"+strconv.Itoa(os.Getuid()))
+}
+
+// Export offers the capture of tap under name, normally the program name,
+// until the returned listener is closed. Each client of the socket receives
+// the capture from when it connected.
+func Export(tap *Tap, name string) (net.Listener, error) {
+	if strings.ContainsAny(name, "/\x00") || name == "" {
+		return nil, fmt.Errorf("capture: invalid name %q", name)
+	}
+	if err := os.MkdirAll(Dir(), 0700); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(Dir(), fmt.Sprintf("%s.%d.sock", name, os.Getpid()))
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				detach := tap.Attach(conn)
+				// Consumers send nothing; a read returns once they leave.
+				conn.Read(make([]byte, 1))
+				detach()
+			}()
+		}
+	}()
+	return l, nil
+}
+
+// Interfaces returns the names of the captures exported on this machine by
+// live processes, as "name.pid".
+func Interfaces() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(Dir(), "*.sock"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, path := range paths {
+		name := strings.TrimSuffix(filepath.Base(path), ".sock")
+		pid, err := strconv.Atoi(name[strings.LastIndexByte(name, '.')+1:])
+		if err != nil || !alive(pid) {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// Open connects to the capture exported as name, streaming it in pcap
+// format.
+func Open(name string) (net.Conn, error) {
+	return net.Dial("unix", filepath.Join(Dir(), name+".sock"))
+}
+
+func alive(pid int) bool {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	return err == nil
+}
@@ -0,0 +1,72 @@
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+type addrConn struct {
+	net.Conn
+	local, remote *vsock.Addr
+}
+
+func (self addrConn) LocalAddr() net.Addr  { return self.local }
+func (self addrConn) RemoteAddr() net.Addr { return self.remote }
+
+func TestTapRecordsPayloads(t *testing.T) {
+	tap := &Tap{}
+	r, w := io.Pipe()
+	defer tap.Attach(w)()
+
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if diff := cmp.Diff(uint32(LinkType), binary.LittleEndian.Uint32(header[20:24])); diff != "" {
+		t.Fatalf("unexpected link type (-want +got):\n%s", diff)
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := tap.Conn(addrConn{Conn: a, local: &vsock.Addr{ContextID: 2, Port: 5200}, remote: &vsock.Addr{ContextID: 3, Port: 1025}})
+	go conn.Write([]byte("hello"))
+	b.Read(make([]byte, 5))
+
+	type record struct {
+		SrcCID, DstCID   uint64
+		SrcPort, DstPort uint32
+		Op               uint16
+		Payload          string
+	}
+	var got []record
+	for len(got) < 2 {
+		var rh [16]byte
+		if _, err := io.ReadFull(r, rh[:]); err != nil {
+			t.Fatalf("failed to read record: %v", err)
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(rh[8:12]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatalf("failed to read record: %v", err)
+		}
+		got = append(got, record{
+			SrcCID:  binary.LittleEndian.Uint64(data[0:8]),
+			DstCID:  binary.LittleEndian.Uint64(data[8:16]),
+			SrcPort: binary.LittleEndian.Uint32(data[16:20]),
+			DstPort: binary.LittleEndian.Uint32(data[20:24]),
+			Op:      binary.LittleEndian.Uint16(data[24:26]),
+			Payload: string(data[headerSize:]),
+		})
+	}
+	want := []record{
+		{SrcCID: 3, DstCID: 2, SrcPort: 1025, DstPort: 5200, Op: opConnect},
+		{SrcCID: 2, DstCID: 3, SrcPort: 5200, DstPort: 1025, Op: opPayload, Payload: "hello"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected records (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,184 @@
+// Package cloudinit configures stock cloud-init images over vsock.
+//
+// The host serves each guest its NoCloud seed over HTTP on a vsock port.
+// In the guest, a shim run before cloud-init fetches the seed and writes it
+// where the NoCloud datasource looks for it, so no network or seed disk is
+// needed.
+package cloudinit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the host vsock port the seed is served on.
+const Port = vsock.PortCloudInit
+
+// DefaultSeedDir is where the NoCloud datasource looks for a local seed.
+const DefaultSeedDir = "/var/lib/cloud/seed/nocloud"
+
+// maxFile bounds each seed file fetched.
+const maxFile = 16 << 20
+
+// Seed is a NoCloud seed. MetaData must at least hold an instance-id.
+type Seed struct {
+	MetaData      []byte
+	UserData      []byte
+	VendorData    []byte
+	NetworkConfig []byte
+}
+
+func (self *Seed) files() map[string][]byte {
+	return map[string][]byte{
+		"meta-data":      self.MetaData,
+		"user-data":      self.UserData,
+		"vendor-data":    self.VendorData,
+		"network-config": self.NetworkConfig,
+	}
+}
+
+type contextKey struct{}
+
+// Server is the host side.
+type Server struct {
+	// Seed returns the seed of the guest with context ID contextID, or nil
+	// if it has none.
+	Seed func(contextID uint32) (*Seed, error)
+}
+
+// Serve serves seeds to the guests connecting to l, which must accept vsock
+// connections.
+func (self *Server) Serve(l net.Listener) error {
+	server := &http.Server{
+		Handler:           self,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, contextKey{}, conn.RemoteAddr())
+		},
+	}
+	return server.Serve(l)
+}
+
+func (self *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// The guest is identified by its connection, never by the request, so
+	// it can only read its own seed.
+	addr, ok := r.Context().Value(contextKey{}).(*vsock.Addr)
+	if !ok {
+		http.Error(w, "not a vsock connection", http.StatusForbidden)
+		return
+	}
+	seed, err := self.Seed(addr.ContextID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if seed == nil {
+		http.NotFound(w, r)
+		return
+	}
+	data := seed.files()[r.URL.Path[1:]]
+	if data == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(data)
+}
+
+// Fetch retrieves the seed of this guest from the host.
+func Fetch(ctx context.Context) (*Seed, error) {
+	return FetchWith(ctx, func() (net.Conn, error) { return vsock.Dial(vsock.Host, Port) })
+}
+
+// FetchWith is Fetch over connections opened by dial.
+func FetchWith(ctx context.Context, dial func() (net.Conn, error)) (*Seed, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) { return dial() },
+	}}
+	defer client.CloseIdleConnections()
+
+	seed := &Seed{}
+	for name, field := range map[string]*[]byte{
+		"meta-data":      &seed.MetaData,
+		"user-data":      &seed.UserData,
+		"vendor-data":    &seed.VendorData,
+		"network-config": &seed.NetworkConfig,
+	} {
+		data, err := fetch(ctx, client, name)
+		if err != nil {
+			return nil, err
+		}
+		*field = data
+	}
+	if len(seed.MetaData) == 0 {
+		return nil, fmt.Errorf("cloudinit: host has no meta-data for this guest")
+	}
+	return seed, nil
+}
+
+func fetch(ctx context.Context, client *http.Client, name string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://vsock/"+name, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("cloudinit: %s: %s", name, resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFile+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFile {
+		return nil, fmt.Errorf("cloudinit: %s exceeds %d bytes", name, maxFile)
+	}
+	return data, nil
+}
+
+// Write writes seed to dir, or to DefaultSeedDir if dir is empty. Files the
+// seed does not have are removed, so a stale seed never lingers.
+func (self *Seed) Write(dir string) error {
+	if dir == "" {
+		dir = DefaultSeedDir
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for name, data := range self.files() {
+		path := filepath.Join(dir, name)
+		if data == nil {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
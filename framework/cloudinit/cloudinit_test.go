@@ -0,0 +1,68 @@
+package cloudinit
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// guestListener reports connections as coming from context ID 7.
+type guestListener struct{ net.Listener }
+
+func (self guestListener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return guestConn{conn}, nil
+}
+
+type guestConn struct{ net.Conn }
+
+func (guestConn) RemoteAddr() net.Addr { return &vsock.Addr{ContextID: 7, Port: 1024} }
+
+func TestFetchAndWriteSeed(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	server := &Server{Seed: func(cid uint32) (*Seed, error) {
+		if cid != 7 {
+			return nil, nil
+		}
+		return &Seed{MetaData: []byte("instance-id: vm-7\n"), UserData: []byte("#cloud-config\n")}, nil
+	}}
+	go server.Serve(guestListener{l})
+
+	seed, err := FetchWith(context.Background(), func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) })
+	if err != nil {
+		t.Fatalf("failed to fetch: %v", err)
+	}
+	want := &Seed{MetaData: []byte("instance-id: vm-7\n"), UserData: []byte("#cloud-config\n")}
+	if diff := cmp.Diff(want, seed); diff != "" {
+		t.Fatalf("unexpected seed (-want +got):\n%s", diff)
+	}
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "network-config"), []byte("stale"), 0600)
+	if err := seed.Write(dir); err != nil {
+		t.Fatalf("failed to write seed: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read seed: %v", err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if diff := cmp.Diff([]string{"meta-data", "user-data"}, names); diff != "" {
+		t.Fatalf("unexpected seed files (-want +got):\n%s", diff)
+	}
+}
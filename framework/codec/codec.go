@@ -0,0 +1,121 @@
+// Package codec names the serializations messages between host and guest
+// are encoded in, so protocols can negotiate one by name and other modules
+// can add their own.
+package codec
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+// A Codec encodes values to bytes and back.
+type Codec interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(b []byte, v interface{}) error
+}
+
+// JSON encodes values with encoding/json.
+type JSON struct{}
+
+func (JSON) Name() string                            { return "json" }
+func (JSON) Marshal(v interface{}) ([]byte, error)   { return json.Marshal(v) }
+func (JSON) Unmarshal(b []byte, v interface{}) error { return json.Unmarshal(b, v) }
+
+// Gob encodes values with encoding/gob, each message standing alone.
+type Gob struct{}
+
+func (Gob) Name() string { return "gob" }
+
+func (Gob) Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	if err := gob.NewEncoder(&b).Encode(v); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (Gob) Unmarshal(b []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// CBOR encodes values as CBOR (RFC 8949), more compactly than JSON while
+// staying readable by peers in other languages.
+type CBOR struct{}
+
+func (CBOR) Name() string                            { return "cbor" }
+func (CBOR) Marshal(v interface{}) ([]byte, error)   { return cbor.Marshal(v) }
+func (CBOR) Unmarshal(b []byte, v interface{}) error { return cbor.Unmarshal(b, v) }
+
+// Registry maps names to codecs. Components taking a registry use Default
+// unless given another, so tests and embedders can restrict or replace what
+// is available without affecting the rest of the process.
+type Registry struct {
+	mutex  sync.RWMutex
+	codecs map[string]Codec
+}
+
+// Default is the registry of the process, holding JSON, CBOR and Gob unless
+// changed.
+var Default = NewRegistry(JSON{}, CBOR{}, Gob{})
+
+// NewRegistry returns a registry holding codecs.
+func NewRegistry(codecs ...Codec) *Registry {
+	self := &Registry{codecs: make(map[string]Codec)}
+	for _, c := range codecs {
+		self.Register(c)
+	}
+	return self
+}
+
+// Register makes c available under its name, replacing any codec
+// registered under the same name.
+func (self *Registry) Register(c Codec) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.codecs == nil {
+		self.codecs = make(map[string]Codec)
+	}
+	self.codecs[c.Name()] = c
+}
+
+// Lookup returns the codec registered under name.
+func (self *Registry) Lookup(name string) (Codec, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	c, ok := self.codecs[name]
+	return c, ok
+}
+
+// Get is Lookup returning an error for unknown names.
+func (self *Registry) Get(name string) (Codec, error) {
+	if c, ok := self.Lookup(name); ok {
+		return c, nil
+	}
+	return nil, fmt.Errorf("codec: unknown codec %q", name)
+}
+
+// Names returns the names of the registered codecs, sorted.
+func (self *Registry) Names() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	names := make([]string, 0, len(self.codecs))
+	for name := range self.codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register registers c with Default, typically from the init function of
+// the package providing it.
+func Register(c Codec) { Default.Register(c) }
+
+// Lookup returns the codec registered under name with Default.
+func Lookup(name string) (Codec, bool) { return Default.Lookup(name) }
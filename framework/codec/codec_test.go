@@ -0,0 +1,51 @@
+package codec
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type message struct {
+	Name  string
+	Sizes []int
+}
+
+type reversed struct{ JSON }
+
+func (reversed) Name() string { return "json" }
+
+func TestCodecs(t *testing.T) {
+	want := message{Name: "vcable", Sizes: []int{1, 2, 3}}
+	for _, name := range Default.Names() {
+		c, err := Default.Get(name)
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", name, err)
+		}
+		b, err := c.Marshal(want)
+		if err != nil {
+			t.Fatalf("failed to marshal with %s: %v", name, err)
+		}
+		var got message
+		if err := c.Unmarshal(b, &got); err != nil {
+			t.Fatalf("failed to unmarshal with %s: %v", name, err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("unexpected message through %s (-want +got):\n%s", name, diff)
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(JSON{})
+	registry.Register(reversed{})
+	if c, _ := registry.Lookup("json"); c != (reversed{}) {
+		t.Errorf("expected registering to replace a codec of the same name, got %T", c)
+	}
+	if _, err := registry.Get("gob"); err == nil {
+		t.Error("expected codecs of other registries to be unknown")
+	}
+	if diff := cmp.Diff([]string{"cbor", "gob", "json"}, Default.Names()); diff != "" {
+		t.Errorf("unexpected default codecs (-want +got):\n%s", diff)
+	}
+}
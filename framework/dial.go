@@ -0,0 +1,93 @@
+package vcable
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	transport "github.com/multiverse-os/vcable/framework/transport"
+)
+
+// Config chooses how Dial reaches its peer.
+type Config struct {
+	// Transports are tried in order, moving on whenever one is unavailable
+	// on this machine. Defaults to native vsock, then the hybrid vsock
+	// socket at HybridPath if set, then virtio-serial, then loopback TCP if
+	// Dev is set.
+	Transports []transport.Transport
+	HybridPath string
+	Dev        bool
+	// Failover makes a cable whose link dropped try every transport in
+	// turn, not only those unavailable on this machine, so it moves to the
+	// next one when the active transport dies. Resumable streams continue
+	// over the new link.
+	Failover bool
+	// Setup, if set, configures the cable before it connects, e.g. to
+	// register handlers.
+	Setup func(cable *Cable)
+}
+
+func (self *Config) transports() transport.Chain {
+	if len(self.Transports) > 0 {
+		return self.Transports
+	}
+
+	chain := transport.Chain{transport.Vsock{}}
+	if self.HybridPath != "" {
+		chain = append(chain, transport.Hybrid{Path: self.HybridPath})
+	}
+	if t, ok := transport.Lookup("virtio-serial"); ok {
+		chain = append(chain, t)
+	}
+	if self.Dev {
+		if t, ok := transport.Lookup("tcp"); ok {
+			chain = append(chain, t)
+		}
+	}
+	return chain
+}
+
+// Dial connects a cable to port of contextID over the best transport
+// available, probing them in the order of config, which may be nil for the
+// defaults. The transport is probed again on every reconnection.
+func Dial(contextID, port uint32, config *Config) (*Cable, error) {
+	if config == nil {
+		config = &Config{}
+	}
+	chain := config.transports()
+
+	cable := NewCable()
+	cable.Dial = func() (net.Conn, error) {
+		if config.Failover && cable.Transport() != "" {
+			return cable.failover(chain, contextID, port)
+		}
+		conn, t, err := chain.DialTransport(contextID, port)
+		if err != nil {
+			return nil, err
+		}
+		cable.setTransport(t.Name())
+		return conn, nil
+	}
+	if config.Setup != nil {
+		config.Setup(cable)
+	}
+
+	if err := cable.Connect(); err != nil {
+		return nil, err
+	}
+	return cable, nil
+}
+
+// failover dials with the first transport of chain which succeeds.
+func (self *Cable) failover(chain transport.Chain, contextID, port uint32) (net.Conn, error) {
+	var errs []string
+	for _, t := range chain {
+		conn, err := t.Dial(contextID, port)
+		if err == nil {
+			self.setTransport(t.Name())
+			return conn, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", t.Name(), err))
+	}
+	return nil, fmt.Errorf("vcable: every transport failed (%s)", strings.Join(errs, "; "))
+}
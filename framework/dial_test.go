@@ -0,0 +1,155 @@
+//go:build linux
+
+package vcable
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	transport "github.com/multiverse-os/vcable/framework/transport"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// probe is a transport recording its dials to dials.
+type probe struct {
+	name  string
+	dial  func(contextID, port uint32) (net.Conn, error)
+	dials *[]string
+}
+
+func (self probe) Name() string { return self.name }
+
+func (self probe) Dial(contextID, port uint32) (net.Conn, error) {
+	*self.dials = append(*self.dials, self.name)
+	return self.dial(contextID, port)
+}
+
+func failing(err error) func(contextID, port uint32) (net.Conn, error) {
+	return func(contextID, port uint32) (net.Conn, error) { return nil, err }
+}
+
+func TestDialTransports(t *testing.T) {
+	var names []string
+	for _, tr := range (&Config{HybridPath: "/run/vm.sock", Dev: true}).transports() {
+		names = append(names, tr.Name())
+	}
+	if diff := cmp.Diff([]string{"vsock", "hybrid", "virtio-serial", "tcp"}, names); diff != "" {
+		t.Fatalf("unexpected default transports (-want +got):\n%s", diff)
+	}
+}
+
+func TestDialProbesTransports(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	host := network.Machine(vsock.Host)
+	restore := host.Install()
+	defer restore()
+	server := serveGuest(t, network.Machine(3), 1024)
+	defer server.Close()
+
+	var dials []string
+	unavailable := &net.OpError{Op: "dial", Net: "vsock", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+	hybrid := probe{name: "hybrid", dial: host.Dial, dials: &dials}
+
+	// Native vsock is used whenever this machine has it.
+	cable, err := Dial(3, 1024, &Config{Transports: []transport.Transport{transport.Vsock{}, hybrid}})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	echo(t, cable)
+	cable.Close()
+	if diff := cmp.Diff("vsock", cable.Transport()); diff != "" {
+		t.Fatalf("unexpected transport (-want +got):\n%s", diff)
+	}
+
+	// A transport this machine lacks is skipped for the next one.
+	cable, err = Dial(3, 1024, &Config{Transports: []transport.Transport{
+		probe{name: "vsock", dial: failing(unavailable), dials: &dials},
+		hybrid,
+	}})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	echo(t, cable)
+	cable.Close()
+	if diff := cmp.Diff("hybrid", cable.Transport()); diff != "" {
+		t.Fatalf("unexpected transport (-want +got):\n%s", diff)
+	}
+
+	// A peer refusing is not a reason to try another transport.
+	_, err = Dial(3, 1024, &Config{Transports: []transport.Transport{
+		probe{name: "vsock", dial: failing(syscall.ECONNREFUSED), dials: &dials},
+		hybrid,
+	}})
+	if err != syscall.ECONNREFUSED {
+		t.Fatalf("expected the refusal of the peer, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"vsock", "hybrid", "vsock"}, dials); diff != "" {
+		t.Fatalf("unexpected dials (-want +got):\n%s", diff)
+	}
+}
+
+func TestDialFailover(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	host := network.Machine(vsock.Host)
+	restore := host.Install()
+	defer restore()
+	guest := network.Machine(3)
+	l, err := guest.Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	native := NewCable()
+	native.Handle("echo", vsock.HandlerFunc(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	}))
+	go native.Serve(l)
+	// The fallback reaches the guest on the next port.
+	fallback := serveGuest(t, guest, 1025)
+	defer fallback.Close()
+
+	var dials []string
+	changes := make(chan [2]string, 1)
+	cable, err := Dial(3, 1024, &Config{
+		Transports: []transport.Transport{
+			transport.Vsock{},
+			probe{name: "hybrid", dial: func(contextID, port uint32) (net.Conn, error) {
+				return host.Dial(contextID, port+1)
+			}, dials: &dials},
+		},
+		Failover: true,
+		Setup: func(cable *Cable) {
+			cable.MinBackoff = time.Millisecond
+			cable.ErrorLog = log.New(io.Discard, "", 0)
+			cable.OnTransportChange = func(from, to string) { changes <- [2]string{from, to} }
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer cable.Close()
+	echo(t, cable)
+
+	// Native vsock failing moves the cable to the next transport, although
+	// it is not unavailable.
+	l.Close()
+	native.Close()
+	select {
+	case change := <-changes:
+		if diff := cmp.Diff([2]string{"vsock", "hybrid"}, change); diff != "" {
+			t.Fatalf("unexpected transport change (-want +got):\n%s", diff)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the cable to fail over")
+	}
+	echo(t, cable)
+	if diff := cmp.Diff("hybrid", cable.Transport()); diff != "" {
+		t.Fatalf("unexpected transport (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,261 @@
+// Package doctor diagnoses why vsock does not work on a machine and says
+// what to do about it.
+package doctor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// Status is the outcome of a check.
+type Status int
+
+const (
+	OK Status = iota
+	Warn
+	Fail
+	Skip
+)
+
+func (self Status) String() string {
+	switch self {
+	case OK:
+		return "ok"
+	case Warn:
+		return "warn"
+	case Fail:
+		return "FAIL"
+	default:
+		return "skip"
+	}
+}
+
+// Result is the outcome of one check, with the remedy when it did not pass.
+type Result struct {
+	Name   string
+	Status Status
+	Detail string
+	Remedy string
+}
+
+// Check is a diagnostic.
+type Check struct {
+	Name string
+	Run  func() Result
+}
+
+// Checks are the diagnostics run by Run, in order.
+var Checks = []Check{
+	{"kernel modules", checkModules},
+	{"/dev/vsock", checkDevice},
+	{"/dev/vhost-vsock", checkVhost},
+	{"local context ID", checkContextID},
+	{"security policy", checkPolicy},
+	{"container", checkContainer},
+	{"loopback self-test", checkLoopback},
+}
+
+// Run runs every check and returns their results.
+func Run() []Result {
+	results := make([]Result, 0, len(Checks))
+	for _, check := range Checks {
+		result := check.Run()
+		result.Name = check.Name
+		results = append(results, result)
+	}
+	return results
+}
+
+// Print writes results to w, with the remedy below each check that did not
+// pass, and reports whether all of them passed.
+func Print(w io.Writer, results []Result) bool {
+	healthy := true
+	for _, result := range results {
+		fmt.Fprintf(w, "[%4s] %-20s %s\n", result.Status, result.Name, result.Detail)
+		if result.Status == Warn || result.Status == Fail {
+			if result.Remedy != "" {
+				fmt.Fprintf(w, "       %-20s -> %s\n", "", result.Remedy)
+			}
+		}
+		if result.Status == Fail {
+			healthy = false
+		}
+	}
+	return healthy
+}
+
+// modules lists the vsock kernel modules and what they provide.
+var modules = []struct {
+	name, role string
+}{
+	{"vsock", "core"},
+	{"vhost_vsock", "host"},
+	{"vmw_vsock_virtio_transport", "guest (virtio)"},
+	{"vmw_vsock_vmci_transport", "guest or host (VMware)"},
+	{"hv_sock", "guest (Hyper-V)"},
+	{"vsock_loopback", "loopback"},
+}
+
+func checkModules() Result {
+	var loaded []string
+	for _, m := range modules {
+		if moduleLoaded(m.name) {
+			loaded = append(loaded, m.name)
+		}
+	}
+	switch {
+	case !moduleLoaded("vsock"):
+		return Result{
+			Status: Fail,
+			Detail: "the vsock module is not loaded",
+			Remedy: "load it with `modprobe vsock` and the transport for this machine: vhost_vsock on a host, vmw_vsock_virtio_transport in a KVM guest",
+		}
+	case len(loaded) == 1:
+		return Result{
+			Status: Fail,
+			Detail: "no vsock transport is loaded",
+			Remedy: "load vhost_vsock on a host, or vmw_vsock_virtio_transport in a KVM guest",
+		}
+	}
+	return Result{Status: OK, Detail: strings.Join(loaded, ", ")}
+}
+
+func moduleLoaded(name string) bool {
+	if _, err := os.Stat("/sys/module/" + name); err == nil {
+		return true
+	}
+	f, err := os.Open("/proc/modules")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), name+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func checkDevice() Result {
+	return checkCharDevice("/dev/vsock", "the vsock module creates it when loaded; check `modprobe vsock`")
+}
+
+func checkVhost() Result {
+	if _, err := os.Stat("/dev/vhost-vsock"); os.IsNotExist(err) {
+		return Result{Status: Skip, Detail: "not present, so this is not a vsock host"}
+	}
+	return checkCharDevice("/dev/vhost-vsock", "")
+}
+
+func checkCharDevice(path, missing string) Result {
+	info, err := os.Stat(path)
+	if err != nil {
+		return Result{Status: Fail, Detail: err.Error(), Remedy: missing}
+	}
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return Result{Status: Fail, Detail: "not a character device", Remedy: "remove it and reload the vsock modules"}
+	}
+	if err := unix.Access(path, unix.R_OK|unix.W_OK); err != nil {
+		return Result{
+			Status: Warn,
+			Detail: fmt.Sprintf("mode %v, not accessible: %v", info.Mode().Perm(), err),
+			Remedy: fmt.Sprintf("run as root, or grant access with a udev rule such as KERNEL==\"%s\", GROUP=\"kvm\", MODE=\"0660\"", strings.TrimPrefix(path, "/dev/")),
+		}
+	}
+	return Result{Status: OK, Detail: fmt.Sprintf("mode %v", info.Mode().Perm())}
+}
+
+func checkContextID() Result {
+	cid, err := vsock.ContextID()
+	if err != nil {
+		return Result{Status: Fail, Detail: err.Error(), Remedy: "fix the checks above first"}
+	}
+	role, _ := vsock.DetectRole()
+	switch role {
+	case vsock.RoleHost:
+		return Result{Status: OK, Detail: fmt.Sprintf("%d (host)", cid)}
+	case vsock.RoleGuest:
+		return Result{Status: OK, Detail: fmt.Sprintf("%d (guest)", cid)}
+	}
+	return Result{
+		Status: Warn,
+		Detail: fmt.Sprintf("%d, which is reserved", cid),
+		Remedy: "give the virtual machine a guest context ID of 3 or more, e.g. -device vhost-vsock-pci,guest-cid=3",
+	}
+}
+
+func checkPolicy() Result {
+	var hints []string
+	if b, err := os.ReadFile("/sys/fs/selinux/enforce"); err == nil && strings.TrimSpace(string(b)) == "1" {
+		hints = append(hints, "SELinux is enforcing: denials show up as `avc: denied { ... } tclass=vsock_socket` in the audit log")
+	}
+	if b, err := os.ReadFile("/sys/module/apparmor/parameters/enabled"); err == nil && strings.TrimSpace(string(b)) == "Y" {
+		hints = append(hints, "AppArmor is enabled: confined profiles need `network vsock`")
+	}
+	if len(hints) == 0 {
+		return Result{Status: OK, Detail: "no mandatory access control restricting sockets detected"}
+	}
+	return Result{Status: Warn, Detail: strings.Join(hints, "; "), Remedy: "if sockets are refused with EACCES, allow vsock in the policy"}
+}
+
+func checkContainer() Result {
+	if _, err := os.Stat("/.dockerenv"); err != nil {
+		if _, err := os.Stat("/run/.containerenv"); err != nil {
+			return Result{Status: Skip, Detail: "not in a container"}
+		}
+	}
+	return Result{
+		Status: Warn,
+		Detail: "running in a container",
+		Remedy: "pass the device through with --device /dev/vsock (or /dev/vhost-vsock on a host), and make sure seccomp allows AF_VSOCK sockets",
+	}
+}
+
+func checkLoopback() Result {
+	if !moduleLoaded("vsock_loopback") {
+		return Result{Status: Skip, Detail: "vsock_loopback is not loaded", Remedy: "`modprobe vsock_loopback` to enable this test"}
+	}
+
+	l, err := vsock.Listen(0)
+	if err != nil {
+		return Result{Status: Fail, Detail: fmt.Sprintf("listen: %v", err), Remedy: "check the results above"}
+	}
+	defer l.Close()
+	port := l.Addr().(*vsock.Addr).Port
+
+	go func() {
+		conn, err := vsock.AcceptWith(l, vsock.AcceptOptions{Timeout: 5 * time.Second})
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := vsock.Dial(vsock.Local, port)
+	if err != nil {
+		return Result{Status: Fail, Detail: fmt.Sprintf("dial: %v", err), Remedy: "check the results above"}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	want := []byte("vcable doctor")
+	if _, err := conn.Write(want); err != nil {
+		return Result{Status: Fail, Detail: fmt.Sprintf("write: %v", err)}
+	}
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != string(want) {
+		return Result{Status: Fail, Detail: fmt.Sprintf("echo failed: %v", err)}
+	}
+	return Result{Status: OK, Detail: fmt.Sprintf("echo over port %d in %v", port, time.Since(start))}
+}
@@ -0,0 +1,81 @@
+//go:build linux
+
+package doctor
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+func TestRunPrint(t *testing.T) {
+	defer func(checks []Check) { Checks = checks }(Checks)
+	Checks = []Check{
+		{"passing", func() Result { return Result{Status: OK, Detail: "fine", Remedy: "unused"} }},
+		{"skipped", func() Result { return Result{Status: Skip, Detail: "not here"} }},
+		{"warning", func() Result { return Result{Status: Warn, Detail: "odd", Remedy: "look"} }},
+	}
+	var b bytes.Buffer
+	if !Print(&b, Run()) {
+		t.Fatal("expected warnings alone to leave the machine healthy")
+	}
+	want := "" +
+		"[  ok] passing              fine\n" +
+		"[skip] skipped              not here\n" +
+		"[warn] warning              odd\n" +
+		"                            -> look\n"
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Fatalf("unexpected output (-want +got):\n%s", diff)
+	}
+
+	Checks = append(Checks, Check{"failing", func() Result { return Result{Status: Fail, Detail: "broken", Remedy: "fix"} }})
+	if Print(&bytes.Buffer{}, Run()) {
+		t.Fatal("expected a failed check to make the machine unhealthy")
+	}
+}
+
+func TestCheckCharDevice(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "vsock")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	got := []Status{
+		checkCharDevice("/dev/null", "").Status,
+		checkCharDevice(file, "").Status,
+		checkCharDevice(filepath.Join(t.TempDir(), "missing"), "load it").Status,
+	}
+	if diff := cmp.Diff([]Status{OK, Fail, Fail}, got); diff != "" {
+		t.Fatalf("unexpected statuses (-want +got):\n%s", diff)
+	}
+	if remedy := checkCharDevice(filepath.Join(t.TempDir(), "missing"), "load it").Remedy; remedy != "load it" {
+		t.Fatalf("expected the remedy for a missing device, got %q", remedy)
+	}
+}
+
+func TestCheckContextID(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	var got []Result
+	for _, cid := range []uint32{vsock.Host, 3, vsock.Hypervisor} {
+		restore := network.Machine(cid).Install()
+		got = append(got, checkContextID())
+		restore()
+	}
+	if !strings.Contains(got[2].Remedy, "guest-cid=3") {
+		t.Fatalf("expected a remedy assigning a guest context ID, got %q", got[2].Remedy)
+	}
+	got[2].Remedy = ""
+	want := []Result{
+		{Status: OK, Detail: "2 (host)"},
+		{Status: OK, Detail: "3 (guest)"},
+		{Status: Warn, Detail: "0, which is reserved"},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected results (-want +got):\n%s", diff)
+	}
+}
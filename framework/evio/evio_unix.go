@@ -7,6 +7,7 @@
 package evio
 
 import (
+	"context"
 	"io"
 	"net"
 	"os"
@@ -16,8 +17,9 @@ import (
 	"syscall"
 	"time"
 
-	reuseport "github.com/kavu/go_reuseport"
-	"github.com/tidwall/evio/internal"
+	"golang.org/x/sys/unix"
+
+	"github.com/multiverse-os/vcable/framework/evio/internal"
 )
 
 type conn struct {
@@ -532,10 +534,27 @@ func (ln *listener) system() error {
 	return syscall.SetNonblock(ln.fd, true)
 }
 
+// reuseport sets SO_REUSEADDR and SO_REUSEPORT, so that several loops may
+// listen on the same address.
+var reuseport = net.ListenConfig{
+	Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+			if err == nil {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	},
+}
+
 func reuseportListenPacket(proto, addr string) (l net.PacketConn, err error) {
-	return reuseport.ListenPacket(proto, addr)
+	return reuseport.ListenPacket(context.Background(), proto, addr)
 }
 
 func reuseportListen(proto, addr string) (l net.Listener, err error) {
-	return reuseport.Listen(proto, addr)
+	return reuseport.Listen(context.Background(), proto, addr)
 }
@@ -10,7 +10,7 @@ import (
 	"log"
 	"strings"
 
-	"github.com/tidwall/evio"
+	"github.com/multiverse-os/vcable/framework/evio"
 )
 
 func main() {
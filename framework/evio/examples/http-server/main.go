@@ -14,7 +14,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/tidwall/evio"
+	"github.com/multiverse-os/vcable/framework/evio"
 )
 
 var res string
@@ -0,0 +1,481 @@
+package guestfs
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	transfer "github.com/multiverse-os/vcable/framework/agent/transfer"
+	"golang.org/x/sys/unix"
+)
+
+// The parts of the FUSE kernel protocol a read-only file system needs, from
+// linux/fuse.h. Requests start with a 40 byte header, replies with a 16
+// byte one, all in the byte order of the machine.
+
+const (
+	opLookup      = 1
+	opForget      = 2
+	opGetattr     = 3
+	opOpen        = 14
+	opRead        = 15
+	opStatfs      = 17
+	opRelease     = 18
+	opFlush       = 25
+	opInit        = 26
+	opOpendir     = 27
+	opReaddir     = 28
+	opReleasedir  = 29
+	opAccess      = 34
+	opInterrupt   = 36
+	opDestroy     = 38
+	opBatchForget = 42
+)
+
+const (
+	kernelMajor = 7
+	kernelMinor = 31
+
+	rootID       = 1
+	inHeaderSize = 40
+	attrSize     = 88
+	// maxRead is the largest read the kernel is allowed to ask for, and
+	// bounds the size of requests.
+	maxRead = 128 << 10
+
+	initAutoInvalData = 1 << 12
+	openKeepCache     = 1 << 1
+	openCacheDir      = 1 << 3
+)
+
+// Cache configures what the kernel may cache of a file system.
+type Cache struct {
+	// Timeout is how long names and attributes are cached. Zero means a
+	// second, a negative duration disables caching them.
+	Timeout time.Duration
+	// Data keeps the contents of files and directories cached when they
+	// are opened again, until their modification time or size is seen to
+	// change.
+	Data bool
+}
+
+func (self Cache) timeout() time.Duration {
+	switch {
+	case self.Timeout == 0:
+		return time.Second
+	case self.Timeout < 0:
+		return 0
+	}
+	return self.Timeout
+}
+
+// FS is a read-only file system. Names are slash separated and relative to
+// its root, which is "".
+type FS interface {
+	Stat(ctx context.Context, name string) (transfer.Entry, error)
+	ReadDir(ctx context.Context, name string) ([]transfer.Entry, error)
+	ReadAt(ctx context.Context, name string, b []byte, offset int64) (int, error)
+}
+
+type request struct {
+	opcode uint32
+	unique uint64
+	node   uint64
+	body   []byte
+}
+
+// server answers the requests of the kernel read from dev.
+type server struct {
+	fs    FS
+	dev   *os.File
+	cache Cache
+	uid   uint32
+	gid   uint32
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nodes   map[uint64]*node
+	ids     map[string]uint64
+	nextID  uint64
+	handles map[uint64][]transfer.Entry
+	nextFH  uint64
+}
+
+type node struct {
+	name    string
+	lookups uint64
+}
+
+func newServer(fsys FS, dev *os.File, cache Cache) *server {
+	return &server{
+		fs:      fsys,
+		dev:     dev,
+		cache:   cache,
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		nodes:   map[uint64]*node{rootID: {name: ""}},
+		ids:     map[string]uint64{"": rootID},
+		nextID:  rootID + 1,
+		handles: make(map[uint64][]transfer.Entry),
+	}
+}
+
+// serve answers requests until the file system is unmounted. Requests
+// other than the first, which sets up the session, are answered
+// concurrently.
+func (self *server) serve(ctx context.Context) error {
+	buf := make([]byte, maxRead+4096)
+	for {
+		n, err := self.dev.Read(buf)
+		switch {
+		case errors.Is(err, syscall.ENOENT), errors.Is(err, syscall.EINTR), errors.Is(err, syscall.EAGAIN):
+			// The request was interrupted before it was read.
+			continue
+		case errors.Is(err, syscall.ENODEV), err == io.EOF:
+			return nil
+		case err != nil:
+			return err
+		}
+		if n < inHeaderSize {
+			continue
+		}
+		req := request{
+			opcode: binary.NativeEndian.Uint32(buf[4:]),
+			unique: binary.NativeEndian.Uint64(buf[8:]),
+			node:   binary.NativeEndian.Uint64(buf[16:]),
+			body:   append([]byte(nil), buf[inHeaderSize:n]...),
+		}
+		switch req.opcode {
+		case opInit:
+			self.init(req)
+		case opDestroy:
+			self.reply(req, 0, nil)
+			return nil
+		default:
+			go self.handle(ctx, req)
+		}
+	}
+}
+
+func (self *server) handle(ctx context.Context, req request) {
+	switch req.opcode {
+	case opLookup:
+		self.lookup(ctx, req)
+	case opForget:
+		if len(req.body) >= 8 {
+			self.forget(req.node, binary.NativeEndian.Uint64(req.body))
+		}
+	case opBatchForget:
+		if len(req.body) < 8 {
+			return
+		}
+		count := binary.NativeEndian.Uint32(req.body)
+		for i, b := 0, req.body[8:]; i < int(count) && len(b) >= 16; i, b = i+1, b[16:] {
+			self.forget(binary.NativeEndian.Uint64(b), binary.NativeEndian.Uint64(b[8:]))
+		}
+	case opGetattr:
+		self.getattr(ctx, req)
+	case opOpen:
+		if len(req.body) >= 4 && binary.NativeEndian.Uint32(req.body)&unix.O_ACCMODE != unix.O_RDONLY {
+			self.reply(req, syscall.EROFS, nil)
+			return
+		}
+		self.reply(req, 0, self.openOut(0))
+	case opRead:
+		self.read(ctx, req)
+	case opOpendir:
+		self.opendir(ctx, req)
+	case opReaddir:
+		self.readdir(req)
+	case opReleasedir:
+		if len(req.body) >= 8 {
+			self.mutex.Lock()
+			delete(self.handles, binary.NativeEndian.Uint64(req.body))
+			self.mutex.Unlock()
+		}
+		self.reply(req, 0, nil)
+	case opRelease, opFlush, opAccess:
+		self.reply(req, 0, nil)
+	case opStatfs:
+		out := make([]byte, 80)
+		binary.NativeEndian.PutUint32(out[40:], 4096) // bsize
+		binary.NativeEndian.PutUint32(out[44:], 255)  // namelen
+		binary.NativeEndian.PutUint32(out[48:], 4096) // frsize
+		self.reply(req, 0, out)
+	case opInterrupt:
+		// Requests are not interrupted; they end on their own.
+	default:
+		self.reply(req, syscall.ENOSYS, nil)
+	}
+}
+
+func (self *server) init(req request) {
+	if len(req.body) < 8 || binary.NativeEndian.Uint32(req.body) != kernelMajor {
+		self.reply(req, syscall.EPROTO, nil)
+		return
+	}
+	minor := binary.NativeEndian.Uint32(req.body[4:])
+	if minor > kernelMinor {
+		minor = kernelMinor
+	}
+	var flags uint32
+	if len(req.body) >= 16 && self.cache.Data {
+		flags = binary.NativeEndian.Uint32(req.body[12:]) & initAutoInvalData
+	}
+	out := make([]byte, 64)
+	binary.NativeEndian.PutUint32(out[0:], kernelMajor)
+	binary.NativeEndian.PutUint32(out[4:], minor)
+	binary.NativeEndian.PutUint32(out[8:], maxRead) // max_readahead
+	binary.NativeEndian.PutUint32(out[12:], flags)
+	binary.NativeEndian.PutUint16(out[16:], 16)   // max_background
+	binary.NativeEndian.PutUint16(out[18:], 12)   // congestion_threshold
+	binary.NativeEndian.PutUint32(out[20:], 4096) // max_write
+	binary.NativeEndian.PutUint32(out[24:], 1)    // time_gran
+	self.reply(req, 0, out)
+}
+
+func (self *server) lookup(ctx context.Context, req request) {
+	parent, ok := self.name(req.node)
+	if !ok {
+		self.reply(req, syscall.ENOENT, nil)
+		return
+	}
+	name := strings.TrimRight(string(req.body), "\x00")
+	if parent != "" {
+		name = parent + "/" + name
+	}
+	entry, err := self.fs.Stat(ctx, name)
+	if err != nil {
+		self.reply(req, errno(err), nil)
+		return
+	}
+
+	self.mutex.Lock()
+	id, ok := self.ids[name]
+	if !ok {
+		id = self.nextID
+		self.nextID++
+		self.ids[name] = id
+		self.nodes[id] = &node{name: name}
+	}
+	self.nodes[id].lookups++
+	self.mutex.Unlock()
+
+	out := make([]byte, 40+attrSize)
+	binary.NativeEndian.PutUint64(out[0:], id)
+	self.putValid(out[16:], out[32:])
+	self.putValid(out[24:], out[36:])
+	self.putAttr(out[40:], id, entry)
+	self.reply(req, 0, out)
+}
+
+func (self *server) forget(id, lookups uint64) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	n, ok := self.nodes[id]
+	if !ok || id == rootID {
+		return
+	}
+	if n.lookups <= lookups {
+		delete(self.nodes, id)
+		delete(self.ids, n.name)
+		return
+	}
+	n.lookups -= lookups
+}
+
+func (self *server) getattr(ctx context.Context, req request) {
+	name, ok := self.name(req.node)
+	if !ok {
+		self.reply(req, syscall.ENOENT, nil)
+		return
+	}
+	entry, err := self.fs.Stat(ctx, name)
+	if err != nil {
+		self.reply(req, errno(err), nil)
+		return
+	}
+	out := make([]byte, 16+attrSize)
+	self.putValid(out[0:], out[8:])
+	self.putAttr(out[16:], req.node, entry)
+	self.reply(req, 0, out)
+}
+
+func (self *server) read(ctx context.Context, req request) {
+	name, ok := self.name(req.node)
+	if !ok || len(req.body) < 24 {
+		self.reply(req, syscall.ENOENT, nil)
+		return
+	}
+	offset := int64(binary.NativeEndian.Uint64(req.body[8:]))
+	size := binary.NativeEndian.Uint32(req.body[16:])
+	if size > maxRead {
+		size = maxRead
+	}
+	b := make([]byte, size)
+	var n int
+	for n < len(b) {
+		read, err := self.fs.ReadAt(ctx, name, b[n:], offset+int64(n))
+		n += read
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			self.reply(req, errno(err), nil)
+			return
+		}
+	}
+	self.reply(req, 0, b[:n])
+}
+
+// opendir lists the directory once, so that it reads consistently however
+// the kernel splits reading it.
+func (self *server) opendir(ctx context.Context, req request) {
+	name, ok := self.name(req.node)
+	if !ok {
+		self.reply(req, syscall.ENOENT, nil)
+		return
+	}
+	entries, err := self.fs.ReadDir(ctx, name)
+	if err != nil {
+		self.reply(req, errno(err), nil)
+		return
+	}
+	self.mutex.Lock()
+	self.nextFH++
+	fh := self.nextFH
+	self.handles[fh] = entries
+	self.mutex.Unlock()
+
+	self.reply(req, 0, self.openOut(fh))
+}
+
+func (self *server) readdir(req request) {
+	if len(req.body) < 24 {
+		self.reply(req, syscall.EINVAL, nil)
+		return
+	}
+	fh := binary.NativeEndian.Uint64(req.body)
+	offset := binary.NativeEndian.Uint64(req.body[8:])
+	size := int(binary.NativeEndian.Uint32(req.body[16:]))
+	self.mutex.Lock()
+	entries, ok := self.handles[fh]
+	self.mutex.Unlock()
+	if !ok {
+		self.reply(req, syscall.EBADF, nil)
+		return
+	}
+
+	var out []byte
+	for i := offset; i < uint64(len(entries)); i++ {
+		entry := entries[i]
+		// Each record is padded to 8 bytes.
+		length := 24 + len(entry.Name)
+		padded := (length + 7) &^ 7
+		if len(out)+padded > size {
+			break
+		}
+		record := make([]byte, padded)
+		binary.NativeEndian.PutUint64(record[0:], 0xffffffff) // unknown inode
+		binary.NativeEndian.PutUint64(record[8:], i+1)        // offset of the next record
+		binary.NativeEndian.PutUint32(record[16:], uint32(len(entry.Name)))
+		binary.NativeEndian.PutUint32(record[20:], mode(entry)>>12)
+		copy(record[24:], entry.Name)
+		out = append(out, record...)
+	}
+	self.reply(req, 0, out)
+}
+
+func (self *server) name(id uint64) (string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	n, ok := self.nodes[id]
+	if !ok {
+		return "", false
+	}
+	return n.name, true
+}
+
+// putAttr encodes the attributes of entry. Files belong to the user serving
+// the file system, who can always read them, and are never writable.
+func (self *server) putAttr(b []byte, id uint64, entry transfer.Entry) {
+	binary.NativeEndian.PutUint64(b[0:], id)
+	binary.NativeEndian.PutUint64(b[8:], uint64(entry.Size))
+	binary.NativeEndian.PutUint64(b[16:], uint64(entry.Size+511)/512)
+	for _, at := range []int{24, 32, 40} {
+		binary.NativeEndian.PutUint64(b[at:], uint64(entry.ModTime.Unix()))
+	}
+	for _, at := range []int{48, 52, 56} {
+		binary.NativeEndian.PutUint32(b[at:], uint32(entry.ModTime.Nanosecond()))
+	}
+	binary.NativeEndian.PutUint32(b[60:], mode(entry))
+	nlink := uint32(1)
+	if entry.Dir {
+		nlink = 2
+	}
+	binary.NativeEndian.PutUint32(b[64:], nlink)
+	binary.NativeEndian.PutUint32(b[68:], self.uid)
+	binary.NativeEndian.PutUint32(b[72:], self.gid)
+	binary.NativeEndian.PutUint32(b[80:], 4096) // blksize
+}
+
+func mode(entry transfer.Entry) uint32 {
+	if entry.Dir {
+		return unix.S_IFDIR | (uint32(entry.Mode.Perm())|0500)&^0222
+	}
+	return unix.S_IFREG | (uint32(entry.Mode.Perm())|0400)&^0222
+}
+
+func (self *server) putValid(seconds, nanoseconds []byte) {
+	valid := self.cache.timeout()
+	binary.NativeEndian.PutUint64(seconds, uint64(valid/time.Second))
+	binary.NativeEndian.PutUint32(nanoseconds, uint32(valid%time.Second))
+}
+
+// openOut answers the opening of a file or directory as handle fh.
+func (self *server) openOut(fh uint64) []byte {
+	out := make([]byte, 16)
+	binary.NativeEndian.PutUint64(out, fh)
+	if self.cache.Data {
+		binary.NativeEndian.PutUint32(out[8:], openKeepCache|openCacheDir)
+	}
+	return out
+}
+
+func errno(err error) syscall.Errno {
+	var e syscall.Errno
+	switch {
+	case errors.As(err, &e):
+		return e
+	case errors.Is(err, fs.ErrNotExist):
+		return syscall.ENOENT
+	case errors.Is(err, fs.ErrPermission):
+		return syscall.EACCES
+	}
+	return syscall.EIO
+}
+
+// reply answers req with errno, or with out if errno is zero.
+func (self *server) reply(req request, e syscall.Errno, out []byte) {
+	if e != 0 {
+		out = nil
+	}
+	b := make([]byte, 16+len(out))
+	binary.NativeEndian.PutUint32(b[0:], uint32(len(b)))
+	binary.NativeEndian.PutUint32(b[4:], uint32(-int32(e)))
+	binary.NativeEndian.PutUint64(b[8:], req.unique)
+	copy(b[16:], out)
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	// The kernel fails replies to requests which were interrupted in the
+	// meantime; there is nothing to do about those.
+	self.dev.Write(b)
+}
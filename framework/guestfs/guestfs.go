@@ -0,0 +1,309 @@
+// Package guestfs mounts files from across the cable with FUSE.
+//
+// On the host, a View has a directory per guest, backed by the transfer
+// service of the agent in that guest, so that operators can browse guest
+// files with the usual tools:
+//
+//	/vcable/<guest>/etc/os-release
+//
+// Inside a guest, a Share mounts a directory the host exports with a
+// transfer service, for shared folders without virtiofs.
+//
+// The file systems are read only.
+package guestfs
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	transfer "github.com/multiverse-os/vcable/framework/agent/transfer"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// DefaultMountPoint is where the guest file systems are usually mounted.
+const DefaultMountPoint = "/vcable"
+
+// Guest is a guest shown in a View.
+type Guest struct {
+	Name      string
+	ContextID uint32
+}
+
+// View is the FS showing guests as directories.
+type View struct {
+	// Guests lists the guests to show.
+	Guests func() ([]Guest, error)
+	// Dial connects to the transfer service of the guest with context ID
+	// cid. Defaults to dialing transfer.Port of the guest.
+	Dial func(cid uint32) (net.Conn, error)
+
+	mutex   sync.Mutex
+	clients map[string]*transfer.Client
+	started time.Time
+}
+
+var _ FS = &View{}
+
+// split splits name into the guest and the name inside it.
+func split(name string) (string, string) {
+	guest, rest, _ := strings.Cut(name, "/")
+	if rest == "" {
+		rest = "."
+	}
+	return guest, rest
+}
+
+func (self *View) Stat(ctx context.Context, name string) (transfer.Entry, error) {
+	if name == "" {
+		return transfer.Entry{Dir: true, Mode: 0555, ModTime: self.startTime()}, nil
+	}
+	guest, rest := split(name)
+	client, err := self.client(guest)
+	if err != nil {
+		return transfer.Entry{}, err
+	}
+	entry, err := client.Stat(ctx, rest)
+	entry.Name = path.Base(name)
+	return entry, err
+}
+
+func (self *View) ReadDir(ctx context.Context, name string) ([]transfer.Entry, error) {
+	if name == "" {
+		guests, err := self.Guests()
+		if err != nil {
+			return nil, err
+		}
+		entries := make([]transfer.Entry, len(guests))
+		for i, guest := range guests {
+			entries[i] = transfer.Entry{Name: guest.Name, Dir: true, Mode: 0555, ModTime: self.startTime()}
+		}
+		return entries, nil
+	}
+	guest, rest := split(name)
+	client, err := self.client(guest)
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadDir(ctx, rest)
+}
+
+func (self *View) ReadAt(ctx context.Context, name string, b []byte, offset int64) (int, error) {
+	guest, rest := split(name)
+	client, err := self.client(guest)
+	if err != nil {
+		return 0, err
+	}
+	return client.ReadAt(ctx, rest, b, offset)
+}
+
+func (self *View) startTime() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.started.IsZero() {
+		self.started = time.Now()
+	}
+	return self.started
+}
+
+// client returns a client of the transfer service of the guest called
+// name, connecting again once a connection broke.
+func (self *View) client(name string) (*transfer.Client, error) {
+	self.mutex.Lock()
+	client, ok := self.clients[name]
+	self.mutex.Unlock()
+	if ok && client.Err() == nil {
+		return client, nil
+	}
+
+	guests, err := self.Guests()
+	if err != nil {
+		return nil, err
+	}
+	var cid uint32
+	found := false
+	for _, guest := range guests {
+		if guest.Name == name {
+			cid, found = guest.ContextID, true
+			break
+		}
+	}
+	if !found {
+		return nil, os.ErrNotExist
+	}
+	dial := self.Dial
+	if dial == nil {
+		dial = func(cid uint32) (net.Conn, error) { return vsock.DialGuest(cid, transfer.Port) }
+	}
+	conn, err := dial(cid)
+	if err != nil {
+		return nil, err
+	}
+	client = transfer.NewClient(conn)
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.clients == nil {
+		self.clients = make(map[string]*transfer.Client)
+	}
+	if old, ok := self.clients[name]; ok && old != client {
+		old.Close()
+	}
+	self.clients[name] = client
+	return client, nil
+}
+
+// Close closes the connections to the guests.
+func (self *View) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for name, client := range self.clients {
+		client.Close()
+		delete(self.clients, name)
+	}
+	return nil
+}
+
+// Share is the FS of a directory exported by a transfer service, usually
+// one the host runs for its guests on SharePort.
+type Share struct {
+	// Dial connects to the transfer service. Defaults to dialing SharePort
+	// on the host.
+	Dial func() (net.Conn, error)
+
+	mutex  sync.Mutex
+	client *transfer.Client
+}
+
+// SharePort is the host port directories are usually shared on.
+const SharePort = vsock.PortShare
+
+var _ FS = &Share{}
+
+func (self *Share) Stat(ctx context.Context, name string) (transfer.Entry, error) {
+	client, err := self.connect()
+	if err != nil {
+		return transfer.Entry{}, err
+	}
+	return client.Stat(ctx, shareName(name))
+}
+
+func (self *Share) ReadDir(ctx context.Context, name string) ([]transfer.Entry, error) {
+	client, err := self.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.ReadDir(ctx, shareName(name))
+}
+
+func (self *Share) ReadAt(ctx context.Context, name string, b []byte, offset int64) (int, error) {
+	client, err := self.connect()
+	if err != nil {
+		return 0, err
+	}
+	return client.ReadAt(ctx, shareName(name), b, offset)
+}
+
+func shareName(name string) string {
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// connect returns the client of the transfer service, connecting again
+// once a connection broke.
+func (self *Share) connect() (*transfer.Client, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.client != nil && self.client.Err() == nil {
+		return self.client, nil
+	}
+	dial := self.Dial
+	if dial == nil {
+		dial = func() (net.Conn, error) { return vsock.DialHost(SharePort) }
+	}
+	conn, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if self.client != nil {
+		self.client.Close()
+	}
+	self.client = transfer.NewClient(conn)
+	return self.client, nil
+}
+
+// Close closes the connection to the transfer service.
+func (self *Share) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.client == nil {
+		return nil
+	}
+	return self.client.Close()
+}
+
+// Mount serves an FS at a mount point.
+type Mount struct {
+	Dir string
+	FS  FS
+	// Cache sets what the kernel caches.
+	Cache Cache
+	// AllowOther lets users other than the one mounting access the file
+	// system.
+	AllowOther bool
+	ErrorLog   *log.Logger
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+}
+
+// Serve mounts the file system and serves it until it is unmounted, by
+// Close or otherwise.
+func (self *Mount) Serve() error {
+	if self.FS == nil {
+		return fmt.Errorf("guestfs: no file system to mount")
+	}
+	dev, err := mount(self.Dir, self.AllowOther)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	self.mutex.Lock()
+	self.cancel = cancel
+	self.mutex.Unlock()
+
+	err = newServer(self.FS, dev, self.Cache).serve(ctx)
+	if err != nil {
+		self.logf("guestfs: %v", err)
+	}
+	return err
+}
+
+// Close unmounts the file system.
+func (self *Mount) Close() error {
+	self.mutex.Lock()
+	if self.cancel != nil {
+		self.cancel()
+	}
+	self.mutex.Unlock()
+	return unmount(self.Dir)
+}
+
+func (self *Mount) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,139 @@
+package guestfs
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	transfer "github.com/multiverse-os/vcable/framework/agent/transfer"
+)
+
+// run runs a command on the mount. The mount is used from other processes:
+// the runtime polls the files this one opens, which it cannot while the
+// kernel waits for this process to answer whether they can be polled.
+func run(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).Output()
+	return string(out), err
+}
+
+// mountTest mounts fsys until the end of the test, and returns the mount
+// point once the root lists as want.
+func mountTest(t *testing.T, fsys FS, cache Cache, want string) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	dir := t.TempDir()
+	m := &Mount{Dir: dir, FS: fsys, Cache: cache}
+	served := make(chan error, 1)
+	go func() { served <- m.Serve() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if out, _ := run("ls", dir); out == want {
+			break
+		}
+		select {
+		case err := <-served:
+			t.Skipf("cannot mount: %v", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			m.Close()
+			t.Fatalf("mount did not show up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Cleanup(func() {
+		if err := m.Close(); err != nil {
+			t.Errorf("failed to unmount: %v", err)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("failed to serve: %v", err)
+		}
+	})
+	return dir
+}
+
+func serviceDial(root string) func() (net.Conn, error) {
+	service := &transfer.Service{Root: root, ReadOnly: true}
+	return func() (net.Conn, error) {
+		client, server := net.Pipe()
+		go service.Serve(server)
+		return client, nil
+	}
+}
+
+func writeFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("failed to create directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+}
+
+func TestView(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "etc", "hostname"), "guest\n")
+	dial := serviceDial(root)
+	view := &View{
+		Guests: func() ([]Guest, error) { return []Guest{{Name: "web", ContextID: 3}}, nil },
+		Dial:   func(uint32) (net.Conn, error) { return dial() },
+	}
+	defer view.Close()
+	dir := mountTest(t, view, Cache{}, "web\n")
+
+	out, err := run("ls", filepath.Join(dir, "web", "etc"))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if diff := cmp.Diff("hostname\n", out); diff != "" {
+		t.Fatalf("unexpected entries (-want +got):\n%s", diff)
+	}
+	out, err = run("cat", filepath.Join(dir, "web", "etc", "hostname"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if diff := cmp.Diff("guest\n", out); diff != "" {
+		t.Fatalf("unexpected file (-want +got):\n%s", diff)
+	}
+	if _, err := run("stat", filepath.Join(dir, "web", "missing")); err == nil {
+		t.Fatalf("expected a missing file")
+	}
+	if _, err := run("touch", filepath.Join(dir, "web", "etc", "new")); err == nil {
+		t.Fatalf("expected the file system to be read only")
+	}
+}
+
+func TestShare(t *testing.T) {
+	root := t.TempDir()
+	writeFile(t, filepath.Join(root, "notes.txt"), "first")
+	share := &Share{Dial: serviceDial(root)}
+	defer share.Close()
+	// Contents are kept, but attributes are checked on every access.
+	dir := mountTest(t, share, Cache{Timeout: -1, Data: true}, "notes.txt\n")
+
+	out, err := run("cat", filepath.Join(dir, "notes.txt"))
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if diff := cmp.Diff("first", out); diff != "" {
+		t.Fatalf("unexpected file (-want +got):\n%s", diff)
+	}
+
+	// A change on the host shows, despite the cached contents.
+	writeFile(t, filepath.Join(root, "notes.txt"), "second version")
+	out, err = run("cat", filepath.Join(dir, "notes.txt"))
+	if err != nil {
+		t.Fatalf("failed to read file again: %v", err)
+	}
+	if diff := cmp.Diff("second version", out); diff != "" {
+		t.Fatalf("unexpected changed file (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,104 @@
+package guestfs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"golang.org/x/sys/unix"
+)
+
+// mount mounts a read-only FUSE file system at dir and returns the device
+// to serve it through. Root mounts it directly, other users need the
+// setuid fusermount3 helper of libfuse.
+func mount(dir string, allowOther bool) (*os.File, error) {
+	if os.Geteuid() == 0 {
+		return mountDirect(dir, allowOther)
+	}
+	return mountHelper(dir, allowOther)
+}
+
+func mountDirect(dir string, allowOther bool) (*os.File, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return nil, fmt.Errorf("guestfs: %s: %v", dir, err)
+	}
+	fd, err := unix.Open("/dev/fuse", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("guestfs: /dev/fuse: %v", err)
+	}
+	data := fmt.Sprintf("fd=%d,rootmode=%o,user_id=%d,group_id=%d", fd, st.Mode&unix.S_IFMT, os.Getuid(), os.Getgid())
+	if allowOther {
+		data += ",allow_other"
+	}
+	flags := uintptr(unix.MS_RDONLY | unix.MS_NOSUID | unix.MS_NODEV)
+	if err := unix.Mount("vcable", dir, "fuse.vcable", flags, data); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("guestfs: mount %s: %v", dir, err)
+	}
+	return os.NewFile(uintptr(fd), "/dev/fuse"), nil
+}
+
+// mountHelper has fusermount3 mount dir; it hands back the device over a
+// socket named by _FUSE_COMMFD.
+func mountHelper(dir string, allowOther bool) (*os.File, error) {
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		if helper, err = exec.LookPath("fusermount"); err != nil {
+			return nil, fmt.Errorf("guestfs: mounting needs root or fusermount3")
+		}
+	}
+	pair, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+	local := os.NewFile(uintptr(pair[0]), "fusermount")
+	remote := os.NewFile(uintptr(pair[1]), "fusermount")
+	defer local.Close()
+
+	options := "ro,nosuid,nodev,fsname=vcable,subtype=vcable"
+	if allowOther {
+		options += ",allow_other"
+	}
+	cmd := exec.Command(helper, "-o", options, "--", dir)
+	cmd.Env = append(os.Environ(), "_FUSE_COMMFD=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	remote.Close()
+	if err != nil {
+		return nil, fmt.Errorf("guestfs: %s: %v", helper, err)
+	}
+
+	b := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(4))
+	_, oobn, _, _, err := unix.Recvmsg(pair[0], b, oob, 0)
+	if err != nil {
+		return nil, fmt.Errorf("guestfs: %s: %v", helper, err)
+	}
+	messages, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(messages) == 0 {
+		return nil, fmt.Errorf("guestfs: %s passed no device", helper)
+	}
+	fds, err := unix.ParseUnixRights(&messages[0])
+	if err != nil || len(fds) == 0 {
+		return nil, fmt.Errorf("guestfs: %s passed no device", helper)
+	}
+	unix.CloseOnExec(fds[0])
+	return os.NewFile(uintptr(fds[0]), "/dev/fuse"), nil
+}
+
+// unmount lazily unmounts dir, so it goes even while in use.
+func unmount(dir string) error {
+	if os.Geteuid() == 0 {
+		return unix.Unmount(dir, unix.MNT_DETACH)
+	}
+	helper, err := exec.LookPath("fusermount3")
+	if err != nil {
+		helper = "fusermount"
+	}
+	if out, err := exec.Command(helper, "-u", "-z", dir).CombinedOutput(); err != nil {
+		return fmt.Errorf("guestfs: %s: %v: %s", helper, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+// Package handoff moves established vsock connections from a running process
+// to its replacement, so long-lived cables survive an agent upgrade.
+//
+// The outgoing process offers its connections on a Unix socket; the new
+// process claims them. Each connection travels as its file descriptor plus
+// an opaque state blob, in which the application serializes whatever it
+// holds in user space: buffered but unprocessed input, sequence numbers,
+// session identifiers.
+package handoff
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"golang.org/x/sys/unix"
+)
+
+const maxHeader = 64 << 20
+
+// Item is one connection being handed off.
+type Item struct {
+	// Name identifies the connection to the new process.
+	Name string
+	// State is opaque application state restored alongside the connection.
+	State []byte
+	Conn  *vsock.Conn
+}
+
+type header struct {
+	Name  string `json:"name"`
+	State []byte `json:"state,omitempty"`
+}
+
+// Offer listens on the Unix socket at path, waits up to timeout for the new
+// process to claim the items, and returns once it has acknowledged them.
+// Only a process of the same user may claim them. The caller must then stop
+// using its connections, and should close them: the new process holds its
+// own descriptors.
+func Offer(path string, items []Item, timeout time.Duration) error {
+	l, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer l.Close()
+	if timeout > 0 {
+		l.SetDeadline(time.Now().Add(timeout))
+	}
+
+	for {
+		uc, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		// Only a process of the same user may take the connections.
+		if uid, err := peerUID(uc); err != nil || uid != os.Geteuid() {
+			uc.Close()
+			continue
+		}
+		defer uc.Close()
+		if timeout > 0 {
+			uc.SetDeadline(time.Now().Add(timeout))
+		}
+		return Send(uc, items)
+	}
+}
+
+// listenPrivate listens on a Unix socket at path that only the current user
+// may connect to. The socket is bound in a private directory and moved into
+// place, so it is never reachable with looser permissions.
+func listenPrivate(path string) (*net.UnixListener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".handoff")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is unlinked at path, not where it was bound.
+	l.SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	os.Remove(path)
+	if err := os.Rename(bound, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// peerUID returns the user ID of the process at the other end of uc.
+func peerUID(uc *net.UnixConn) (int, error) {
+	rc, err := uc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *unix.Ucred
+	doErr := rc.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if doErr != nil {
+		return 0, doErr
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(cred.Uid), nil
+}
+
+// Claim connects to the Unix socket at path and receives the connections
+// offered by the outgoing process.
+func Claim(path string, timeout time.Duration) ([]Item, error) {
+	uc, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer uc.Close()
+	if timeout > 0 {
+		uc.SetDeadline(time.Now().Add(timeout))
+	}
+
+	return Receive(uc)
+}
+
+// Send writes items to uc and waits for the receiver's acknowledgement.
+func Send(uc *net.UnixConn, items []Item) error {
+	for _, item := range items {
+		f, err := item.Conn.File()
+		if err != nil {
+			return err
+		}
+		err = send(uc, f, header{Name: item.Name, State: item.State})
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("handoff: %s: %v", item.Name, err)
+		}
+	}
+	if err := send(uc, nil, header{}); err != nil {
+		return err
+	}
+
+	var ack [1]byte
+	if _, err := io.ReadFull(uc, ack[:]); err != nil {
+		return fmt.Errorf("handoff: no acknowledgement from receiver: %v", err)
+	}
+	return nil
+}
+
+// send writes a length prefix carrying f, if any, followed by the header.
+// A nil f marks the end of the items.
+func send(uc *net.UnixConn, f *os.File, h header) error {
+	var b []byte
+	if f != nil {
+		var err error
+		if b, err = json.Marshal(h); err != nil {
+			return err
+		}
+	}
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(b)))
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	if _, _, err := uc.WriteMsgUnix(length[:], oob, nil); err != nil {
+		return err
+	}
+	_, err := uc.Write(b)
+	return err
+}
+
+// Receive reads the items sent on uc and acknowledges them. On error, any
+// connections already received are closed.
+func Receive(uc *net.UnixConn) (items []Item, err error) {
+	defer func() {
+		if err != nil {
+			for _, item := range items {
+				item.Conn.Close()
+			}
+			items = nil
+		}
+	}()
+
+	for {
+		var length [4]byte
+		oob := make([]byte, unix.CmsgSpace(4))
+		n, oobn, _, _, err := uc.ReadMsgUnix(length[:], oob)
+		if err != nil {
+			return items, err
+		}
+		f, err := parseRights(oob[:oobn])
+		if err != nil {
+			return items, err
+		}
+		if n < len(length) {
+			if _, err := io.ReadFull(uc, length[n:]); err != nil {
+				closeFile(f)
+				return items, err
+			}
+		}
+
+		size := binary.BigEndian.Uint32(length[:])
+		if size == 0 && f == nil {
+			break
+		}
+		if f == nil {
+			return items, fmt.Errorf("handoff: item without a descriptor")
+		}
+		if size > maxHeader {
+			f.Close()
+			return items, fmt.Errorf("handoff: header of %d bytes exceeds limit", size)
+		}
+
+		b := make([]byte, size)
+		if _, err := io.ReadFull(uc, b); err != nil {
+			f.Close()
+			return items, err
+		}
+		var h header
+		if err := json.Unmarshal(b, &h); err != nil {
+			f.Close()
+			return items, err
+		}
+
+		conn, err := vsock.FileConn(f)
+		f.Close()
+		if err != nil {
+			return items, fmt.Errorf("handoff: %s: %v", h.Name, err)
+		}
+		items = append(items, Item{Name: h.Name, State: h.State, Conn: conn})
+	}
+
+	if _, err := uc.Write([]byte{1}); err != nil {
+		return items, err
+	}
+	return items, nil
+}
+
+func parseRights(oob []byte) (*os.File, error) {
+	if len(oob) == 0 {
+		return nil, nil
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+
+	var f *os.File
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if f == nil {
+				f = os.NewFile(uintptr(fd), "handoff")
+			} else {
+				unix.Close(fd)
+			}
+		}
+	}
+	return f, nil
+}
+
+func closeFile(f *os.File) {
+	if f != nil {
+		f.Close()
+	}
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package handoff
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+	"golang.org/x/sys/unix"
+)
+
+// unixPair returns both ends of a Unix socket pair.
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("failed to create socket pair: %v", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("failed to create connection: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+		t.Cleanup(func() { c.Close() })
+	}
+	return conns[0], conns[1]
+}
+
+func TestOfferClaim(t *testing.T) {
+	l, err := vsock.Listen(0)
+	if err != nil {
+		t.Skipf("vsock unavailable: %v", err)
+	}
+	defer l.Close()
+	local := l.Addr().(*vsock.Addr)
+	c, err := vsock.DialContext(context.Background(), local.ContextID, local.Port, vsock.WithTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Skipf("no loopback transport: %v", err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer peer.Close()
+
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	offered := make(chan error, 1)
+	go func() {
+		offered <- Offer(path, []Item{{Name: "cable", State: []byte("seq=42"), Conn: c}}, 5*time.Second)
+	}()
+	var items []Item
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if items, err = Claim(path, 5*time.Second); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	if err := <-offered; err != nil {
+		t.Fatalf("failed to offer: %v", err)
+	}
+	if len(items) != 1 {
+		t.Fatalf("expected one item, got %d", len(items))
+	}
+	defer items[0].Conn.Close()
+	if diff := cmp.Diff([]string{"cable", "seq=42"}, []string{items[0].Name, string(items[0].State)}); diff != "" {
+		t.Fatalf("unexpected item (-want +got):\n%s", diff)
+	}
+
+	// The connection outlives the descriptor of the outgoing process.
+	c.Close()
+	if _, err := io.WriteString(items[0].Conn, "resumed"); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, len("resumed"))
+	if _, err := io.ReadFull(peer, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("resumed", string(b)); diff != "" {
+		t.Fatalf("unexpected message (-want +got):\n%s", diff)
+	}
+}
+
+func TestSendWithoutSocket(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+	l, err := network.Machine(3).Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	c, err := vsock.Dial(3, 1024)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	// Connections in memory have no descriptor to hand off; the receiver
+	// gets nothing.
+	a, b := unixPair(t)
+	received := make(chan error, 1)
+	go func() {
+		items, err := Receive(b)
+		if len(items) != 0 {
+			t.Errorf("expected no items, got %d", len(items))
+		}
+		received <- err
+	}()
+	if err := Send(a, []Item{{Name: "cable", Conn: c}}); err == nil || !strings.Contains(err.Error(), "no socket") {
+		t.Fatalf("expected Send to fail for want of a socket, got %v", err)
+	}
+	a.Close()
+	if err := <-received; err == nil {
+		t.Fatal("expected Receive to fail once the sender gave up")
+	}
+}
+
+func TestReceiveItemWithoutDescriptor(t *testing.T) {
+	a, b := unixPair(t)
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], 2)
+	a.Write(append(length[:], "{}"...))
+	if _, err := Receive(b); err == nil || !strings.Contains(err.Error(), "without a descriptor") {
+		t.Fatalf("expected an item without a descriptor to be refused, got %v", err)
+	}
+
+	// The end of the items alone is acknowledged.
+	a, b = unixPair(t)
+	go Receive(b)
+	if err := Send(a, nil); err != nil {
+		t.Fatalf("failed to send no items: %v", err)
+	}
+}
+
+func TestOfferPrivate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	offered := make(chan error, 1)
+	go func() { offered <- Offer(path, nil, 5*time.Second) }()
+
+	var fi os.FileInfo
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		var err error
+		if fi, err = os.Stat(path); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("socket never appeared: %v", err)
+		}
+	}
+	// The socket appears only once bound with its final permissions.
+	if mode := fi.Mode(); mode&os.ModeSocket == 0 || mode.Perm() != 0600 {
+		t.Fatalf("expected a socket only the user may use, got %v", mode)
+	}
+	items, err := Claim(path, 5*time.Second)
+	if err != nil || len(items) != 0 {
+		t.Fatalf("Claim() = %v, %v, want no items", items, err)
+	}
+	if err := <-offered; err != nil {
+		t.Fatalf("failed to offer: %v", err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 0 {
+		t.Fatalf("expected the socket to be removed, found %v", entries)
+	}
+}
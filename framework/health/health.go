@@ -0,0 +1,327 @@
+// Package health keeps long-lived links between host and guest agents
+// alive. A vsock connection whose peer is paused, migrated or rebooted
+// does not fail; it goes silent. Monitor frames a connection with
+// heartbeats so either end notices a silent peer, and a Manager redials
+// links that die, with backoff, reporting each change of state.
+//
+// Both ends of a monitored connection must use Monitor. Every frame is a 5
+// byte header, the frame type and the payload length, big endian, then the
+// payload. A side sends a heartbeat whenever it has sent nothing for an
+// interval, so a busy link carries none.
+package health
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	typeData uint8 = iota
+	typeHeartbeat
+	// typeEnd ends the writes of a side, while heartbeats go on.
+	typeEnd
+)
+
+const (
+	headerSize = 5
+	// maxPayload bounds the payload of a single frame.
+	maxPayload = 32 << 10
+)
+
+// ErrPeerDead ends a monitored connection whose peer sent nothing, not even
+// a heartbeat, for the timeout.
+var ErrPeerDead = errors.New("health: peer stopped responding")
+
+// Config holds the options of a monitored connection.
+type Config struct {
+	// Interval is how long a side may send nothing before it sends a
+	// heartbeat. Defaults to 5s.
+	Interval time.Duration
+	// Timeout is how long the peer may send nothing before the connection
+	// fails with ErrPeerDead. It should exceed twice the Interval of the
+	// peer. Defaults to three times Interval.
+	Timeout time.Duration
+}
+
+func (self *Config) interval() time.Duration {
+	if self == nil || self.Interval <= 0 {
+		return 5 * time.Second
+	}
+	return self.Interval
+}
+
+func (self *Config) timeout() time.Duration {
+	if self == nil || self.Timeout <= 0 {
+		return 3 * self.interval()
+	}
+	return self.Timeout
+}
+
+var _ net.Conn = &Conn{}
+
+// Conn is a connection monitored with heartbeats. A background goroutine
+// reads the frames of the peer; while Read is not called the data waits,
+// and the peer, which is not read from, is not suspected dead.
+type Conn struct {
+	conn     net.Conn
+	interval time.Duration
+	timeout  time.Duration
+
+	writeMutex sync.Mutex
+	lastWrite  atomic.Int64 // unix nanoseconds
+
+	// waiting is set while the reader waits on the peer, since the time
+	// in waitingSince.
+	waiting      atomic.Bool
+	waitingSince atomic.Int64
+
+	frames    chan []byte
+	readMutex sync.Mutex
+	pending   []byte
+
+	mutex        sync.Mutex
+	err          error
+	readDeadline time.Time
+	// deadlineChanged is closed and replaced when the read deadline
+	// changes, waking a blocked Read.
+	deadlineChanged chan struct{}
+	done            chan struct{}
+	closeOnce       sync.Once
+}
+
+// Monitor wraps conn, whose peer must be monitored too, with heartbeats.
+// config may be nil for the defaults.
+func Monitor(conn net.Conn, config *Config) *Conn {
+	c := &Conn{
+		conn:            conn,
+		interval:        config.interval(),
+		timeout:         config.timeout(),
+		frames:          make(chan []byte),
+		deadlineChanged: make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	c.lastWrite.Store(time.Now().UnixNano())
+	go c.readLoop()
+	go c.heartbeat()
+	return c
+}
+
+// Done is closed when the connection fails or is closed.
+func (self *Conn) Done() <-chan struct{} { return self.done }
+
+// Err returns why the connection ended, such as ErrPeerDead, once Done is
+// closed.
+func (self *Conn) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+// fail ends the connection with err, unless it has ended already.
+func (self *Conn) fail(err error) {
+	self.closeOnce.Do(func() {
+		self.mutex.Lock()
+		self.err = err
+		self.mutex.Unlock()
+		close(self.done)
+		self.conn.Close()
+	})
+}
+
+func (self *Conn) readLoop() {
+	header := make([]byte, headerSize)
+	ended := false
+	for {
+		self.waitingSince.Store(time.Now().UnixNano())
+		self.waiting.Store(true)
+		typ, payload, err := readFrame(self.conn, header)
+		self.waiting.Store(false)
+		if err != nil {
+			self.fail(err)
+			return
+		}
+		switch typ {
+		case typeHeartbeat:
+		case typeData:
+			if ended {
+				self.fail(fmt.Errorf("health: data after the end of the stream"))
+				return
+			}
+			select {
+			case self.frames <- payload:
+			case <-self.done:
+				return
+			}
+		case typeEnd:
+			if !ended {
+				ended = true
+				close(self.frames)
+			}
+			// Keep reading heartbeats.
+		default:
+			self.fail(fmt.Errorf("health: unknown frame type %d", typ))
+			return
+		}
+	}
+}
+
+func readFrame(r io.Reader, header []byte) (uint8, []byte, error) {
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > maxPayload {
+		return 0, nil, fmt.Errorf("health: frame of %d bytes exceeds the maximum", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, err
+	}
+	return header[0], payload, nil
+}
+
+// heartbeat sends heartbeats when the connection is idle, and fails it if
+// the peer has been silent for the timeout.
+func (self *Conn) heartbeat() {
+	ticker := time.NewTicker(self.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+		now := time.Now()
+		if self.waiting.Load() && now.Sub(time.Unix(0, self.waitingSince.Load())) > self.timeout {
+			self.fail(ErrPeerDead)
+			return
+		}
+		if now.Sub(time.Unix(0, self.lastWrite.Load())) < self.interval {
+			continue
+		}
+		// A write in progress tells the peer as much as a heartbeat.
+		if !self.writeMutex.TryLock() {
+			continue
+		}
+		err := self.writeFrame(typeHeartbeat, nil)
+		self.writeMutex.Unlock()
+		var netErr net.Error
+		if err != nil && !(errors.As(err, &netErr) && netErr.Timeout()) {
+			self.fail(err)
+			return
+		}
+	}
+}
+
+// writeFrame writes a frame in one write; the caller holds writeMutex.
+func (self *Conn) writeFrame(typ uint8, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	_, err := self.conn.Write(frame)
+	self.lastWrite.Store(time.Now().UnixNano())
+	return err
+}
+
+func (self *Conn) Read(b []byte) (int, error) {
+	self.readMutex.Lock()
+	defer self.readMutex.Unlock()
+	for len(self.pending) == 0 {
+		if err := self.wait(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// wait waits for the next frame of data, the read deadline or a change of
+// it.
+func (self *Conn) wait() error {
+	self.mutex.Lock()
+	deadline, changed := self.readDeadline, self.deadlineChanged
+	self.mutex.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case frame, ok := <-self.frames:
+		if !ok {
+			return io.EOF
+		}
+		self.pending = frame
+	case <-self.done:
+		return self.Err()
+	case <-expired:
+		return os.ErrDeadlineExceeded
+	case <-changed:
+	}
+	return nil
+}
+
+func (self *Conn) Write(b []byte) (int, error) {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		if err := self.writeFrame(typeData, chunk); err != nil {
+			return n, err
+		}
+		n, b = n+len(chunk), b[len(chunk):]
+	}
+	return n, nil
+}
+
+// CloseWrite ends the writes of this side; the peer reads io.EOF after what
+// was written. Heartbeats go on until the connection is closed.
+func (self *Conn) CloseWrite() error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	return self.writeFrame(typeEnd, nil)
+}
+
+func (self *Conn) Close() error {
+	err := self.conn.Close()
+	self.fail(net.ErrClosed)
+	return err
+}
+
+func (self *Conn) LocalAddr() net.Addr  { return self.conn.LocalAddr() }
+func (self *Conn) RemoteAddr() net.Addr { return self.conn.RemoteAddr() }
+
+func (self *Conn) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.conn.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of Read, which the background reader
+// does not see.
+func (self *Conn) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.readDeadline = t
+	close(self.deadlineChanged)
+	self.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (self *Conn) SetWriteDeadline(t time.Time) error { return self.conn.SetWriteDeadline(t) }
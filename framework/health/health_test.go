@@ -0,0 +1,85 @@
+package health
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+var fast = &Config{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+func TestMonitor(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Monitor(a, fast), Monitor(b, fast)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		client.Write([]byte("hello"))
+		client.CloseWrite()
+	}()
+	got, err := io.ReadAll(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("read %q, want hello", got)
+	}
+
+	// Idle for several timeouts, the heartbeats keep the link up.
+	select {
+	case <-server.Done():
+		t.Fatalf("link died while idle: %v", server.Err())
+	case <-client.Done():
+		t.Fatalf("link died while idle: %v", client.Err())
+	case <-time.After(200 * time.Millisecond):
+	}
+	if _, err := server.Write([]byte("still here")); err != nil {
+		t.Fatal(err)
+	}
+	b2 := make([]byte, 16)
+	if n, err := client.Read(b2); err != nil || string(b2[:n]) != "still here" {
+		t.Fatalf("Read() = %q, %v", b2[:n], err)
+	}
+}
+
+func TestMonitorSilentPeer(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// The peer reads, so heartbeats go out, but never sends one.
+	go io.Copy(io.Discard, b)
+	c := Monitor(a, fast)
+	defer c.Close()
+
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the silent peer to be declared dead")
+	}
+	if err := c.Err(); err != ErrPeerDead {
+		t.Fatalf("Err() = %v, want ErrPeerDead", err)
+	}
+	if _, err := c.Read(make([]byte, 1)); err != ErrPeerDead {
+		t.Fatalf("Read() error = %v, want ErrPeerDead", err)
+	}
+}
+
+func TestMonitorReadDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Monitor(a, fast), Monitor(b, fast)
+	defer client.Close()
+	defer server.Close()
+
+	server.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, err := server.Read(make([]byte, 1))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Read() error = %v, want a timeout", err)
+	}
+	// The link outlives the deadline.
+	server.SetReadDeadline(time.Time{})
+	go client.Write([]byte("x"))
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,378 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// ErrManagerClosed is returned once a Manager is closed.
+var ErrManagerClosed = errors.New("health: manager closed")
+
+// State is the state of the link of a Manager.
+type State int
+
+const (
+	StateDisconnected State = iota
+	StateConnecting
+	StateConnected
+	// StateReconnecting is StateConnecting after the link has been up.
+	StateReconnecting
+	StateClosed
+)
+
+func (self State) String() string {
+	switch self {
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateClosed:
+		return "closed"
+	default:
+		return "disconnected"
+	}
+}
+
+// Manager keeps a link to a peer up, redialing with backoff whenever it
+// dies. It dials once Conn is first called.
+type Manager struct {
+	// Dial opens a connection to the peer; ctx is cancelled by Close.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Heartbeat, if set, monitors the connections dialed with it, so a
+	// silent peer is redialed; the peer must Monitor them too.
+	Heartbeat *Config
+	// Backoff is the delay before each redial. Defaults to jittered
+	// exponential backoff from 100ms up to 30s.
+	Backoff vsock.Backoff
+	// OnState, if set, is called on every state change, in order.
+	OnState  func(State)
+	ErrorLog *log.Logger
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mutex sync.Mutex
+	state State
+	link  *link
+	// ready is closed when a link is up or the manager is closed.
+	ready chan struct{}
+	done  chan struct{}
+}
+
+// link is a connection of the manager, until broken is closed.
+type link struct {
+	conn   net.Conn
+	broken chan struct{}
+	once   sync.Once
+}
+
+func (self *link) breakOff() { self.once.Do(func() { close(self.broken) }) }
+
+func (self *Manager) init() {
+	self.once.Do(func() {
+		self.ctx, self.cancel = context.WithCancel(context.Background())
+		self.mutex.Lock()
+		self.ready = make(chan struct{})
+		self.done = make(chan struct{})
+		self.mutex.Unlock()
+		go self.run()
+	})
+}
+
+// Conn returns the connection to the peer, waiting until the link is up or
+// ctx is done.
+func (self *Manager) Conn(ctx context.Context) (net.Conn, error) {
+	self.init()
+	for {
+		self.mutex.Lock()
+		state, l, ready := self.state, self.link, self.ready
+		self.mutex.Unlock()
+		if state == StateClosed {
+			return nil, ErrManagerClosed
+		}
+		if l != nil {
+			return l.conn, nil
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Drop reports conn broken, such as after a failed read, so the link is
+// closed and redialed. It does nothing if conn is no longer the link.
+func (self *Manager) Drop(conn net.Conn) {
+	self.mutex.Lock()
+	l := self.link
+	if l != nil && l.conn == conn {
+		// Conn waits for the next link from now on.
+		self.link = nil
+	}
+	self.mutex.Unlock()
+	if l != nil && l.conn == conn {
+		l.breakOff()
+	}
+}
+
+// State returns the state of the link.
+func (self *Manager) State() State {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.state
+}
+
+// Close closes the link and stops redialing.
+func (self *Manager) Close() error {
+	self.init()
+	self.cancel()
+	<-self.done
+	return nil
+}
+
+func (self *Manager) run() {
+	defer close(self.done)
+	connecting := StateConnecting
+	for {
+		self.setState(connecting, nil)
+		conn, err := self.redial()
+		if err != nil {
+			self.setState(StateClosed, nil)
+			return
+		}
+		l := &link{conn: conn, broken: make(chan struct{})}
+		var died <-chan struct{}
+		if hc, ok := conn.(*Conn); ok {
+			died = hc.Done()
+		}
+		self.setState(StateConnected, l)
+		select {
+		case <-l.broken:
+		case <-died:
+			self.logf("health: link to %v died: %v", conn.RemoteAddr(), conn.(*Conn).Err())
+		case <-self.ctx.Done():
+		}
+		conn.Close()
+		if self.ctx.Err() != nil {
+			self.setState(StateClosed, nil)
+			return
+		}
+		self.setState(StateDisconnected, nil)
+		connecting = StateReconnecting
+	}
+}
+
+// redial dials until it succeeds or the manager is closed.
+func (self *Manager) redial() (net.Conn, error) {
+	backoff := self.Backoff
+	if backoff == nil {
+		backoff = vsock.Jittered(vsock.Exponential(100*time.Millisecond, 30*time.Second))
+	}
+	for attempt := 1; ; attempt++ {
+		conn, err := self.Dial(self.ctx)
+		if err == nil {
+			if self.Heartbeat != nil {
+				conn = Monitor(conn, self.Heartbeat)
+			}
+			return conn, nil
+		}
+		if self.ctx.Err() != nil {
+			return nil, ErrManagerClosed
+		}
+		delay := backoff(attempt)
+		self.logf("health: dial failed: %v; retrying in %v", err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-self.ctx.Done():
+			timer.Stop()
+			return nil, ErrManagerClosed
+		}
+	}
+}
+
+// setState moves to state with the link l, waking the callers of Conn
+// once the link is up or the manager closed.
+func (self *Manager) setState(state State, l *link) {
+	self.mutex.Lock()
+	self.state, self.link = state, l
+	if state == StateConnected || state == StateClosed {
+		close(self.ready)
+		if state == StateConnected {
+			self.ready = make(chan struct{})
+		}
+	}
+	self.mutex.Unlock()
+	if self.OnState != nil {
+		self.OnState(state)
+	}
+}
+
+func (self *Manager) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+var _ net.Conn = &ReconnectingConn{}
+
+// ReconnectingConn is a connection over the links of a Manager: when the
+// link dies, reads and writes wait for the next and go on over it. Data in
+// flight when a link dies is lost, so it suits protocols whose messages
+// stand alone, or which resynchronise on StateConnected.
+type ReconnectingConn struct {
+	manager *Manager
+
+	mutex         sync.Mutex
+	last          net.Conn
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// ReconnectingConn returns a connection over the links of the manager.
+func (self *Manager) ReconnectingConn() *ReconnectingConn {
+	return &ReconnectingConn{manager: self}
+}
+
+// conn returns the current link, waiting for it until deadline, and applies
+// the deadlines to it.
+func (self *ReconnectingConn) conn(deadline time.Time) (net.Conn, error) {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	conn, err := self.manager.Conn(ctx)
+	if err == context.DeadlineExceeded {
+		return nil, os.ErrDeadlineExceeded
+	}
+	if err != nil {
+		return nil, err
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if conn != self.last {
+		self.last = conn
+		conn.SetReadDeadline(self.readDeadline)
+		conn.SetWriteDeadline(self.writeDeadline)
+	}
+	return conn, nil
+}
+
+func (self *ReconnectingConn) deadlines() (read, write time.Time) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.readDeadline, self.writeDeadline
+}
+
+// broken reports whether err, from conn, means the link is dead, in which
+// case it is dropped.
+func (self *ReconnectingConn) broken(conn net.Conn, err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return false
+	}
+	self.manager.Drop(conn)
+	return true
+}
+
+func (self *ReconnectingConn) Read(b []byte) (int, error) {
+	for {
+		deadline, _ := self.deadlines()
+		conn, err := self.conn(deadline)
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if err == nil || n > 0 {
+			return n, nil
+		}
+		// The peer closing the link, io.EOF, is a link dying too.
+		if err == io.EOF {
+			self.manager.Drop(conn)
+			continue
+		}
+		if !self.broken(conn, err) {
+			return 0, err
+		}
+	}
+}
+
+func (self *ReconnectingConn) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		_, deadline := self.deadlines()
+		conn, err := self.conn(deadline)
+		if err != nil {
+			return written, err
+		}
+		n, err := conn.Write(b[written:])
+		written += n
+		if err != nil && !self.broken(conn, err) {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Close closes the manager.
+func (self *ReconnectingConn) Close() error { return self.manager.Close() }
+
+func (self *ReconnectingConn) LocalAddr() net.Addr  { return self.addr(net.Conn.LocalAddr) }
+func (self *ReconnectingConn) RemoteAddr() net.Addr { return self.addr(net.Conn.RemoteAddr) }
+
+// addr returns the address of the last link, or an unknown one before the
+// first.
+func (self *ReconnectingConn) addr(of func(net.Conn) net.Addr) net.Addr {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.last == nil {
+		return unknownAddr{}
+	}
+	return of(self.last)
+}
+
+func (self *ReconnectingConn) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.readDeadline = t
+	if self.last != nil {
+		self.last.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (self *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.writeDeadline = t
+	if self.last != nil {
+		self.last.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+type unknownAddr struct{}
+
+func (unknownAddr) Network() string { return "unknown" }
+func (unknownAddr) String() string  { return "unknown" }
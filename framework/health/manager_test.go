@@ -0,0 +1,150 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// echoPeer accepts the links of a manager over pipes, echoing each, and
+// can hang up on the current one.
+type echoPeer struct {
+	mutex sync.Mutex
+	conns []net.Conn
+	dials int
+	fail  int // dials to refuse
+}
+
+func (self *echoPeer) dial(ctx context.Context) (net.Conn, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.dials++
+	if self.fail > 0 {
+		self.fail--
+		return nil, errors.New("refused")
+	}
+	a, b := net.Pipe()
+	self.conns = append(self.conns, b)
+	go io.Copy(b, b)
+	return a, nil
+}
+
+func (self *echoPeer) hangUp() {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.conns[len(self.conns)-1].Close()
+}
+
+func echo(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != msg {
+		t.Fatalf("echoed %q, want %q", b, msg)
+	}
+}
+
+func TestManagerReconnects(t *testing.T) {
+	peer := &echoPeer{fail: 2}
+	var (
+		mutex  sync.Mutex
+		states []State
+	)
+	m := &Manager{
+		Dial:     peer.dial,
+		Backoff:  vsock.Constant(time.Millisecond),
+		ErrorLog: log.New(io.Discard, "", 0),
+		OnState: func(s State) {
+			mutex.Lock()
+			states = append(states, s)
+			mutex.Unlock()
+		},
+	}
+	conn := m.ReconnectingConn()
+
+	echo(t, conn, "first")
+	peer.hangUp()
+	// The read of the dead link fails, and the conn goes on over the next.
+	echo(t, conn, "second")
+
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("x")); err != ErrManagerClosed {
+		t.Fatalf("Write() after Close = %v, want ErrManagerClosed", err)
+	}
+
+	want := []State{StateConnecting, StateConnected, StateDisconnected, StateReconnecting, StateConnected, StateClosed}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if diff := cmp.Diff(want, states); diff != "" {
+		t.Fatalf("unexpected states (-want +got):\n%s", diff)
+	}
+	if peer.dials != 4 {
+		t.Fatalf("dialed %d times, want 4", peer.dials)
+	}
+}
+
+func TestManagerHeartbeat(t *testing.T) {
+	// The peer answers the first link with heartbeats, and leaves the
+	// second silent.
+	var dials int
+	m := &Manager{
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			a, b := net.Pipe()
+			dials++
+			if dials == 1 {
+				go io.Copy(io.Discard, Monitor(b, fast))
+			} else {
+				go io.Copy(io.Discard, b)
+			}
+			return a, nil
+		},
+		Heartbeat: fast,
+		Backoff:   vsock.Constant(time.Hour),
+		ErrorLog:  log.New(io.Discard, "", 0),
+	}
+	defer m.Close()
+
+	first, err := m.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := first.(*Conn); !ok {
+		t.Fatalf("Conn() = %T, want a monitored *Conn", first)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if m.State() != StateConnected {
+		t.Fatalf("State() = %v with a live peer", m.State())
+	}
+
+	m.Drop(first)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	second, err := m.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-second.(*Conn).Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the silent link to die")
+	}
+	if err := second.(*Conn).Err(); err != ErrPeerDead {
+		t.Fatalf("Err() = %v, want ErrPeerDead", err)
+	}
+}
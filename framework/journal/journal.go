@@ -0,0 +1,266 @@
+// Package journal keeps an append-only record of what happened to cables,
+// so operators can reconstruct the history of a guest connection after the
+// fact.
+//
+// Events are written as JSON lines to journal.log in a directory. Once it
+// grows past MaxSize it is rotated to journal.log.1, shifting older files
+// up, and the oldest beyond MaxFiles are deleted.
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+const (
+	DefaultMaxSize  = 16 << 20
+	DefaultMaxFiles = 8
+	fileName        = "journal.log"
+)
+
+type Kind string
+
+const (
+	KindConnect    Kind = "connect"
+	KindDisconnect Kind = "disconnect"
+	KindTransport  Kind = "transport"
+	KindError      Kind = "error"
+	KindTransfer   Kind = "transfer"
+	KindClose      Kind = "close"
+)
+
+// Event is one entry of the journal.
+type Event struct {
+	Time     time.Time      `json:"time"`
+	Kind     Kind           `json:"kind"`
+	Metadata vsock.Metadata `json:"metadata,omitempty"`
+	Detail   string         `json:"detail,omitempty"`
+}
+
+// Journal appends events to files in a directory.
+type Journal struct {
+	// MaxSize is the size past which the current file is rotated. Defaults
+	// to DefaultMaxSize.
+	MaxSize int64
+	// MaxFiles is how many rotated files are kept. Defaults to
+	// DefaultMaxFiles.
+	MaxFiles int
+
+	dir   string
+	mutex sync.Mutex
+	file  *os.File
+	size  int64
+}
+
+// Open opens the journal in dir, creating it if needed.
+func Open(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	self := &Journal{dir: dir}
+	if err := self.open(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *Journal) open() error {
+	f, err := os.OpenFile(filepath.Join(self.dir, fileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	self.file, self.size = f, info.Size()
+	return nil
+}
+
+// Record appends event, stamping it with the current time if it has none.
+func (self *Journal) Record(event Event) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.file == nil {
+		return fmt.Errorf("journal: closed")
+	}
+	if self.size > 0 && self.size+int64(len(b)) > self.maxSize() {
+		if err := self.rotate(); err != nil {
+			return err
+		}
+	}
+	// One write per event, so a crash loses at most the last line.
+	n, err := self.file.Write(b)
+	self.size += int64(n)
+	return err
+}
+
+// Recordf is Record with a formatted detail.
+func (self *Journal) Recordf(kind Kind, md vsock.Metadata, format string, args ...interface{}) error {
+	return self.Record(Event{Kind: kind, Metadata: md, Detail: fmt.Sprintf(format, args...)})
+}
+
+// rotate starts a new file. The caller holds mutex.
+func (self *Journal) rotate() error {
+	if err := self.file.Close(); err != nil {
+		return err
+	}
+	self.file = nil
+
+	maxFiles := self.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	os.Remove(self.path(maxFiles))
+	for i := maxFiles - 1; i >= 0; i-- {
+		if err := os.Rename(self.path(i), self.path(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return self.open()
+}
+
+// path returns the path of the file rotated n times, 0 being the current.
+func (self *Journal) path(n int) string {
+	name := fileName
+	if n > 0 {
+		name += "." + strconv.Itoa(n)
+	}
+	return filepath.Join(self.dir, name)
+}
+
+func (self *Journal) maxSize() int64 {
+	if self.MaxSize > 0 {
+		return self.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+func (self *Journal) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.file == nil {
+		return nil
+	}
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// Filter selects events. Zero fields match everything.
+type Filter struct {
+	Since, Until time.Time
+	Kinds        []Kind
+	// Metadata matches events having all of these entries, e.g. {"vm": name}.
+	Metadata vsock.Metadata
+	// Limit keeps only the most recent events matched.
+	Limit int
+}
+
+func (self Filter) match(event Event) bool {
+	if !self.Since.IsZero() && event.Time.Before(self.Since) {
+		return false
+	}
+	if !self.Until.IsZero() && !event.Time.Before(self.Until) {
+		return false
+	}
+	if len(self.Kinds) > 0 {
+		found := false
+		for _, kind := range self.Kinds {
+			if kind == event.Kind {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for k, v := range self.Metadata {
+		if event.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Query returns the events matching filter, oldest first. Lines which fail
+// to parse, such as one cut short by a crash, are skipped.
+func (self *Journal) Query(filter Filter) ([]Event, error) {
+	return Query(self.dir, filter)
+}
+
+// Query reads the journal in dir, which may be in use by another process.
+func Query(dir string, filter Filter) ([]Event, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, fileName+".*"))
+	if err != nil {
+		return nil, err
+	}
+	// Oldest first: the highest rotation number, down to the current file.
+	var rotations []int
+	for _, path := range paths {
+		if n, err := strconv.Atoi(filepath.Ext(path)[1:]); err == nil && n > 0 {
+			rotations = append(rotations, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(rotations)))
+	ordered := make([]string, 0, len(rotations)+1)
+	for _, n := range rotations {
+		ordered = append(ordered, filepath.Join(dir, fileName+"."+strconv.Itoa(n)))
+	}
+	ordered = append(ordered, filepath.Join(dir, fileName))
+
+	var events []Event
+	for _, path := range ordered {
+		if err := scan(path, filter, &events); err != nil {
+			return nil, err
+		}
+	}
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[len(events)-filter.Limit:]
+	}
+	return events, nil
+}
+
+func scan(path string, filter Filter, events *[]Event) error {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		if filter.match(event) {
+			*events = append(*events, event)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,48 @@
+package journal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestRotationAndQuery(t *testing.T) {
+	dir := t.TempDir()
+	j, err := Open(dir)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	j.MaxSize, j.MaxFiles = 200, 2
+	defer j.Close()
+
+	start := time.Unix(1000, 0).UTC()
+	for i := 0; i < 10; i++ {
+		vm := "a"
+		if i%2 == 1 {
+			vm = "b"
+		}
+		event := Event{Time: start.Add(time.Duration(i) * time.Second), Kind: KindConnect, Metadata: vsock.Metadata{"vm": vm}}
+		if err := j.Record(event); err != nil {
+			t.Fatalf("failed to record: %v", err)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "journal.log.3")); !os.IsNotExist(err) {
+		t.Fatalf("expected old files to be deleted, got %v", err)
+	}
+	events, err := j.Query(Filter{Metadata: vsock.Metadata{"vm": "b"}, Limit: 2})
+	if err != nil {
+		t.Fatalf("failed to query: %v", err)
+	}
+	var times []time.Time
+	for _, event := range events {
+		times = append(times, event.Time)
+	}
+	if diff := cmp.Diff([]time.Time{start.Add(7 * time.Second), start.Add(9 * time.Second)}, times); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,155 @@
+package memfd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// Threshold is the size from which Send offers shared memory instead of
+// writing the data to the connection.
+var Threshold int64 = 1 << 20
+
+// Frame types on the control connection.
+const (
+	frameInline byte = 'I'
+	frameShared byte = 'S'
+)
+
+// Send transfers size bytes read from r to the peer calling Receive on
+// conn. Large transfers are offered through shared memory, which the peer
+// can map when it runs on the same machine and may open this process's
+// descriptors; otherwise the data is written to conn.
+func Send(conn net.Conn, r io.Reader, size int64) error {
+	if size >= Threshold && size <= int64(maxInt) {
+		shared, err := sendShared(conn, r, size)
+		if err != nil || shared {
+			return err
+		}
+	}
+
+	var header [9]byte
+	header[0] = frameInline
+	binary.BigEndian.PutUint64(header[1:], uint64(size))
+	if _, err := conn.Write(header[:]); err != nil {
+		return err
+	}
+	n, err := io.CopyN(conn, r, size)
+	if err != nil && n < size {
+		return fmt.Errorf("memfd: sent %d of %d bytes: %v", n, size, err)
+	}
+	return nil
+}
+
+// sendShared offers the data in a region, reporting whether the peer took
+// it. When the peer declines nothing has been read from r yet.
+func sendShared(conn net.Conn, r io.Reader, size int64) (bool, error) {
+	region, err := Create("vcable-bulk", int(size))
+	if err != nil {
+		// No memfd support: fall back to the connection.
+		return false, nil
+	}
+	defer region.Close()
+
+	var offer [17]byte
+	offer[0] = frameShared
+	binary.BigEndian.PutUint64(offer[1:9], uint64(size))
+	binary.BigEndian.PutUint32(offer[9:13], uint32(os.Getpid()))
+	binary.BigEndian.PutUint32(offer[13:17], uint32(region.File().Fd()))
+	if _, err := conn.Write(offer[:]); err != nil {
+		return false, err
+	}
+
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return false, err
+	}
+	if reply[0] == 0 {
+		return false, nil
+	}
+
+	if _, err := io.ReadFull(r, region.Bytes()); err != nil {
+		// Tell the peer the region is unusable before giving up.
+		conn.Write([]byte{0})
+		return true, err
+	}
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return true, err
+	}
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return true, fmt.Errorf("memfd: no acknowledgement from peer: %v", err)
+	}
+	return true, nil
+}
+
+// Receive reads a transfer made by Send on conn and writes it to w,
+// returning its size.
+func Receive(conn net.Conn, w io.Writer) (int64, error) {
+	var typ [1]byte
+	if _, err := io.ReadFull(conn, typ[:]); err != nil {
+		return 0, err
+	}
+
+	switch typ[0] {
+	case frameShared:
+		var offer [16]byte
+		if _, err := io.ReadFull(conn, offer[:]); err != nil {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint64(offer[0:8]))
+		pid := binary.BigEndian.Uint32(offer[8:12])
+		fd := binary.BigEndian.Uint32(offer[12:16])
+
+		region, err := openRemote(pid, fd, size)
+		if err != nil {
+			if _, err := conn.Write([]byte{0}); err != nil {
+				return 0, err
+			}
+			// The sender falls back to an inline transfer.
+			return Receive(conn, w)
+		}
+		defer region.Close()
+		if _, err := conn.Write([]byte{1}); err != nil {
+			return 0, err
+		}
+
+		var ready [1]byte
+		if _, err := io.ReadFull(conn, ready[:]); err != nil {
+			return 0, err
+		}
+		if ready[0] != 1 {
+			return 0, fmt.Errorf("memfd: sender failed to fill the region")
+		}
+		n, err := w.Write(region.Bytes())
+		if err != nil {
+			return int64(n), err
+		}
+		_, err = conn.Write([]byte{1})
+		return int64(n), err
+	case frameInline:
+		var length [8]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return 0, err
+		}
+		size := int64(binary.BigEndian.Uint64(length[:]))
+		return io.CopyN(w, conn, size)
+	default:
+		return 0, fmt.Errorf("memfd: unknown frame type %q", typ[0])
+	}
+}
+
+// openRemote opens and maps the region fd of process pid.
+func openRemote(pid, fd uint32, size int64) (*Region, error) {
+	if size > int64(maxInt) {
+		return nil, fmt.Errorf("memfd: region too large")
+	}
+	f, err := os.OpenFile(fmt.Sprintf("/proc/%d/fd/%d", pid, fd), os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return Open(f, int(size))
+}
+
+const maxInt = int(^uint(0) >> 1)
@@ -0,0 +1,37 @@
+package memfd
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSendReceive(t *testing.T) {
+	defer func(threshold int64) { Threshold = threshold }(Threshold)
+
+	for _, threshold := range []int64{1, 1 << 30} {
+		Threshold = threshold
+		data := bytes.Repeat([]byte("vcable"), 1000)
+
+		a, b := net.Pipe()
+		errs := make(chan error, 1)
+		go func() {
+			errs <- Send(a, bytes.NewReader(data), int64(len(data)))
+		}()
+
+		var got bytes.Buffer
+		if _, err := Receive(b, &got); err != nil {
+			t.Fatalf("threshold %d: failed to receive: %v", threshold, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("threshold %d: failed to send: %v", threshold, err)
+		}
+		if diff := cmp.Diff(data, got.Bytes()); diff != "" {
+			t.Fatalf("threshold %d: unexpected data (-want +got):\n%s", threshold, diff)
+		}
+		a.Close()
+		b.Close()
+	}
+}
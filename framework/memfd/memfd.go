@@ -0,0 +1,76 @@
+// Package memfd moves bulk data between processes on the same machine
+// through anonymous shared memory, keeping only the control plane on vsock.
+package memfd
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Region is a shared memory region backed by a memfd.
+type Region struct {
+	f    *os.File
+	data []byte
+}
+
+// Create creates a region of size bytes.
+func Create(name string, size int) (*Region, error) {
+	fd, err := unix.MemfdCreate(name, unix.MFD_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("memfd: create: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), name)
+	if err := f.Truncate(int64(size)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return mapFile(f, size)
+}
+
+// Open maps the region open in f, which must be at least size bytes long.
+// The region takes ownership of f.
+func Open(f *os.File, size int) (*Region, error) {
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if info.Size() < int64(size) {
+		f.Close()
+		return nil, fmt.Errorf("memfd: region of %d bytes is smaller than %d", info.Size(), size)
+	}
+	return mapFile(f, size)
+}
+
+func mapFile(f *os.File, size int) (*Region, error) {
+	if size == 0 {
+		return &Region{f: f}, nil
+	}
+	data, err := unix.Mmap(int(f.Fd()), 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("memfd: mmap: %v", err)
+	}
+	return &Region{f: f, data: data}, nil
+}
+
+// Bytes returns the mapped memory. It is invalid after Close.
+func (self *Region) Bytes() []byte { return self.data }
+
+// File returns the memfd backing the region.
+func (self *Region) File() *os.File { return self.f }
+
+// Close unmaps the region and closes its memfd.
+func (self *Region) Close() error {
+	var err error
+	if self.data != nil {
+		err = unix.Munmap(self.data)
+		self.data = nil
+	}
+	if cerr := self.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,480 @@
+// Package mux multiplexes logical streams over a single connection, so one
+// vsock port can carry any number of channels between host and guest.
+//
+// Every frame starts with a 9 byte header: the frame type, the stream ID and
+// the payload length, both big endian. Streams opened by the client have
+// odd IDs, those opened by the server even ones.
+//
+// Each side starts by sending a ping with ID 0 carrying its window, the
+// bytes of a stream it buffers before the data is read, and answers the
+// peer's with a pong carrying the same. Once both know the other's window,
+// streams are flow controlled: a sender stops when it has used the
+// receiver's window, until window frames grant it more. Earlier peers
+// answer the ping with an empty pong, and their streams are not flow
+// controlled.
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	typeOpen uint8 = iota
+	typeData
+	typeClose
+	typeReset
+	typePing
+	typePong
+	typeGoAway
+	typeWindow
+)
+
+const (
+	headerSize = 9
+	// maxPayload bounds the payload of a single frame.
+	maxPayload = 64 << 10
+	// helloID is the ID of the ping which negotiates flow control.
+	helloID = 0
+)
+
+// DefaultWindow is the window of a stream unless configured otherwise.
+const DefaultWindow = 256 << 10
+
+// Config holds the options of a session.
+type Config struct {
+	// Window is the number of bytes of each stream the peer may send
+	// before they are read. Defaults to DefaultWindow.
+	Window uint32
+	// KeepAlive is the interval between pings, zero for none. A ping
+	// unanswered for KeepAliveTimeout, which defaults to KeepAlive, ends
+	// the session with ErrKeepAliveTimeout.
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+	// AcceptBacklog is the number of opened streams waiting for Accept
+	// before further ones are reset. Defaults to 256.
+	AcceptBacklog int
+}
+
+// Client returns the session of the side that dialed conn.
+func (self *Config) Client(conn net.Conn) *Session { return newSession(conn, true, *self) }
+
+// Server returns the session of the side that accepted conn.
+func (self *Config) Server(conn net.Conn) *Session { return newSession(conn, false, *self) }
+
+var (
+	// ErrSessionClosed is returned by operations on a closed session.
+	ErrSessionClosed = errors.New("mux: session closed")
+	// ErrStreamReset is returned when the peer aborted a stream.
+	ErrStreamReset = errors.New("mux: stream reset by peer")
+	// ErrKeepAliveTimeout ends a session whose peer stopped answering
+	// pings.
+	ErrKeepAliveTimeout = errors.New("mux: keepalive timed out")
+)
+
+// Session is one side of a multiplexed connection. It implements
+// net.Listener, accepting the streams the peer opens.
+type Session struct {
+	conn   net.Conn
+	client bool
+	config Config
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	pings   map[uint32]chan struct{}
+	pingID  uint32
+	err     error
+
+	// peerWindow is the window of the peer, zero if it does not flow
+	// control streams. negotiated is closed once it is known and the
+	// peer has been sent ours.
+	peerWindow    uint32
+	helloSent     bool
+	helloReceived bool
+	negotiated    chan struct{}
+
+	accept chan *Stream
+	done   chan struct{}
+}
+
+// Client returns the session of the side that dialed conn, with the
+// default configuration.
+func Client(conn net.Conn) *Session { return newSession(conn, true, Config{}) }
+
+// Server returns the session of the side that accepted conn, with the
+// default configuration.
+func Server(conn net.Conn) *Session { return newSession(conn, false, Config{}) }
+
+func newSession(conn net.Conn, client bool, config Config) *Session {
+	if config.Window == 0 {
+		config.Window = DefaultWindow
+	}
+	if config.KeepAliveTimeout <= 0 {
+		config.KeepAliveTimeout = config.KeepAlive
+	}
+	if config.AcceptBacklog <= 0 {
+		config.AcceptBacklog = 256
+	}
+	self := &Session{
+		conn:       conn,
+		client:     client,
+		config:     config,
+		streams:    make(map[uint32]*Stream),
+		pings:      make(map[uint32]chan struct{}),
+		negotiated: make(chan struct{}),
+		accept:     make(chan *Stream, config.AcceptBacklog),
+		done:       make(chan struct{}),
+	}
+	if client {
+		self.nextID = 1
+	} else {
+		self.nextID = 2
+	}
+	go self.receive()
+	go func() {
+		if self.writeFrame(typePing, helloID, self.hello()) == nil {
+			self.negotiate(func() { self.helloSent = true })
+		}
+	}()
+	if config.KeepAlive > 0 {
+		go self.keepAlive()
+	}
+	return self
+}
+
+// hello is the payload of the ping and pong negotiating flow control.
+func (self *Session) hello() []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, self.config.Window)
+	return payload
+}
+
+// negotiate records a step of the negotiation with fn, and lets streams
+// be opened once both are done.
+func (self *Session) negotiate(fn func()) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	done := self.helloSent && self.helloReceived
+	fn()
+	if !done && self.helloSent && self.helloReceived {
+		close(self.negotiated)
+	}
+}
+
+// receiveHello records the window of the peer. Earlier peers send none.
+func (self *Session) receiveHello(payload []byte) {
+	self.negotiate(func() {
+		if self.helloReceived {
+			return
+		}
+		self.helloReceived = true
+		if len(payload) >= 4 {
+			self.peerWindow = binary.BigEndian.Uint32(payload)
+		}
+	})
+}
+
+// FlowControl reports whether streams are flow controlled, waiting for
+// the negotiation with the peer if need be.
+func (self *Session) FlowControl() (bool, error) {
+	select {
+	case <-self.negotiated:
+	case <-self.done:
+		return false, self.Err()
+	}
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.peerWindow > 0, nil
+}
+
+// Open opens a new stream to the peer.
+func (self *Session) Open() (*Stream, error) {
+	// The peer learns whether the stream is flow controlled from our
+	// hello, which must precede the open.
+	select {
+	case <-self.negotiated:
+	case <-self.done:
+		return nil, self.Err()
+	}
+	self.mutex.Lock()
+	if self.err != nil {
+		self.mutex.Unlock()
+		return nil, self.err
+	}
+	id := self.nextID
+	self.nextID += 2
+	stream := newStream(self, id, self.peerWindow)
+	self.streams[id] = stream
+	self.mutex.Unlock()
+
+	if err := self.writeFrame(typeOpen, id, nil); err != nil {
+		self.forget(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the peer to open a stream.
+func (self *Session) Accept() (net.Conn, error) { return self.AcceptStream() }
+
+// AcceptStream is Accept returning the concrete stream type.
+func (self *Session) AcceptStream() (*Stream, error) {
+	select {
+	case stream := <-self.accept:
+		return stream, nil
+	case <-self.done:
+		return nil, self.Err()
+	}
+}
+
+// Addr returns the local address of the underlying connection.
+func (self *Session) Addr() net.Addr { return self.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the underlying connection.
+func (self *Session) RemoteAddr() net.Addr { return self.conn.RemoteAddr() }
+
+// NumStreams returns the number of open streams.
+func (self *Session) NumStreams() int {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return len(self.streams)
+}
+
+func (self *Session) keepAlive() {
+	ticker := time.NewTicker(self.config.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.done:
+			return
+		}
+
+		timer := time.AfterFunc(self.config.KeepAliveTimeout, func() {
+			self.shutdown(ErrKeepAliveTimeout)
+		})
+		_, err := self.Ping()
+		timer.Stop()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Ping measures the round trip time to the peer.
+func (self *Session) Ping() (time.Duration, error) {
+	self.mutex.Lock()
+	if self.err != nil {
+		self.mutex.Unlock()
+		return 0, self.err
+	}
+	self.pingID++
+	id := self.pingID
+	pong := make(chan struct{})
+	self.pings[id] = pong
+	self.mutex.Unlock()
+
+	defer func() {
+		self.mutex.Lock()
+		delete(self.pings, id)
+		self.mutex.Unlock()
+	}()
+
+	start := time.Now()
+	if err := self.writeFrame(typePing, id, nil); err != nil {
+		return 0, err
+	}
+	select {
+	case <-pong:
+		return time.Since(start), nil
+	case <-self.done:
+		return 0, self.Err()
+	}
+}
+
+// Done is closed when the session ends.
+func (self *Session) Done() <-chan struct{} { return self.done }
+
+// Err returns why the session ended, or nil while it is open.
+func (self *Session) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+// Close tells the peer the session is going away, closes the underlying
+// connection and resets every open stream.
+func (self *Session) Close() error {
+	self.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	self.writeFrame(typeGoAway, 0, nil)
+	return self.shutdown(ErrSessionClosed)
+}
+
+func (self *Session) shutdown(err error) error {
+	self.mutex.Lock()
+	if self.err != nil {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.err = err
+	streams := self.streams
+	self.streams = make(map[uint32]*Stream)
+	close(self.done)
+	self.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.abort(err)
+	}
+	return self.conn.Close()
+}
+
+func (self *Session) forget(id uint32) {
+	self.mutex.Lock()
+	delete(self.streams, id)
+	self.mutex.Unlock()
+}
+
+func (self *Session) stream(id uint32) *Stream {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.streams[id]
+}
+
+func (self *Session) writeFrame(typ uint8, id uint32, payload []byte) error {
+	var header [headerSize]byte
+	header[0] = typ
+	binary.BigEndian.PutUint32(header[1:5], id)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	if err := self.Err(); err != nil {
+		return err
+	}
+	if _, err := self.conn.Write(header[:]); err != nil {
+		self.shutdown(err)
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := self.conn.Write(payload); err != nil {
+			self.shutdown(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// writeWindow grants the peer delta more bytes of the window of stream id.
+func (self *Session) writeWindow(id uint32, delta uint32) error {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], delta)
+	return self.writeFrame(typeWindow, id, payload[:])
+}
+
+func (self *Session) receive() {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(self.conn, header[:]); err != nil {
+			self.shutdown(err)
+			return
+		}
+		typ := header[0]
+		id := binary.BigEndian.Uint32(header[1:5])
+		length := binary.BigEndian.Uint32(header[5:9])
+		if length > maxPayload {
+			self.shutdown(fmt.Errorf("mux: frame of %d bytes exceeds limit", length))
+			return
+		}
+
+		var payload []byte
+		if length > 0 {
+			payload = make([]byte, length)
+			if _, err := io.ReadFull(self.conn, payload); err != nil {
+				self.shutdown(err)
+				return
+			}
+		}
+
+		if err := self.handle(typ, id, payload); err != nil {
+			self.shutdown(err)
+			return
+		}
+	}
+}
+
+func (self *Session) handle(typ uint8, id uint32, payload []byte) error {
+	switch typ {
+	case typeOpen:
+		if id == 0 || (id%2 == 1) == self.client {
+			return fmt.Errorf("mux: peer opened stream %d with an ID of ours", id)
+		}
+		self.mutex.Lock()
+		stream := newStream(self, id, self.peerWindow)
+		if _, ok := self.streams[id]; ok {
+			self.mutex.Unlock()
+			return fmt.Errorf("mux: peer reopened stream %d", id)
+		}
+		self.streams[id] = stream
+		self.mutex.Unlock()
+
+		select {
+		case self.accept <- stream:
+		default:
+			self.forget(id)
+			go self.writeFrame(typeReset, id, nil)
+		}
+	case typeData:
+		if stream := self.stream(id); stream != nil {
+			return stream.receive(payload)
+		}
+	case typeWindow:
+		if len(payload) != 4 {
+			return fmt.Errorf("mux: window frame of %d bytes", len(payload))
+		}
+		if stream := self.stream(id); stream != nil {
+			stream.grow(binary.BigEndian.Uint32(payload))
+		}
+	case typeClose:
+		if stream := self.stream(id); stream != nil {
+			stream.remoteClose()
+		}
+	case typeReset:
+		if stream := self.stream(id); stream != nil {
+			self.forget(id)
+			stream.abort(ErrStreamReset)
+		}
+	case typePing:
+		// Reply from another goroutine, so a peer that is itself blocked
+		// writing cannot stall the receive loop.
+		if id == helloID {
+			self.receiveHello(payload)
+			go self.writeFrame(typePong, id, self.hello())
+			break
+		}
+		go self.writeFrame(typePong, id, nil)
+	case typePong:
+		if id == helloID {
+			self.receiveHello(payload)
+			break
+		}
+		self.mutex.Lock()
+		if pong, ok := self.pings[id]; ok {
+			close(pong)
+			delete(self.pings, id)
+		}
+		self.mutex.Unlock()
+	case typeGoAway:
+		return ErrSessionClosed
+	default:
+		return fmt.Errorf("mux: unknown frame type %d", typ)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSessionStreams(t *testing.T) {
+	a, b := net.Pipe()
+	client, server := Client(a), Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	var got []string
+	for _, msg := range []string{"first", "second"} {
+		stream, err := client.Open()
+		if err != nil {
+			t.Fatalf("failed to open stream: %v", err)
+		}
+		if _, err := stream.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		stream.CloseWrite()
+
+		b, err := io.ReadAll(stream)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		got = append(got, string(b))
+		stream.Close()
+	}
+
+	if diff := cmp.Diff([]string{"first", "second"}, got); diff != "" {
+		t.Fatalf("unexpected echoes (-want +got):\n%s", diff)
+	}
+	if _, err := client.Ping(); err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	a, b := net.Pipe()
+	config := &Config{Window: 1024}
+	client, server := config.Client(a), config.Server(b)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if flow, err := client.FlowControl(); err != nil || !flow {
+		t.Fatalf("expected streams to be flow controlled, got %v, %v", flow, err)
+	}
+	peer, err := server.AcceptStream()
+	if err != nil {
+		t.Fatalf("failed to accept stream: %v", err)
+	}
+
+	// Nothing is read, so the write stops once the window is used up.
+	msg := make([]byte, 4096)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	stream.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	n, err := stream.Write(msg)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the write to wait for the window, got %v", err)
+	}
+	if diff := cmp.Diff(1024, n); diff != "" {
+		t.Fatalf("unexpected bytes written (-want +got):\n%s", diff)
+	}
+
+	// Reading opens the window again.
+	stream.SetWriteDeadline(time.Time{})
+	go func() {
+		stream.Write(msg[n:])
+		stream.CloseWrite()
+	}()
+	got, err := io.ReadAll(peer)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff(msg, got); diff != "" {
+		t.Fatalf("unexpected data (-want +got):\n%s", diff)
+	}
+}
+
+// legacyPeer answers frames as sessions predating flow control do: pings
+// with empty pongs, and nothing else.
+func legacyPeer(conn net.Conn) {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			return
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[5:9]))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		switch header[0] {
+		case typeWindow:
+			// Unknown to these peers, and fatal to the session.
+			conn.Close()
+			return
+		case typePing:
+			header[0] = typePong
+			binary.BigEndian.PutUint32(header[5:9], 0)
+			conn.Write(header[:])
+		}
+	}
+}
+
+func TestLegacyPeer(t *testing.T) {
+	a, b := net.Pipe()
+	go legacyPeer(b)
+	client := (&Config{Window: 1024}).Client(a)
+	defer client.Close()
+
+	stream, err := client.Open()
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	if flow, _ := client.FlowControl(); flow {
+		t.Fatal("expected streams to earlier peers not to be flow controlled")
+	}
+	stream.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Write(make([]byte, 4096)); err != nil {
+		t.Fatalf("expected writes beyond the window to succeed, got %v", err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	// The peer reads, but never answers.
+	go io.Copy(io.Discard, b)
+	client := (&Config{KeepAlive: 10 * time.Millisecond}).Client(a)
+
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected the session to end")
+	}
+	if err := client.Err(); err != ErrKeepAliveTimeout {
+		t.Fatalf("expected the keepalive to time out, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package mux
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+var _ net.Conn = &Stream{}
+
+// Stream is a logical connection within a session.
+type Stream struct {
+	id      uint32
+	session *Session
+
+	mutex         sync.Mutex
+	buf           bytes.Buffer
+	readClosed    bool // the peer closed its write side
+	writeClosed   bool // we closed our write side
+	closed        bool // Close was called
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readable      chan struct{}
+
+	// flow is set when the stream is flow controlled. sendWindow is what
+	// remains of the peer's window, and consumed the bytes read since we
+	// last granted the peer more of ours.
+	flow       bool
+	sendWindow uint32
+	consumed   uint32
+	writable   chan struct{}
+}
+
+// newStream returns a stream flow controlled by peerWindow, if non-zero.
+func newStream(session *Session, id uint32, peerWindow uint32) *Stream {
+	return &Stream{
+		id:         id,
+		session:    session,
+		readable:   make(chan struct{}, 1),
+		flow:       peerWindow > 0,
+		sendWindow: peerWindow,
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the stream ID, unique within its session.
+func (self *Stream) ID() uint32 { return self.id }
+
+// Session returns the session carrying the stream.
+func (self *Stream) Session() *Session { return self.session }
+
+func (self *Stream) LocalAddr() net.Addr  { return self.session.conn.LocalAddr() }
+func (self *Stream) RemoteAddr() net.Addr { return self.session.conn.RemoteAddr() }
+
+func (self *Stream) Read(b []byte) (int, error) {
+	for {
+		self.mutex.Lock()
+		switch {
+		case self.buf.Len() > 0:
+			n, _ := self.buf.Read(b)
+			grant := self.consume(n)
+			self.mutex.Unlock()
+			if grant > 0 {
+				self.session.writeWindow(self.id, grant)
+			}
+			return n, nil
+		case self.err != nil:
+			err := self.err
+			self.mutex.Unlock()
+			return 0, err
+		case self.readClosed:
+			self.mutex.Unlock()
+			return 0, io.EOF
+		case self.closed:
+			self.mutex.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		deadline := self.readDeadline
+		self.mutex.Unlock()
+
+		if err := wait(self.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (self *Stream) Write(b []byte) (int, error) {
+	var n int
+	for len(b) > 0 {
+		self.mutex.Lock()
+		switch {
+		case self.err != nil:
+			err := self.err
+			self.mutex.Unlock()
+			return n, err
+		case self.writeClosed:
+			self.mutex.Unlock()
+			return n, io.ErrClosedPipe
+		case !self.writeDeadline.IsZero() && !time.Now().Before(self.writeDeadline):
+			self.mutex.Unlock()
+			return n, os.ErrDeadlineExceeded
+		case self.flow && self.sendWindow == 0:
+			deadline := self.writeDeadline
+			self.mutex.Unlock()
+			if err := wait(self.writable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		chunk := b
+		if len(chunk) > maxPayload {
+			chunk = chunk[:maxPayload]
+		}
+		if self.flow {
+			if uint32(len(chunk)) > self.sendWindow {
+				chunk = chunk[:self.sendWindow]
+			}
+			self.sendWindow -= uint32(len(chunk))
+		}
+		self.mutex.Unlock()
+
+		if err := self.session.writeFrame(typeData, self.id, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+// CloseWrite closes the write side of the stream; the peer reads io.EOF
+// once it has read everything written before.
+func (self *Stream) CloseWrite() error {
+	self.mutex.Lock()
+	if self.writeClosed || self.err != nil {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.writeClosed = true
+	done := self.readClosed
+	self.mutex.Unlock()
+
+	err := self.session.writeFrame(typeClose, self.id, nil)
+	if done {
+		self.session.forget(self.id)
+	}
+	return err
+}
+
+// Close closes both sides of the stream. Data still arriving from the peer
+// is discarded.
+func (self *Stream) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	n := self.buf.Len()
+	self.buf.Reset()
+	grant := self.consume(n)
+	self.mutex.Unlock()
+	self.notify()
+	if grant > 0 {
+		self.session.writeWindow(self.id, grant)
+	}
+	return self.CloseWrite()
+}
+
+func (self *Stream) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *Stream) SetReadDeadline(t time.Time) error {
+	self.mutex.Lock()
+	self.readDeadline = t
+	self.mutex.Unlock()
+	self.notify()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for future writes, and for a write
+// waiting for the peer's window. A write already blocked on the session is
+// not interrupted.
+func (self *Stream) SetWriteDeadline(t time.Time) error {
+	self.mutex.Lock()
+	self.writeDeadline = t
+	self.mutex.Unlock()
+	self.notifyWritable()
+	return nil
+}
+
+func (self *Stream) receive(payload []byte) error {
+	self.mutex.Lock()
+	if self.flow && uint64(self.buf.Len())+uint64(self.consumed)+uint64(len(payload)) > uint64(self.session.config.Window) {
+		self.mutex.Unlock()
+		return fmt.Errorf("mux: peer overran the window of stream %d", self.id)
+	}
+	if self.closed {
+		// Discarded data is granted back at once, so the peer is not
+		// left waiting for a window which never opens.
+		grant := self.consume(len(payload))
+		self.mutex.Unlock()
+		if grant > 0 {
+			go self.session.writeWindow(self.id, grant)
+		}
+		return nil
+	}
+	self.buf.Write(payload)
+	self.mutex.Unlock()
+	self.notify()
+	return nil
+}
+
+// consume records n bytes read or discarded and returns how much of the
+// window to grant the peer: all of it once the stream is closed, otherwise
+// once half of it has been used up.
+func (self *Stream) consume(n int) uint32 {
+	if !self.flow {
+		return 0
+	}
+	self.consumed += uint32(n)
+	if self.consumed > 0 && (self.closed || self.consumed >= self.session.config.Window/2) {
+		grant := self.consumed
+		self.consumed = 0
+		return grant
+	}
+	return 0
+}
+
+// grow adds delta to the window the peer granted us.
+func (self *Stream) grow(delta uint32) {
+	self.mutex.Lock()
+	self.sendWindow += delta
+	self.mutex.Unlock()
+	self.notifyWritable()
+}
+
+func (self *Stream) remoteClose() {
+	self.mutex.Lock()
+	self.readClosed = true
+	done := self.writeClosed
+	self.mutex.Unlock()
+	if done {
+		self.session.forget(self.id)
+	}
+	self.notify()
+}
+
+func (self *Stream) abort(err error) {
+	self.mutex.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.mutex.Unlock()
+	self.notify()
+	self.notifyWritable()
+}
+
+func (self *Stream) notify() {
+	select {
+	case self.readable <- struct{}{}:
+	default:
+	}
+}
+
+func (self *Stream) notifyWritable() {
+	select {
+	case self.writable <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks until ready is signalled or deadline passes.
+func wait(ready <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ready
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ready:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
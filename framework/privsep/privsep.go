@@ -0,0 +1,378 @@
+// Package privsep lets an unprivileged process use vsock: a small privileged
+// helper opens vsock sockets on its behalf and passes their descriptors over
+// a Unix socket, so agents can drop root after starting.
+//
+// Requests and replies are JSON lines; a reply carrying a socket has the
+// descriptor attached as SCM_RIGHTS.
+package privsep
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"golang.org/x/sys/unix"
+)
+
+// DefaultPath is where the helper listens unless configured otherwise.
+const DefaultPath = "/run/vcable/privsep.sock"
+
+// Operations a client may request.
+const (
+	OpListen    = "listen"
+	OpDial      = "dial"
+	OpContextID = "cid"
+)
+
+// Request asks the helper for a socket.
+type Request struct {
+	Op        string `json:"op"`
+	ContextID uint32 `json:"cid,omitempty"`
+	Port      uint32 `json:"port,omitempty"`
+}
+
+type reply struct {
+	ContextID uint32 `json:"cid,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Peer identifies the process making a request.
+type Peer struct {
+	PID, UID, GID int
+}
+
+// Helper is the privileged side. Access to it is controlled by the
+// permissions of its socket, and by Allow.
+type Helper struct {
+	// Path of the socket. Defaults to DefaultPath.
+	Path string
+	// Group, if set, owns the socket, which is then accessible to its
+	// members; otherwise only root may connect.
+	Group string
+	// Allow, if set, decides each request.
+	Allow    func(peer Peer, req Request) bool
+	ErrorLog *log.Logger
+}
+
+// ListenAndServe serves requests until the listener fails.
+func (self *Helper) ListenAndServe() error {
+	path := self.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	l, err := self.listen(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer l.Close()
+	return self.Serve(l)
+}
+
+// listen creates the socket at path. It is bound in a private directory,
+// given its owner and mode, then moved into place, so that it is never
+// reachable with looser permissions.
+func (self *Helper) listen(path string) (*net.UnixListener, error) {
+	gid, mode := -1, os.FileMode(0600)
+	if self.Group != "" {
+		var err error
+		if gid, err = lookupGroup(self.Group); err != nil {
+			return nil, err
+		}
+		mode = 0660
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".privsep")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	bound := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed from path, not where it was bound.
+	l.SetUnlinkOnClose(false)
+	if gid != -1 {
+		if err := os.Chown(bound, 0, gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	if err := os.Chmod(bound, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	os.Remove(path)
+	if err := os.Rename(bound, path); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// Serve serves requests on l.
+func (self *Helper) Serve(l *net.UnixListener) error {
+	for {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			return err
+		}
+		go self.serve(conn)
+	}
+}
+
+func (self *Helper) serve(conn *net.UnixConn) {
+	defer conn.Close()
+
+	peer, err := peerOf(conn)
+	if err != nil {
+		self.logf("privsep: peer credentials: %v", err)
+		return
+	}
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		var req Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			writeReply(conn, reply{Error: "malformed request"}, nil)
+			return
+		}
+		if self.Allow != nil && !self.Allow(peer, req) {
+			self.logf("privsep: denied %s %d:%d to pid %d uid %d", req.Op, req.ContextID, req.Port, peer.PID, peer.UID)
+			if err := writeReply(conn, reply{Error: "permission denied"}, nil); err != nil {
+				return
+			}
+			continue
+		}
+
+		f, r := self.handle(req)
+		err := writeReply(conn, r, f)
+		if f != nil {
+			f.Close()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (self *Helper) handle(req Request) (*os.File, reply) {
+	switch req.Op {
+	case OpContextID:
+		cid, err := vsock.ContextID()
+		if err != nil {
+			return nil, reply{Error: err.Error()}
+		}
+		return nil, reply{ContextID: cid}
+	case OpListen:
+		l, err := vsock.Listen(req.Port)
+		if err != nil {
+			return nil, reply{Error: err.Error()}
+		}
+		defer l.Close()
+		f, err := l.File()
+		if err != nil {
+			return nil, reply{Error: err.Error()}
+		}
+		return f, reply{}
+	case OpDial:
+		c, err := vsock.Dial(req.ContextID, req.Port)
+		if err != nil {
+			return nil, reply{Error: err.Error()}
+		}
+		defer c.Close()
+		f, err := c.File()
+		if err != nil {
+			return nil, reply{Error: err.Error()}
+		}
+		return f, reply{}
+	}
+	return nil, reply{Error: fmt.Sprintf("unknown operation %q", req.Op)}
+}
+
+func (self *Helper) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Client is the unprivileged side.
+type Client struct {
+	// Path of the helper socket. Defaults to DefaultPath.
+	Path string
+}
+
+// Listen returns a listener on port opened by the helper.
+func (self *Client) Listen(port uint32) (*vsock.VsockListener, error) {
+	f, _, err := self.request(Request{Op: OpListen, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vsock.FileListener(f)
+}
+
+// Dial returns a connection to port of contextID opened by the helper.
+func (self *Client) Dial(contextID, port uint32) (*vsock.Conn, error) {
+	f, _, err := self.request(Request{Op: OpDial, ContextID: contextID, Port: port})
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return vsock.FileConn(f)
+}
+
+// ContextID returns the local context ID, read by the helper.
+func (self *Client) ContextID() (uint32, error) {
+	_, r, err := self.request(Request{Op: OpContextID})
+	return r.ContextID, err
+}
+
+func (self *Client) request(req Request) (*os.File, reply, error) {
+	path := self.Path
+	if path == "" {
+		path = DefaultPath
+	}
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, reply{}, err
+	}
+	defer conn.Close()
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, reply{}, err
+	}
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return nil, reply{}, err
+	}
+
+	f, r, err := readReply(conn)
+	if err != nil {
+		return nil, r, err
+	}
+	if r.Error != "" {
+		if f != nil {
+			f.Close()
+		}
+		return nil, r, fmt.Errorf("privsep: %s: %s", req.Op, r.Error)
+	}
+	if f == nil && req.Op != OpContextID {
+		return nil, r, fmt.Errorf("privsep: %s: no descriptor in reply", req.Op)
+	}
+	return f, r, nil
+}
+
+func writeReply(conn *net.UnixConn, r reply, f *os.File) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	_, _, err = conn.WriteMsgUnix(append(b, '\n'), oob, nil)
+	return err
+}
+
+// readReply reads a reply line and the descriptor attached to it, if any.
+func readReply(conn *net.UnixConn) (*os.File, reply, error) {
+	var (
+		f    *os.File
+		line []byte
+		buf  = make([]byte, 4096)
+		oob  = make([]byte, unix.CmsgSpace(4))
+	)
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+		if oobn > 0 && f == nil {
+			if f, err = parseRights(oob[:oobn]); err != nil {
+				return nil, reply{}, err
+			}
+		}
+		line = append(line, buf[:n]...)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			var r reply
+			if err := json.Unmarshal(line[:i], &r); err != nil {
+				if f != nil {
+					f.Close()
+				}
+				return nil, reply{}, err
+			}
+			return f, r, nil
+		}
+		if err != nil {
+			if f != nil {
+				f.Close()
+			}
+			return nil, reply{}, err
+		}
+	}
+}
+
+func parseRights(oob []byte) (*os.File, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	var f *os.File
+	for _, msg := range msgs {
+		fds, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			if f == nil {
+				f = os.NewFile(uintptr(fd), "privsep")
+			} else {
+				unix.Close(fd)
+			}
+		}
+	}
+	return f, nil
+}
+
+func peerOf(conn *net.UnixConn) (Peer, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return Peer{}, err
+	}
+	var cred *unix.Ucred
+	doErr := rc.Control(func(fd uintptr) {
+		cred, err = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if doErr != nil {
+		return Peer{}, doErr
+	}
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{PID: int(cred.Pid), UID: int(cred.Uid), GID: int(cred.Gid)}, nil
+}
+
+func lookupGroup(name string) (int, error) {
+	if gid, err := strconv.Atoi(name); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return 0, fmt.Errorf("privsep: %v", err)
+	}
+	return strconv.Atoi(g.Gid)
+}
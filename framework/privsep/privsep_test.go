@@ -0,0 +1,124 @@
+package privsep
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestHelperDeniesRequests(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "privsep.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	var (
+		mutex sync.Mutex
+		seen  []Request
+	)
+	helper := &Helper{Allow: func(peer Peer, req Request) bool {
+		if peer.PID != os.Getpid() {
+			t.Errorf("unexpected peer pid %d", peer.PID)
+		}
+		mutex.Lock()
+		seen = append(seen, req)
+		mutex.Unlock()
+		return false
+	}}
+	go helper.Serve(l)
+
+	client := &Client{Path: path}
+	_, err = client.Dial(2, 1024)
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected permission denied, got %v", err)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if diff := cmp.Diff([]Request{{Op: OpDial, ContextID: 2, Port: 1024}}, seen); diff != "" {
+		t.Fatalf("unexpected requests (-want +got):\n%s", diff)
+	}
+}
+
+func TestHelperListen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run", "privsep.sock")
+	l, err := (&Helper{}).listen(path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if diff := cmp.Diff(os.ModeSocket|0600, info.Mode()); diff != "" {
+		t.Fatalf("unexpected socket mode (-want +got):\n%s", diff)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("failed to read directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected only the socket to be left, got %d entries", len(entries))
+	}
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c.Close()
+}
+
+func TestReplyCarriesDescriptor(t *testing.T) {
+	a, b, err := socketPair(filepath.Join(t.TempDir(), "pair.sock"))
+	if err != nil {
+		t.Fatalf("failed to create socket pair: %v", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %v", os.DevNull, err)
+	}
+	defer f.Close()
+	if err := writeReply(a, reply{ContextID: 7}, f); err != nil {
+		t.Fatalf("failed to write reply: %v", err)
+	}
+
+	got, r, err := readReply(b)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	if got == nil {
+		t.Fatal("expected a descriptor")
+	}
+	got.Close()
+	if diff := cmp.Diff(uint32(7), r.ContextID); diff != "" {
+		t.Fatalf("unexpected context ID (-want +got):\n%s", diff)
+	}
+}
+
+func socketPair(path string) (*net.UnixConn, *net.UnixConn, error) {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, nil, err
+	}
+	defer l.Close()
+	a, err := net.DialUnix("unix", nil, l.Addr().(*net.UnixAddr))
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := l.AcceptUnix()
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+	return a, b, nil
+}
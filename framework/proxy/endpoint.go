@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Endpoint is one side of a forward.
+type Endpoint struct {
+	// Network is "vsock", "tcp" or "unix".
+	Network string
+	// Address is the address of tcp and unix endpoints, as net.Dial takes
+	// it.
+	Address string
+	// ContextID and Port address vsock endpoints. Listening endpoints
+	// listen on Port of the local context ID, ignoring ContextID.
+	ContextID uint32
+	Port      uint32
+}
+
+// ParseEndpoint parses endpoints written as
+//
+//	vsock:cid:port   e.g. vsock:3:5000, or vsock:host:5000
+//	vsock:port       vsock:host:port
+//	tcp:host:port    e.g. tcp:127.0.0.1:8080
+//	unix:path        e.g. unix:/run/app.sock
+func ParseEndpoint(s string) (Endpoint, error) {
+	network, address, ok := strings.Cut(s, ":")
+	if !ok || address == "" {
+		return Endpoint{}, fmt.Errorf("proxy: endpoint %q is not network:address", s)
+	}
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return Endpoint{}, fmt.Errorf("proxy: endpoint %q: %v", s, err)
+		}
+		return Endpoint{Network: network, Address: address}, nil
+	case "unix":
+		return Endpoint{Network: network, Address: address}, nil
+	case "vsock":
+		cid, port := "host", address
+		if i := strings.LastIndex(address, ":"); i >= 0 {
+			cid, port = address[:i], address[i+1:]
+		}
+		e := Endpoint{Network: network}
+		switch cid {
+		case "host":
+			e.ContextID = vsock.Host
+		case "hypervisor":
+			e.ContextID = vsock.Hypervisor
+		case "local":
+			e.ContextID = vsock.Local
+		default:
+			n, err := strconv.ParseUint(cid, 10, 32)
+			if err != nil {
+				return Endpoint{}, fmt.Errorf("proxy: endpoint %q: invalid context ID %q", s, cid)
+			}
+			e.ContextID = uint32(n)
+		}
+		n, err := strconv.ParseUint(port, 10, 32)
+		if err != nil {
+			return Endpoint{}, fmt.Errorf("proxy: endpoint %q: invalid port %q", s, port)
+		}
+		e.Port = uint32(n)
+		return e, nil
+	}
+	return Endpoint{}, fmt.Errorf("proxy: endpoint %q: unknown network %q", s, network)
+}
+
+func (self Endpoint) String() string {
+	if self.Network == "vsock" {
+		return fmt.Sprintf("vsock:%d:%d", self.ContextID, self.Port)
+	}
+	return self.Network + ":" + self.Address
+}
+
+// listenEndpoint listens on the endpoint. A Unix socket left behind by an
+// earlier listener is replaced.
+func listenEndpoint(e Endpoint) (net.Listener, error) {
+	switch e.Network {
+	case "vsock":
+		l, err := vsock.Listen(e.Port)
+		if err != nil {
+			return nil, err
+		}
+		return l, nil
+	case "unix":
+		if info, err := os.Lstat(e.Address); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(e.Address)
+		}
+	}
+	return net.Listen(e.Network, e.Address)
+}
+
+func dialEndpoint(e Endpoint) (net.Conn, error) {
+	if e.Network == "vsock" {
+		conn, err := vsock.Dial(e.ContextID, e.Port)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	return net.Dial(e.Network, e.Address)
+}
@@ -0,0 +1,254 @@
+// Package proxy forwards connections between vsock and TCP or Unix sockets,
+// in either direction, so a host agent can expose guest services, or a
+// guest reach host ones, without copy loops of its own.
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	bridge "github.com/multiverse-os/vcable/framework/bridge"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Forward joins each connection accepted on Listen to a connection to
+// Target.
+type Forward struct {
+	// Name identifies the forward; it must be unique within a Forwarder.
+	Name   string
+	Listen Endpoint
+	Target Endpoint
+	// MaxConns limits the connections forwarded at once. While the limit
+	// is reached, new connections wait in the listen backlog. Zero means no
+	// limit.
+	MaxConns int
+	Profile  bridge.Profile
+}
+
+// Stats counts the connections and bytes of a forward.
+type Stats struct {
+	Active int64
+	Total  int64
+	// Failed counts connections dropped because Target could not be
+	// dialed.
+	Failed int64
+	// Received counts bytes from the accepted connections to Target, and
+	// Sent the bytes back.
+	Received int64
+	Sent     int64
+}
+
+// Forwarder runs forwards, each until it is removed or the Forwarder is
+// shut down.
+type Forwarder struct {
+	// Listen opens the listening side of a forward. Defaults to
+	// vsock.Listen for vsock endpoints and net.Listen for others.
+	Listen func(Endpoint) (net.Listener, error)
+	// Dial connects to the target of a forward. Defaults to vsock.Dial for
+	// vsock endpoints and net.Dial for others.
+	Dial     func(Endpoint) (net.Conn, error)
+	ErrorLog *log.Logger
+
+	mutex    sync.Mutex
+	forwards map[string]*forward
+}
+
+type forward struct {
+	Forward
+	addr   net.Addr
+	server *vsock.Server
+	stats  Stats
+	done   chan struct{}
+}
+
+// Add starts forwarding f.
+func (self *Forwarder) Add(f Forward) error {
+	if f.Name == "" {
+		return fmt.Errorf("proxy: forward from %v to %v has no name", f.Listen, f.Target)
+	}
+	listen := self.Listen
+	if listen == nil {
+		listen = listenEndpoint
+	}
+	l, err := listen(f.Listen)
+	if err != nil {
+		return fmt.Errorf("proxy: %s: %v", f.Name, err)
+	}
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if _, ok := self.forwards[f.Name]; ok {
+		l.Close()
+		return fmt.Errorf("proxy: duplicate forward %q", f.Name)
+	}
+	if self.forwards == nil {
+		self.forwards = make(map[string]*forward)
+	}
+	fw := &forward{Forward: f, addr: l.Addr(), done: make(chan struct{})}
+	self.forwards[f.Name] = fw
+
+	fw.server = &vsock.Server{
+		Handler:  vsock.HandlerFunc(func(conn net.Conn) { self.join(fw, conn) }),
+		MaxConns: f.MaxConns,
+		ErrorLog: self.ErrorLog,
+	}
+	go func() {
+		defer close(fw.done)
+		if err := fw.server.Serve(l); err != nil && err != vsock.ErrServerClosed {
+			self.logf("proxy: %s: %v", f.Name, err)
+		}
+	}()
+	return nil
+}
+
+func (self *Forwarder) join(fw *forward, conn net.Conn) {
+	atomic.AddInt64(&fw.stats.Total, 1)
+	atomic.AddInt64(&fw.stats.Active, 1)
+	defer atomic.AddInt64(&fw.stats.Active, -1)
+
+	dial := self.Dial
+	if dial == nil {
+		dial = dialEndpoint
+	}
+	target, err := dial(fw.Target)
+	if err != nil {
+		atomic.AddInt64(&fw.stats.Failed, 1)
+		self.logf("proxy: %s: %v: %v", fw.Name, conn.RemoteAddr(), err)
+		return
+	}
+	if err := bridge.Join(&countedConn{Conn: conn, stats: &fw.stats}, target, fw.Profile); err != nil {
+		self.logf("proxy: %s: %v: %v", fw.Name, conn.RemoteAddr(), err)
+	}
+}
+
+// Remove stops the forward called name, closing its connections.
+func (self *Forwarder) Remove(name string) error {
+	self.mutex.Lock()
+	fw, ok := self.forwards[name]
+	delete(self.forwards, name)
+	self.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("proxy: no forward %q", name)
+	}
+	err := fw.server.Close()
+	<-fw.done
+	return err
+}
+
+// Stats returns the counters of the forward called name.
+func (self *Forwarder) Stats(name string) (Stats, bool) {
+	self.mutex.Lock()
+	fw, ok := self.forwards[name]
+	self.mutex.Unlock()
+	if !ok {
+		return Stats{}, false
+	}
+	return Stats{
+		Active:   atomic.LoadInt64(&fw.stats.Active),
+		Total:    atomic.LoadInt64(&fw.stats.Total),
+		Failed:   atomic.LoadInt64(&fw.stats.Failed),
+		Received: atomic.LoadInt64(&fw.stats.Received),
+		Sent:     atomic.LoadInt64(&fw.stats.Sent),
+	}, true
+}
+
+// Addr returns the address the forward called name listens on, e.g. to
+// find the port chosen for a listening port of 0.
+func (self *Forwarder) Addr(name string) (net.Addr, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	fw, ok := self.forwards[name]
+	if !ok {
+		return nil, false
+	}
+	return fw.addr, true
+}
+
+// Forwards returns the running forwards, ordered by name.
+func (self *Forwarder) Forwards() []Forward {
+	self.mutex.Lock()
+	forwards := make([]Forward, 0, len(self.forwards))
+	for _, fw := range self.forwards {
+		forwards = append(forwards, fw.Forward)
+	}
+	self.mutex.Unlock()
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Name < forwards[j].Name })
+	return forwards
+}
+
+// Shutdown stops accepting on every forward and waits for the connections
+// to end. Once ctx is done, the remaining connections are closed.
+func (self *Forwarder) Shutdown(ctx context.Context) error {
+	self.mutex.Lock()
+	forwards := self.forwards
+	self.forwards = nil
+	self.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(forwards))
+	for _, fw := range forwards {
+		wg.Add(1)
+		go func(fw *forward) {
+			defer wg.Done()
+			if err := fw.server.Shutdown(ctx); err != nil {
+				fw.server.Close()
+				errs <- err
+			}
+			<-fw.done
+		}(fw)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// Close stops every forward at once, closing its connections.
+func (self *Forwarder) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := self.Shutdown(ctx); err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+func (self *Forwarder) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// countedConn counts the bytes read from and written to an accepted
+// connection.
+type countedConn struct {
+	net.Conn
+	stats *Stats
+}
+
+func (self *countedConn) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	atomic.AddInt64(&self.stats.Received, int64(n))
+	return n, err
+}
+
+func (self *countedConn) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	atomic.AddInt64(&self.stats.Sent, int64(n))
+	return n, err
+}
+
+// CloseWrite half-closes the connection where it supports it, so bridge
+// propagates the end of the stream rather than closing.
+func (self *countedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return self.Conn.Close()
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestParseEndpoint(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		want Endpoint
+	}{
+		{"vsock:3:5000", Endpoint{Network: "vsock", ContextID: 3, Port: 5000}},
+		{"vsock:host:22", Endpoint{Network: "vsock", ContextID: vsock.Host, Port: 22}},
+		{"vsock:5000", Endpoint{Network: "vsock", ContextID: vsock.Host, Port: 5000}},
+		{"tcp:127.0.0.1:8080", Endpoint{Network: "tcp", Address: "127.0.0.1:8080"}},
+		{"unix:/run/app.sock", Endpoint{Network: "unix", Address: "/run/app.sock"}},
+	} {
+		got, err := ParseEndpoint(test.s)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", test.s, err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("unexpected endpoint for %q (-want +got):\n%s", test.s, diff)
+		}
+	}
+	for _, s := range []string{"vsock:guest:1", "vsock:3:x", "tcp:nohost", "udp:1.2.3.4:5", "unix:"} {
+		if _, err := ParseEndpoint(s); err == nil {
+			t.Errorf("expected %q to be invalid", s)
+		}
+	}
+}
+
+// echo serves an echo server on a Unix socket in a temporary directory.
+func echo(t *testing.T) Endpoint {
+	path := filepath.Join(t.TempDir(), "echo.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return Endpoint{Network: "unix", Address: path}
+}
+
+func TestForwarder(t *testing.T) {
+	forwarder := &Forwarder{}
+	defer forwarder.Close()
+	err := forwarder.Add(Forward{
+		Name:   "echo",
+		Listen: Endpoint{Network: "tcp", Address: "127.0.0.1:0"},
+		Target: echo(t),
+	})
+	if err != nil {
+		t.Fatalf("failed to add the forward: %v", err)
+	}
+	if err := forwarder.Add(Forward{Name: "echo", Listen: Endpoint{Network: "tcp", Address: "127.0.0.1:0"}}); err == nil {
+		t.Fatal("expected a duplicate forward to be refused")
+	}
+
+	addr, _ := forwarder.Addr("echo")
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	conn.Close()
+	if diff := cmp.Diff("hello", string(got)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+
+	want := Stats{Total: 1, Received: 5, Sent: 5}
+	deadline := time.Now().Add(time.Second)
+	for {
+		stats, _ := forwarder.Stats("echo")
+		diff := cmp.Diff(want, stats)
+		if diff == "" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected stats (-want +got):\n%s", diff)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := forwarder.Remove("echo"); err != nil {
+		t.Fatalf("failed to remove the forward: %v", err)
+	}
+	if diff := cmp.Diff([]Forward{}, forwarder.Forwards()); diff != "" {
+		t.Fatalf("unexpected forwards (-want +got):\n%s", diff)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	forwarder := &Forwarder{}
+	err := forwarder.Add(Forward{
+		Name:     "echo",
+		Listen:   Endpoint{Network: "tcp", Address: "127.0.0.1:0"},
+		Target:   echo(t),
+		MaxConns: 1,
+	})
+	if err != nil {
+		t.Fatalf("failed to add the forward: %v", err)
+	}
+	addr, _ := forwarder.Addr("echo")
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// A round trip ensures the connection is being forwarded.
+	b := make([]byte, 4)
+	conn.Write([]byte("ping"))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := forwarder.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the shutdown to time out, got %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(b); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", addr.String()); err == nil {
+		t.Fatal("expected the listener to be closed")
+	}
+}
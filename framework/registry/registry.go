@@ -0,0 +1,233 @@
+// Package registry maps the names of virtual machines to their context IDs,
+// so host software dials guests by name. Guests announce themselves, with
+// the services they offer, to a Server on port Port of the host, and stay
+// registered for as long as the connection of their announcement lives;
+// the context ID of an entry is the one the connection came from, never
+// one the guest claims.
+//
+// Lookup, Watch and Dial act on Default, the registry a Server fills
+// unless given another, so they answer in the process serving it.
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Port is the host vsock port guests announce themselves on.
+const Port = vsock.PortDiscovery
+
+// watchBuffer is how many events a watcher may fall behind by before it is
+// dropped.
+const watchBuffer = 64
+
+// Service is a service a guest offers.
+type Service struct {
+	Name string `json:"name"`
+	Port uint32 `json:"port"`
+}
+
+// Entry is a registered guest.
+type Entry struct {
+	Name      string
+	ContextID uint32
+	Services  []Service
+	// Since is when the guest announced itself.
+	Since time.Time
+}
+
+// Service returns the port of the service called name.
+func (self Entry) Service(name string) (uint32, bool) {
+	for _, s := range self.Services {
+		if s.Name == name {
+			return s.Port, true
+		}
+	}
+	return 0, false
+}
+
+type EventType int
+
+const (
+	Added EventType = iota
+	Removed
+)
+
+func (self EventType) String() string {
+	if self == Removed {
+		return "removed"
+	}
+	return "added"
+}
+
+// Event reports a guest joining or leaving the registry. A guest announcing
+// itself again is removed, then added.
+type Event struct {
+	Type  EventType
+	Entry Entry
+}
+
+// Registry holds the guests which have announced themselves.
+type Registry struct {
+	mutex    sync.Mutex
+	entries  map[string]*Entry
+	watchers map[chan Event]struct{}
+}
+
+// Default is the registry of the process.
+var Default = &Registry{}
+
+// Register adds entry, returning the function which removes it. A name
+// registered by another context ID is refused; one registered by the same
+// context ID, as by a guest which rebooted, is replaced.
+func (self *Registry) Register(entry Entry) (remove func(), err error) {
+	if entry.Name == "" || len(entry.Name) > 255 {
+		return nil, fmt.Errorf("registry: invalid name %q", entry.Name)
+	}
+	if entry.Since.IsZero() {
+		entry.Since = time.Now()
+	}
+	entry.Services = append([]Service(nil), entry.Services...)
+	e := &entry
+
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if old, ok := self.entries[entry.Name]; ok {
+		if old.ContextID != entry.ContextID {
+			return nil, fmt.Errorf("registry: %q is registered by context ID %d", entry.Name, old.ContextID)
+		}
+		self.notify(Event{Removed, *old})
+	}
+	if self.entries == nil {
+		self.entries = make(map[string]*Entry)
+	}
+	self.entries[entry.Name] = e
+	self.notify(Event{Added, entry})
+
+	return func() {
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		if self.entries[e.Name] == e {
+			delete(self.entries, e.Name)
+			self.notify(Event{Removed, *e})
+		}
+	}, nil
+}
+
+// notify sends event to the watchers, dropping those which have fallen
+// behind; the caller holds mutex.
+func (self *Registry) notify(event Event) {
+	for ch := range self.watchers {
+		select {
+		case ch <- event:
+		default:
+			delete(self.watchers, ch)
+			close(ch)
+		}
+	}
+}
+
+// Lookup returns the guest called name.
+func (self *Registry) Lookup(name string) (Entry, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if e, ok := self.entries[name]; ok {
+		return *e, true
+	}
+	return Entry{}, false
+}
+
+// LookupContextID returns the guest with context ID cid.
+func (self *Registry) LookupContextID(cid uint32) (Entry, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, e := range self.entries {
+		if e.ContextID == cid {
+			return *e, true
+		}
+	}
+	return Entry{}, false
+}
+
+// Entries returns the registered guests, ordered by name.
+func (self *Registry) Entries() []Entry {
+	self.mutex.Lock()
+	entries := make([]Entry, 0, len(self.entries))
+	for _, e := range self.entries {
+		entries = append(entries, *e)
+	}
+	self.mutex.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries
+}
+
+// Watch returns the guests registered now, as Added events, followed by
+// every change until ctx is done and the channel closed. A watcher which
+// falls behind by more than 64 events has its channel closed early.
+func (self *Registry) Watch(ctx context.Context) <-chan Event {
+	self.mutex.Lock()
+	ch := make(chan Event, len(self.entries)+watchBuffer)
+	for _, e := range self.entries {
+		ch <- Event{Added, *e}
+	}
+	if self.watchers == nil {
+		self.watchers = make(map[chan Event]struct{})
+	}
+	self.watchers[ch] = struct{}{}
+	self.mutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		self.mutex.Lock()
+		defer self.mutex.Unlock()
+		if _, ok := self.watchers[ch]; ok {
+			delete(self.watchers, ch)
+			close(ch)
+		}
+	}()
+	return ch
+}
+
+// Dial dials port on the guest called name.
+func (self *Registry) Dial(ctx context.Context, name string, port uint32) (*vsock.Conn, error) {
+	e, ok := self.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("registry: unknown guest %q", name)
+	}
+	return vsock.DialContext(ctx, e.ContextID, port)
+}
+
+// DialService dials the service called service on the guest called name.
+func (self *Registry) DialService(ctx context.Context, name, service string) (*vsock.Conn, error) {
+	e, ok := self.Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("registry: unknown guest %q", name)
+	}
+	port, ok := e.Service(service)
+	if !ok {
+		return nil, fmt.Errorf("registry: guest %q offers no service %q", name, service)
+	}
+	return vsock.DialContext(ctx, e.ContextID, port)
+}
+
+// Lookup returns the guest called name in Default.
+func Lookup(name string) (Entry, bool) { return Default.Lookup(name) }
+
+// Watch watches Default; see Registry.Watch.
+func Watch(ctx context.Context) <-chan Event { return Default.Watch(ctx) }
+
+// Dial dials port on the guest called name in Default.
+func Dial(ctx context.Context, name string, port uint32) (*vsock.Conn, error) {
+	return Default.Dial(ctx, name, port)
+}
+
+// DialService dials the service called service on the guest called name in
+// Default.
+func DialService(ctx context.Context, name, service string) (*vsock.Conn, error) {
+	return Default.DialService(ctx, name, service)
+}
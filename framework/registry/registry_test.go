@@ -0,0 +1,82 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRegister(t *testing.T) {
+	r := &Registry{}
+	since := time.Unix(1, 0)
+	db := Entry{Name: "db-vm", ContextID: 3, Services: []Service{{"postgres", 5432}}, Since: since}
+	remove, err := r.Register(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := r.Lookup("db-vm")
+	if !ok {
+		t.Fatal("Lookup() found nothing")
+	}
+	if diff := cmp.Diff(db, got); diff != "" {
+		t.Fatalf("unexpected entry (-want +got):\n%s", diff)
+	}
+	if port, ok := got.Service("postgres"); !ok || port != 5432 {
+		t.Fatalf("Service() = %d, %v", port, ok)
+	}
+	if _, ok := r.LookupContextID(3); !ok {
+		t.Fatal("LookupContextID() found nothing")
+	}
+
+	if _, err := r.Register(Entry{Name: "db-vm", ContextID: 4}); err == nil {
+		t.Fatal("registered a name held by another context ID")
+	}
+	// The same guest announcing itself again replaces its entry, and the
+	// remove function of the old one no longer applies.
+	again := Entry{Name: "db-vm", ContextID: 3, Since: since}
+	removeAgain, err := r.Register(again)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remove()
+	if diff := cmp.Diff([]Entry{again}, r.Entries()); diff != "" {
+		t.Fatalf("unexpected entries (-want +got):\n%s", diff)
+	}
+	removeAgain()
+	if _, ok := r.Lookup("db-vm"); ok {
+		t.Fatal("Lookup() found a removed entry")
+	}
+
+	if _, err := r.Register(Entry{ContextID: 5}); err == nil {
+		t.Fatal("registered an entry without a name")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	r := &Registry{}
+	since := time.Unix(1, 0)
+	web := Entry{Name: "web", ContextID: 3, Services: []Service{{"http", 80}}, Since: since}
+	db := Entry{Name: "db", ContextID: 4, Services: []Service{{"postgres", 5432}}, Since: since}
+	if _, err := r.Register(web); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	events := r.Watch(ctx)
+	remove, err := r.Register(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remove()
+	cancel()
+
+	var got []Event
+	for event := range events {
+		got = append(got, event)
+	}
+	want := []Event{{Added, web}, {Added, db}, {Removed, db}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,245 @@
+package registry
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	health "github.com/multiverse-os/vcable/framework/health"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// maxAnnouncement bounds the announcement line a guest sends.
+const maxAnnouncement = 64 << 10
+
+// Announcement is what a guest tells the registry of itself. The exchange
+// runs over a connection monitored with heartbeats: the guest sends its
+// announcement as a line of JSON, and the server answers with a line of
+// JSON holding an error, empty on success.
+type Announcement struct {
+	Name     string    `json:"name"`
+	Services []Service `json:"services,omitempty"`
+}
+
+type reply struct {
+	Error string `json:"error,omitempty"`
+}
+
+// Server registers the guests which announce themselves, for as long as
+// their connections live.
+type Server struct {
+	// Registry is filled with the guests. Defaults to Default.
+	Registry *Registry
+	// Heartbeat configures the heartbeats of the connections, those of the
+	// guests must match. Defaults to those of health.
+	Heartbeat *health.Config
+	ErrorLog  *log.Logger
+}
+
+// ListenAndServe serves guests on port Port of the host.
+func (self *Server) ListenAndServe() error {
+	l, err := vsock.ListenHost(Port)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return self.Serve(l)
+}
+
+// Serve serves the guests connecting to l until it fails.
+func (self *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := self.ServeConn(conn); err != nil {
+				self.logf("registry: %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// ServeConn registers the guest announcing itself on conn until the
+// connection ends.
+func (self *Server) ServeConn(conn net.Conn) error {
+	addr, ok := conn.RemoteAddr().(*vsock.Addr)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("registry: %s peer %v has no context ID", conn.RemoteAddr().Network(), conn.RemoteAddr())
+	}
+	hc := health.Monitor(conn, self.Heartbeat)
+	defer hc.Close()
+
+	var a Announcement
+	line, err := bufio.NewReader(io.LimitReader(hc, maxAnnouncement)).ReadBytes('\n')
+	if err == nil {
+		err = json.Unmarshal(line, &a)
+	}
+	if err != nil {
+		return err
+	}
+	registry := self.Registry
+	if registry == nil {
+		registry = Default
+	}
+	remove, err := registry.Register(Entry{Name: a.Name, ContextID: addr.ContextID, Services: a.Services})
+	if err != nil {
+		writeReply(hc, err)
+		return err
+	}
+	defer remove()
+	if err := writeReply(hc, nil); err != nil {
+		return err
+	}
+
+	<-hc.Done()
+	if err := hc.Err(); err != io.EOF && !errors.Is(err, net.ErrClosed) {
+		return err
+	}
+	return nil
+}
+
+func writeReply(w io.Writer, err error) error {
+	var r reply
+	if err != nil {
+		r.Error = err.Error()
+	}
+	b, _ := json.Marshal(r)
+	_, werr := w.Write(append(b, '\n'))
+	return werr
+}
+
+func (self *Server) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// Announcer announces a guest to the registry of the host, and announces it
+// again whenever the connection drops.
+type Announcer struct {
+	Announcement
+	// Dial connects to the registry. Defaults to port Port of the host.
+	Dial func(ctx context.Context) (net.Conn, error)
+	// Heartbeat configures the heartbeats of the connection, which must
+	// match those of the server. Defaults to those of health.
+	Heartbeat *health.Config
+	// Backoff is the delay before each attempt to announce again.
+	// Defaults to jittered exponential backoff from 1s up to 1m.
+	Backoff vsock.Backoff
+	// OnAnnounce, if set, is called with the result of every attempt.
+	OnAnnounce func(error)
+}
+
+// Announce keeps the guest announced as a until ctx is done; see Announcer.
+func Announce(ctx context.Context, a Announcement) error {
+	return (&Announcer{Announcement: a}).Run(ctx)
+}
+
+// Run keeps the guest announced until ctx is done, returning its error,
+// or the registry refuses the announcement.
+func (self *Announcer) Run(ctx context.Context) error {
+	backoff := self.Backoff
+	if backoff == nil {
+		backoff = vsock.Jittered(vsock.Exponential(time.Second, time.Minute))
+	}
+	for attempt := 1; ; attempt++ {
+		err := self.announce(ctx, func() { attempt = 0 })
+		var refused *refusedError
+		if errors.As(err, &refused) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		timer := time.NewTimer(backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// announce announces the guest once and holds the connection until it
+// ends, calling registered once the registry accepted the announcement.
+func (self *Announcer) announce(ctx context.Context, registered func()) error {
+	dial := self.Dial
+	if dial == nil {
+		dial = func(ctx context.Context) (net.Conn, error) {
+			return vsock.DialContext(ctx, vsock.Host, Port)
+		}
+	}
+	conn, err := dial(ctx)
+	if err != nil {
+		self.report(err)
+		return err
+	}
+	hc := health.Monitor(conn, self.Heartbeat)
+	defer hc.Close()
+
+	stop := vsock.BindContext(ctx, hc)
+	err = exchange(hc, self.Announcement)
+	stop()
+	self.report(err)
+	if err != nil {
+		return err
+	}
+	registered()
+
+	select {
+	case <-hc.Done():
+		return hc.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func exchange(conn net.Conn, a Announcement) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		return err
+	}
+	var r reply
+	if err := json.Unmarshal(line, &r); err != nil {
+		return err
+	}
+	if r.Error != "" {
+		return &refusedError{r.Error}
+	}
+	return nil
+}
+
+func (self *Announcer) report(err error) {
+	if self.OnAnnounce != nil {
+		self.OnAnnounce(err)
+	}
+}
+
+// refusedError is the registry refusing an announcement, which is not
+// retried.
+type refusedError struct {
+	reason string
+}
+
+func (self *refusedError) Error() string {
+	return "registry: host refused announcement: " + self.reason
+}
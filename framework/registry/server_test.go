@@ -0,0 +1,99 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	health "github.com/multiverse-os/vcable/framework/health"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+var fast = &health.Config{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
+
+func TestAnnounce(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	host, guest := network.Machine(vsock.Host), network.Machine(3)
+	l, err := host.Listen(Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	r := &Registry{}
+	server := &Server{Registry: r, Heartbeat: fast, ErrorLog: log.New(io.Discard, "", 0)}
+	go server.Serve(l)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx)
+	announced := make(chan error, 1)
+	announcer := &Announcer{
+		Announcement: Announcement{Name: "db-vm", Services: []Service{{"postgres", 5432}}},
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return guest.DialContext(ctx, vsock.Host, Port)
+		},
+		Heartbeat:  fast,
+		OnAnnounce: func(err error) { announced <- err },
+	}
+	stopped := make(chan error, 1)
+	go func() { stopped <- announcer.Run(ctx) }()
+	if err := <-announced; err != nil {
+		t.Fatal(err)
+	}
+
+	event := <-events
+	if event.Type != Added {
+		t.Fatalf("got a %v event, want added", event.Type)
+	}
+	want := Entry{Name: "db-vm", ContextID: 3, Services: []Service{{"postgres", 5432}}}
+	got := event.Entry
+	if got.Since.IsZero() {
+		t.Fatal("entry has no Since")
+	}
+	got.Since = time.Time{}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected entry (-want +got):\n%s", diff)
+	}
+
+	// Idle for several heartbeat timeouts, the guest stays registered.
+	time.Sleep(200 * time.Millisecond)
+	if _, ok := r.Lookup("db-vm"); !ok {
+		t.Fatal("guest dropped while idle")
+	}
+
+	// Another guest may not take the name.
+	other := &Announcer{
+		Announcement: Announcement{Name: "db-vm"},
+		Dial: func(ctx context.Context) (net.Conn, error) {
+			return network.Machine(4).DialContext(ctx, vsock.Host, Port)
+		},
+		Heartbeat: fast,
+	}
+	var refused *refusedError
+	if err := other.Run(ctx); !errors.As(err, &refused) {
+		t.Fatalf("Run() of a conflicting guest = %v, want a refusal", err)
+	}
+
+	cancel()
+	if err := <-stopped; err != context.Canceled {
+		t.Fatalf("Run() = %v, want context.Canceled", err)
+	}
+	deadline := time.After(time.Second)
+	for {
+		if _, ok := r.Lookup("db-vm"); !ok {
+			break
+		}
+		select {
+		case <-deadline:
+			t.Fatal("guest still registered after it stopped announcing")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
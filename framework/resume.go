@@ -0,0 +1,404 @@
+package vcable
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	mux "github.com/multiverse-os/vcable/framework/mux"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+const (
+	// resumeBacklog is how much written data a resumable stream keeps for
+	// retransmission after its link drops.
+	resumeBacklog = 1 << 20
+	// ResumeTimeout bounds how long a resumable stream waits for its link
+	// to be re-established.
+	ResumeTimeout = 30 * time.Second
+)
+
+type resumeToken [16]byte
+
+// OpenResumable opens a stream to service which survives the link dropping:
+// once the cable reconnects, over the same transport or another, the stream
+// continues where it left off. Up to 1MiB of data in flight is retransmitted;
+// if more was lost, or the link stays down longer than ResumeTimeout, the
+// stream fails.
+func (self *Cable) OpenResumable(ctx context.Context, service string) (net.Conn, error) {
+	if len(service) == 0 || len(service) > maxServiceName {
+		return nil, fmt.Errorf("vcable: invalid service name %q", service)
+	}
+	var token resumeToken
+	if _, err := rand.Read(token[:]); err != nil {
+		return nil, err
+	}
+
+	session, err := self.SessionContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	stop := vsock.BindContext(ctx, stream)
+	defer stop()
+
+	if _, err := stream.Write(append(streamHeader(streamResumable, service), token[:]...)); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(stream, reply[:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	if reply[0] != serviceOK {
+		stream.Close()
+		return nil, fmt.Errorf("vcable: peer has no service %q", service)
+	}
+	return self.tag(self.resumable(stream, service, token, true), service), nil
+}
+
+// resumable wraps the first stream of a resumable stream.
+func (self *Cable) resumable(stream net.Conn, service string, token resumeToken, client bool) *resumableConn {
+	conn := &resumableConn{
+		cable:   self,
+		service: service,
+		token:   token,
+		client:  client,
+		current: stream,
+		changed: make(chan struct{}),
+	}
+	if !client {
+		self.mutex.Lock()
+		if self.resumes == nil {
+			self.resumes = make(map[resumeToken]*resumableConn)
+		}
+		self.resumes[token] = conn
+		self.mutex.Unlock()
+	}
+	return conn
+}
+
+// resume hands a stream continuing a resumable stream over to it.
+func (self *Cable) resume(stream *mux.Stream) {
+	var header [len(resumeToken{}) + 8]byte
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		stream.Close()
+		return
+	}
+	var token resumeToken
+	copy(token[:], header[:])
+	received := binary.BigEndian.Uint64(header[len(token):])
+
+	self.mutex.Lock()
+	conn, ok := self.resumes[token]
+	self.mutex.Unlock()
+	if !ok {
+		stream.Write([]byte{serviceUnknown})
+		stream.Close()
+		return
+	}
+	if err := conn.adopt(stream, received); err != nil {
+		self.logf("vcable: failed to resume %s stream: %v", conn.service, err)
+		stream.Close()
+	}
+}
+
+// resumableConn is a stream which moves to a new underlying stream when its
+// link drops. Both ends count the bytes they received; on resumption each
+// retransmits what the other missed from its backlog of written data.
+type resumableConn struct {
+	cable   *Cable
+	service string
+	token   resumeToken
+	// client ends reopen the stream; the other end waits to adopt it.
+	client bool
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex // held while writing, and while switching streams
+
+	mutex    sync.Mutex
+	current  net.Conn
+	changed  chan struct{} // closed when current changes or on Close
+	closed   bool
+	sent     uint64
+	backlog  []byte // the last bytes written, up to sent
+	received uint64
+}
+
+func (self *resumableConn) Read(b []byte) (int, error) {
+	self.readMutex.Lock()
+	defer self.readMutex.Unlock()
+
+	for {
+		conn, changed, err := self.snapshot()
+		if err != nil {
+			return 0, err
+		}
+		n, err := conn.Read(b)
+		if n > 0 {
+			self.mutex.Lock()
+			self.received += uint64(n)
+			self.mutex.Unlock()
+			return n, nil
+		}
+		if err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded) {
+			return 0, err
+		}
+		if err := self.recover(conn, changed); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (self *resumableConn) Write(b []byte) (int, error) {
+	self.writeMutex.Lock()
+	conn, changed, err := self.snapshot()
+	if err != nil {
+		self.writeMutex.Unlock()
+		return 0, err
+	}
+	n, err := conn.Write(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		// Only the first n bytes went out; the caller decides about the rest.
+		self.record(b[:n])
+		self.writeMutex.Unlock()
+		return n, err
+	}
+	// Should the link have dropped, resuming retransmits what the peer
+	// missed of b.
+	self.record(b)
+	self.writeMutex.Unlock()
+
+	if err != nil {
+		if err := self.recover(conn, changed); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// record adds b to the data sent and the backlog. The caller holds
+// writeMutex.
+func (self *resumableConn) record(b []byte) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.sent += uint64(len(b))
+	self.backlog = append(self.backlog, b...)
+	if len(self.backlog) > resumeBacklog {
+		self.backlog = append(self.backlog[:0], self.backlog[len(self.backlog)-resumeBacklog:]...)
+	}
+}
+
+// recover moves on from the broken stream conn: the client end reopens it,
+// the other end waits for the client to do so.
+func (self *resumableConn) recover(conn net.Conn, changed chan struct{}) error {
+	if !self.client {
+		timer := time.NewTimer(ResumeTimeout)
+		defer timer.Stop()
+		select {
+		case <-changed:
+			return nil
+		case <-timer.C:
+			return fmt.Errorf("vcable: %s stream was not resumed within %v", self.service, ResumeTimeout)
+		}
+	}
+
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	current, _, err := self.snapshot()
+	if err != nil || current != conn {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ResumeTimeout)
+	defer cancel()
+	for {
+		err := self.reopen(ctx)
+		if err == nil {
+			return nil
+		}
+		if _, _, cerr := self.snapshot(); cerr != nil || ctx.Err() != nil {
+			return fmt.Errorf("vcable: failed to resume %s stream: %v", self.service, err)
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return fmt.Errorf("vcable: failed to resume %s stream: %v", self.service, err)
+		}
+	}
+}
+
+// reopen opens a stream continuing this one. The caller holds writeMutex.
+func (self *resumableConn) reopen(ctx context.Context) error {
+	session, err := self.cable.SessionContext(ctx)
+	if err != nil {
+		return err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return err
+	}
+	stop := vsock.BindContext(ctx, stream)
+	defer stop()
+
+	self.mutex.Lock()
+	received := self.received
+	self.mutex.Unlock()
+	header := append(streamHeader(streamResume, self.service), self.token[:]...)
+	header = binary.BigEndian.AppendUint64(header, received)
+	if _, err := stream.Write(header); err != nil {
+		stream.Close()
+		return err
+	}
+
+	var reply [9]byte
+	if _, err := io.ReadFull(stream, reply[:1]); err != nil {
+		stream.Close()
+		return err
+	}
+	if reply[0] != serviceOK {
+		stream.Close()
+		self.Close()
+		return fmt.Errorf("vcable: peer no longer has the stream")
+	}
+	if _, err := io.ReadFull(stream, reply[1:]); err != nil {
+		stream.Close()
+		return err
+	}
+	if err := self.switchTo(stream, binary.BigEndian.Uint64(reply[1:])); err != nil {
+		stream.Close()
+		return err
+	}
+	return nil
+}
+
+// adopt continues the stream on stream, opened by the client end which has
+// received the given number of bytes.
+func (self *resumableConn) adopt(stream net.Conn, received uint64) error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+
+	self.mutex.Lock()
+	ours := self.received
+	self.mutex.Unlock()
+	reply := binary.BigEndian.AppendUint64([]byte{serviceOK}, ours)
+	if _, err := stream.Write(reply); err != nil {
+		return err
+	}
+	return self.switchTo(stream, received)
+}
+
+// switchTo retransmits what the peer missed on stream and makes it current.
+// The caller holds writeMutex.
+func (self *resumableConn) switchTo(stream net.Conn, peerReceived uint64) error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return net.ErrClosed
+	}
+	missing := self.sent - peerReceived
+	if peerReceived > self.sent || missing > uint64(len(self.backlog)) {
+		self.mutex.Unlock()
+		self.Close()
+		return fmt.Errorf("vcable: %d bytes lost, more than the resume backlog", missing)
+	}
+	retransmit := append([]byte(nil), self.backlog[uint64(len(self.backlog))-missing:]...)
+	self.mutex.Unlock()
+
+	if _, err := stream.Write(retransmit); err != nil {
+		return err
+	}
+
+	self.mutex.Lock()
+	old := self.current
+	self.current = stream
+	close(self.changed)
+	self.changed = make(chan struct{})
+	self.mutex.Unlock()
+	old.Close()
+	return nil
+}
+
+func (self *resumableConn) snapshot() (net.Conn, chan struct{}, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.closed {
+		return nil, nil, net.ErrClosed
+	}
+	return self.current, self.changed, nil
+}
+
+func (self *resumableConn) Close() error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.closed = true
+	close(self.changed)
+	conn := self.current
+	self.mutex.Unlock()
+
+	if !self.client {
+		self.cable.mutex.Lock()
+		delete(self.cable.resumes, self.token)
+		self.cable.mutex.Unlock()
+	}
+	return conn.Close()
+}
+
+func (self *resumableConn) CloseWrite() error {
+	conn, _, err := self.snapshot()
+	if err != nil {
+		return err
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (self *resumableConn) LocalAddr() net.Addr  { return self.conn().LocalAddr() }
+func (self *resumableConn) RemoteAddr() net.Addr { return self.conn().RemoteAddr() }
+
+func (self *resumableConn) conn() net.Conn {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.current
+}
+
+// Deadlines apply to the current stream only.
+func (self *resumableConn) SetDeadline(t time.Time) error {
+	conn, _, err := self.snapshot()
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(t)
+}
+
+func (self *resumableConn) SetReadDeadline(t time.Time) error {
+	conn, _, err := self.snapshot()
+	if err != nil {
+		return err
+	}
+	return conn.SetReadDeadline(t)
+}
+
+func (self *resumableConn) SetWriteDeadline(t time.Time) error {
+	conn, _, err := self.snapshot()
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
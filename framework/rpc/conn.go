@@ -0,0 +1,336 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	codec "github.com/multiverse-os/vcable/framework/codec"
+)
+
+// envelope heads the messages of calls over a connection.
+type envelope struct {
+	ID uint64 `json:"id"`
+	// Method, Codec and Timeout are set on requests, as in header.
+	Method  string        `json:"method,omitempty"`
+	Codec   string        `json:"codec,omitempty"`
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Cancel abandons the request ID, which gets no response.
+	Cancel bool `json:"cancel,omitempty"`
+	// Status is set on responses.
+	status
+}
+
+// hasBody reports whether a frame follows the envelope.
+func (self *envelope) hasBody() bool { return !self.Cancel && self.Error == "" }
+
+// writeEnvelope writes m and, if it has one, its body in a single write.
+// Writers sharing conn must still hold a lock across the call, as net.Conn
+// does not promise concurrent writes are atomic.
+func writeEnvelope(conn net.Conn, m *envelope, body []byte) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, b); err != nil {
+		return err
+	}
+	if m.hasBody() {
+		if err := writeFrame(&buf, body); err != nil {
+			return err
+		}
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+func readEnvelope(conn net.Conn) (*envelope, []byte, error) {
+	var m envelope
+	if err := readJSON(conn, &m); err != nil {
+		return nil, nil, err
+	}
+	if !m.hasBody() {
+		return &m, nil, nil
+	}
+	body, err := readFrame(conn)
+	if err != nil {
+		return nil, nil, unexpected(err)
+	}
+	return &m, body, nil
+}
+
+// ErrClientClosed is returned by calls on a closed Client, or one whose
+// connection failed; see Client.Err.
+var ErrClientClosed = errors.New("rpc: client closed")
+
+// Client makes calls over a connection served by Server.ServeConn. Calls
+// may be made concurrently.
+type Client struct {
+	conn net.Conn
+	// Codec encodes requests and responses. Defaults to codec.JSON; set it
+	// before the first call.
+	Codec codec.Codec
+
+	writeMutex sync.Mutex
+
+	mutex   sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *reply
+	err     error // why the connection ended
+	done    chan struct{}
+}
+
+type reply struct {
+	envelope *envelope
+	body     []byte
+}
+
+// NewClient returns a client calling over conn, which it owns from then on.
+func NewClient(conn net.Conn) *Client {
+	self := &Client{
+		conn:    conn,
+		pending: make(map[uint64]chan *reply),
+		done:    make(chan struct{}),
+	}
+	go self.read()
+	return self
+}
+
+// read delivers responses to their calls until the connection ends.
+func (self *Client) read() {
+	defer close(self.done)
+	for {
+		m, body, err := readEnvelope(self.conn)
+		if err != nil {
+			self.fail(err)
+			return
+		}
+		self.mutex.Lock()
+		ch, ok := self.pending[m.ID]
+		delete(self.pending, m.ID)
+		self.mutex.Unlock()
+		// Responses to calls given up on are dropped.
+		if ok {
+			ch <- &reply{envelope: m, body: body}
+		}
+	}
+}
+
+func (self *Client) fail(err error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.err == nil {
+		self.err = err
+	}
+	for id, ch := range self.pending {
+		close(ch)
+		delete(self.pending, id)
+	}
+	self.conn.Close()
+}
+
+// Err returns why the connection ended, or nil while it is up.
+func (self *Client) Err() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.err
+}
+
+// Done is closed once the connection has ended.
+func (self *Client) Done() <-chan struct{} { return self.done }
+
+// Close closes the connection, failing the calls in progress with
+// ErrClientClosed.
+func (self *Client) Close() error {
+	self.fail(ErrClientClosed)
+	<-self.done
+	return nil
+}
+
+// Call calls method on the peer with req, decoding its response into resp,
+// a pointer. The deadline of ctx is passed on to the handler; if ctx is done
+// first, the call is cancelled on the peer too.
+func (self *Client) Call(ctx context.Context, method string, req, resp interface{}) error {
+	c := self.Codec
+	if c == nil {
+		c = codec.JSON{}
+	}
+	body, err := c.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("rpc: %s: %v", method, err)
+	}
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *reply, 1)
+	self.mutex.Lock()
+	if self.err != nil {
+		self.mutex.Unlock()
+		return ErrClientClosed
+	}
+	self.nextID++
+	id := self.nextID
+	self.pending[id] = ch
+	self.mutex.Unlock()
+
+	m := &envelope{ID: id, Method: method, Codec: c.Name(), Timeout: timeout}
+	if err := self.write(m, body); err != nil {
+		self.forget(id)
+		return err
+	}
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return ErrClientClosed
+		}
+		if r.envelope.Error != "" {
+			return &Error{Method: method, Message: r.envelope.Error, Unknown: r.envelope.Unknown}
+		}
+		if err := c.Unmarshal(r.body, resp); err != nil {
+			return fmt.Errorf("rpc: %s: %v", method, err)
+		}
+		return nil
+	case <-ctx.Done():
+		if self.forget(id) {
+			self.write(&envelope{ID: id, Cancel: true}, nil)
+		}
+		return ctx.Err()
+	}
+}
+
+// forget abandons the call id, reporting whether it was still pending.
+func (self *Client) forget(id uint64) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	_, ok := self.pending[id]
+	delete(self.pending, id)
+	return ok
+}
+
+func (self *Client) write(m *envelope, body []byte) error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	if err := writeEnvelope(self.conn, m, body); err != nil {
+		self.fail(err)
+		return err
+	}
+	return nil
+}
+
+// CallConn calls method over the connection of client with req, and
+// returns its response, as Call does over a cable.
+func CallConn[Req, Resp interface{}](ctx context.Context, client *Client, method string, req Req) (Resp, error) {
+	var resp Resp
+	err := client.Call(ctx, method, req, &resp)
+	return resp, err
+}
+
+// ServeConn serves the calls a Client makes over conn, each concurrently,
+// until the connection ends; it then cancels the calls in progress and
+// waits for them. Requests beyond MaxCalls in progress fail. Streaming methods need a stream each, so only ServeVsock
+// serves them.
+func (self *Server) ServeConn(conn net.Conn) {
+	defer conn.Close()
+	var (
+		writeMutex sync.Mutex
+		mutex      sync.Mutex
+		calls      = make(map[uint64]context.CancelFunc)
+		wg         sync.WaitGroup
+	)
+	defer wg.Wait()
+	defer func() {
+		mutex.Lock()
+		for _, cancel := range calls {
+			cancel()
+		}
+		mutex.Unlock()
+	}()
+	maxCalls := self.MaxCalls
+	if maxCalls <= 0 {
+		maxCalls = 256
+	}
+	respond := func(m *envelope, body []byte) {
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		if err := writeEnvelope(conn, m, body); err != nil {
+			self.logf("rpc: %s: %v", conn.RemoteAddr(), err)
+			conn.Close()
+		}
+	}
+
+	for {
+		m, request, err := readEnvelope(conn)
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				self.logf("rpc: %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if m.Cancel {
+			mutex.Lock()
+			if cancel, ok := calls[m.ID]; ok {
+				cancel()
+			}
+			mutex.Unlock()
+			continue
+		}
+
+		self.mutex.RLock()
+		fn, ok := self.handlers[m.Method]
+		self.mutex.RUnlock()
+		if !ok {
+			respond(&envelope{ID: m.ID, status: status{Error: "unknown method", Unknown: true}}, nil)
+			continue
+		}
+		c, err := self.codec(m.Codec)
+		if err != nil {
+			respond(&envelope{ID: m.ID, status: status{Error: err.Error()}}, nil)
+			continue
+		}
+
+		ctx, cancel, err := callContext(m.Timeout)
+		if err != nil {
+			respond(&envelope{ID: m.ID, status: status{Error: err.Error()}}, nil)
+			continue
+		}
+		mutex.Lock()
+		if len(calls) >= maxCalls {
+			mutex.Unlock()
+			cancel()
+			respond(&envelope{ID: m.ID, status: status{Error: "too many calls in progress"}}, nil)
+			continue
+		}
+		calls[m.ID] = cancel
+		mutex.Unlock()
+		wg.Add(1)
+		go func(id uint64) {
+			defer wg.Done()
+			defer func() {
+				mutex.Lock()
+				delete(calls, id)
+				mutex.Unlock()
+				cancel()
+			}()
+			response, err := fn(ctx, c, request)
+			if ctx.Err() == context.Canceled {
+				// Given up on by the caller.
+				return
+			}
+			if err != nil {
+				respond(&envelope{ID: id, status: status{Error: err.Error()}}, nil)
+				return
+			}
+			respond(&envelope{ID: id}, response)
+		}(m.ID)
+	}
+}
@@ -0,0 +1,151 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	codec "github.com/multiverse-os/vcable/framework/codec"
+)
+
+func testClient(t *testing.T, server *Server) *Client {
+	client, conn := net.Pipe()
+	go server.ServeConn(conn)
+	c := NewClient(client)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestClient(t *testing.T) {
+	client := testClient(t, testServer())
+
+	// Concurrent calls share the connection, each getting its response.
+	var wg sync.WaitGroup
+	totals := make([]int, 8)
+	for i := range totals {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := CallConn[sum, total](context.Background(), client, "sum", sum{Terms: []int{i, i}})
+			if err != nil {
+				t.Errorf("failed to call: %v", err)
+			}
+			totals[i] = resp.Total
+		}(i)
+	}
+	wg.Wait()
+	if diff := cmp.Diff([]int{0, 2, 4, 6, 8, 10, 12, 14}, totals); diff != "" {
+		t.Errorf("unexpected responses (-want +got):\n%s", diff)
+	}
+
+	var rerr *Error
+	if _, err := CallConn[struct{}, struct{}](context.Background(), client, "fail", struct{}{}); !errors.As(err, &rerr) || rerr.Message != "failed on purpose" {
+		t.Errorf("expected the error of the handler, got %v", err)
+	}
+	if _, err := CallConn[struct{}, struct{}](context.Background(), client, "missing", struct{}{}); !errors.As(err, &rerr) || !rerr.Unknown {
+		t.Errorf("expected an unknown method, got %v", err)
+	}
+
+	client.Close()
+	if _, err := CallConn[sum, total](context.Background(), client, "sum", sum{}); err != ErrClientClosed {
+		t.Errorf("expected ErrClientClosed calling a closed client, got %v", err)
+	}
+}
+
+func TestClientCodec(t *testing.T) {
+	for _, c := range []codec.Codec{codec.Gob{}, codec.CBOR{}} {
+		client := testClient(t, testServer())
+		client.Codec = c
+		got, err := CallConn[sum, total](context.Background(), client, "sum", sum{Terms: []int{40, 2}})
+		if err != nil {
+			t.Fatalf("failed to call with %s: %v", c.Name(), err)
+		}
+		if diff := cmp.Diff(total{42}, got); diff != "" {
+			t.Errorf("unexpected response with %s (-want +got):\n%s", c.Name(), diff)
+		}
+	}
+}
+
+func TestServeConnLimits(t *testing.T) {
+	server := testServer()
+	server.MaxCalls = 1
+	started := make(chan struct{})
+	Handle(server, "block", func(ctx context.Context, req struct{}) (struct{}, error) {
+		close(started)
+		<-ctx.Done()
+		return struct{}{}, ctx.Err()
+	})
+	client := testClient(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go CallConn[struct{}, struct{}](ctx, client, "block", struct{}{})
+	<-started
+	var rerr *Error
+	if _, err := CallConn[sum, total](context.Background(), client, "sum", sum{}); !errors.As(err, &rerr) || rerr.Message != "too many calls in progress" {
+		t.Errorf("expected a call beyond MaxCalls to fail, got %v", err)
+	}
+
+	// A deadline passed fails the call before it is sent.
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	if _, err := CallConn[sum, total](expired, client, "sum", sum{}); err != context.DeadlineExceeded {
+		t.Errorf("expected a call past its deadline to fail, got %v", err)
+	}
+
+	// Peers sending a negative timeout are refused rather than given none.
+	conn, peer := net.Pipe()
+	go server.ServeConn(peer)
+	defer conn.Close()
+	if err := writeEnvelope(conn, &envelope{ID: 1, Method: "wait", Codec: "json", Timeout: -time.Second}, []byte("{}")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	m, _, err := readEnvelope(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("negative timeout -1s", m.Error); diff != "" {
+		t.Errorf("unexpected error (-want +got):\n%s", diff)
+	}
+}
+
+func TestClientContext(t *testing.T) {
+	server := testServer()
+	cancelled := make(chan struct{})
+	Handle(server, "block", func(ctx context.Context, req struct{}) (struct{}, error) {
+		<-ctx.Done()
+		close(cancelled)
+		return struct{}{}, ctx.Err()
+	})
+	client := testClient(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	left, err := CallConn[struct{}, time.Duration](ctx, client, "wait", struct{}{})
+	cancel()
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if left <= 0 || left > time.Minute {
+		t.Errorf("expected the deadline to reach the handler, got %v left", left)
+	}
+
+	// Giving up on a call cancels its handler, and leaves the connection
+	// usable.
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := CallConn[struct{}, struct{}](ctx, client, "block", struct{}{}); err != context.Canceled {
+		t.Errorf("expected the call to be cancelled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the handler was not cancelled")
+	}
+	if _, err := CallConn[sum, total](context.Background(), client, "sum", sum{Terms: []int{1}}); err != nil {
+		t.Errorf("failed to call after a cancellation: %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Package rpc calls typed functions of the peer of a cable.
+//
+// Each call opens a stream to the rpc service of the peer. The caller sends
+// a header naming the method and the codec of the request, then the
+// request; the peer answers with a status, and unless the call failed, the
+// response. Each is a frame: a 4 byte big endian length, then as many bytes.
+// Headers and statuses are JSON, requests and responses use the codec
+// named.
+//
+// Streaming calls carry any number of requests and responses instead,
+// each side ending its own. The frames of a streaming call start with a
+// kind byte, of a message, an end, or a credit: either side only sends as
+// many messages as the other gave it credit for, so a slow receiver holds
+// up the sender rather than buffering without bound.
+//
+// Calls made with a Client share a single connection, such as a
+// *vsock.Conn, rather than each opening a stream. Every request and
+// response is headed by a JSON envelope carrying the ID the caller gave the
+// request, so responses are matched to their calls whatever order they
+// complete in, and a caller giving up sends the ID back to cancel the
+// handler. A frame of the request or response follows its envelope, unless
+// the call failed. Codecs beyond JSON, CBOR and gob plug in through
+// codec.Register.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	codec "github.com/multiverse-os/vcable/framework/codec"
+)
+
+// ServiceName is the cable service calls are made to.
+const ServiceName = "rpc"
+
+// MaxMessageSize bounds the frames of a call.
+const MaxMessageSize = 16 << 20
+
+// DefaultCodec encodes the requests and responses of calls.
+const DefaultCodec = "json"
+
+// An Opener opens streams to the services of a peer, such as a
+// *vcable.Cable.
+type Opener interface {
+	OpenStreamContext(ctx context.Context, service string) (net.Conn, error)
+}
+
+type header struct {
+	Method string `json:"method"`
+	Codec  string `json:"codec"`
+	// Timeout is what is left of the deadline of the caller, if any; the
+	// clocks of host and guest need not agree.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	// Stream is set for streaming calls, which the handler accepts with a
+	// status before any messages follow.
+	Stream bool `json:"stream,omitempty"`
+}
+
+type status struct {
+	Error   string `json:"error,omitempty"`
+	Unknown bool   `json:"unknown,omitempty"`
+}
+
+// Error is the failure of a call, as reported by the peer.
+type Error struct {
+	Method  string
+	Message string
+	// Unknown is set if the peer has no such method.
+	Unknown bool
+}
+
+func (self *Error) Error() string { return fmt.Sprintf("rpc: %s: %s", self.Method, self.Message) }
+
+// Call calls method on the peer cable leads to with req, and returns its
+// response. The deadline of ctx is passed on to the handler, whose context
+// is cancelled if ctx is.
+func Call[Req, Resp interface{}](ctx context.Context, cable Opener, method string, req Req) (Resp, error) {
+	var resp Resp
+	c := codec.JSON{}
+	body, err := c.Marshal(req)
+	if err != nil {
+		return resp, fmt.Errorf("rpc: %s: %v", method, err)
+	}
+
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return resp, err
+	}
+
+	conn, err := cable.OpenStreamContext(ctx, ServiceName)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+
+	h := header{Method: method, Codec: c.Name(), Timeout: timeout}
+	if err := writeJSON(conn, h); err != nil {
+		return resp, contextError(ctx, err)
+	}
+	if err := writeFrame(conn, body); err != nil {
+		return resp, contextError(ctx, err)
+	}
+
+	var st status
+	if err := readJSON(conn, &st); err != nil {
+		return resp, contextError(ctx, err)
+	}
+	if st.Error != "" {
+		return resp, &Error{Method: method, Message: st.Error, Unknown: st.Unknown}
+	}
+	b, err := readFrame(conn)
+	if err != nil {
+		return resp, contextError(ctx, err)
+	}
+	if err := c.Unmarshal(b, &resp); err != nil {
+		return resp, fmt.Errorf("rpc: %s: %v", method, err)
+	}
+	return resp, nil
+}
+
+// callTimeout returns what is left of the deadline of ctx, zero for none,
+// or an error once the deadline has passed.
+func callTimeout(ctx context.Context) (time.Duration, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return 0, nil
+	}
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return 0, context.DeadlineExceeded
+	}
+	return timeout, nil
+}
+
+func writeFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxMessageSize {
+		return fmt.Errorf("rpc: message of %d bytes exceeds the maximum of %d", len(b), MaxMessageSize)
+	}
+	frame := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(frame, uint32(len(b)))
+	_, err := w.Write(append(frame, b...))
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > MaxMessageSize {
+		return nil, fmt.Errorf("rpc: message of %d bytes exceeds the maximum of %d", n, MaxMessageSize)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, unexpected(err)
+	}
+	return b, nil
+}
+
+func writeJSON(w io.Writer, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeFrame(w, b)
+}
+
+func readJSON(r io.Reader, v interface{}) error {
+	b, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("rpc: %v", err)
+	}
+	return nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// contextError prefers the error of ctx, which explains an I/O failure
+// caused by its cancellation.
+func contextError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vcable "github.com/multiverse-os/vcable/framework"
+)
+
+var _ Opener = &vcable.Cable{}
+
+// pipe opens streams to server through net.Pipe.
+type pipe struct{ server *Server }
+
+func (self pipe) OpenStreamContext(ctx context.Context, service string) (net.Conn, error) {
+	client, server := net.Pipe()
+	go self.server.ServeVsock(server)
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+	return client, nil
+}
+
+type sum struct {
+	Terms []int `json:"terms"`
+}
+
+type total struct {
+	Total int `json:"total"`
+}
+
+func testServer() *Server {
+	server := &Server{ErrorLog: log.New(io.Discard, "", 0)}
+	Handle(server, "sum", func(ctx context.Context, req sum) (total, error) {
+		var resp total
+		for _, term := range req.Terms {
+			resp.Total += term
+		}
+		return resp, nil
+	})
+	Handle(server, "fail", func(ctx context.Context, req struct{}) (struct{}, error) {
+		return struct{}{}, errors.New("failed on purpose")
+	})
+	Handle(server, "wait", func(ctx context.Context, req struct{}) (time.Duration, error) {
+		deadline, ok := ctx.Deadline()
+		if ok {
+			return time.Until(deadline), nil
+		}
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+	return server
+}
+
+func TestCall(t *testing.T) {
+	cable := pipe{testServer()}
+	got, err := Call[sum, total](context.Background(), cable, "sum", sum{Terms: []int{1, 2, 3}})
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if diff := cmp.Diff(total{6}, got); diff != "" {
+		t.Errorf("unexpected response (-want +got):\n%s", diff)
+	}
+
+	_, err = Call[struct{}, struct{}](context.Background(), cable, "fail", struct{}{})
+	var rerr *Error
+	if !errors.As(err, &rerr) || rerr.Message != "failed on purpose" || rerr.Unknown {
+		t.Errorf("expected the error of the handler, got %v", err)
+	}
+	_, err = Call[struct{}, struct{}](context.Background(), cable, "missing", struct{}{})
+	if !errors.As(err, &rerr) || !rerr.Unknown {
+		t.Errorf("expected an unknown method, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"fail", "sum", "wait"}, cable.server.Methods()); diff != "" {
+		t.Errorf("unexpected methods (-want +got):\n%s", diff)
+	}
+}
+
+func TestCallContext(t *testing.T) {
+	cable := pipe{testServer()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	left, err := Call[struct{}, time.Duration](ctx, cable, "wait", struct{}{})
+	cancel()
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if left <= 0 || left > time.Minute {
+		t.Errorf("expected the deadline to reach the handler, got %v left", left)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := Call[struct{}, time.Duration](ctx, cable, "wait", struct{}{}); err != context.Canceled {
+		t.Errorf("expected the call to be cancelled, got %v", err)
+	}
+}
+
+func TestCallCable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	server := vcable.NewCable()
+	server.Handle(ServiceName, testServer())
+	go server.Serve(l)
+	defer server.Close()
+
+	client := vcable.NewCable()
+	client.Dial = func() (net.Conn, error) { return net.Dial("tcp", l.Addr().String()) }
+	if err := client.Connect(); err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer client.Close()
+
+	got, err := Call[sum, total](context.Background(), client, "sum", sum{Terms: []int{40, 2}})
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	if diff := cmp.Diff(total{42}, got); diff != "" {
+		t.Errorf("unexpected response (-want +got):\n%s", diff)
+	}
+}
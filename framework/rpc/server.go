@@ -0,0 +1,223 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	codec "github.com/multiverse-os/vcable/framework/codec"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// handler decodes a request with c, calls the function registered and
+// encodes its response.
+type handler func(ctx context.Context, c codec.Codec, request []byte) ([]byte, error)
+
+// streamHandler serves a streaming call.
+type streamHandler func(ctx context.Context, s *stream) error
+
+// Server serves calls to the methods registered with it. Register it as
+// the ServiceName service of a cable.
+type Server struct {
+	// Codecs resolves the codecs calls name. Defaults to codec.Default.
+	Codecs *codec.Registry
+	// MaxCalls bounds the calls ServeConn runs at once on a connection;
+	// requests beyond it fail until one completes. Defaults to 256.
+	MaxCalls int
+	ErrorLog *log.Logger
+
+	mutex    sync.RWMutex
+	handlers map[string]handler
+	streams  map[string]streamHandler
+}
+
+// DefaultServer is the server Register registers with.
+var DefaultServer = &Server{}
+
+var _ vsock.Handler = &Server{}
+
+// Handle registers fn as method of server, replacing any function
+// registered under the same name.
+func Handle[Req, Resp interface{}](server *Server, method string, fn func(ctx context.Context, req Req) (Resp, error)) {
+	server.handle(method, func(ctx context.Context, c codec.Codec, b []byte) ([]byte, error) {
+		var req Req
+		if err := c.Unmarshal(b, &req); err != nil {
+			return nil, fmt.Errorf("invalid request: %v", err)
+		}
+		resp, err := fn(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		return c.Marshal(resp)
+	})
+}
+
+// Register registers fn as method of DefaultServer.
+func Register[Req, Resp interface{}](method string, fn func(ctx context.Context, req Req) (Resp, error)) {
+	Handle(DefaultServer, method, fn)
+}
+
+func (self *Server) handle(method string, h handler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.handlers == nil {
+		self.handlers = make(map[string]handler)
+	}
+	self.handlers[method] = h
+}
+
+func (self *Server) handleStream(method string, h streamHandler) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.streams == nil {
+		self.streams = make(map[string]streamHandler)
+	}
+	self.streams[method] = h
+}
+
+// Methods returns the names of the methods registered, sorted.
+func (self *Server) Methods() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	methods := make([]string, 0, len(self.handlers)+len(self.streams))
+	for method := range self.handlers {
+		methods = append(methods, method)
+	}
+	for method := range self.streams {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// ServeVsock serves the call made on conn.
+func (self *Server) ServeVsock(conn net.Conn) {
+	defer conn.Close()
+	var h header
+	if err := readJSON(conn, &h); err != nil {
+		self.logf("rpc: %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	if h.Stream {
+		self.serveStream(conn, h)
+		return
+	}
+	request, err := readFrame(conn)
+	if err != nil {
+		self.logf("rpc: %s: %s: %v", conn.RemoteAddr(), h.Method, err)
+		return
+	}
+
+	self.mutex.RLock()
+	fn, ok := self.handlers[h.Method]
+	self.mutex.RUnlock()
+	if !ok {
+		writeJSON(conn, status{Error: "unknown method", Unknown: true})
+		return
+	}
+	c, err := self.codec(h.Codec)
+	if err != nil {
+		writeJSON(conn, status{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel, err := callContext(h.Timeout)
+	if err != nil {
+		writeJSON(conn, status{Error: err.Error()})
+		return
+	}
+	defer cancel()
+	// The caller sends nothing more; the stream ending means it gave up.
+	go func() {
+		var b [1]byte
+		conn.Read(b[:])
+		cancel()
+	}()
+
+	response, err := fn(ctx, c, request)
+	if err != nil {
+		writeJSON(conn, status{Error: err.Error()})
+		return
+	}
+	if err := writeJSON(conn, status{}); err == nil {
+		err = writeFrame(conn, response)
+	}
+	if err != nil && ctx.Err() == nil {
+		self.logf("rpc: %s: %s: %v", conn.RemoteAddr(), h.Method, err)
+	}
+}
+
+// serveStream serves the streaming call made on conn.
+func (self *Server) serveStream(conn net.Conn, h header) {
+	self.mutex.RLock()
+	fn, ok := self.streams[h.Method]
+	self.mutex.RUnlock()
+	if !ok {
+		writeJSON(conn, status{Error: "unknown method", Unknown: true})
+		return
+	}
+	c, err := self.codec(h.Codec)
+	if err != nil {
+		writeJSON(conn, status{Error: err.Error()})
+		return
+	}
+	ctx, cancel, err := callContext(h.Timeout)
+	if err != nil {
+		writeJSON(conn, status{Error: err.Error()})
+		return
+	}
+	defer cancel()
+	if err := writeJSON(conn, status{}); err != nil {
+		return
+	}
+
+	s := newStream(conn, c, h.Method, false)
+	// The stream failing, or the caller closing it, means it gave up.
+	go func() {
+		<-s.done
+		cancel()
+	}()
+
+	var st status
+	if err := fn(ctx, s); err != nil {
+		st.Error = err.Error()
+	}
+	if err := s.end(&st); err != nil && ctx.Err() == nil {
+		self.logf("rpc: %s: %s: %v", conn.RemoteAddr(), h.Method, err)
+	}
+}
+
+func (self *Server) codec(name string) (codec.Codec, error) {
+	codecs := self.Codecs
+	if codecs == nil {
+		codecs = codec.Default
+	}
+	return codecs.Get(name)
+}
+
+// callContext returns the context of a handler, bounded by the timeout of
+// the caller, zero for none. Callers never send negative timeouts, having
+// given up by then.
+func callContext(timeout time.Duration) (context.Context, context.CancelFunc, error) {
+	if timeout < 0 {
+		return nil, nil, fmt.Errorf("negative timeout %v", timeout)
+	}
+	if timeout > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return ctx, cancel, nil
+}
+
+func (self *Server) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
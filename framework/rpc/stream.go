@@ -0,0 +1,377 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	codec "github.com/multiverse-os/vcable/framework/codec"
+)
+
+// Window is the number of messages either side of a streaming call may send
+// before the other has received them.
+const Window = 16
+
+// Kinds of the frames of a streaming call, their first byte.
+const (
+	frameMessage byte = iota
+	// frameEnd ends the messages of a side; the handler's carries the
+	// status of the call.
+	frameEnd
+	// frameCredit lets the peer send as many more messages as it gives.
+	frameCredit
+)
+
+// stream is one side of a streaming call. A goroutine reads the frames of
+// the peer, queueing messages, which the peer never sends more of than the
+// credit it was given, so the queue never fills.
+type stream struct {
+	conn   net.Conn
+	codec  codec.Codec
+	method string
+	client bool
+
+	writeMutex sync.Mutex
+
+	mutex    sync.Mutex
+	credit   int
+	consumed int
+	ended    bool // we sent frameEnd
+	err      error
+	status   status
+	credited chan struct{}
+
+	messages chan []byte // closed once the peer ends
+	done     chan struct{}
+}
+
+func newStream(conn net.Conn, c codec.Codec, method string, client bool) *stream {
+	self := &stream{
+		conn:     conn,
+		codec:    c,
+		method:   method,
+		client:   client,
+		credit:   Window,
+		credited: make(chan struct{}, 1),
+		messages: make(chan []byte, Window),
+		done:     make(chan struct{}),
+	}
+	go self.read()
+	return self
+}
+
+func (self *stream) read() {
+	defer close(self.done)
+	ended := false
+	for {
+		frame, err := readFrame(self.conn)
+		if err == nil && len(frame) == 0 {
+			err = fmt.Errorf("rpc: %s: empty frame", self.method)
+		}
+		if err != nil {
+			if err == io.EOF {
+				// Only an end frame ends the stream cleanly.
+				err = io.ErrUnexpectedEOF
+				if ended {
+					err = nil
+				}
+			}
+			self.fail(err)
+			return
+		}
+		switch kind, data := frame[0], frame[1:]; {
+		case kind == frameMessage && !ended:
+			select {
+			case self.messages <- data:
+			default:
+				self.fail(fmt.Errorf("rpc: %s: peer exceeded its credit", self.method))
+				return
+			}
+		case kind == frameEnd && !ended:
+			ended = true
+			if self.client {
+				var st status
+				if err := json.Unmarshal(data, &st); err != nil {
+					self.fail(fmt.Errorf("rpc: %s: %v", self.method, err))
+					return
+				}
+				self.mutex.Lock()
+				self.status = st
+				self.mutex.Unlock()
+			}
+			close(self.messages)
+		case kind == frameCredit && len(data) == 4:
+			self.mutex.Lock()
+			self.credit += int(binary.BigEndian.Uint32(data))
+			self.mutex.Unlock()
+			select {
+			case self.credited <- struct{}{}:
+			default:
+			}
+		default:
+			self.fail(fmt.Errorf("rpc: %s: unexpected frame %d", self.method, kind))
+			return
+		}
+	}
+}
+
+// fail records why the stream ended, unless it ended cleanly.
+func (self *stream) fail(err error) {
+	self.mutex.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.mutex.Unlock()
+	if err != nil {
+		self.conn.Close()
+	}
+}
+
+func (self *stream) writeFrame(kind byte, data []byte) error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	return writeFrame(self.conn, append([]byte{kind}, data...))
+}
+
+// send encodes v and sends it once the peer has credit for it.
+func (self *stream) send(ctx context.Context, v interface{}) error {
+	b, err := self.codec.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("rpc: %s: %v", self.method, err)
+	}
+	for {
+		self.mutex.Lock()
+		switch {
+		case self.ended:
+			self.mutex.Unlock()
+			return fmt.Errorf("rpc: %s: send after end", self.method)
+		case self.err != nil:
+			err := self.err
+			self.mutex.Unlock()
+			return contextError(ctx, err)
+		case self.credit > 0:
+			self.credit--
+			self.mutex.Unlock()
+			return contextError(ctx, self.writeFrame(frameMessage, b))
+		}
+		self.mutex.Unlock()
+
+		select {
+		case <-self.credited:
+		case <-self.done:
+			self.mutex.Lock()
+			if self.err == nil {
+				self.err = io.ErrClosedPipe
+			}
+			self.mutex.Unlock()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// recv decodes the next message of the peer into v, returning io.EOF once
+// the peer ended.
+func (self *stream) recv(ctx context.Context, v interface{}) error {
+	var b []byte
+	var ok bool
+	select {
+	case b, ok = <-self.messages:
+	default:
+		select {
+		case b, ok = <-self.messages:
+		case <-self.done:
+			// Messages read before the failure are still delivered.
+			select {
+			case b, ok = <-self.messages:
+			default:
+				self.mutex.Lock()
+				err := self.err
+				self.mutex.Unlock()
+				if err == nil {
+					err = io.ErrUnexpectedEOF
+				}
+				return contextError(ctx, err)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if !ok {
+		self.mutex.Lock()
+		st := self.status
+		self.mutex.Unlock()
+		if st.Error != "" {
+			return &Error{Method: self.method, Message: st.Error, Unknown: st.Unknown}
+		}
+		return io.EOF
+	}
+
+	// Give the peer credit back in batches.
+	self.mutex.Lock()
+	self.consumed++
+	var credit int
+	if self.consumed >= Window/2 {
+		credit, self.consumed = self.consumed, 0
+	}
+	self.mutex.Unlock()
+	if credit > 0 {
+		// The peer may have ended and gone, needing no more credit; if the
+		// stream broke, the next recv reports it.
+		self.writeFrame(frameCredit, binary.BigEndian.AppendUint32(nil, uint32(credit)))
+	}
+	if err := self.codec.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("rpc: %s: %v", self.method, err)
+	}
+	return nil
+}
+
+// end tells the peer no more messages follow; the handler's side gives the
+// status of the call.
+func (self *stream) end(st *status) error {
+	self.mutex.Lock()
+	if self.ended {
+		self.mutex.Unlock()
+		return nil
+	}
+	self.ended = true
+	self.mutex.Unlock()
+	var data []byte
+	if st != nil {
+		var err error
+		if data, err = json.Marshal(st); err != nil {
+			return err
+		}
+	}
+	return self.writeFrame(frameEnd, data)
+}
+
+// ClientStream is the caller's side of a streaming call, sending requests
+// and receiving responses.
+type ClientStream[Req, Resp interface{}] struct {
+	ctx    context.Context
+	stream *stream
+}
+
+// Open starts a streaming call of method on the peer cable leads to. The
+// handler may send any number of responses, and receive any number of
+// requests, until either side ends. Cancelling ctx aborts the call.
+func Open[Req, Resp interface{}](ctx context.Context, cable Opener, method string) (*ClientStream[Req, Resp], error) {
+	timeout, err := callTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := cable.OpenStreamContext(ctx, ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	c := codec.JSON{}
+	h := header{Method: method, Codec: c.Name(), Timeout: timeout, Stream: true}
+	var st status
+	err = writeJSON(conn, h)
+	if err == nil {
+		err = readJSON(conn, &st)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+	if st.Error != "" {
+		conn.Close()
+		return nil, &Error{Method: method, Message: st.Error, Unknown: st.Unknown}
+	}
+	return &ClientStream[Req, Resp]{ctx: ctx, stream: newStream(conn, c, method, true)}, nil
+}
+
+// CallStream calls method with a single request, and returns the stream of
+// its responses, as for watching logs or progress.
+func CallStream[Req, Resp interface{}](ctx context.Context, cable Opener, method string, req Req) (*ClientStream[Req, Resp], error) {
+	s, err := Open[Req, Resp](ctx, cable, method)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Send(req); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.CloseSend(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Send sends a request, waiting while the handler is behind on receiving.
+func (self *ClientStream[Req, Resp]) Send(req Req) error {
+	return self.stream.send(self.ctx, req)
+}
+
+// CloseSend tells the handler no more requests follow.
+func (self *ClientStream[Req, Resp]) CloseSend() error {
+	return contextError(self.ctx, self.stream.end(nil))
+}
+
+// Recv receives the next response. It returns io.EOF once the handler
+// returned, or the *Error it returned.
+func (self *ClientStream[Req, Resp]) Recv() (Resp, error) {
+	var resp Resp
+	err := self.stream.recv(self.ctx, &resp)
+	return resp, err
+}
+
+// CloseAndRecv ends the requests of a call and receives its single
+// response, as for an upload.
+func (self *ClientStream[Req, Resp]) CloseAndRecv() (Resp, error) {
+	var resp Resp
+	if err := self.CloseSend(); err != nil {
+		return resp, err
+	}
+	resp, err := self.Recv()
+	if err == io.EOF {
+		err = fmt.Errorf("rpc: %s: no response", self.stream.method)
+	}
+	return resp, err
+}
+
+// Close aborts the call, if it has not ended, and releases the stream.
+func (self *ClientStream[Req, Resp]) Close() error { return self.stream.conn.Close() }
+
+// ServerStream is the handler's side of a streaming call, receiving
+// requests and sending responses.
+type ServerStream[Req, Resp interface{}] struct {
+	ctx    context.Context
+	stream *stream
+}
+
+// Context is done once the caller gives up, or its deadline passes.
+func (self *ServerStream[Req, Resp]) Context() context.Context { return self.ctx }
+
+// Recv receives the next request, returning io.EOF once the caller closed
+// its side.
+func (self *ServerStream[Req, Resp]) Recv() (Req, error) {
+	var req Req
+	err := self.stream.recv(self.ctx, &req)
+	return req, err
+}
+
+// Send sends a response, waiting while the caller is behind on receiving.
+func (self *ServerStream[Req, Resp]) Send(resp Resp) error {
+	return self.stream.send(self.ctx, resp)
+}
+
+// HandleStream registers fn as the streaming method of server. The call
+// ends when fn returns, with the error it returns, if any.
+func HandleStream[Req, Resp interface{}](server *Server, method string, fn func(stream *ServerStream[Req, Resp]) error) {
+	server.handleStream(method, func(ctx context.Context, s *stream) error {
+		return fn(&ServerStream[Req, Resp]{ctx: ctx, stream: s})
+	})
+}
+
+// RegisterStream registers fn as a streaming method of DefaultServer.
+func RegisterStream[Req, Resp interface{}](method string, fn func(stream *ServerStream[Req, Resp]) error) {
+	HandleStream(DefaultServer, method, fn)
+}
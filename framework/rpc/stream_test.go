@@ -0,0 +1,198 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type count struct {
+	N int `json:"n"`
+}
+
+func streamServer(sent *int32, cancelled chan error) *Server {
+	server := testServer()
+	HandleStream(server, "count", func(stream *ServerStream[count, int]) error {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < req.N; i++ {
+			if err := stream.Send(i); err != nil {
+				return err
+			}
+			if sent != nil {
+				atomic.AddInt32(sent, 1)
+			}
+		}
+		return nil
+	})
+	HandleStream(server, "sum", func(stream *ServerStream[int, total]) error {
+		var resp total
+		for {
+			term, err := stream.Recv()
+			if err == io.EOF {
+				return stream.Send(resp)
+			}
+			if err != nil {
+				return err
+			}
+			resp.Total += term
+		}
+	})
+	HandleStream(server, "echo", func(stream *ServerStream[string, string]) error {
+		for {
+			s, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if s == "fail" {
+				return errors.New("failed on purpose")
+			}
+			if err := stream.Send(s); err != nil {
+				return err
+			}
+		}
+	})
+	HandleStream(server, "block", func(stream *ServerStream[int, int]) error {
+		<-stream.Context().Done()
+		cancelled <- stream.Context().Err()
+		return stream.Context().Err()
+	})
+	return server
+}
+
+func TestServerStream(t *testing.T) {
+	cable := pipe{streamServer(nil, nil)}
+	stream, err := CallStream[count, int](context.Background(), cable, "count", count{N: 5 * Window})
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	defer stream.Close()
+	var got []int
+	for {
+		i, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		got = append(got, i)
+	}
+	want := make([]int, 5*Window)
+	for i := range want {
+		want[i] = i
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("unexpected responses (-want +got):\n%s", diff)
+	}
+}
+
+func TestClientStream(t *testing.T) {
+	cable := pipe{streamServer(nil, nil)}
+	stream, err := Open[int, total](context.Background(), cable, "sum")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer stream.Close()
+	for i := 1; i <= 100; i++ {
+		if err := stream.Send(i); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	got, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	if diff := cmp.Diff(total{5050}, got); diff != "" {
+		t.Errorf("unexpected response (-want +got):\n%s", diff)
+	}
+}
+
+func TestBidiStream(t *testing.T) {
+	cable := pipe{streamServer(nil, nil)}
+	stream, err := Open[string, string](context.Background(), cable, "echo")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer stream.Close()
+	for _, s := range []string{"a", "b", "c"} {
+		if err := stream.Send(s); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		if diff := cmp.Diff(s, got); diff != "" {
+			t.Errorf("unexpected echo (-want +got):\n%s", diff)
+		}
+	}
+	if err := stream.Send("fail"); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	var rerr *Error
+	if _, err := stream.Recv(); !errors.As(err, &rerr) || rerr.Message != "failed on purpose" {
+		t.Errorf("expected the error of the handler, got %v", err)
+	}
+
+	if _, err := Open[string, string](context.Background(), cable, "missing"); !errors.As(err, &rerr) || !rerr.Unknown {
+		t.Errorf("expected an unknown method, got %v", err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	var sent int32
+	cable := pipe{streamServer(&sent, nil)}
+	stream, err := CallStream[count, int](context.Background(), cable, "count", count{N: 10 * Window})
+	if err != nil {
+		t.Fatalf("failed to call: %v", err)
+	}
+	defer stream.Close()
+
+	// Without receiving, the handler runs out of credit.
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&sent); n != Window {
+		t.Fatalf("expected %d messages sent ahead of the receiver, got %d", Window, n)
+	}
+	for i := 0; i < 10*Window; i++ {
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("failed to receive %d: %v", i, err)
+		}
+	}
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Fatalf("expected the end of the stream, got %v", err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	cancelled := make(chan error, 1)
+	cable := pipe{streamServer(nil, cancelled)}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := Open[int, int](ctx, cable, "block")
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer stream.Close()
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := stream.Recv(); err != context.Canceled {
+		t.Errorf("expected the call to be cancelled, got %v", err)
+	}
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Errorf("expected the handler to be cancelled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
@@ -0,0 +1,306 @@
+package securevsock
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// MaxRecordSize bounds the data sealed in one record.
+const MaxRecordSize = 16 << 10
+
+// Record types, the first byte of the data sealed in a record.
+const (
+	recordData byte = iota
+	// recordClose ends the writes of a side, so a truncated stream is
+	// told apart from a finished one.
+	recordClose
+)
+
+// closeTimeout bounds how long Close waits to send the close record.
+const closeTimeout = 5 * time.Second
+
+var _ net.Conn = &Conn{}
+
+// Conn is a connection authenticated with a pre-shared key. Each record is
+// a 4 byte big endian length, then as many bytes sealed with AES-256-GCM
+// under the key of its direction, with a counter as nonce.
+type Conn struct {
+	conn   net.Conn
+	config *PSKConfig
+	client bool
+
+	handshakeMutex sync.Mutex
+	handshakeErr   error
+	// handshaken is set once the handshake is complete, leaving peer and
+	// the ciphers fixed, so Close need not wait for one in progress.
+	handshaken atomic.Bool
+	peer       string
+
+	readMutex sync.Mutex
+	reader    cipher.AEAD
+	readSeq   uint64
+	raw       []byte // the part of the next record read so far
+	pending   []byte // opened but not yet read
+	readErr   error
+
+	writeMutex sync.Mutex
+	writer     cipher.AEAD
+	writeSeq   uint64
+	writeErr   error
+}
+
+// Client returns the client end of a connection over conn, which
+// handshakes on the first read or write unless Handshake is called first.
+func Client(conn net.Conn, config *PSKConfig) *Conn {
+	return &Conn{conn: conn, config: config, client: true}
+}
+
+// Server returns the server end of a connection over conn; see Client.
+func Server(conn net.Conn, config *PSKConfig) *Conn {
+	return &Conn{conn: conn, config: config}
+}
+
+// Handshake runs the handshake unless it has run already, returning its
+// error.
+func (self *Conn) Handshake() error {
+	return self.HandshakeContext(context.Background())
+}
+
+// HandshakeContext is Handshake abandoning the handshake, and failing the
+// connection, if ctx is done first.
+func (self *Conn) HandshakeContext(ctx context.Context) error {
+	self.handshakeMutex.Lock()
+	defer self.handshakeMutex.Unlock()
+	if self.handshaken.Load() || self.handshakeErr != nil {
+		return self.handshakeErr
+	}
+
+	stop := vsock.BindContext(ctx, self.conn)
+	var (
+		peer string
+		keys sessionKeys
+		err  error
+	)
+	if self.client {
+		peer, keys, err = clientHandshake(self.conn, self.config)
+	} else {
+		peer, keys, err = serverHandshake(self.conn, self.config)
+	}
+	stop()
+	if err == nil {
+		read, write := keys.serverWrite, keys.clientWrite
+		if !self.client {
+			read, write = write, read
+		}
+		if self.reader, err = newAEAD(read); err == nil {
+			self.writer, err = newAEAD(write)
+		}
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		self.handshakeErr = err
+		self.conn.Close()
+		return err
+	}
+	self.peer = peer
+	self.handshaken.Store(true)
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// PeerIdentity returns the identity the peer presented, once the handshake
+// is complete.
+func (self *Conn) PeerIdentity() (string, bool) {
+	if !self.handshaken.Load() {
+		return "", false
+	}
+	return self.peer, true
+}
+
+// NetConn returns the connection wrapped.
+func (self *Conn) NetConn() net.Conn { return self.conn }
+
+func nonce(seq uint64) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint64(b[4:], seq)
+	return b[:]
+}
+
+func (self *Conn) Read(b []byte) (int, error) {
+	if err := self.Handshake(); err != nil {
+		return 0, err
+	}
+	self.readMutex.Lock()
+	defer self.readMutex.Unlock()
+	for len(self.pending) == 0 {
+		if self.readErr != nil {
+			return 0, self.readErr
+		}
+		if err := self.readRecord(); err != nil {
+			// A deadline passing leaves the stream intact, what was
+			// read of the record kept for the next read.
+			if isTimeout(err) {
+				return 0, err
+			}
+			self.readErr = err
+		}
+	}
+	n := copy(b, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// readRecord opens the next record into pending.
+func (self *Conn) readRecord() error {
+	if err := self.fill(4); err != nil {
+		return err
+	}
+	n := binary.BigEndian.Uint32(self.raw)
+	if n > MaxRecordSize+1+uint32(self.reader.Overhead()) {
+		return fmt.Errorf("securevsock: record of %d bytes exceeds the maximum", n)
+	}
+	if err := self.fill(4 + int(n)); err != nil {
+		return err
+	}
+	length, sealed := self.raw[:4], self.raw[4:]
+	self.raw = nil
+	opened, err := self.reader.Open(sealed[:0], nonce(self.readSeq), sealed, length)
+	if err != nil || len(opened) == 0 {
+		return fmt.Errorf("securevsock: corrupt record")
+	}
+	self.readSeq++
+	switch opened[0] {
+	case recordData:
+		self.pending = opened[1:]
+		return nil
+	case recordClose:
+		return io.EOF
+	}
+	return fmt.Errorf("securevsock: unknown record type %d", opened[0])
+}
+
+// fill reads until raw holds n bytes.
+func (self *Conn) fill(n int) error {
+	if cap(self.raw) < n {
+		raw := make([]byte, len(self.raw), n)
+		copy(raw, self.raw)
+		self.raw = raw
+	}
+	for len(self.raw) < n {
+		m, err := self.conn.Read(self.raw[len(self.raw):n])
+		self.raw = self.raw[:len(self.raw)+m]
+		if err == io.EOF {
+			// Only a close record ends the stream cleanly.
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func (self *Conn) Write(b []byte) (int, error) {
+	if err := self.Handshake(); err != nil {
+		return 0, err
+	}
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > MaxRecordSize {
+			chunk = chunk[:MaxRecordSize]
+		}
+		if err := self.writeRecord(recordData, chunk); err != nil {
+			return n, err
+		}
+		n, b = n+len(chunk), b[len(chunk):]
+	}
+	return n, nil
+}
+
+// writeRecord seals data in a record of typ and writes it. A failed write
+// fails all later ones, the stream having lost its place.
+func (self *Conn) writeRecord(typ byte, data []byte) error {
+	if self.writeErr != nil {
+		return self.writeErr
+	}
+	size := 1 + len(data) + self.writer.Overhead()
+	record := make([]byte, 4, 4+size)
+	binary.BigEndian.PutUint32(record, uint32(size))
+	plain := append([]byte{typ}, data...)
+	record = self.writer.Seal(record, nonce(self.writeSeq), plain, record[:4])
+	self.writeSeq++
+	if _, err := self.conn.Write(record); err != nil {
+		self.writeErr = err
+		return err
+	}
+	return nil
+}
+
+// CloseWrite ends the writes of this side; the peer reads io.EOF after
+// what was written.
+func (self *Conn) CloseWrite() error {
+	if err := self.Handshake(); err != nil {
+		return err
+	}
+	if err := self.closeRecord(); err != nil {
+		return err
+	}
+	if cw, ok := self.conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (self *Conn) closeRecord() error {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+	if err := self.writeRecord(recordClose, nil); err != nil {
+		return err
+	}
+	self.writeErr = net.ErrClosed
+	return nil
+}
+
+// Close sends the close record, if the handshake is complete and the
+// writes were not ended already, and closes the connection.
+func (self *Conn) Close() error {
+	if self.handshaken.Load() {
+		self.conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+		self.closeRecord()
+	}
+	return self.conn.Close()
+}
+
+func (self *Conn) LocalAddr() net.Addr                { return self.conn.LocalAddr() }
+func (self *Conn) RemoteAddr() net.Addr               { return self.conn.RemoteAddr() }
+func (self *Conn) SetDeadline(t time.Time) error      { return self.conn.SetDeadline(t) }
+func (self *Conn) SetReadDeadline(t time.Time) error  { return self.conn.SetReadDeadline(t) }
+func (self *Conn) SetWriteDeadline(t time.Time) error { return self.conn.SetWriteDeadline(t) }
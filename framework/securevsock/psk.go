@@ -0,0 +1,252 @@
+package securevsock
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// pskVersion is the first byte of both handshake messages.
+const pskVersion = 1
+
+// MinKeySize is the shortest pre-shared key accepted.
+const MinKeySize = 16
+
+// ErrHandshake is returned when the peer does not prove it holds the key,
+// or the server knows no key for the identity of the client.
+var ErrHandshake = errors.New("securevsock: handshake failed")
+
+// PSKConfig configures the pre-shared key handshake.
+type PSKConfig struct {
+	// Identity names this side to the peer, at most 255 bytes. Servers use
+	// the identity of a client to look up its key.
+	Identity string
+	// Key is the key a client dials with, at least MinKeySize random bytes.
+	Key []byte
+	// Keys returns the key of the client with identity, on the server.
+	// Defaults to Key, whatever the identity.
+	Keys func(identity string) ([]byte, bool)
+}
+
+func (self *PSKConfig) key(identity string) ([]byte, bool) {
+	if self.Keys != nil {
+		return self.Keys(identity)
+	}
+	return self.Key, self.Key != nil
+}
+
+// ListenPSK listens on port for connections authenticated with a
+// pre-shared key. Handshakes happen on the first read or write of the
+// connections accepted, which are *Conns.
+func ListenPSK(port uint32, config *PSKConfig) (net.Listener, error) {
+	l, err := vsock.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return NewListener(l, config), nil
+}
+
+// NewListener wraps the connections inner accepts with Server.
+func NewListener(inner net.Listener, config *PSKConfig) net.Listener {
+	return &listener{Listener: inner, config: config}
+}
+
+type listener struct {
+	net.Listener
+	config *PSKConfig
+}
+
+func (self *listener) Accept() (net.Conn, error) {
+	conn, err := self.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return Server(conn, self.config), nil
+}
+
+// DialPSK dials port on contextID and authenticates with a pre-shared key.
+func DialPSK(contextID, port uint32, config *PSKConfig) (*Conn, error) {
+	return DialPSKContext(context.Background(), contextID, port, config)
+}
+
+// DialPSKContext is DialPSK abandoning the dial and handshake if ctx is
+// done first.
+func DialPSKContext(ctx context.Context, contextID, port uint32, config *PSKConfig) (*Conn, error) {
+	conn, err := vsock.DialContext(ctx, contextID, port)
+	if err != nil {
+		return nil, err
+	}
+	c := Client(conn, config)
+	if err := c.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// sessionKeys are what a handshake derives.
+type sessionKeys struct {
+	clientWrite, serverWrite     []byte
+	clientConfirm, serverConfirm []byte
+}
+
+// deriveKeys derives the keys of a session from the key, the shared
+// secret of the exchange, and the transcript of the handshake: HKDF with
+// SHA-256, the key as salt.
+func deriveKeys(psk, shared, transcript []byte) sessionKeys {
+	prk := mac(psk, shared, transcript)
+	expand := func(label string) []byte { return mac(prk, []byte(label), []byte{1}) }
+	return sessionKeys{
+		clientWrite:   expand("vcable psk client write"),
+		serverWrite:   expand("vcable psk server write"),
+		clientConfirm: expand("vcable psk client confirm"),
+		serverConfirm: expand("vcable psk server confirm"),
+	}
+}
+
+func mac(key []byte, data ...[]byte) []byte {
+	h := hmac.New(sha256.New, key)
+	for _, b := range data {
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// hello is the first message of either side: the version, the identity
+// and the ephemeral public key.
+func hello(identity string, public []byte) ([]byte, error) {
+	if len(identity) > 255 {
+		return nil, fmt.Errorf("securevsock: identity of %d bytes exceeds 255", len(identity))
+	}
+	b := []byte{pskVersion, byte(len(identity))}
+	b = append(b, identity...)
+	return append(b, public...), nil
+}
+
+// readHello reads the hello of the peer, returning it whole, the identity
+// and the public key.
+func readHello(r io.Reader) ([]byte, string, *ecdh.PublicKey, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, "", nil, err
+	}
+	if head[0] != pskVersion {
+		return nil, "", nil, fmt.Errorf("securevsock: unsupported handshake version %d", head[0])
+	}
+	rest := make([]byte, int(head[1])+32)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, "", nil, err
+	}
+	public, err := ecdh.X25519().NewPublicKey(rest[head[1]:])
+	if err != nil {
+		return nil, "", nil, ErrHandshake
+	}
+	return append(head[:], rest...), string(rest[:head[1]]), public, nil
+}
+
+// clientHandshake runs the handshake of the client on conn:
+//
+//	client: hello
+//	server: hello, MAC of the server
+//	client: MAC of the client
+func clientHandshake(conn net.Conn, config *PSKConfig) (string, sessionKeys, error) {
+	if len(config.Key) < MinKeySize {
+		return "", sessionKeys{}, fmt.Errorf("securevsock: key of %d bytes is shorter than %d", len(config.Key), MinKeySize)
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", sessionKeys{}, err
+	}
+	ours, err := hello(config.Identity, private.PublicKey().Bytes())
+	if err != nil {
+		return "", sessionKeys{}, err
+	}
+	if _, err := conn.Write(ours); err != nil {
+		return "", sessionKeys{}, err
+	}
+
+	theirs, identity, public, err := readHello(conn)
+	if err != nil {
+		return "", sessionKeys{}, handshakeError(err)
+	}
+	var confirm [sha256.Size]byte
+	if _, err := io.ReadFull(conn, confirm[:]); err != nil {
+		return "", sessionKeys{}, handshakeError(err)
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return "", sessionKeys{}, ErrHandshake
+	}
+	transcript := transcriptOf(ours, theirs)
+	keys := deriveKeys(config.Key, shared, transcript)
+	if !hmac.Equal(confirm[:], mac(keys.serverConfirm, transcript)) {
+		return "", sessionKeys{}, ErrHandshake
+	}
+	if _, err := conn.Write(mac(keys.clientConfirm, transcript)); err != nil {
+		return "", sessionKeys{}, err
+	}
+	return identity, keys, nil
+}
+
+// serverHandshake runs the handshake of the server on conn; see
+// clientHandshake.
+func serverHandshake(conn net.Conn, config *PSKConfig) (string, sessionKeys, error) {
+	theirs, identity, public, err := readHello(conn)
+	if err != nil {
+		return "", sessionKeys{}, handshakeError(err)
+	}
+	psk, ok := config.key(identity)
+	if !ok || len(psk) < MinKeySize {
+		return "", sessionKeys{}, ErrHandshake
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", sessionKeys{}, err
+	}
+	shared, err := private.ECDH(public)
+	if err != nil {
+		return "", sessionKeys{}, ErrHandshake
+	}
+	ours, err := hello(config.Identity, private.PublicKey().Bytes())
+	if err != nil {
+		return "", sessionKeys{}, err
+	}
+	transcript := transcriptOf(theirs, ours)
+	keys := deriveKeys(psk, shared, transcript)
+	if _, err := conn.Write(append(ours, mac(keys.serverConfirm, transcript)...)); err != nil {
+		return "", sessionKeys{}, err
+	}
+
+	var confirm [sha256.Size]byte
+	if _, err := io.ReadFull(conn, confirm[:]); err != nil {
+		return "", sessionKeys{}, handshakeError(err)
+	}
+	if !hmac.Equal(confirm[:], mac(keys.clientConfirm, transcript)) {
+		return "", sessionKeys{}, ErrHandshake
+	}
+	return identity, keys, nil
+}
+
+// transcriptOf hashes the hellos of client and server.
+func transcriptOf(client, server []byte) []byte {
+	sum := sha256.Sum256(bytes.Join([][]byte{client, server}, nil))
+	return sum[:]
+}
+
+// handshakeError reports the peer hanging up mid-handshake, as a server
+// does on a key it does not know, as ErrHandshake.
+func handshakeError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrHandshake
+	}
+	return err
+}
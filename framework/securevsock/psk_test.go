@@ -0,0 +1,98 @@
+package securevsock
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testKey = bytes.Repeat([]byte{0x5a}, 32)
+
+// handshake runs the handshakes of client and server over a pipe,
+// returning the error of each.
+func handshake(client, server *PSKConfig) (*Conn, *Conn, error, error) {
+	a, b := net.Pipe()
+	c, s := Client(a, client), Server(b, server)
+	done := make(chan error)
+	go func() { done <- s.Handshake() }()
+	cerr := c.Handshake()
+	return c, s, cerr, <-done
+}
+
+func TestPSK(t *testing.T) {
+	keys := map[string][]byte{"guest-3": testKey}
+	c, s, cerr, serr := handshake(
+		&PSKConfig{Identity: "guest-3", Key: testKey},
+		&PSKConfig{Identity: "host", Keys: func(identity string) ([]byte, bool) {
+			key, ok := keys[identity]
+			return key, ok
+		}},
+	)
+	if cerr != nil || serr != nil {
+		t.Fatalf("failed to handshake: %v, %v", cerr, serr)
+	}
+	defer s.Close()
+	defer c.Close()
+
+	client, _ := PeerIdentity(s)
+	server, _ := PeerIdentity(c)
+	if diff := cmp.Diff([]string{"guest-3", "host"}, []string{client.Name, server.Name}); diff != "" {
+		t.Fatalf("unexpected identities (-want +got):\n%s", diff)
+	}
+
+	// Writes larger than a record arrive whole, then the close record.
+	want := bytes.Repeat([]byte("vsock"), MaxRecordSize)
+	go func() {
+		c.Write(want)
+		c.CloseWrite()
+	}()
+	got, err := io.ReadAll(s)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("read %d bytes, want the %d written", len(got), len(want))
+	}
+}
+
+func TestPSKRefused(t *testing.T) {
+	wrong := bytes.Repeat([]byte{0xa5}, 32)
+	_, _, cerr, serr := handshake(&PSKConfig{Identity: "guest-3", Key: wrong}, &PSKConfig{Key: testKey})
+	if !errors.Is(cerr, ErrHandshake) || !errors.Is(serr, ErrHandshake) {
+		t.Fatalf("expected a wrong key to fail both handshakes, got %v, %v", cerr, serr)
+	}
+
+	none := func(string) ([]byte, bool) { return nil, false }
+	_, _, cerr, serr = handshake(&PSKConfig{Identity: "stranger", Key: testKey}, &PSKConfig{Keys: none})
+	if !errors.Is(cerr, ErrHandshake) || !errors.Is(serr, ErrHandshake) {
+		t.Fatalf("expected an unknown identity to fail both handshakes, got %v, %v", cerr, serr)
+	}
+
+	if _, _, cerr, _ = handshake(&PSKConfig{Key: []byte("short")}, &PSKConfig{Key: testKey}); cerr == nil {
+		t.Fatal("expected a short key to be refused")
+	}
+}
+
+func TestPSKTruncated(t *testing.T) {
+	c, s, cerr, serr := handshake(&PSKConfig{Key: testKey}, &PSKConfig{Key: testKey})
+	if cerr != nil || serr != nil {
+		t.Fatalf("failed to handshake: %v, %v", cerr, serr)
+	}
+	defer s.Close()
+	go func() {
+		c.Write([]byte("partial"))
+		// Closing the connection itself sends no close record.
+		c.NetConn().Close()
+	}()
+	got, err := io.ReadAll(s)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected a truncated stream to fail, got %v", err)
+	}
+	if diff := cmp.Diff("partial", string(got)); diff != "" {
+		t.Fatalf("unexpected data (-want +got):\n%s", diff)
+	}
+}
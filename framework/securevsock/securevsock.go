@@ -0,0 +1,88 @@
+// Package securevsock authenticates and encrypts vsock connections. A
+// context ID alone proves little: a compromised process on the host can
+// claim any. Peers holding certificates use TLS through ListenTLS and
+// DialTLS; guests which cannot manage certificates share a key with the
+// host instead, through ListenPSK and DialPSK.
+//
+// The pre-shared key handshake exchanges ephemeral X25519 keys, and each
+// side proves it holds the key with a MAC over the handshake, keyed from
+// both the key and the exchange: an eavesdropper learns nothing, and one
+// recording the connection cannot decrypt it after the key leaks. Records
+// are sealed with AES-256-GCM.
+package securevsock
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Identity is who the peer of a connection proved to be.
+type Identity struct {
+	// Name is the identity the peer presented with its pre-shared key, or
+	// the common name of its certificate.
+	Name string
+	// Certificate is the verified certificate of a TLS peer.
+	Certificate *x509.Certificate
+}
+
+// PeerIdentity returns the identity of the peer of conn, a *tls.Conn or a
+// *Conn, once its handshake is complete. It reports false if the peer
+// proved none, such as a TLS client without a certificate, or one whose
+// certificate was not verified, as with InsecureSkipVerify or
+// tls.RequireAnyClientCert.
+func PeerIdentity(conn net.Conn) (Identity, bool) {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		if !state.HandshakeComplete || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+			return Identity{}, false
+		}
+		cert := state.VerifiedChains[0][0]
+		name := cert.Subject.CommonName
+		if name == "" && len(cert.DNSNames) > 0 {
+			name = cert.DNSNames[0]
+		}
+		return Identity{Name: name, Certificate: cert}, true
+	case *Conn:
+		name, ok := c.PeerIdentity()
+		return Identity{Name: name}, ok
+	}
+	return Identity{}, false
+}
+
+// ListenTLS listens on port for TLS connections. For mutual
+// authentication, set config.ClientAuth to tls.RequireAndVerifyClientCert
+// and config.ClientCAs to the authority of the guests' certificates.
+func ListenTLS(port uint32, config *tls.Config) (net.Listener, error) {
+	l, err := vsock.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// DialTLS dials a TLS connection to port on contextID. The certificate of
+// the peer is verified against config.ServerName, which must be set unless
+// config.InsecureSkipVerify is.
+func DialTLS(contextID, port uint32, config *tls.Config) (*tls.Conn, error) {
+	return DialTLSContext(context.Background(), contextID, port, config)
+}
+
+// DialTLSContext is DialTLS abandoning the dial and handshake if ctx is
+// done first.
+func DialTLSContext(ctx context.Context, contextID, port uint32, config *tls.Config) (*tls.Conn, error) {
+	conn, err := vsock.DialContext(ctx, contextID, port)
+	if err != nil {
+		return nil, err
+	}
+	c := tls.Client(conn, config)
+	if err := c.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,170 @@
+//go:build linux
+
+package securevsock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// certificate returns a self-signed certificate for name.
+func certificate(t *testing.T, name string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, pool
+}
+
+func TestTLS(t *testing.T) {
+	restore := vsocktest.NewNetwork().Machine(vsock.Host).Install()
+	defer restore()
+
+	hostCert, hostPool := certificate(t, "host")
+	guestCert, guestPool := certificate(t, "guest-3")
+	l, err := ListenTLS(1024, &tls.Config{
+		Certificates: []tls.Certificate{hostCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    guestPool,
+	})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	peers := make(chan Identity, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.(*tls.Conn).Handshake()
+		peer, _ := PeerIdentity(c)
+		peers <- peer
+		io.Copy(c, c)
+	}()
+
+	c, err := DialTLS(vsock.Local, 1024, &tls.Config{
+		Certificates: []tls.Certificate{guestCert},
+		RootCAs:      hostPool,
+		ServerName:   "host",
+	})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	server, _ := PeerIdentity(c)
+	client := <-peers
+	if diff := cmp.Diff([]string{"guest-3", "host"}, []string{client.Name, server.Name}); diff != "" {
+		t.Fatalf("unexpected identities (-want +got):\n%s", diff)
+	}
+
+	if _, err := c.Write([]byte("echo")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("echo", string(b)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+}
+
+func TestTLSUnverified(t *testing.T) {
+	hostCert, _ := certificate(t, "host")
+	// A client may claim any name with a self-signed certificate.
+	impostor, _ := certificate(t, "guest-3")
+	a, b := net.Pipe()
+	server := tls.Server(b, &tls.Config{
+		Certificates: []tls.Certificate{hostCert},
+		ClientAuth:   tls.RequireAnyClientCert,
+	})
+	client := tls.Client(a, &tls.Config{
+		Certificates:       []tls.Certificate{impostor},
+		InsecureSkipVerify: true,
+	})
+	// Close the pipe, not the TLS conns, whose close alerts nobody reads.
+	defer a.Close()
+	defer b.Close()
+	done := make(chan error, 1)
+	go func() { done <- server.Handshake() }()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("failed to handshake: %v", err)
+	}
+
+	if peer, ok := PeerIdentity(server); ok {
+		t.Fatalf("PeerIdentity() of an unverified client = %q, want none", peer.Name)
+	}
+	if peer, ok := PeerIdentity(client); ok {
+		t.Fatalf("PeerIdentity() of an unverified server = %q, want none", peer.Name)
+	}
+}
+
+func TestListenPSK(t *testing.T) {
+	restore := vsocktest.NewNetwork().Machine(vsock.Host).Install()
+	defer restore()
+
+	l, err := ListenPSK(1024, &PSKConfig{Identity: "host", Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "hello")
+	}()
+
+	c, err := DialPSK(vsock.Local, 1024, &PSKConfig{Identity: "guest-3", Key: testKey})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("hello", string(b)); diff != "" {
+		t.Fatalf("unexpected message (-want +got):\n%s", diff)
+	}
+}
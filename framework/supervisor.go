@@ -0,0 +1,221 @@
+package vcable
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	journal "github.com/multiverse-os/vcable/framework/journal"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Guest identifies a virtual machine a supervisor keeps a cable to.
+type Guest struct {
+	Name      string
+	ContextID uint32
+	// Port the guest accepts cables on. Defaults to DefaultPort.
+	Port uint32
+	// Metadata tags the cable, in addition to the guest name and context ID.
+	Metadata vsock.Metadata
+}
+
+// Event reports a state change of one of the cables of a supervisor.
+type Event struct {
+	Guest Guest
+	State State
+	Time  time.Time
+}
+
+// Status describes one supervised cable.
+type Status struct {
+	Guest Guest
+	State State
+	// Since is when the cable entered State.
+	Since    time.Time
+	Metadata vsock.Metadata
+}
+
+// Supervisor keeps a cable to each of a fleet of guests, dialing them from
+// the host and redialing whenever a link drops.
+type Supervisor struct {
+	// Configure, if set, is called with each new cable before it connects,
+	// e.g. to register handlers or change its keepalive.
+	Configure func(guest Guest, cable *Cable)
+	// OnEvent, if set, receives the state changes of all cables.
+	OnEvent func(Event)
+	// Journal, if set, is given to every cable.
+	Journal *journal.Journal
+
+	mutex   sync.Mutex
+	members map[string]*member
+	closed  bool
+}
+
+type member struct {
+	guest Guest
+	cable *Cable
+	state State
+	since time.Time
+}
+
+// Add starts supervising a cable to guest. Guest names must be unique.
+func (self *Supervisor) Add(guest Guest) (*Cable, error) {
+	if guest.Name == "" {
+		guest.Name = fmt.Sprintf("cid-%d", guest.ContextID)
+	}
+	if guest.Port == 0 {
+		guest.Port = DefaultPort
+	}
+
+	m := &member{guest: guest, since: time.Now()}
+	m.cable = &Cable{
+		Dial: func() (net.Conn, error) { return vsock.DialGuest(guest.ContextID, guest.Port) },
+		Metadata: guest.Metadata.Merge(vsock.Metadata{
+			"vm":  guest.Name,
+			"cid": strconv.FormatUint(uint64(guest.ContextID), 10),
+		}),
+		Journal: self.Journal,
+	}
+	if self.Configure != nil {
+		self.Configure(guest, m.cable)
+	}
+	onState := m.cable.OnState
+	m.cable.OnState = func(state State) {
+		self.update(m, state)
+		if onState != nil {
+			onState(state)
+		}
+	}
+
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return nil, fmt.Errorf("vcable: supervisor closed")
+	}
+	if self.members == nil {
+		self.members = make(map[string]*member)
+	}
+	if _, ok := self.members[guest.Name]; ok {
+		self.mutex.Unlock()
+		return nil, fmt.Errorf("vcable: guest %q already supervised", guest.Name)
+	}
+	self.members[guest.Name] = m
+	self.mutex.Unlock()
+
+	go self.connect(m.cable)
+	return m.cable, nil
+}
+
+// connect keeps trying the first connection of cable; once it succeeds the
+// cable redials by itself.
+func (self *Supervisor) connect(cable *Cable) {
+	delay := 100 * time.Millisecond
+	for {
+		err := cable.Connect()
+		if err == nil || err == ErrCableClosed {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-cable.done:
+			return
+		}
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+// Remove stops supervising the guest called name and closes its cable.
+func (self *Supervisor) Remove(name string) error {
+	self.mutex.Lock()
+	m, ok := self.members[name]
+	delete(self.members, name)
+	self.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("vcable: guest %q not supervised", name)
+	}
+	return m.cable.Close()
+}
+
+// Cable returns the cable to the guest called name.
+func (self *Supervisor) Cable(name string) (*Cable, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if m, ok := self.members[name]; ok {
+		return m.cable, true
+	}
+	return nil, false
+}
+
+// CableByContextID returns the cable to the guest with context ID cid.
+func (self *Supervisor) CableByContextID(cid uint32) (*Cable, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	for _, m := range self.members {
+		if m.guest.ContextID == cid {
+			return m.cable, true
+		}
+	}
+	return nil, false
+}
+
+// Healthy returns the cables which are currently connected, ordered by
+// guest name.
+func (self *Supervisor) Healthy() []*Cable {
+	var cables []*Cable
+	for _, status := range self.Status() {
+		if status.State != StateConnected {
+			continue
+		}
+		if cable, ok := self.Cable(status.Guest.Name); ok {
+			cables = append(cables, cable)
+		}
+	}
+	return cables
+}
+
+// Status returns the status of every supervised cable, ordered by guest
+// name.
+func (self *Supervisor) Status() []Status {
+	self.mutex.Lock()
+	statuses := make([]Status, 0, len(self.members))
+	for _, m := range self.members {
+		statuses = append(statuses, Status{Guest: m.guest, State: m.state, Since: m.since, Metadata: m.cable.Metadata})
+	}
+	self.mutex.Unlock()
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Guest.Name < statuses[j].Guest.Name })
+	return statuses
+}
+
+// Close closes every cable and stops supervising.
+func (self *Supervisor) Close() error {
+	self.mutex.Lock()
+	self.closed = true
+	members := self.members
+	self.members = nil
+	self.mutex.Unlock()
+
+	var err error
+	for _, m := range members {
+		if cerr := m.cable.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (self *Supervisor) update(m *member, state State) {
+	now := time.Now()
+	self.mutex.Lock()
+	m.state, m.since = state, now
+	self.mutex.Unlock()
+
+	if self.OnEvent != nil {
+		self.OnEvent(Event{Guest: m.guest, State: state, Time: now})
+	}
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package vcable
+
+import (
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// serveGuest serves a cable on port of guest, echoing the streams of its
+// echo service.
+func serveGuest(t *testing.T, guest *vsocktest.Machine, port uint32) *Cable {
+	l, err := guest.Listen(port)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	cable := NewCable()
+	cable.Handle("echo", vsock.HandlerFunc(func(conn net.Conn) {
+		io.Copy(conn, conn)
+	}))
+	go cable.Serve(l)
+	return cable
+}
+
+// echo round trips a message through the echo service of the peer of
+// cable.
+func echo(t *testing.T, cable *Cable) {
+	t.Helper()
+	stream, err := cable.OpenStream("echo")
+	if err != nil {
+		t.Fatalf("failed to open stream: %v", err)
+	}
+	defer stream.Close()
+	if _, err := io.WriteString(stream, "ping"); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(stream, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("ping", string(b)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+}
+
+// waitState returns the time of the next event of events reaching state.
+func waitState(t *testing.T, events <-chan Event, state State) time.Time {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event := <-events:
+			if event.State == state {
+				return event.Time
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for the cable to be %v", state)
+		}
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+	guest := network.Machine(3)
+
+	events := make(chan Event, 64)
+	supervisor := &Supervisor{
+		Configure: func(guest Guest, cable *Cable) {
+			cable.MinBackoff = time.Millisecond
+			cable.ErrorLog = log.New(io.Discard, "", 0)
+		},
+		OnEvent: func(event Event) {
+			select {
+			case events <- event:
+			default:
+			}
+		},
+	}
+	defer supervisor.Close()
+
+	cable, err := supervisor.Add(Guest{Name: "web", ContextID: 3, Port: 1024})
+	if err != nil {
+		t.Fatalf("failed to add guest: %v", err)
+	}
+	if _, err := supervisor.Add(Guest{Name: "web", ContextID: 4}); err == nil {
+		t.Fatal("expected a second guest of the same name to be refused")
+	}
+
+	// Until the guest listens, the first connection is retried with
+	// growing delays.
+	var attempts []time.Time
+	for len(attempts) < 3 {
+		attempts = append(attempts, waitState(t, events, StateConnecting))
+	}
+	first, second := attempts[1].Sub(attempts[0]), attempts[2].Sub(attempts[1])
+	if first < 100*time.Millisecond || second < 2*first-50*time.Millisecond {
+		t.Fatalf("expected the delays between attempts to double from 100ms, got %v then %v", first, second)
+	}
+
+	server := serveGuest(t, guest, 1024)
+	waitState(t, events, StateConnected)
+	echo(t, cable)
+	if got, ok := supervisor.CableByContextID(3); !ok || got != cable {
+		t.Fatalf("CableByContextID(3) = %p, %v, want %p", got, ok, cable)
+	}
+	if healthy := supervisor.Healthy(); len(healthy) != 1 || healthy[0] != cable {
+		t.Fatalf("expected the cable to be healthy, got %v", healthy)
+	}
+	statuses := supervisor.Status()
+	if len(statuses) != 1 {
+		t.Fatalf("expected the status of one cable, got %d", len(statuses))
+	}
+	want := vsock.Metadata{"vm": "web", "cid": "3"}
+	if diff := cmp.Diff(want, statuses[0].Metadata); diff != "" {
+		t.Fatalf("unexpected metadata (-want +got):\n%s", diff)
+	}
+
+	// The link dropping is reported, and the cable redials on its own once
+	// the guest is back.
+	server.Close()
+	waitState(t, events, StateConnecting)
+	if healthy := supervisor.Healthy(); len(healthy) != 0 {
+		t.Fatalf("expected no healthy cables while the guest is down, got %d", len(healthy))
+	}
+	server = serveGuest(t, guest, 1024)
+	defer server.Close()
+	waitState(t, events, StateConnected)
+	echo(t, cable)
+
+	if err := supervisor.Remove("web"); err != nil {
+		t.Fatalf("failed to remove guest: %v", err)
+	}
+	waitState(t, events, StateClosed)
+	if _, ok := supervisor.Cable("web"); ok {
+		t.Fatal("expected a removed guest to have no cable")
+	}
+	if err := supervisor.Remove("web"); err == nil {
+		t.Fatal("expected removing a guest twice to fail")
+	}
+
+	supervisor.Close()
+	if _, err := supervisor.Add(Guest{Name: "db", ContextID: 4}); err == nil {
+		t.Fatal("expected adding to a closed supervisor to fail")
+	}
+}
@@ -0,0 +1,82 @@
+// Package systemd implements the sd_notify protocol, so vcable daemons can
+// report readiness to their service manager and feed its watchdog.
+package systemd
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notify sends state, such as "READY=1", to the service manager. It reports
+// false without error when the process is not run under one.
+func Notify(state string) (bool, error) {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return false, nil
+	}
+	// Names starting with '@' are in the abstract namespace.
+	if strings.HasPrefix(path, "@") {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready reports that the service finished starting up.
+func Ready() (bool, error) { return Notify("READY=1") }
+
+// Stopping reports that the service is shutting down.
+func Stopping() (bool, error) { return Notify("STOPPING=1") }
+
+// Status sets the free-form status shown by systemctl.
+func Status(status string) (bool, error) { return Notify("STATUS=" + status) }
+
+// WatchdogInterval returns how often the service manager expects a watchdog
+// keep-alive, or zero if the watchdog is disabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Watchdog feeds the watchdog at half its interval for as long as healthy
+// reports true, until ctx is done. When healthy reports false the keep-alive
+// is withheld, so the service manager restarts the service once the
+// interval elapses. A nil healthy is always true. Watchdog returns
+// immediately if the watchdog is disabled.
+func Watchdog(ctx context.Context, healthy func() bool) error {
+	interval := WatchdogInterval()
+	if interval == 0 {
+		return nil
+	}
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		if healthy == nil || healthy() {
+			if _, err := Notify("WATCHDOG=1"); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package systemd
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func listen(t *testing.T) *net.UnixConn {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Setenv("NOTIFY_SOCKET", path)
+	return conn
+}
+
+func receive(t *testing.T, conn *net.UnixConn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 256)
+	n, err := conn.Read(b)
+	if err != nil {
+		t.Fatalf("failed to receive: %v", err)
+	}
+	return string(b[:n])
+}
+
+func TestNotify(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+
+	sent, err := Ready()
+	if err != nil || !sent {
+		t.Fatalf("failed to notify: %v", err)
+	}
+	if diff := cmp.Diff("READY=1", receive(t, conn)); diff != "" {
+		t.Fatalf("unexpected state (-want +got):\n%s", diff)
+	}
+
+	t.Setenv("NOTIFY_SOCKET", "")
+	if sent, err := Ready(); sent || err != nil {
+		t.Fatalf("expected no notification outside systemd, got %v, %v", sent, err)
+	}
+}
+
+func TestWatchdogWithheldWhileUnhealthy(t *testing.T) {
+	conn := listen(t)
+	defer conn.Close()
+	t.Setenv("WATCHDOG_USEC", "20000")
+
+	healthy := make(chan bool, 1)
+	healthy <- false
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go Watchdog(ctx, func() bool {
+		select {
+		case h := <-healthy:
+			return h
+		default:
+			return true
+		}
+	})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 16)); err == nil {
+		t.Fatal("expected no keep-alive while unhealthy")
+	}
+	if diff := cmp.Diff("WATCHDOG=1", receive(t, conn)); diff != "" {
+		t.Fatalf("unexpected state (-want +got):\n%s", diff)
+	}
+}
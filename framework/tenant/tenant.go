@@ -0,0 +1,311 @@
+// Package tenant isolates the services of tenants sharing a host.
+//
+// Guests dial the logical port of a service, the same for every tenant. A
+// broker on the host accepts on the logical ports and forwards each
+// connection to the real port that tenant's instance of the service listens
+// on, so guests of one tenant never reach another tenant's services. The
+// services themselves use Guard to refuse connections from other tenants'
+// guests which dial their real ports directly.
+package tenant
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	bridge "github.com/multiverse-os/vcable/framework/bridge"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Tenant is a group of guests with their own instances of services.
+type Tenant struct {
+	Name       string   `json:"name"`
+	ContextIDs []uint32 `json:"cids"`
+	// Ports maps logical service ports to the real ports of this tenant's
+	// instances.
+	Ports map[uint32]uint32 `json:"ports"`
+	// TransferQuota is the number of bytes the tenant's guests may store
+	// through file transfer services, zero for no limit.
+	TransferQuota int64 `json:"transfer_quota,omitempty"`
+}
+
+// Policy assigns guests to tenants.
+type Policy struct {
+	Tenants []Tenant `json:"tenants"`
+}
+
+// LoadPolicy reads a policy from a JSON file, such as
+//
+//	{"tenants": [{"name": "acme", "cids": [3, 4], "ports": {"5300": 40300}}]}
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return nil, fmt.Errorf("tenant: %s: %v", path, err)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("tenant: %s: %v", path, err)
+	}
+	return &policy, nil
+}
+
+// Validate checks that no guest belongs to two tenants, and that no real
+// port serves two tenants or doubles as a logical port.
+func (self *Policy) Validate() error {
+	names := make(map[string]bool)
+	guests := make(map[uint32]string)
+	logical := make(map[uint32]bool)
+	real := make(map[uint32]string)
+	for _, t := range self.Tenants {
+		if t.Name == "" || names[t.Name] {
+			return fmt.Errorf("tenant: missing or duplicate tenant name %q", t.Name)
+		}
+		names[t.Name] = true
+		for _, cid := range t.ContextIDs {
+			if other, ok := guests[cid]; ok {
+				return fmt.Errorf("tenant: context ID %d belongs to %s and %s", cid, other, t.Name)
+			}
+			guests[cid] = t.Name
+		}
+		for l, r := range t.Ports {
+			logical[l] = true
+			if other, ok := real[r]; ok && other != t.Name {
+				return fmt.Errorf("tenant: port %d serves %s and %s", r, other, t.Name)
+			}
+			real[r] = t.Name
+		}
+	}
+	for r := range real {
+		if logical[r] {
+			return fmt.Errorf("tenant: port %d is both logical and real", r)
+		}
+	}
+	return nil
+}
+
+// TenantOf returns the tenant of the guest with context ID cid.
+func (self *Policy) TenantOf(cid uint32) (*Tenant, bool) {
+	for i := range self.Tenants {
+		for _, c := range self.Tenants[i].ContextIDs {
+			if c == cid {
+				return &self.Tenants[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Resolve returns the real port the guest with context ID cid reaches when
+// it dials logical port port.
+func (self *Policy) Resolve(cid, port uint32) (uint32, error) {
+	t, ok := self.TenantOf(cid)
+	if !ok {
+		return 0, fmt.Errorf("tenant: context ID %d belongs to no tenant", cid)
+	}
+	real, ok := t.Ports[port]
+	if !ok {
+		return 0, fmt.Errorf("tenant: %s has no service on port %d", t.Name, port)
+	}
+	return real, nil
+}
+
+// LogicalPorts returns every logical port of the policy.
+func (self *Policy) LogicalPorts() []uint32 {
+	seen := make(map[uint32]bool)
+	var ports []uint32
+	for _, t := range self.Tenants {
+		for l := range t.Ports {
+			if !seen[l] {
+				seen[l] = true
+				ports = append(ports, l)
+			}
+		}
+	}
+	return ports
+}
+
+// QuotaKey groups the guests of each tenant under its name, for use as
+// the Key of a transfer.Quota. Other guests are keyed by their context ID.
+func (self *Policy) QuotaKey(peer net.Addr) string {
+	addr, ok := peer.(*vsock.Addr)
+	if !ok {
+		return peer.String()
+	}
+	if t, ok := self.TenantOf(addr.ContextID); ok {
+		return t.Name
+	}
+	return strconv.FormatUint(uint64(addr.ContextID), 10)
+}
+
+// QuotaLimit returns the transfer quota of the tenant named key, for use
+// as the Limit of a transfer.Quota. Keys of no tenant have no limit.
+func (self *Policy) QuotaLimit(key string) int64 {
+	for _, t := range self.Tenants {
+		if t.Name == key && t.TransferQuota > 0 {
+			return t.TransferQuota
+		}
+	}
+	return -1
+}
+
+// Guard refuses connections from guests outside the tenant called name.
+// Connections from the host, including those forwarded by a broker, are
+// allowed.
+func (self *Policy) Guard(name string) vsock.Middleware {
+	return func(next vsock.Handler) vsock.Handler {
+		return vsock.HandlerFunc(func(conn net.Conn) {
+			addr, ok := conn.RemoteAddr().(*vsock.Addr)
+			if !ok {
+				conn.Close()
+				return
+			}
+			if addr.ContextID != vsock.Host && addr.ContextID != vsock.Local {
+				if t, ok := self.TenantOf(addr.ContextID); !ok || t.Name != name {
+					conn.Close()
+					return
+				}
+			}
+			next.ServeVsock(conn)
+		})
+	}
+}
+
+// Broker forwards connections to logical ports to the real port of the
+// connecting guest's tenant.
+type Broker struct {
+	Policy *Policy
+	// Listen defaults to vsock.Listen.
+	Listen func(port uint32) (net.Listener, error)
+	// Dial reaches a real port. Defaults to dialing vsock.Local.
+	Dial    func(port uint32) (net.Conn, error)
+	Profile bridge.Profile
+	// Backoff spaces retries after temporary accept errors, such as
+	// EMFILE. Defaults to exponential backoff from 5ms to 1s.
+	Backoff  vsock.Backoff
+	ErrorLog *log.Logger
+
+	mutex     sync.Mutex
+	listeners []net.Listener
+	closed    bool
+}
+
+// ErrBrokerClosed is returned by Broker.ListenAndServe after a call to Close.
+var ErrBrokerClosed = errors.New("tenant: Broker closed")
+
+// ListenAndServe listens on every logical port and forwards connections
+// until Close is called, in which case ErrBrokerClosed is returned, or a
+// listener fails.
+func (self *Broker) ListenAndServe() error {
+	listen := self.Listen
+	if listen == nil {
+		listen = func(port uint32) (net.Listener, error) { return vsock.Listen(port) }
+	}
+
+	ports := self.Policy.LogicalPorts()
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return ErrBrokerClosed
+	}
+	for _, port := range ports {
+		l, err := listen(port)
+		if err != nil {
+			self.closeListeners()
+			self.mutex.Unlock()
+			return fmt.Errorf("tenant: port %d: %v", port, err)
+		}
+		self.listeners = append(self.listeners, l)
+	}
+	listeners := self.listeners
+	self.mutex.Unlock()
+
+	errs := make(chan error, len(listeners))
+	for i, port := range ports {
+		go func(l net.Listener, port uint32) {
+			errs <- self.serve(l, port)
+		}(listeners[i], port)
+	}
+	err := <-errs
+	self.mutex.Lock()
+	self.closeListeners()
+	self.mutex.Unlock()
+	return err
+}
+
+func (self *Broker) serve(l net.Listener, port uint32) error {
+	for {
+		conn, err := vsock.AcceptWith(l, vsock.AcceptOptions{Backoff: self.Backoff})
+		if err != nil {
+			if self.isClosed() {
+				return ErrBrokerClosed
+			}
+			return err
+		}
+		go self.forward(conn, port)
+	}
+}
+
+func (self *Broker) forward(conn net.Conn, port uint32) {
+	addr, ok := conn.RemoteAddr().(*vsock.Addr)
+	if !ok {
+		conn.Close()
+		return
+	}
+	real, err := self.Policy.Resolve(addr.ContextID, port)
+	if err != nil {
+		self.logf("%v: refused", err)
+		conn.Close()
+		return
+	}
+
+	dial := self.Dial
+	if dial == nil {
+		dial = func(port uint32) (net.Conn, error) { return vsock.Dial(vsock.Local, port) }
+	}
+	upstream, err := dial(real)
+	if err != nil {
+		self.logf("tenant: %v: port %d: %v", addr, real, err)
+		conn.Close()
+		return
+	}
+	bridge.Join(conn, upstream, self.Profile)
+}
+
+// Close stops forwarding new connections.
+func (self *Broker) Close() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.closed = true
+	self.closeListeners()
+	return nil
+}
+
+// closeListeners closes the listeners. The caller holds mutex.
+func (self *Broker) closeListeners() {
+	for _, l := range self.listeners {
+		l.Close()
+	}
+	self.listeners = nil
+}
+
+func (self *Broker) isClosed() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.closed
+}
+
+func (self *Broker) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
@@ -0,0 +1,151 @@
+package tenant
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+var policy = &Policy{Tenants: []Tenant{
+	{Name: "acme", ContextIDs: []uint32{3, 4}, Ports: map[uint32]uint32{5300: 40300}, TransferQuota: 1 << 30},
+	{Name: "globex", ContextIDs: []uint32{5}, Ports: map[uint32]uint32{5300: 41300}},
+}}
+
+func TestResolve(t *testing.T) {
+	if err := policy.Validate(); err != nil {
+		t.Fatalf("unexpected invalid policy: %v", err)
+	}
+	for _, test := range []struct {
+		cid, port uint32
+		want      uint32
+	}{
+		{3, 5300, 40300},
+		{4, 5300, 40300},
+		{5, 5300, 41300},
+	} {
+		got, err := policy.Resolve(test.cid, test.port)
+		if err != nil {
+			t.Fatalf("failed to resolve %d:%d: %v", test.cid, test.port, err)
+		}
+		if diff := cmp.Diff(test.want, got); diff != "" {
+			t.Errorf("unexpected port for %d:%d (-want +got):\n%s", test.cid, test.port, diff)
+		}
+	}
+	if _, err := policy.Resolve(6, 5300); err == nil {
+		t.Error("expected guests outside any tenant to be refused")
+	}
+	if _, err := policy.Resolve(3, 5301); err == nil {
+		t.Error("expected unknown logical ports to be refused")
+	}
+
+	shared := &Policy{Tenants: []Tenant{
+		{Name: "a", ContextIDs: []uint32{3}},
+		{Name: "b", ContextIDs: []uint32{3}},
+	}}
+	if err := shared.Validate(); err == nil {
+		t.Error("expected a guest in two tenants to be invalid")
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for _, test := range []struct {
+		cid   uint32
+		key   string
+		limit int64
+	}{
+		{3, "acme", 1 << 30},
+		{4, "acme", 1 << 30},
+		{5, "globex", -1},
+		{6, "6", -1},
+	} {
+		key := policy.QuotaKey(&vsock.Addr{ContextID: test.cid, Port: 1024})
+		if diff := cmp.Diff(test.key, key); diff != "" {
+			t.Errorf("unexpected key for %d (-want +got):\n%s", test.cid, diff)
+		}
+		if diff := cmp.Diff(test.limit, policy.QuotaLimit(key)); diff != "" {
+			t.Errorf("unexpected limit for %d (-want +got):\n%s", test.cid, diff)
+		}
+	}
+}
+
+type peerConn struct {
+	net.Conn
+	cid uint32
+}
+
+func (self peerConn) RemoteAddr() net.Addr { return &vsock.Addr{ContextID: self.cid, Port: 1024} }
+
+func TestGuard(t *testing.T) {
+	var served []uint32
+	handler := policy.Guard("acme")(vsock.HandlerFunc(func(conn net.Conn) {
+		served = append(served, conn.RemoteAddr().(*vsock.Addr).ContextID)
+	}))
+	for _, cid := range []uint32{3, 5, 6, vsock.Host} {
+		a, b := net.Pipe()
+		handler.ServeVsock(peerConn{Conn: a, cid: cid})
+		b.Close()
+	}
+	if diff := cmp.Diff([]uint32{3, vsock.Host}, served); diff != "" {
+		t.Fatalf("unexpected connections served (-want +got):\n%s", diff)
+	}
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyListener fails Accept with a temporary error once, then waits to be
+// closed.
+type flakyListener struct {
+	net.Listener
+	once   sync.Once
+	failed bool
+	closed chan struct{}
+}
+
+func (self *flakyListener) Accept() (net.Conn, error) {
+	if !self.failed {
+		self.failed = true
+		return nil, temporaryError{}
+	}
+	<-self.closed
+	return nil, net.ErrClosed
+}
+
+func (self *flakyListener) Close() error {
+	self.once.Do(func() { close(self.closed) })
+	return nil
+}
+
+func TestBrokerClose(t *testing.T) {
+	retried := make(chan int, len(policy.LogicalPorts()))
+	broker := &Broker{
+		Policy: policy,
+		Listen: func(port uint32) (net.Listener, error) {
+			return &flakyListener{closed: make(chan struct{})}, nil
+		},
+		Backoff: func(attempt int) time.Duration {
+			retried <- attempt
+			return time.Millisecond
+		},
+	}
+	served := make(chan error, 1)
+	go func() { served <- broker.ListenAndServe() }()
+	if diff := cmp.Diff(1, <-retried); diff != "" {
+		t.Fatalf("unexpected retry (-want +got):\n%s", diff)
+	}
+
+	broker.Close()
+	if err := <-served; err != ErrBrokerClosed {
+		t.Fatalf("ListenAndServe() = %v, want ErrBrokerClosed", err)
+	}
+	if err := broker.ListenAndServe(); err != ErrBrokerClosed {
+		t.Fatalf("ListenAndServe() after Close = %v, want ErrBrokerClosed", err)
+	}
+}
@@ -0,0 +1,179 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net"
+	"sync"
+)
+
+// maxSerialFrame is the largest payload of a single serial frame.
+const maxSerialFrame = 240
+
+// base64Prefix starts each line of the base64 framing, telling frames apart
+// from console chatter.
+var base64Prefix = []byte("~VC:")
+
+var errSerialGap = errors.New("transport: serial frames lost")
+
+// framedConn carries a byte stream in checked frames over a noisy line.
+type framedConn struct {
+	net.Conn
+	base64 bool
+	reader *bufio.Reader
+
+	readMutex sync.Mutex
+	pending   []byte
+	readSeq   uint32
+
+	writeMutex sync.Mutex
+	writeSeq   uint32
+}
+
+func newFramedConn(conn net.Conn, base64 bool) *framedConn {
+	return &framedConn{Conn: conn, base64: base64, reader: bufio.NewReader(conn)}
+}
+
+func (self *framedConn) Write(b []byte) (int, error) {
+	self.writeMutex.Lock()
+	defer self.writeMutex.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxSerialFrame {
+			chunk = chunk[:maxSerialFrame]
+		}
+		if _, err := self.Conn.Write(self.encode(self.writeSeq, chunk)); err != nil {
+			return n, err
+		}
+		self.writeSeq++
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (self *framedConn) Read(b []byte) (int, error) {
+	self.readMutex.Lock()
+	defer self.readMutex.Unlock()
+
+	for len(self.pending) == 0 {
+		seq, payload, err := self.next()
+		if err != nil {
+			return 0, err
+		}
+		if seq != self.readSeq {
+			return 0, errSerialGap
+		}
+		self.readSeq++
+		self.pending = payload
+	}
+	n := copy(b, self.pending)
+	self.pending = self.pending[n:]
+	return n, nil
+}
+
+// next returns the next valid frame, skipping noise.
+func (self *framedConn) next() (uint32, []byte, error) {
+	for {
+		var (
+			frame []byte
+			err   error
+		)
+		if self.base64 {
+			line, rerr := self.reader.ReadBytes('\n')
+			if rerr != nil {
+				return 0, nil, rerr
+			}
+			i := bytes.Index(line, base64Prefix)
+			if i < 0 {
+				continue
+			}
+			line = bytes.TrimRight(line[i+len(base64Prefix):], "\r\n")
+			frame = make([]byte, base64.StdEncoding.DecodedLen(len(line)))
+			n, derr := base64.StdEncoding.Decode(frame, line)
+			if derr != nil {
+				continue
+			}
+			frame = frame[:n]
+		} else {
+			encoded, rerr := self.reader.ReadBytes(0)
+			if rerr != nil {
+				return 0, nil, rerr
+			}
+			if frame, err = cobsDecode(encoded[:len(encoded)-1]); err != nil {
+				continue
+			}
+		}
+
+		if len(frame) < 8 {
+			continue
+		}
+		body, sum := frame[:len(frame)-4], binary.BigEndian.Uint32(frame[len(frame)-4:])
+		if crc32.ChecksumIEEE(body) != sum {
+			continue
+		}
+		return binary.BigEndian.Uint32(body[:4]), body[4:], nil
+	}
+}
+
+// encode frames payload as: sequence number, payload, CRC32 of both.
+func (self *framedConn) encode(seq uint32, payload []byte) []byte {
+	frame := make([]byte, 4, 8+len(payload))
+	binary.BigEndian.PutUint32(frame, seq)
+	frame = append(frame, payload...)
+	frame = binary.BigEndian.AppendUint32(frame, crc32.ChecksumIEEE(frame))
+
+	if self.base64 {
+		line := append([]byte("\r\n"), base64Prefix...)
+		line = append(line, base64.StdEncoding.EncodeToString(frame)...)
+		return append(line, '\n')
+	}
+	// A leading zero flushes any partial garbage on the receiving side.
+	return append(append([]byte{0}, cobsEncode(frame)...), 0)
+}
+
+// cobsEncode encodes b with consistent overhead byte stuffing, so that the
+// result contains no zero bytes.
+func cobsEncode(b []byte) []byte {
+	out := make([]byte, 1, len(b)+len(b)/254+2)
+	code, codeAt := byte(1), 0
+	for _, c := range b {
+		if c != 0 {
+			out = append(out, c)
+			code++
+		}
+		if c == 0 || code == 0xff {
+			out[codeAt] = code
+			code, codeAt = 1, len(out)
+			out = append(out, 0)
+		}
+	}
+	out[codeAt] = code
+	return out
+}
+
+func cobsDecode(b []byte) ([]byte, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("transport: empty COBS frame")
+	}
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); {
+		code := int(b[i])
+		if code == 0 || i+code > len(b) {
+			return nil, fmt.Errorf("transport: invalid COBS frame")
+		}
+		out = append(out, b[i+1:i+code]...)
+		i += code
+		if code < 0xff && i < len(b) {
+			out = append(out, 0)
+		}
+	}
+	return out, nil
+}
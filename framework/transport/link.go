@@ -0,0 +1,191 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	mux "github.com/multiverse-os/vcable/framework/mux"
+)
+
+// Addr is the address of a port carried over a link transport.
+type Addr struct {
+	Transport string
+	Path      string
+	Port      uint32
+}
+
+func (self *Addr) Network() string { return self.Transport }
+func (self *Addr) String() string  { return fmt.Sprintf("%s:%d", self.Path, self.Port) }
+
+// link carries vsock-style ports over a single byte stream, such as a
+// serial device, by multiplexing it with mux. Each stream starts with the
+// port it is addressed to as a 4 byte big endian integer.
+type link struct {
+	name   string
+	path   string
+	server bool
+	open   func() (net.Conn, error)
+
+	mutex     sync.Mutex
+	session   *mux.Session
+	listeners map[uint32]*linkListener
+}
+
+func (self *link) get() (*mux.Session, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.session != nil {
+		select {
+		case <-self.session.Done():
+		default:
+			return self.session, nil
+		}
+	}
+
+	conn, err := self.open()
+	if err != nil {
+		return nil, err
+	}
+	if self.server {
+		self.session = mux.Server(conn)
+	} else {
+		self.session = mux.Client(conn)
+	}
+	go self.dispatch(self.session)
+	return self.session, nil
+}
+
+func (self *link) dial(port uint32) (net.Conn, error) {
+	session, err := self.get()
+	if err != nil {
+		return nil, err
+	}
+	stream, err := session.Open()
+	if err != nil {
+		return nil, err
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], port)
+	if _, err := stream.Write(header[:]); err != nil {
+		stream.Close()
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (self *link) listen(port uint32) (net.Listener, error) {
+	self.mutex.Lock()
+	if self.listeners == nil {
+		self.listeners = make(map[uint32]*linkListener)
+	}
+	if _, ok := self.listeners[port]; ok {
+		self.mutex.Unlock()
+		return nil, fmt.Errorf("transport: %s port %d already in use", self.name, port)
+	}
+	l := &linkListener{
+		link:  self,
+		addr:  &Addr{Transport: self.name, Path: self.path, Port: port},
+		conns: make(chan net.Conn),
+		done:  make(chan struct{}),
+	}
+	self.listeners[port] = l
+	self.mutex.Unlock()
+
+	if _, err := self.get(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// dispatch hands the streams the peer opens to the listeners of their
+// ports. When the session ends while ports are listened on, it reopens the
+// link.
+func (self *link) dispatch(session *mux.Session) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			break
+		}
+		go self.route(stream)
+	}
+
+	for {
+		self.mutex.Lock()
+		listening := len(self.listeners) > 0
+		self.mutex.Unlock()
+		if !listening {
+			return
+		}
+		time.Sleep(time.Second)
+		if _, err := self.get(); err == nil {
+			return
+		}
+	}
+}
+
+func (self *link) route(stream *mux.Stream) {
+	var header [4]byte
+	stream.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(stream, header[:]); err != nil {
+		stream.Close()
+		return
+	}
+	stream.SetReadDeadline(time.Time{})
+
+	self.mutex.Lock()
+	l, ok := self.listeners[binary.BigEndian.Uint32(header[:])]
+	self.mutex.Unlock()
+	if !ok {
+		stream.Close()
+		return
+	}
+	select {
+	case l.conns <- stream:
+	case <-l.done:
+		stream.Close()
+	}
+}
+
+type linkListener struct {
+	link  *link
+	addr  *Addr
+	conns chan net.Conn
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (self *linkListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.done:
+		return nil, &net.OpError{Op: "accept", Net: self.addr.Network(), Addr: self.addr, Err: net.ErrClosed}
+	}
+}
+
+func (self *linkListener) Close() error {
+	self.once.Do(func() {
+		close(self.done)
+		self.link.mutex.Lock()
+		delete(self.link.listeners, self.addr.Port)
+		self.link.mutex.Unlock()
+	})
+	return nil
+}
+
+func (self *linkListener) Addr() net.Addr { return self.addr }
+
+// fileConn adapts a character device to net.Conn.
+type fileConn struct {
+	*os.File
+	addr *Addr
+}
+
+func (self *fileConn) LocalAddr() net.Addr  { return self.addr }
+func (self *fileConn) RemoteAddr() net.Addr { return self.addr }
@@ -0,0 +1,90 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// A Listener is a transport which can also accept connections.
+type Listener interface {
+	Transport
+	Listen(port uint32) (net.Listener, error)
+}
+
+// Registry maps names to transports. The package functions use Default;
+// components given their own registry see only what it holds.
+type Registry struct {
+	mutex      sync.RWMutex
+	transports map[string]Transport
+}
+
+// Default is the registry of the process, holding the built-in transports
+// and those registered by other packages.
+var Default = NewRegistry(Vsock{}, &VirtioSerial{}, &TCP{})
+
+// NewRegistry returns a registry holding transports.
+func NewRegistry(transports ...Transport) *Registry {
+	self := &Registry{transports: make(map[string]Transport)}
+	for _, t := range transports {
+		self.Register(t)
+	}
+	return self
+}
+
+// Register makes t available under its name, replacing any transport
+// registered under the same name.
+func (self *Registry) Register(t Transport) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.transports == nil {
+		self.transports = make(map[string]Transport)
+	}
+	self.transports[t.Name()] = t
+}
+
+// Lookup returns the transport registered under name.
+func (self *Registry) Lookup(name string) (Transport, bool) {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	t, ok := self.transports[name]
+	return t, ok
+}
+
+// Names returns the names of the registered transports, sorted.
+func (self *Registry) Names() []string {
+	self.mutex.RLock()
+	defer self.mutex.RUnlock()
+	names := make([]string, 0, len(self.transports))
+	for name := range self.transports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ChainOf returns the chain of the registered transports named.
+func (self *Registry) ChainOf(names ...string) (Chain, error) {
+	chain := make(Chain, 0, len(names))
+	for _, name := range names {
+		t, ok := self.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("transport: unknown transport %q", name)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+// Register registers t with Default.
+func Register(t Transport) { Default.Register(t) }
+
+// Lookup returns the transport registered under name with Default.
+func Lookup(name string) (Transport, bool) { return Default.Lookup(name) }
+
+// Names returns the names of the transports registered with Default.
+func Names() []string { return Default.Names() }
+
+// ChainOf returns the chain of the transports named in Default.
+func ChainOf(names ...string) (Chain, error) { return Default.ChainOf(names...) }
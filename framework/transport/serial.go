@@ -0,0 +1,97 @@
+//go:build linux
+
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Serial is the transport of last resort: it runs cables over a raw serial
+// console, such as /dev/ttyS1 in the guest or the pty or Unix socket the
+// hypervisor connects it to on the host (with Host set). It is slow, but
+// works when every virtio device is broken.
+//
+// Data travels in frames carrying a sequence number and a CRC32, so noise
+// from the kernel or a getty sharing the console is skipped. Frames are COBS
+// encoded and separated by zero bytes, or, with Base64 set for consoles which
+// are not 8-bit clean, sent as base64 lines. A lost frame resets the link.
+type Serial struct {
+	Path   string
+	Host   bool
+	Base64 bool
+
+	once sync.Once
+	link *link
+}
+
+func (self *Serial) Name() string { return "serial" }
+
+func (self *Serial) Dial(contextID, port uint32) (net.Conn, error) {
+	return self.get().dial(port)
+}
+
+// Listen accepts the streams the peer dials to port.
+func (self *Serial) Listen(port uint32) (net.Listener, error) {
+	return self.get().listen(port)
+}
+
+func (self *Serial) get() *link {
+	self.once.Do(func() {
+		self.link = &link{
+			name:   self.Name(),
+			path:   self.Path,
+			server: self.Host,
+			open:   self.open,
+		}
+	})
+	return self.link
+}
+
+func (self *Serial) open() (net.Conn, error) {
+	addr := &Addr{Transport: self.Name(), Path: self.Path}
+
+	var conn net.Conn
+	if info, err := os.Stat(self.Path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		c, err := net.Dial("unix", self.Path)
+		if err != nil {
+			return nil, err
+		}
+		conn = c
+	} else {
+		f, err := os.OpenFile(self.Path, os.O_RDWR|unix.O_NOCTTY, 0)
+		if err != nil {
+			return nil, err
+		}
+		if err := makeRaw(f); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("transport: %s: %v", self.Path, err)
+		}
+		conn = &fileConn{File: f, addr: addr}
+	}
+	return newFramedConn(conn, self.Base64), nil
+}
+
+// makeRaw puts a terminal into raw mode, so no byte is interpreted or
+// echoed. Files which are not terminals are left alone.
+func makeRaw(f *os.File) error {
+	termios, err := unix.IoctlGetTermios(int(f.Fd()), unix.TCGETS)
+	if err != nil {
+		if err == unix.ENOTTY {
+			return nil
+		}
+		return err
+	}
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Oflag &^= unix.OPOST
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cflag &^= unix.CSIZE | unix.PARENB
+	termios.Cflag |= unix.CS8
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	return unix.IoctlSetTermios(int(f.Fd()), unix.TCSETS, termios)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+var errSerialUnsupported = errors.New("transport: serial consoles are only supported on linux")
+
+// Serial runs cables over a raw serial console. It needs the termios of
+// linux, so elsewhere it fails to dial and listen.
+type Serial struct {
+	Path   string
+	Host   bool
+	Base64 bool
+}
+
+func (self *Serial) Name() string { return "serial" }
+
+func (self *Serial) Dial(contextID, port uint32) (net.Conn, error) {
+	return nil, errSerialUnsupported
+}
+
+func (self *Serial) Listen(port uint32) (net.Listener, error) {
+	return nil, errSerialUnsupported
+}
@@ -0,0 +1,216 @@
+package transport
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// DefaultTCPBase is the TCP port of context ID 0 under the TCP transport.
+const DefaultTCPBase = 52000
+
+// EnvDevContextID names the environment variable holding the context ID a
+// process pretends to have under the TCP transport.
+const EnvDevContextID = "VCABLE_DEV_CID"
+
+// Replies to a TCP transport connection header.
+const (
+	tcpAccepted byte = iota
+	tcpRefused
+)
+
+// TCP emulates vsock over loopback TCP, so code using vcable can run and be
+// tested without any virtual machine, such as on a laptop or in CI. Each
+// emulated machine listens on TCP port Base plus its context ID, and every
+// connection starts with a header naming the source context ID and the
+// destination port, so listeners and dialers see vsock addresses.
+//
+// It must not be used in production: TCP offers none of the isolation of
+// vsock, and any local process can claim any context ID.
+type TCP struct {
+	// Host is the address machines listen on. Defaults to 127.0.0.1.
+	Host string
+	// Base defaults to DefaultTCPBase.
+	Base uint32
+	// ContextID is the context ID of this process. Defaults to the value
+	// of VCABLE_DEV_CID, or else to vsock.Host.
+	ContextID uint32
+
+	mutex     sync.Mutex
+	listener  net.Listener
+	listeners map[uint32]*tcpListener
+}
+
+func (self *TCP) Name() string { return "tcp" }
+
+// Dial connects to port of the emulated machine with context ID contextID.
+func (self *TCP) Dial(contextID, port uint32) (net.Conn, error) {
+	conn, err := net.Dial("tcp", self.address(contextID))
+	if err != nil {
+		return nil, err
+	}
+
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[0:4], self.contextID())
+	binary.BigEndian.PutUint32(header[4:8], port)
+	if _, err := conn.Write(header[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var reply [1]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	local := &vsock.Addr{ContextID: self.contextID(), Port: uint32(conn.LocalAddr().(*net.TCPAddr).Port)}
+	remote := &vsock.Addr{ContextID: contextID, Port: port}
+	if reply[0] != tcpAccepted {
+		conn.Close()
+		return nil, &net.OpError{Op: "dial", Net: "vsock", Source: local, Addr: remote, Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	return &tcpConn{Conn: conn, local: local, remote: remote}, nil
+}
+
+// Listen accepts the connections dialed to port of this process's context
+// ID.
+func (self *TCP) Listen(port uint32) (net.Listener, error) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if self.listener == nil {
+		l, err := net.Listen("tcp", self.address(self.contextID()))
+		if err != nil {
+			return nil, err
+		}
+		self.listener = l
+		self.listeners = make(map[uint32]*tcpListener)
+		go self.accept(l)
+	}
+	if _, ok := self.listeners[port]; ok {
+		return nil, fmt.Errorf("transport: tcp port %d already in use", port)
+	}
+
+	l := &tcpListener{
+		transport: self,
+		addr:      &vsock.Addr{ContextID: self.contextID(), Port: port},
+		conns:     make(chan net.Conn),
+		done:      make(chan struct{}),
+	}
+	self.listeners[port] = l
+	return l, nil
+}
+
+func (self *TCP) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go self.route(conn)
+	}
+}
+
+func (self *TCP) route(conn net.Conn) {
+	var header [8]byte
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	source, port := binary.BigEndian.Uint32(header[0:4]), binary.BigEndian.Uint32(header[4:8])
+
+	self.mutex.Lock()
+	l, ok := self.listeners[port]
+	self.mutex.Unlock()
+	if !ok {
+		conn.Write([]byte{tcpRefused})
+		conn.Close()
+		return
+	}
+
+	c := &tcpConn{
+		Conn:   conn,
+		local:  l.addr,
+		remote: &vsock.Addr{ContextID: source, Port: uint32(conn.RemoteAddr().(*net.TCPAddr).Port)},
+	}
+	if _, err := conn.Write([]byte{tcpAccepted}); err != nil {
+		conn.Close()
+		return
+	}
+	select {
+	case l.conns <- c:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (self *TCP) address(contextID uint32) string {
+	host, base := self.Host, self.Base
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if base == 0 {
+		base = DefaultTCPBase
+	}
+	return net.JoinHostPort(host, strconv.FormatUint(uint64(base)+uint64(contextID), 10))
+}
+
+func (self *TCP) contextID() uint32 {
+	if self.ContextID != 0 {
+		return self.ContextID
+	}
+	if cid, err := strconv.ParseUint(os.Getenv(EnvDevContextID), 10, 32); err == nil {
+		return uint32(cid)
+	}
+	return vsock.Host
+}
+
+type tcpListener struct {
+	transport *TCP
+	addr      *vsock.Addr
+	conns     chan net.Conn
+	done      chan struct{}
+	once      sync.Once
+}
+
+func (self *tcpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-self.conns:
+		return conn, nil
+	case <-self.done:
+		return nil, &net.OpError{Op: "accept", Net: "vsock", Addr: self.addr, Err: net.ErrClosed}
+	}
+}
+
+func (self *tcpListener) Close() error {
+	self.once.Do(func() {
+		close(self.done)
+		self.transport.mutex.Lock()
+		delete(self.transport.listeners, self.addr.Port)
+		self.transport.mutex.Unlock()
+	})
+	return nil
+}
+
+func (self *tcpListener) Addr() net.Addr { return self.addr }
+
+// tcpConn reports vsock addresses for a TCP connection.
+type tcpConn struct {
+	net.Conn
+	local, remote *vsock.Addr
+}
+
+func (self *tcpConn) LocalAddr() net.Addr  { return self.local }
+func (self *tcpConn) RemoteAddr() net.Addr { return self.remote }
+
+func (self *tcpConn) CloseWrite() error { return self.Conn.(*net.TCPConn).CloseWrite() }
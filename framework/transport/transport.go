@@ -0,0 +1,113 @@
+// Package transport carries cables over something other than native
+// AF_VSOCK when it is unavailable: the Unix socket a hybrid vsock device
+// such as Firecracker's exposes, or loopback TCP during development.
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// A Transport dials a port of a context ID over some medium.
+type Transport interface {
+	Name() string
+	Dial(contextID, port uint32) (net.Conn, error)
+}
+
+// Unavailable reports whether err shows that a transport cannot be used on
+// this machine at all, as opposed to the peer refusing or being absent.
+func Unavailable(err error) bool {
+	if _, ok := vsock.IsUnavailable(err); ok {
+		return true
+	}
+	return errors.Is(err, syscall.ENODEV) ||
+		errors.Is(err, syscall.EAFNOSUPPORT) ||
+		errors.Is(err, syscall.ENOENT) ||
+		errors.Is(err, syscall.ENXIO)
+}
+
+// Chain tries each transport in order, moving on to the next only when the
+// previous one is Unavailable. Its Dial method is a vsock.DialFunc.
+type Chain []Transport
+
+// Dial dials with the first available transport of the chain.
+func (self Chain) Dial(contextID, port uint32) (net.Conn, error) {
+	conn, _, err := self.DialTransport(contextID, port)
+	return conn, err
+}
+
+// DialTransport is Dial also returning the transport used.
+func (self Chain) DialTransport(contextID, port uint32) (net.Conn, Transport, error) {
+	if len(self) == 0 {
+		return nil, nil, fmt.Errorf("transport: empty chain")
+	}
+
+	var errs []string
+	for _, t := range self {
+		conn, err := t.Dial(contextID, port)
+		if err == nil {
+			return conn, t, nil
+		}
+		if !Unavailable(err) {
+			return nil, t, err
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", t.Name(), err))
+	}
+	return nil, nil, fmt.Errorf("transport: no transport available (%s)", strings.Join(errs, "; "))
+}
+
+// Vsock is native AF_VSOCK.
+type Vsock struct{}
+
+func (Vsock) Name() string { return "vsock" }
+
+func (Vsock) Dial(contextID, port uint32) (net.Conn, error) { return vsock.Dial(contextID, port) }
+
+// Hybrid dials through the Unix socket of a hybrid vsock device, which
+// multiplexes guest ports behind a "CONNECT <port>" handshake. The context
+// ID is implied by the socket and ignored.
+type Hybrid struct {
+	Path string
+}
+
+func (self Hybrid) Name() string { return "hybrid" }
+
+func (self Hybrid) Dial(contextID, port uint32) (net.Conn, error) {
+	conn, err := net.Dial("unix", self.Path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Read the reply a byte at a time so nothing past it is buffered away
+	// from the caller.
+	r := bufio.NewReaderSize(oneByteReader{conn}, 16)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("transport: hybrid handshake: %v", err)
+	}
+	if !strings.HasPrefix(line, "OK ") {
+		conn.Close()
+		return nil, fmt.Errorf("transport: hybrid handshake refused: %q", strings.TrimSpace(line))
+	}
+	return conn, nil
+}
+
+type oneByteReader struct{ conn net.Conn }
+
+func (self oneByteReader) Read(b []byte) (int, error) {
+	if len(b) > 1 {
+		b = b[:1]
+	}
+	return self.conn.Read(b)
+}
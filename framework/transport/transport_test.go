@@ -0,0 +1,170 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fake struct {
+	name  string
+	err   error
+	dials *[]string
+}
+
+func (self fake) Name() string { return self.name }
+
+func (self fake) Dial(contextID, port uint32) (net.Conn, error) {
+	*self.dials = append(*self.dials, self.name)
+	if self.err != nil {
+		return nil, self.err
+	}
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestChainFallsBackOnlyWhenUnavailable(t *testing.T) {
+	unavailable := &net.OpError{Op: "dial", Net: "vsock", Err: os.NewSyscallError("socket", syscall.EAFNOSUPPORT)}
+
+	var dials []string
+	chain := Chain{
+		fake{name: "vsock", err: unavailable, dials: &dials},
+		fake{name: "hybrid", dials: &dials},
+		fake{name: "tcp", dials: &dials},
+	}
+	if _, err := chain.Dial(3, 1024); err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	if diff := cmp.Diff([]string{"vsock", "hybrid"}, dials); diff != "" {
+		t.Fatalf("unexpected dials (-want +got):\n%s", diff)
+	}
+
+	dials = nil
+	refused := errors.New("connection refused")
+	chain[0] = fake{name: "vsock", err: refused, dials: &dials}
+	if _, err := chain.Dial(3, 1024); err != refused {
+		t.Fatalf("expected refusal to be returned, got %v", err)
+	}
+	if diff := cmp.Diff([]string{"vsock"}, dials); diff != "" {
+		t.Fatalf("unexpected dials (-want +got):\n%s", diff)
+	}
+}
+
+func TestLinkRoutesPorts(t *testing.T) {
+	a, b := net.Pipe()
+	guest := &link{name: "test", open: func() (net.Conn, error) { return a, nil }}
+	host := &link{name: "test", server: true, open: func() (net.Conn, error) { return b, nil }}
+
+	l, err := host.listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := guest.dial(1024)
+		if err != nil {
+			return
+		}
+		conn.Write([]byte("hi"))
+		conn.Close()
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	b2 := make([]byte, 2)
+	if _, err := io.ReadFull(conn, b2); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("hi", string(b2)); diff != "" {
+		t.Fatalf("unexpected data (-want +got):\n%s", diff)
+	}
+}
+
+func TestCOBSRoundTrip(t *testing.T) {
+	for _, b := range [][]byte{
+		{0},
+		{1, 0, 2},
+		bytes.Repeat([]byte{7}, 300),
+		append(bytes.Repeat([]byte{7}, 254), 0, 0),
+	} {
+		encoded := cobsEncode(b)
+		if bytes.IndexByte(encoded, 0) >= 0 {
+			t.Fatalf("encoding of %v contains a zero byte", b)
+		}
+		decoded, err := cobsDecode(encoded)
+		if err != nil {
+			t.Fatalf("failed to decode: %v", err)
+		}
+		if diff := cmp.Diff(b, decoded); diff != "" {
+			t.Fatalf("unexpected round trip (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func TestFramedConnSkipsNoise(t *testing.T) {
+	for _, base64 := range []bool{false, true} {
+		a, b := net.Pipe()
+		sender, receiver := newFramedConn(a, base64), newFramedConn(b, base64)
+
+		go func() {
+			a.Write([]byte("[    1.234] console noise\r\n\x00\x05garbage\x00"))
+			sender.Write([]byte("hello"))
+		}()
+
+		got := make([]byte, 5)
+		if _, err := io.ReadFull(receiver, got); err != nil {
+			t.Fatalf("base64 %v: failed to read: %v", base64, err)
+		}
+		if diff := cmp.Diff("hello", string(got)); diff != "" {
+			t.Fatalf("base64 %v: unexpected data (-want +got):\n%s", base64, diff)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestTCPEmulatesAddressing(t *testing.T) {
+	guest := &TCP{Base: 41000, ContextID: 3}
+	host := &TCP{Base: 41000, ContextID: 2}
+
+	l, err := guest.Listen(1024)
+	if err != nil {
+		t.Skipf("cannot listen on loopback: %v", err)
+	}
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(conn.RemoteAddr().String()))
+		conn.Close()
+	}()
+
+	conn, err := host.Dial(3, 1024)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	b, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if got := string(b); got[:len("host(2):")] != "host(2):" {
+		t.Fatalf("unexpected remote address seen by guest: %q", got)
+	}
+
+	if _, err := host.Dial(3, 2048); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected connection refused, got %v", err)
+	}
+}
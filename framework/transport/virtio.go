@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"sync"
+)
+
+// DefaultVirtioSerialPort is the guest device of the virtio-serial port
+// named org.multiverse.vcable, as created by udev.
+const DefaultVirtioSerialPort = "/dev/virtio-ports/org.multiverse.vcable"
+
+// VirtioSerial carries cables over a virtio-serial port, for hypervisors or
+// kernels without vsock. In the guest, Path is the port device, such as
+// /dev/vport0p1; on the host, Host is set and Path is the Unix socket of
+// the chardev backing the port. Context IDs are meaningless on the single
+// link and ignored.
+type VirtioSerial struct {
+	Path string
+	Host bool
+
+	once sync.Once
+	link *link
+}
+
+func (self *VirtioSerial) Name() string { return "virtio-serial" }
+
+func (self *VirtioSerial) Dial(contextID, port uint32) (net.Conn, error) {
+	return self.get().dial(port)
+}
+
+// Listen accepts the streams the peer dials to port.
+func (self *VirtioSerial) Listen(port uint32) (net.Listener, error) {
+	return self.get().listen(port)
+}
+
+func (self *VirtioSerial) get() *link {
+	self.once.Do(func() {
+		path := self.Path
+		if path == "" {
+			path = DefaultVirtioSerialPort
+		}
+		self.link = &link{
+			name:   self.Name(),
+			path:   path,
+			server: self.Host,
+			open: func() (net.Conn, error) {
+				if self.Host {
+					return net.Dial("unix", path)
+				}
+				f, err := os.OpenFile(path, os.O_RDWR, 0)
+				if err != nil {
+					return nil, err
+				}
+				return &fileConn{File: f, addr: &Addr{Transport: self.Name(), Path: path}}, nil
+			},
+		}
+	})
+	return self.link
+}
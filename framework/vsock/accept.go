@@ -0,0 +1,229 @@
+package vsock
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// validate checks the context ID ranges of the configuration.
+func (self *ListenConfig) validate() error {
+	if err := self.ContextIDs.Validate(); err != nil {
+		return err
+	}
+	return self.DenyContextIDs.Validate()
+}
+
+// allows reports whether connections from cid are accepted.
+func (self *ListenConfig) allows(cid uint32) bool {
+	if _, denied := self.DenyContextIDs.Lookup(cid); denied {
+		return false
+	}
+	return self.ContextIDs.Contains(cid)
+}
+
+// listenerConns tracks the connections a listener accepted, to count them,
+// hold Accept at MaxConns and drain them on Shutdown.
+type listenerConns struct {
+	accepted     atomic.Int64
+	acceptErrors atomic.Int64
+
+	once   sync.Once
+	mutex  sync.Mutex
+	conns  map[*Conn]struct{}
+	slots  chan struct{}
+	closed chan struct{}
+	// drained, if set, is closed once no connection is left.
+	drained chan struct{}
+}
+
+func (self *listenerConns) init(max int) {
+	self.once.Do(func() {
+		self.mutex.Lock()
+		self.conns = make(map[*Conn]struct{})
+		if max > 0 {
+			self.slots = make(chan struct{}, max)
+		}
+		self.closed = make(chan struct{})
+		self.mutex.Unlock()
+	})
+}
+
+// acquire waits for a slot to accept a connection in, failing once the
+// listener is closed.
+func (self *listenerConns) acquire() bool {
+	select {
+	case <-self.closed:
+		return false
+	default:
+	}
+	if self.slots == nil {
+		return true
+	}
+	select {
+	case self.slots <- struct{}{}:
+		return true
+	case <-self.closed:
+		return false
+	}
+}
+
+func (self *listenerConns) release() {
+	if self.slots != nil {
+		<-self.slots
+	}
+}
+
+func (self *listenerConns) add(c *Conn) {
+	self.accepted.Add(1)
+	self.mutex.Lock()
+	self.conns[c] = struct{}{}
+	self.mutex.Unlock()
+	c.counters.listener = self
+}
+
+// remove forgets c, closed, and frees its slot.
+func (self *listenerConns) remove(c *Conn) {
+	self.mutex.Lock()
+	delete(self.conns, c)
+	if len(self.conns) == 0 && self.drained != nil {
+		close(self.drained)
+		self.drained = nil
+	}
+	self.mutex.Unlock()
+	self.release()
+}
+
+func (self *listenerConns) active() int64 {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return int64(len(self.conns))
+}
+
+// close wakes Accept calls waiting for a slot, returning false if the
+// listener was closed already.
+func (self *listenerConns) close() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	select {
+	case <-self.closed:
+		return false
+	default:
+		close(self.closed)
+		return true
+	}
+}
+
+// drain returns a channel closed once no connection is left.
+func (self *listenerConns) drain() <-chan struct{} {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.conns) == 0 {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	if self.drained == nil {
+		self.drained = make(chan struct{})
+	}
+	return self.drained
+}
+
+// closeAll closes the connections left.
+func (self *listenerConns) closeAll() {
+	self.mutex.Lock()
+	conns := make([]*Conn, 0, len(self.conns))
+	for c := range self.conns {
+		conns = append(conns, c)
+	}
+	self.mutex.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func (self *VsockListener) Accept() (net.Conn, error) {
+	config := &self.listener.config
+	self.conns.init(config.MaxConns)
+	if !self.conns.acquire() {
+		return nil, self.acceptError(config.Tracer, os.ErrClosed)
+	}
+	c, err := self.listener.Accept()
+	if err != nil {
+		self.conns.release()
+		return nil, self.acceptError(config.Tracer, err)
+	}
+
+	vc, ok := c.(*Conn)
+	if !ok {
+		self.conns.release()
+		return c, nil
+	}
+	self.conns.add(vc)
+	vc.counters.tracer = config.Tracer
+	if config.Tracer != nil {
+		config.Tracer.Accept(vc)
+	}
+	return vc, nil
+}
+
+func (self *VsockListener) acceptError(tracer Tracer, err error) error {
+	err = self.opError(opAccept, err)
+	self.conns.acceptErrors.Add(1)
+	if tracer != nil {
+		tracer.AcceptError(err)
+	}
+	return err
+}
+
+// Close stops accepting connections. Those accepted are left open; see
+// Shutdown.
+func (self *VsockListener) Close() error {
+	first, err := self.close()
+	if !first {
+		return self.opError(opClose, os.ErrClosed)
+	}
+	return err
+}
+
+// close closes the listener, if first to.
+func (self *VsockListener) close() (first bool, err error) {
+	self.conns.init(self.listener.config.MaxConns)
+	if !self.conns.close() {
+		return false, nil
+	}
+	return true, self.opError(opClose, self.listener.Close())
+}
+
+// Shutdown stops accepting connections, and waits for those accepted to be
+// closed, or for ctx to be done, in which case it closes them and returns
+// ctx.Err().
+func (self *VsockListener) Shutdown(ctx context.Context) error {
+	_, err := self.close()
+	select {
+	case <-self.conns.drain():
+		return err
+	case <-ctx.Done():
+		self.conns.closeAll()
+		return ctx.Err()
+	}
+}
+
+// ListenerStats are the counters of a listener.
+type ListenerStats struct {
+	Accepted     int64
+	AcceptErrors int64
+	// Active counts the accepted connections still open.
+	Active int64
+}
+
+// Stats returns the counters of the listener.
+func (self *VsockListener) Stats() ListenerStats {
+	return ListenerStats{
+		Accepted:     self.conns.accepted.Load(),
+		AcceptErrors: self.conns.acceptErrors.Load(),
+		Active:       self.conns.active(),
+	}
+}
@@ -0,0 +1,282 @@
+//go:build linux
+
+package vsock_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// accept returns the next connection accepted by l, or nil if none is
+// within a short while.
+func accept(t *testing.T, l net.Listener) net.Conn {
+	t.Helper()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			c = nil
+		}
+		accepted <- c
+	}()
+	select {
+	case c := <-accepted:
+		return c
+	case <-time.After(100 * time.Millisecond):
+		t.Cleanup(func() {
+			if c := <-accepted; c != nil {
+				c.Close()
+			}
+		})
+		return nil
+	}
+}
+
+func TestListenConfigDeny(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	config := &vsock.ListenConfig{
+		ContextIDs:     vsock.CIDRanges{vsock.GuestCIDs},
+		DenyContextIDs: vsock.CIDRanges{{Min: 3, Max: 3}},
+	}
+	l, err := config.Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	denied, err := network.Machine(3).Dial(vsock.Host, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer denied.Close()
+	allowed, err := network.Machine(4).Dial(vsock.Host, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer allowed.Close()
+
+	c := accept(t, l)
+	if c == nil {
+		t.Fatal("failed to accept the allowed peer")
+	}
+	defer c.Close()
+	if diff := cmp.Diff(uint32(4), c.RemoteAddr().(*vsock.Addr).ContextID); diff != "" {
+		t.Fatalf("unexpected peer (-want +got):\n%s", diff)
+	}
+	denied.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := denied.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() of the denied peer = %v, want io.EOF", err)
+	}
+}
+
+func TestListenConfigDeadline(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	for _, config := range []*vsock.ListenConfig{
+		{Deadline: 50 * time.Millisecond},
+		{ReadDeadline: 50 * time.Millisecond},
+	} {
+		l, err := config.Listen(1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer, err := network.Machine(3).Dial(vsock.Host, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := accept(t, l)
+		if c == nil {
+			t.Fatal("failed to accept")
+		}
+
+		// The deadline runs from the accept, without the handler setting it.
+		start := time.Now()
+		if _, err := c.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Read() = %v, want os.ErrDeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("read timed out after %v, want about 50ms", elapsed)
+		}
+		go io.Copy(io.Discard, peer)
+		_, err = c.Write([]byte("x"))
+		if config.Deadline > 0 && !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("Write() past Deadline = %v, want os.ErrDeadlineExceeded", err)
+		}
+		if config.Deadline == 0 && err != nil {
+			t.Fatalf("Write() with a ReadDeadline alone = %v, want nil", err)
+		}
+		c.Close()
+		peer.Close()
+		l.Close()
+	}
+}
+
+func TestListenConfigMaxConns(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	l, err := (&vsock.ListenConfig{MaxConns: 1}).Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 2; i++ {
+		c, err := network.Machine(3).Dial(vsock.Host, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	first := accept(t, l)
+	if first == nil {
+		t.Fatal("failed to accept")
+	}
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	select {
+	case <-accepted:
+		t.Fatal("accepted past MaxConns")
+	case <-time.After(50 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case c := <-accepted:
+		if c == nil {
+			t.Fatal("failed to accept")
+		}
+		c.Close()
+	case <-time.After(time.Second):
+		t.Fatal("Accept still held after a connection closed")
+	}
+}
+
+func TestListenerShutdown(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	l, err := vsock.Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		c, err := network.Machine(3).Dial(vsock.Host, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+	}
+	drained, stuck := accept(t, l), accept(t, l)
+	if drained == nil || stuck == nil {
+		t.Fatal("failed to accept")
+	}
+	time.AfterFunc(20*time.Millisecond, func() { drained.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := l.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown() = %v, want context.DeadlineExceeded", err)
+	}
+	if _, err := stuck.Write([]byte("x")); err == nil {
+		t.Fatal("expected Shutdown to close the connection left")
+	}
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("accepted after Shutdown")
+	}
+	if diff := cmp.Diff(vsock.ListenerStats{Accepted: 2, AcceptErrors: 1}, l.Stats()); diff != "" {
+		t.Fatalf("unexpected stats (-want +got):\n%s", diff)
+	}
+	if err := l.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown() of a drained listener = %v", err)
+	}
+}
+
+func TestRoleHelpers(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	host := network.Machine(vsock.Host)
+	restore := network.Machine(3).Install()
+	defer func() { restore() }()
+	if role, err := vsock.DetectRole(); err != nil || role != vsock.RoleGuest {
+		t.Fatalf("DetectRole() = %v, %v, want guest", role, err)
+	}
+
+	// A guest reaches the host without naming its context ID, accepts
+	// only the host, and may not listen as one.
+	hl, err := host.Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+	c, err := vsock.DialHost(1024)
+	if err != nil {
+		t.Fatalf("failed to dial the host: %v", err)
+	}
+	c.Close()
+	if _, err := vsock.DialGuest(vsock.Host, 1024); err == nil {
+		t.Fatal("expected DialGuest to refuse the context ID of the host")
+	}
+	var rerr *vsock.RoleError
+	if _, err := vsock.ListenHost(1024); !errors.As(err, &rerr) || rerr.Have != vsock.RoleGuest {
+		t.Fatalf("ListenHost() on a guest = %v, want a RoleError", err)
+	}
+	l, err := vsock.ListenGuest(1025)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	stranger, err := network.Machine(4).Dial(3, 1025)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	fromHost, err := host.Dial(3, 1025)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fromHost.Close()
+	accepted := accept(t, l)
+	if accepted == nil {
+		t.Fatal("ListenGuest did not accept the host")
+	}
+	accepted.Close()
+	if diff := cmp.Diff(uint32(vsock.Host), accepted.RemoteAddr().(*vsock.Addr).ContextID); diff != "" {
+		t.Fatalf("unexpected peer (-want +got):\n%s", diff)
+	}
+	stranger.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stranger.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Read() of another guest = %v, want io.EOF", err)
+	}
+
+	// The host reaches its own services over the loopback, and has no
+	// hypervisor to dial.
+	restore()
+	restore = host.Install()
+	c, err = vsock.DialHost(1024)
+	if err != nil {
+		t.Fatalf("failed to dial the host from itself: %v", err)
+	}
+	c.Close()
+	if _, err := vsock.DialHypervisor(1024); !errors.As(err, &rerr) || rerr.Want != vsock.RoleGuest {
+		t.Fatalf("DialHypervisor() on the host = %v, want a RoleError", err)
+	}
+}
@@ -0,0 +1,119 @@
+package vsock
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ParseAddr parses an address written as [vsock://]host:port. The host is a
+// context ID, one of host, hypervisor, local and any, or as Addr.String
+// writes it, such as vm(3). An empty host is any, so ":1024" listens on every
+// local context ID.
+func ParseAddr(s string) (*Addr, error) {
+	rest := strings.TrimPrefix(s, network+"://")
+	i := strings.LastIndex(rest, ":")
+	if i < 0 {
+		return nil, fmt.Errorf("vsock: address %q has no port", s)
+	}
+	cid, err := parseContextID(rest[:i])
+	if err != nil {
+		return nil, fmt.Errorf("vsock: address %q: %v", s, err)
+	}
+	port, err := strconv.ParseUint(rest[i+1:], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("vsock: address %q: invalid port %q", s, rest[i+1:])
+	}
+	return &Addr{ContextID: cid, Port: uint32(port)}, nil
+}
+
+func parseContextID(host string) (uint32, error) {
+	switch host {
+	case "", "any":
+		return Any, nil
+	case "host":
+		return Host, nil
+	case "hypervisor":
+		return Hypervisor, nil
+	case "local":
+		return Local, nil
+	}
+	// The forms of Addr.String, e.g. vm(3), give the context ID in
+	// parentheses after its label.
+	label, number, labelled := "", host, false
+	if open := strings.IndexByte(host, '('); open >= 0 && strings.HasSuffix(host, ")") {
+		label, number, labelled = host[:open], host[open+1:len(host)-1], true
+	}
+	cid, err := strconv.ParseUint(number, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid context ID %q", host)
+	}
+	if labelled {
+		want, ok := labels[label]
+		switch {
+		case !ok:
+			return 0, fmt.Errorf("unknown context ID label %q", label)
+		case label == "vm" && cid > uint64(Host):
+		case label != "vm" && cid == uint64(want):
+		default:
+			return 0, fmt.Errorf("context ID %d is not %s", cid, label)
+		}
+	}
+	return uint32(cid), nil
+}
+
+// labels are those a context ID may carry in parentheses, as Addr.String
+// writes them, with the ID each stands for; vm stands for any guest.
+var labels = map[string]uint32{
+	"hypervisor": Hypervisor,
+	"local":      Local,
+	"reserved":   cidReserved,
+	"host":       Host,
+	"vm":         0,
+}
+
+// DialAddr dials address, as ParseAddr parses it, with options.
+func DialAddr(address string, options ...DialOption) (*Conn, error) {
+	addr, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return DialContext(context.Background(), addr.ContextID, addr.Port, options...)
+}
+
+// DialNetwork dials address, as ParseAddr parses it. It has the signature
+// of net.Dialer.DialContext, to plug into http.Transport.DialContext and
+// the like; network is ignored, as those pass tcp.
+func (self *Dialer) DialNetwork(ctx context.Context, network, address string) (net.Conn, error) {
+	addr, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	return self.DialContext(ctx, addr.ContextID, addr.Port)
+}
+
+// ListenAddr listens on address, as ParseAddr parses it.
+func ListenAddr(address string) (*VsockListener, error) {
+	return (&ListenConfig{}).ListenAddr(address)
+}
+
+// ListenAddr listens on address, as ParseAddr parses it, with the options
+// in the configuration. Unlike Listen, it binds the context ID of the
+// address, such as any for every local context ID.
+func (self *ListenConfig) ListenAddr(address string) (*VsockListener, error) {
+	addr, err := ParseAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.validate(); err != nil {
+		return nil, err
+	}
+	l, err := listen(addr.ContextID, addr.Port, self)
+	if err != nil {
+		return nil, opError(opListen, err, addr, nil)
+	}
+	l.listener.config = *self
+	return l, nil
+}
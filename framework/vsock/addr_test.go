@@ -0,0 +1,46 @@
+package vsock
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseAddr(t *testing.T) {
+	tests := []struct {
+		s    string
+		want *Addr
+	}{
+		{"vsock://3:1024", &Addr{ContextID: 3, Port: 1024}},
+		{"3:1024", &Addr{ContextID: 3, Port: 1024}},
+		{"host:22", &Addr{ContextID: Host, Port: 22}},
+		{"hypervisor:0", &Addr{ContextID: Hypervisor, Port: 0}},
+		{"local:5000", &Addr{ContextID: Local, Port: 5000}},
+		{"any:80", &Addr{ContextID: Any, Port: 80}},
+		{":80", &Addr{ContextID: Any, Port: 80}},
+		{"vm(42):7", &Addr{ContextID: 42, Port: 7}},
+		{"vsock://host(2):7", &Addr{ContextID: Host, Port: 7}},
+		{"local(1):7", &Addr{ContextID: Local, Port: 7}},
+		{"hypervisor(0):7", &Addr{ContextID: Hypervisor, Port: 7}},
+		{"4294967295:1", &Addr{ContextID: Any, Port: 1}},
+	}
+	for _, tt := range tests {
+		got, err := ParseAddr(tt.s)
+		if err != nil {
+			t.Errorf("ParseAddr(%q): %v", tt.s, err)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("ParseAddr(%q) (-want +got):\n%s", tt.s, diff)
+		}
+		if round, err := ParseAddr(got.String()); err != nil || *round != *got {
+			t.Errorf("ParseAddr(%q) = %v, %v, want %v", got.String(), round, err, got)
+		}
+	}
+
+	for _, s := range []string{"", "3", "vsock://3", "guest:1", "3:port", "3:-1", "3:4294967296", "4294967296:1", "vm(x):1", "bogus(3):1", "(3):1", "host(3):1", "vm(2):1", "local(2):1"} {
+		if _, err := ParseAddr(s); err == nil {
+			t.Errorf("ParseAddr(%q): expected an error", s)
+		}
+	}
+}
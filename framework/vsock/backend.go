@@ -0,0 +1,211 @@
+//go:build linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A Backend carries the connections of Listen and Dial in place of
+// AF_VSOCK sockets, so code built on them can be tested on machines without
+// vsock; see package vsocktest. Its listeners and connections must use
+// *Addr addresses.
+type Backend interface {
+	// ContextID is the context ID of the local machine.
+	ContextID() uint32
+	Listen(port uint32) (net.Listener, error)
+	DialContext(ctx context.Context, contextID, port uint32) (net.Conn, error)
+}
+
+var backend struct {
+	sync.RWMutex
+	b Backend
+}
+
+// SetBackend routes Listen, Dial and ContextID of the process through b
+// until restore is called. Connections so made have no socket: their
+// SyscallConn fails, and the Control hook of a Dialer is not called. Only
+// stream sockets are supported.
+func SetBackend(b Backend) (restore func()) {
+	backend.Lock()
+	previous := backend.b
+	backend.b = b
+	backend.Unlock()
+	return func() {
+		backend.Lock()
+		backend.b = previous
+		backend.Unlock()
+	}
+}
+
+func currentBackend() Backend {
+	backend.RLock()
+	defer backend.RUnlock()
+	return backend.b
+}
+
+var errNoSocket = errors.New("vsock: the connection has no socket on this backend")
+
+func listenBackend(b Backend, port uint32, typ SocketType) (*VsockListener, error) {
+	if typ != Stream {
+		return nil, fmt.Errorf("vsock: the backend carries %s sockets only, not %s", Stream, typ)
+	}
+	l, err := b.Listen(port)
+	if err != nil {
+		return nil, err
+	}
+	addr, ok := l.Addr().(*Addr)
+	if !ok {
+		l.Close()
+		return nil, fmt.Errorf("vsock: backend listener has %s address %v", l.Addr().Network(), l.Addr())
+	}
+	return &VsockListener{
+		listener: &listener{
+			fd:   &netListenFD{l: l, addr: addr},
+			addr: addr,
+		},
+	}, nil
+}
+
+func dialBackend(ctx context.Context, b Backend, d *Dialer, cid, port uint32) (*Conn, error) {
+	if d.Type != Stream {
+		return nil, fmt.Errorf("vsock: the backend carries %s sockets only, not %s", Stream, d.Type)
+	}
+	conn, err := b.DialContext(ctx, cid, port)
+	if err != nil {
+		return nil, err
+	}
+	local, lok := conn.LocalAddr().(*Addr)
+	remote, rok := conn.RemoteAddr().(*Addr)
+	if !lok || !rok {
+		conn.Close()
+		return nil, fmt.Errorf("vsock: backend connection has %s address %v", conn.RemoteAddr().Network(), conn.RemoteAddr())
+	}
+	return newConn(&netConnFD{c: conn}, local, remote)
+}
+
+var _ connFD = &netConnFD{}
+
+// netConnFD is the connFD of a connection made by a Backend, or over a
+// hybrid vsock device.
+type netConnFD struct {
+	c net.Conn
+	// local, if set, is the address of the connection, whose own is not
+	// an *Addr.
+	local *Addr
+}
+
+func (self *netConnFD) Read(b []byte) (int, error)  { return self.c.Read(b) }
+func (self *netConnFD) Write(b []byte) (int, error) { return self.c.Write(b) }
+func (self *netConnFD) Close() error                { return self.c.Close() }
+func (self *netConnFD) EarlyClose() error           { return self.c.Close() }
+
+func (self *netConnFD) Bind(unix.Sockaddr) error         { return errNoSocket }
+func (self *netConnFD) Connect(unix.Sockaddr) error      { return errNoSocket }
+func (self *netConnFD) SetNonblocking(name string) error { return nil }
+
+func (self *netConnFD) SyscallConn() (syscall.RawConn, error) {
+	if sc, ok := self.c.(syscall.Conn); ok {
+		return sc.SyscallConn()
+	}
+	return nil, errNoSocket
+}
+
+func (self *netConnFD) File() (*os.File, error) {
+	if fc, ok := self.c.(interface{ File() (*os.File, error) }); ok {
+		return fc.File()
+	}
+	return nil, errNoSocket
+}
+
+func (self *netConnFD) Getsockname() (unix.Sockaddr, error) {
+	addr := self.local
+	if addr == nil {
+		addr = self.c.LocalAddr().(*Addr)
+	}
+	return &unix.SockaddrVM{CID: addr.ContextID, Port: addr.Port}, nil
+}
+
+func (self *netConnFD) Shutdown(how int) error {
+	if how == unix.SHUT_RD {
+		cr, ok := self.c.(interface{ CloseRead() error })
+		if !ok {
+			return errNoSocket
+		}
+		return cr.CloseRead()
+	}
+	cw, ok := self.c.(interface{ CloseWrite() error })
+	if !ok {
+		return errNoSocket
+	}
+	return cw.CloseWrite()
+}
+
+func (self *netConnFD) SetDeadline(t time.Time, typ deadlineType) error {
+	switch typ {
+	case readDeadline:
+		return self.c.SetReadDeadline(t)
+	case writeDeadline:
+		return self.c.SetWriteDeadline(t)
+	}
+	return self.c.SetDeadline(t)
+}
+
+var _ listenFD = &netListenFD{}
+
+// netListenFD is the listenFD of a listener made by a Backend, or on a
+// hybrid vsock device.
+type netListenFD struct {
+	l    net.Listener
+	addr *Addr
+	// peer, if set, is the address of every connection accepted, whose
+	// own are not *Addrs.
+	peer *Addr
+}
+
+func (self *netListenFD) Close() error                     { return self.l.Close() }
+func (self *netListenFD) EarlyClose() error                { return self.l.Close() }
+func (self *netListenFD) Bind(unix.Sockaddr) error         { return errNoSocket }
+func (self *netListenFD) Listen(n int) error               { return errNoSocket }
+func (self *netListenFD) SetNonblocking(name string) error { return nil }
+func (self *netListenFD) File() (*os.File, error)          { return nil, errNoSocket }
+
+func (self *netListenFD) SyscallConn() (syscall.RawConn, error) { return nil, errNoSocket }
+
+func (self *netListenFD) Getsockname() (unix.Sockaddr, error) {
+	addr := self.addr
+	return &unix.SockaddrVM{CID: addr.ContextID, Port: addr.Port}, nil
+}
+
+func (self *netListenFD) SetDeadline(t time.Time) error {
+	dl, ok := self.l.(interface{ SetDeadline(time.Time) error })
+	if !ok {
+		return errNoSocket
+	}
+	return dl.SetDeadline(t)
+}
+
+func (self *netListenFD) Accept4(flags int) (connFD, unix.Sockaddr, error) {
+	conn, err := self.l.Accept()
+	if err != nil {
+		return nil, nil, err
+	}
+	remote := self.peer
+	if remote == nil {
+		var ok bool
+		if remote, ok = conn.RemoteAddr().(*Addr); !ok {
+			conn.Close()
+			return nil, nil, fmt.Errorf("vsock: backend connection has %s address %v", conn.RemoteAddr().Network(), conn.RemoteAddr())
+		}
+	}
+	return &netConnFD{c: conn, local: self.addr}, &unix.SockaddrVM{CID: remote.ContextID, Port: remote.Port}, nil
+}
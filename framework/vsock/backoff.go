@@ -0,0 +1,50 @@
+package vsock
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff returns how long to wait before retry number attempt, counting
+// from 1.
+type Backoff func(attempt int) time.Duration
+
+// Immediate retries at once.
+func Immediate() Backoff {
+	return func(int) time.Duration { return 0 }
+}
+
+// Constant waits d before every retry.
+func Constant(d time.Duration) Backoff {
+	return func(int) time.Duration { return d }
+}
+
+// Exponential waits min before the first retry and doubles the wait for
+// each further one, up to max.
+func Exponential(min, max time.Duration) Backoff {
+	return func(attempt int) time.Duration {
+		d := min
+		for i := 1; i < attempt && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// Jittered waits a random duration between zero and what backoff would,
+// so that many processes retrying at once spread out.
+func Jittered(backoff Backoff) Backoff {
+	return func(attempt int) time.Duration {
+		d := backoff(attempt)
+		if d <= 0 {
+			return 0
+		}
+		return time.Duration(rand.Int63n(int64(d) + 1))
+	}
+}
+
+// defaultBackoff is used on temporary accept errors, such as EMFILE.
+var defaultBackoff = Exponential(5*time.Millisecond, time.Second)
@@ -0,0 +1,21 @@
+package vsock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := Exponential(10*time.Millisecond, 50*time.Millisecond)
+
+	var got []time.Duration
+	for attempt := 1; attempt <= 4; attempt++ {
+		got = append(got, backoff(attempt))
+	}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 50 * time.Millisecond}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected delays (-want +got):\n%s", diff)
+	}
+}
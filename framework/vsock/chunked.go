@@ -0,0 +1,133 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultChunkSize is the chunk size of WriteChunked and CopyChunked.
+const DefaultChunkSize = 256 * 1024
+
+// ChunkOptions configures WriteChunked and CopyChunked.
+type ChunkOptions struct {
+	// ChunkSize defaults to DefaultChunkSize.
+	ChunkSize int
+	// ChunkTimeout, if set, bounds the write of each chunk, so a stalled
+	// peer fails the transfer without bounding the transfer as a whole.
+	ChunkTimeout time.Duration
+	// Progress, if set, is called after each chunk with the bytes written
+	// so far and the total, or -1 if unknown. Returning an error stops the
+	// transfer with that error.
+	Progress func(written, total int64) error
+}
+
+// WriteChunked writes b to conn in chunks, reporting progress after each.
+// Cancelling ctx interrupts the write in flight. Only the write deadline of
+// conn is used, so reads may continue concurrently; it is cleared on
+// return.
+func WriteChunked(ctx context.Context, conn net.Conn, b []byte, options ChunkOptions) (int, error) {
+	n, err := copyChunked(ctx, conn, &chunkSource{b: b}, int64(len(b)), options)
+	return int(n), err
+}
+
+// CopyChunked copies from r to conn in chunks, as WriteChunked. size is the
+// total to report to Progress, or -1 if unknown.
+func CopyChunked(ctx context.Context, conn net.Conn, r io.Reader, size int64, options ChunkOptions) (int64, error) {
+	return copyChunked(ctx, conn, r, size, options)
+}
+
+// chunkSource lets copyChunked take chunks of a slice without copying.
+type chunkSource struct{ b []byte }
+
+func (self *chunkSource) Read(b []byte) (int, error) {
+	if len(self.b) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, self.b)
+	self.b = self.b[n:]
+	return n, nil
+}
+
+func copyChunked(ctx context.Context, conn net.Conn, r io.Reader, size int64, options ChunkOptions) (int64, error) {
+	chunkSize := options.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+
+	var (
+		mutex     sync.Mutex
+		cancelled bool
+	)
+	// deadline is the write deadline of the next chunk.
+	deadline := func() time.Time {
+		var t time.Time
+		if options.ChunkTimeout > 0 {
+			t = time.Now().Add(options.ChunkTimeout)
+		}
+		if d, ok := ctx.Deadline(); ok && (t.IsZero() || d.Before(t)) {
+			t = d
+		}
+		return t
+	}
+	defer conn.SetWriteDeadline(time.Time{})
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			select {
+			case <-ctx.Done():
+				mutex.Lock()
+				cancelled = true
+				conn.SetWriteDeadline(time.Unix(1, 0))
+				mutex.Unlock()
+			case <-done:
+			}
+		}()
+		defer func() {
+			close(done)
+			<-finished
+		}()
+	}
+
+	buf := make([]byte, chunkSize)
+	var written int64
+	for {
+		if err := ctx.Err(); err != nil {
+			return written, err
+		}
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			mutex.Lock()
+			if !cancelled {
+				conn.SetWriteDeadline(deadline())
+			}
+			mutex.Unlock()
+
+			m, err := conn.Write(buf[:n])
+			written += int64(m)
+			if err != nil {
+				if errors.Is(err, os.ErrDeadlineExceeded) && ctx.Err() != nil {
+					return written, ctx.Err()
+				}
+				return written, err
+			}
+			if options.Progress != nil {
+				if err := options.Progress(written, size); err != nil {
+					return written, err
+				}
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestWriteChunked(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go io.Copy(io.Discard, b)
+
+	var progress []int64
+	n, err := WriteChunked(context.Background(), a, make([]byte, 10), ChunkOptions{
+		ChunkSize: 4,
+		Progress: func(written, total int64) error {
+			progress = append(progress, written)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if diff := cmp.Diff(10, n); diff != "" {
+		t.Fatalf("unexpected count (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int64{4, 8, 10}, progress); diff != "" {
+		t.Fatalf("unexpected progress (-want +got):\n%s", diff)
+	}
+}
+
+func TestWriteChunkedCancel(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	// Nothing reads b, so the first chunk blocks until cancelled.
+	go func() {
+		b.Read(make([]byte, 1))
+		cancel()
+	}()
+	_, err := WriteChunked(ctx, a, make([]byte, 10), ChunkOptions{ChunkSize: 4})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation, got %v", err)
+	}
+}
@@ -0,0 +1,152 @@
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Any is VMADDR_CID_ANY, which binds to every local context ID and is
+// never the address of a peer.
+const Any = 0xffffffff
+
+// CIDClass classifies context IDs.
+type CIDClass int
+
+const (
+	CIDHypervisor CIDClass = iota
+	// CIDLocal is the reserved ID, now used for loopback.
+	CIDLocal
+	CIDHost
+	CIDGuest
+	CIDAny
+)
+
+func (self CIDClass) String() string {
+	switch self {
+	case CIDHypervisor:
+		return "hypervisor"
+	case CIDLocal:
+		return "local"
+	case CIDHost:
+		return "host"
+	case CIDGuest:
+		return "guest"
+	default:
+		return "any"
+	}
+}
+
+// ClassifyCID returns the class of cid.
+func ClassifyCID(cid uint32) CIDClass {
+	switch cid {
+	case Hypervisor:
+		return CIDHypervisor
+	case Local:
+		return CIDLocal
+	case Host:
+		return CIDHost
+	case Any:
+		return CIDAny
+	default:
+		return CIDGuest
+	}
+}
+
+// ValidateGuestCID reports why cid cannot be assigned to a guest, if so.
+func ValidateGuestCID(cid uint32) error {
+	if class := ClassifyCID(cid); class != CIDGuest {
+		return fmt.Errorf("vsock: context ID %d is reserved for the %s", cid, class)
+	}
+	return nil
+}
+
+// CIDRange is an inclusive range of context IDs, optionally named, e.g.
+// after the tenant its guests belong to.
+type CIDRange struct {
+	Name     string
+	Min, Max uint32
+}
+
+func (self CIDRange) Contains(cid uint32) bool { return cid >= self.Min && cid <= self.Max }
+
+func (self CIDRange) String() string {
+	s := fmt.Sprintf("%d-%d", self.Min, self.Max)
+	if self.Name != "" {
+		s = self.Name + ":" + s
+	}
+	return s
+}
+
+// GuestCIDs is the range of context IDs guests may have.
+var GuestCIDs = CIDRange{Name: "guests", Min: Host + 1, Max: Any - 1}
+
+// CIDRanges is a set of approved context IDs.
+type CIDRanges []CIDRange
+
+// Contains reports whether cid is in any of the ranges. An empty set
+// contains every context ID.
+func (self CIDRanges) Contains(cid uint32) bool {
+	_, ok := self.Lookup(cid)
+	return ok || len(self) == 0
+}
+
+// Lookup returns the first range containing cid.
+func (self CIDRanges) Lookup(cid uint32) (CIDRange, bool) {
+	for _, r := range self {
+		if r.Contains(cid) {
+			return r, true
+		}
+	}
+	return CIDRange{}, false
+}
+
+// Validate checks the ranges are well formed and do not overlap, so each
+// context ID has one owner.
+func (self CIDRanges) Validate() error {
+	for i, r := range self {
+		if r.Min > r.Max {
+			return fmt.Errorf("vsock: empty context ID range %v", r)
+		}
+		for _, other := range self[:i] {
+			if r.Min <= other.Max && other.Min <= r.Max {
+				return fmt.Errorf("vsock: context ID ranges %v and %v overlap", other, r)
+			}
+		}
+	}
+	return nil
+}
+
+func (self CIDRanges) String() string {
+	s := make([]string, len(self))
+	for i, r := range self {
+		s[i] = r.String()
+	}
+	return strings.Join(s, ", ")
+}
+
+// RestrictContextIDs closes connections from peers outside ranges before the
+// handler sees them.
+func RestrictContextIDs(ranges CIDRanges) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			if addr, ok := conn.RemoteAddr().(*Addr); ok && ranges.Contains(addr.ContextID) {
+				next.ServeVsock(conn)
+				return
+			}
+			conn.Close()
+		})
+	}
+}
+
+// RestrictDial refuses to dial context IDs outside ranges.
+func RestrictDial(ranges CIDRanges) DialMiddleware {
+	return func(next DialFunc) DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			if !ranges.Contains(contextID) {
+				return nil, opError(opDial, fmt.Errorf("vsock: context ID %d is outside the approved ranges %v", contextID, ranges), nil, &Addr{ContextID: contextID, Port: port})
+			}
+			return next(contextID, port)
+		}
+	}
+}
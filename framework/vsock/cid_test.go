@@ -0,0 +1,43 @@
+package vsock
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestClassifyCID(t *testing.T) {
+	got := []CIDClass{ClassifyCID(0), ClassifyCID(1), ClassifyCID(2), ClassifyCID(3), ClassifyCID(Any)}
+	want := []CIDClass{CIDHypervisor, CIDLocal, CIDHost, CIDGuest, CIDAny}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected classes (-want +got):\n%s", diff)
+	}
+	if err := ValidateGuestCID(Host); err == nil {
+		t.Fatal("expected the host context ID to be invalid for a guest")
+	}
+}
+
+func TestCIDRanges(t *testing.T) {
+	ranges := CIDRanges{{Name: "acme", Min: 100, Max: 199}, {Name: "globex", Min: 200, Max: 299}}
+	if err := ranges.Validate(); err != nil {
+		t.Fatalf("unexpected invalid ranges: %v", err)
+	}
+	if r, ok := ranges.Lookup(250); !ok || r.Name != "globex" {
+		t.Fatalf("unexpected range for 250: %v, %v", r, ok)
+	}
+	if ranges.Contains(300) {
+		t.Fatal("expected 300 to be outside the ranges")
+	}
+	if err := append(ranges, CIDRange{Min: 150, Max: 160}).Validate(); err == nil {
+		t.Fatal("expected overlapping ranges to be invalid")
+	}
+
+	dial := RestrictDial(ranges)(func(contextID, port uint32) (net.Conn, error) { return nil, nil })
+	if _, err := dial(300, 1024); err == nil {
+		t.Fatal("expected dialing outside the ranges to fail")
+	}
+	if _, err := dial(150, 1024); err != nil {
+		t.Fatalf("failed to dial inside the ranges: %v", err)
+	}
+}
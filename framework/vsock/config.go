@@ -0,0 +1,74 @@
+package vsock
+
+import (
+	"syscall"
+	"time"
+)
+
+// ListenConfig holds options for listening on a port.
+type ListenConfig struct {
+	// Deadline, when non-zero, is set on each accepted connection relative
+	// to the time it was accepted, e.g. to bound how long a peer may take to
+	// complete a handshake. Handlers that outlive it must extend or clear the
+	// deadline themselves.
+	Deadline time.Duration
+	// ReadDeadline and WriteDeadline do the same for reads or writes alone,
+	// and are ignored when Deadline is set.
+	ReadDeadline  time.Duration
+	WriteDeadline time.Duration
+	// ContextIDs, if set, restricts peers to these ranges. Connections from
+	// other peers are closed as they are accepted.
+	ContextIDs CIDRanges
+	// DenyContextIDs, if set, refuses peers in these ranges in the same
+	// way, whether or not ContextIDs lists them.
+	DenyContextIDs CIDRanges
+	// MaxConns limits the accepted connections open at once. While the
+	// limit is reached, Accept waits for one to be closed, leaving new
+	// connections in the listen backlog. Zero means no limit.
+	MaxConns int
+	// Type is the type of the listening socket, Stream by default.
+	// Datagram sockets have no listeners; use ListenDatagram.
+	Type SocketType
+	// Control, if set, is called with the listening socket before it
+	// binds, to set socket options.
+	Control func(network, address string, c syscall.RawConn) error
+	// SocketOptions are set on the listening socket before Control is
+	// called. Connections accepted inherit its vsock buffer sizes; where
+	// they do not inherit ReadBuffer and WriteBuffer, as on Linux, set
+	// those with Conn.SetReadBuffer and SetWriteBuffer.
+	SocketOptions
+	// Tracer, if set, is told of the accepts and of the connections
+	// accepted.
+	Tracer Tracer
+}
+
+// Listen listens on port of the local context ID with the options in the
+// configuration.
+func (self *ListenConfig) Listen(port uint32) (*VsockListener, error) {
+	if err := self.validate(); err != nil {
+		return nil, err
+	}
+	l, err := listenPort(port, self)
+	if err != nil {
+		return nil, err
+	}
+	l.listener.config = *self
+	return l, nil
+}
+
+// apply sets the configured deadlines on a newly accepted connection.
+func (self *ListenConfig) apply(c *Conn) error {
+	now := time.Now()
+	if self.Deadline > 0 {
+		return c.SetDeadline(now.Add(self.Deadline))
+	}
+	if self.ReadDeadline > 0 {
+		if err := c.SetReadDeadline(now.Add(self.ReadDeadline)); err != nil {
+			return err
+		}
+	}
+	if self.WriteDeadline > 0 {
+		return c.SetWriteDeadline(now.Add(self.WriteDeadline))
+	}
+	return nil
+}
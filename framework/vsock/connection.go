@@ -1,6 +1,13 @@
+//go:build linux
+
 package vsock
 
 import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+
 	"golang.org/x/sys/unix"
 )
 
@@ -13,19 +20,26 @@ func newConn(cfd connFD, local, remote *Addr) (*Conn, error) {
 		fd:     cfd,
 		local:  local,
 		remote: remote,
+		opened: time.Now(),
 	}, nil
 }
 
-func dial(cid, port uint32) (*Conn, error) {
-	cfd, err := newConnFD()
+func dial(ctx context.Context, d *Dialer, cid, port uint32) (*Conn, error) {
+	if d.Type == Datagram {
+		return nil, errDatagram
+	}
+	if b := currentBackend(); b != nil {
+		return dialBackend(ctx, b, d, cid, port)
+	}
+	cfd, err := newConnFD(d.Type)
 	if err != nil {
 		return nil, err
 	}
 
-	return dialLinux(cfd, cid, port)
+	return dialLinux(ctx, d, cfd, cid, port)
 }
 
-func dialLinux(cfd connFD, cid, port uint32) (c *Conn, err error) {
+func dialLinux(ctx context.Context, d *Dialer, cfd connFD, cid, port uint32) (c *Conn, err error) {
 	defer func() {
 		if err != nil {
 			_ = cfd.EarlyClose()
@@ -37,9 +51,31 @@ func dialLinux(cfd connFD, cid, port uint32) (c *Conn, err error) {
 		Port: port,
 	}
 
-	if err := cfd.Connect(rsa); err != nil {
+	remote := &Addr{
+		ContextID: cid,
+		Port:      port,
+	}
+
+	// The socket is made non-blocking before connecting, so the connect
+	// can be abandoned.
+	if err = cfd.SetNonblocking(remote.fileName()); err != nil {
 		return nil, err
 	}
+	if d.LocalAddr != nil {
+		if err = cfd.Bind(&unix.SockaddrVM{CID: d.LocalAddr.ContextID, Port: d.LocalAddr.Port}); err != nil {
+			return nil, err
+		}
+	}
+	rc, err := cfd.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.prepare(rc, remote.String()); err != nil {
+		return nil, err
+	}
+	if err = connect(ctx, cfd, rsa); err != nil {
+		return nil, diagnose(err)
+	}
 
 	lsa, err := cfd.Getsockname()
 	if err != nil {
@@ -53,10 +89,76 @@ func dialLinux(cfd connFD, cid, port uint32) (c *Conn, err error) {
 		Port:      lsavm.Port,
 	}
 
-	remote := &Addr{
-		ContextID: cid,
-		Port:      port,
+	return newConn(cfd, local, remote)
+}
+
+// connect connects the non-blocking cfd to sa, waiting for the connection
+// to complete until ctx is done.
+func connect(ctx context.Context, cfd connFD, sa unix.Sockaddr) error {
+	switch err := cfd.Connect(sa); err {
+	case nil:
+		return nil
+	case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+	default:
+		return err
 	}
 
-	return newConn(cfd, local, remote)
+	if deadline, ok := ctx.Deadline(); ok {
+		cfd.SetDeadline(deadline, writeDeadline)
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			defer close(finished)
+			select {
+			case <-ctx.Done():
+				// A deadline in the past wakes up the wait at once.
+				cfd.SetDeadline(time.Unix(1, 0), writeDeadline)
+			case <-done:
+			}
+		}()
+		defer func() {
+			// The deadline is only cleared once the watcher cannot set
+			// it any more.
+			close(done)
+			<-finished
+			cfd.SetDeadline(time.Time{}, writeDeadline)
+		}()
+	}
+
+	rc, err := cfd.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	doErr := rc.Write(func(fd uintptr) bool {
+		n, err := unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_ERROR)
+		if err != nil {
+			serr = err
+			return true
+		}
+		switch errno := syscall.Errno(n); errno {
+		case unix.EINPROGRESS, unix.EALREADY, unix.EINTR:
+			return false
+		case 0:
+			// Writable without an error may be spurious; connected is
+			// when the peer is known.
+			_, err := unix.Getpeername(int(fd))
+			return err == nil
+		default:
+			serr = errno
+			return true
+		}
+	})
+	if doErr != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if os.IsTimeout(doErr) {
+			return context.DeadlineExceeded
+		}
+		return doErr
+	}
+	return serr
 }
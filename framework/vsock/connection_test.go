@@ -0,0 +1,70 @@
+//go:build linux
+
+package vsock
+
+import (
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// connectingFD is a socket whose connect completes while ctx is cancelled,
+// recording the write deadlines set on it.
+type connectingFD struct {
+	connFD
+	cancel func()
+
+	mutex     sync.Mutex
+	deadlines []time.Time
+}
+
+func (self *connectingFD) Connect(unix.Sockaddr) error { return unix.EINPROGRESS }
+
+func (self *connectingFD) SetDeadline(t time.Time, typ deadlineType) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	self.deadlines = append(self.deadlines, t)
+	return nil
+}
+
+func (self *connectingFD) SyscallConn() (syscall.RawConn, error) {
+	return connectedRawConn{cancel: self.cancel}, nil
+}
+
+func (self *connectingFD) deadline() time.Time {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if len(self.deadlines) == 0 {
+		return time.Time{}
+	}
+	return self.deadlines[len(self.deadlines)-1]
+}
+
+type connectedRawConn struct {
+	syscall.RawConn
+	cancel func()
+}
+
+func (self connectedRawConn) Write(func(fd uintptr) bool) error {
+	self.cancel()
+	return nil
+}
+
+func TestConnectClearsDeadline(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		cfd := &connectingFD{cancel: cancel}
+		if err := connect(ctx, cfd, &unix.SockaddrVM{CID: Host, Port: 1024}); err != nil {
+			t.Fatalf("failed to connect: %v", err)
+		}
+		// Nothing may set a deadline once connect returned.
+		time.Sleep(time.Millisecond)
+		if deadline := cfd.deadline(); !deadline.IsZero() {
+			t.Fatalf("connection left with the write deadline %v", deadline)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package vsock
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// BindContext makes ctx bound the I/O of conn: the deadline of ctx becomes
+// the deadline of conn, and cancelling ctx interrupts any blocked read or
+// write. The returned function detaches ctx, clearing the deadline it set;
+// it must be called once the operation is over.
+func BindContext(ctx context.Context, conn net.Conn) (stop func()) {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if ctx.Done() == nil {
+		return func() { conn.SetDeadline(time.Time{}) }
+	}
+
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			// A deadline in the past wakes up blocked calls at once.
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-finished
+			conn.SetDeadline(time.Time{})
+		})
+	}
+}
+
+// ContextConn binds ctx to conn as BindContext does, until the returned
+// connection is closed.
+func ContextConn(ctx context.Context, conn net.Conn) net.Conn {
+	return &contextConn{Conn: conn, stop: BindContext(ctx, conn)}
+}
+
+type contextConn struct {
+	net.Conn
+	stop func()
+}
+
+func (self *contextConn) Close() error {
+	self.stop()
+	return self.Conn.Close()
+}
+
+func (self *contextConn) Metadata() Metadata { return MetadataOf(self.Conn) }
+
+func (self *contextConn) CloseWrite() error {
+	return (&taggedConn{Conn: self.Conn}).CloseWrite()
+}
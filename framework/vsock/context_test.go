@@ -0,0 +1,25 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBindContextInterruptsRead(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := BindContext(ctx, a)
+	defer stop()
+
+	time.AfterFunc(10*time.Millisecond, cancel)
+	if _, err := a.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected read to be interrupted, got %v", err)
+	}
+}
@@ -0,0 +1,66 @@
+//go:build linux
+
+package vsock
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// diagnose turns an error from creating a socket, opening /dev/vsock or
+// connecting into an UnavailableError when it shows vsock is unavailable,
+// and returns other errors unchanged.
+func diagnose(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := IsUnavailable(err); ok {
+		return err
+	}
+
+	switch {
+	case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+		return &UnavailableError{
+			Cause: CausePermission,
+			Hint:  "run as root, grant access to /dev/vsock, or allow vsock sockets in the seccomp, SELinux or AppArmor policy",
+			Err:   err,
+		}
+	case errors.Is(err, unix.EAFNOSUPPORT), errors.Is(err, os.ErrNotExist):
+		if !moduleLoaded("vsock") {
+			return &UnavailableError{
+				Cause: CauseModuleNotLoaded,
+				Hint:  "load the vsock module and its transport: modprobe vhost_vsock on a host, modprobe vmw_vsock_virtio_transport in a guest",
+				Err:   err,
+			}
+		}
+		return &UnavailableError{
+			Cause: CauseUnknown,
+			Hint:  "the vsock module is loaded but its device is missing; in a container, pass it through with --device /dev/vsock",
+			Err:   err,
+		}
+	case errors.Is(err, unix.ENODEV):
+		return noTransport(err)
+	}
+	return err
+}
+
+// noTransport tells a guest without a vsock device from a kernel without
+// any transport.
+func noTransport(err error) error {
+	for _, tm := range transportModules {
+		if moduleLoaded(tm.module) {
+			return &UnavailableError{
+				Cause: CauseDeviceNotAttached,
+				Hint:  "attach a vsock device to the virtual machine, e.g. -device vhost-vsock-pci,guest-cid=3 with QEMU",
+				Err:   err,
+			}
+		}
+	}
+	return &UnavailableError{
+		Cause: CauseNoTransport,
+		Hint:  "load a transport: vhost_vsock on a host, vmw_vsock_virtio_transport in a guest, or vsock_loopback for local use",
+		Err:   err,
+	}
+}
@@ -0,0 +1,109 @@
+package vsock
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+)
+
+// A Dialer holds options for connecting to a port, as net.Dialer does for
+// other networks. The zero value dials with no options.
+type Dialer struct {
+	// Timeout bounds how long a connect may take, on top of any deadline
+	// of the context. Connecting to a guest that is still booting
+	// otherwise waits until the kernel gives up.
+	Timeout time.Duration
+	// LocalAddr, if set, is the address the connection is bound to before
+	// connecting, e.g. to use a fixed local port.
+	LocalAddr *Addr
+	// Control, if set, is called with the socket before it connects, to
+	// set socket options.
+	Control func(network, address string, c syscall.RawConn) error
+	// Type is the type of the socket, Stream by default. Datagram sockets
+	// are not dialed this way; use DialDatagram.
+	Type SocketType
+	// ConnectTimeout is how long the kernel waits for the peer to accept,
+	// SO_VM_SOCKETS_CONNECT_TIMEOUT; 2 seconds by default on Linux. Unlike
+	// Timeout it can be raised, for peers slow to answer.
+	ConnectTimeout time.Duration
+	// SocketOptions are set on the socket before Control is called.
+	SocketOptions
+	// Tracer, if set, is told of the dials and of the connections dialed.
+	Tracer Tracer
+}
+
+// A DialOption sets an option of a Dialer.
+type DialOption func(*Dialer)
+
+// WithTimeout sets the Timeout of a dialer.
+func WithTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.Timeout = timeout }
+}
+
+// WithLocalAddr sets the LocalAddr of a dialer.
+func WithLocalAddr(addr *Addr) DialOption {
+	return func(d *Dialer) { d.LocalAddr = addr }
+}
+
+// WithControl sets the Control hook of a dialer.
+func WithControl(control func(network, address string, c syscall.RawConn) error) DialOption {
+	return func(d *Dialer) { d.Control = control }
+}
+
+// WithTracer sets the Tracer of a dialer.
+func WithTracer(tracer Tracer) DialOption {
+	return func(d *Dialer) { d.Tracer = tracer }
+}
+
+// WithType sets the socket Type of a dialer.
+func WithType(typ SocketType) DialOption {
+	return func(d *Dialer) { d.Type = typ }
+}
+
+// DialContext dials port on contextID with options. Cancelling ctx, or its
+// deadline passing, abandons a connect in progress; once connected, ctx has
+// no effect on the connection.
+func DialContext(ctx context.Context, contextID, port uint32, options ...DialOption) (*Conn, error) {
+	var d Dialer
+	for _, option := range options {
+		option(&d)
+	}
+	return d.DialContext(ctx, contextID, port)
+}
+
+// Dial dials port on contextID.
+func (self *Dialer) Dial(contextID, port uint32) (*Conn, error) {
+	return self.DialContext(context.Background(), contextID, port)
+}
+
+// DialContext dials port on contextID, abandoning the connect if ctx is done
+// first.
+func (self *Dialer) DialContext(ctx context.Context, contextID, port uint32) (*Conn, error) {
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+	remote := &Addr{ContextID: contextID, Port: port}
+	if self.Tracer != nil {
+		self.Tracer.DialStart(remote)
+	}
+	c, err := dial(ctx, self, contextID, port)
+	if err != nil {
+		var local net.Addr
+		if self.LocalAddr != nil {
+			local = self.LocalAddr
+		}
+		err = opError(opDial, err, local, remote)
+		if self.Tracer != nil {
+			self.Tracer.DialDone(remote, nil, err)
+		}
+		return nil, err
+	}
+	if self.Tracer != nil {
+		c.counters.tracer = self.Tracer
+		self.Tracer.DialDone(remote, c, nil)
+	}
+	return c, nil
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialContext(t *testing.T) {
+	if _, err := socket(Stream); err != nil {
+		t.Skipf("vsock unavailable: %v", err)
+	}
+
+	// Without a loopback transport, connects to Local hang until the
+	// kernel gives up; with one, the unused port refuses at once.
+	var controlled bool
+	start := time.Now()
+	_, err := DialContext(context.Background(), Local, 1023, WithTimeout(50*time.Millisecond), WithControl(func(network, address string, c syscall.RawConn) error {
+		controlled = network == "vsock"
+		return nil
+	}))
+	if err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the timeout to abandon the connect, took %v: %v", elapsed, err)
+	} else if elapsed > 50*time.Millisecond && !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected a timed out dial, got %v", err)
+	}
+	if !controlled {
+		t.Error("expected the control hook to be called")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start = time.Now()
+	if _, err := DialContext(ctx, Local, 1023); err == nil {
+		t.Fatal("expected the dial to fail")
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected cancelling to abandon the connect, took %v: %v", elapsed, err)
+	} else if elapsed > 20*time.Millisecond && !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a cancelled dial, got %v", err)
+	}
+
+	failing := &Dialer{Control: func(string, string, syscall.RawConn) error { return errors.New("refused by control") }}
+	if _, err := failing.Dial(Local, 1023); err == nil {
+		t.Fatal("expected the control hook to fail the dial")
+	}
+}
+
+func TestDiagnose(t *testing.T) {
+	err := diagnose(&os.SyscallError{Syscall: "socket", Err: syscall.EACCES})
+	uerr, ok := IsUnavailable(fmt.Errorf("vsock: dial: %w", err))
+	if !ok {
+		t.Fatalf("expected EACCES to make vsock unavailable, got %v", err)
+	}
+	if uerr.Cause != CausePermission || !errors.Is(err, syscall.EACCES) {
+		t.Fatalf("expected a permission error wrapping EACCES, got %v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "vsock unavailable (permission denied): socket: permission denied; run as root") {
+		t.Fatalf("unexpected message: %v", err)
+	}
+	if again := diagnose(err); again != err {
+		t.Fatalf("expected a diagnosed error to be kept, got %v", again)
+	}
+
+	// Which cause a missing device has depends on the modules loaded.
+	uerr, ok = IsUnavailable(diagnose(syscall.ENODEV))
+	if !ok {
+		t.Fatal("expected ENODEV to make vsock unavailable")
+	}
+	if uerr.Cause != CauseDeviceNotAttached && uerr.Cause != CauseNoTransport {
+		t.Fatalf("expected a missing device or transport, got %v", uerr.Cause)
+	}
+
+	for _, err := range []error{nil, syscall.ECONNREFUSED, errors.New("other")} {
+		if got := diagnose(err); got != err {
+			t.Errorf("expected %v to be returned unchanged, got %v", err, got)
+		}
+		if _, ok := IsUnavailable(err); ok {
+			t.Errorf("expected %v not to make vsock unavailable", err)
+		}
+	}
+}
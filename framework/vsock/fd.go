@@ -1,3 +1,5 @@
+//go:build linux
+
 package vsock
 
 import (
@@ -11,13 +13,24 @@ import (
 )
 
 func contextID() (uint32, error) {
+	if b := currentBackend(); b != nil {
+		return b.ContextID(), nil
+	}
 	f, err := os.Open(devVsock)
 	if err != nil {
-		return 0, err
+		return 0, diagnose(err)
 	}
 	defer f.Close()
 
-	return unix.IoctlGetUint32(int(f.Fd()), unix.IOCTL_VM_SOCKETS_GET_LOCAL_CID)
+	cid, err := unix.IoctlGetUint32(int(f.Fd()), unix.IOCTL_VM_SOCKETS_GET_LOCAL_CID)
+	if err != nil {
+		return 0, err
+	}
+	if cid == unix.VMADDR_CID_ANY {
+		// No transport has assigned this machine a context ID.
+		return 0, noTransport(unix.ENODEV)
+	}
+	return cid, nil
 }
 
 type listenFD interface {
@@ -29,6 +42,8 @@ type listenFD interface {
 	Getsockname() (unix.Sockaddr, error)
 	SetNonblocking(name string) error
 	SetDeadline(t time.Time) error
+	SyscallConn() (syscall.RawConn, error)
+	File() (*os.File, error)
 }
 
 var _ listenFD = &sysListenFD{}
@@ -38,8 +53,8 @@ type sysListenFD struct {
 	f  *os.File // Used in non-blocking mode.
 }
 
-func newListenFD() (*sysListenFD, error) {
-	fd, err := socket()
+func newListenFD(typ SocketType) (*sysListenFD, error) {
+	fd, err := socket(typ)
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +73,14 @@ func (self *sysListenFD) SetNonblocking(name string) error {
 	return self.setNonblocking(name)
 }
 
-func (self *sysListenFD) EarlyClose() error { return unix.Close(self.fd) }
+// EarlyClose closes a descriptor not yet handed to a listener, through its
+// file if it has one, so the file does not close it again.
+func (self *sysListenFD) EarlyClose() error {
+	if self.f != nil {
+		return self.f.Close()
+	}
+	return unix.Close(self.fd)
+}
 func (self *sysListenFD) Accept4(flags int) (connFD, unix.Sockaddr, error) {
 	newFD, socketAddress, err := self.accept4(flags)
 	if err != nil {
@@ -71,23 +93,28 @@ func (self *sysListenFD) Accept4(flags int) (connFD, unix.Sockaddr, error) {
 
 func (self *sysListenFD) Close() error                  { return self.f.Close() }
 func (self *sysListenFD) SetDeadline(t time.Time) error { return self.setDeadline(t) }
+func (self *sysListenFD) File() (*os.File, error)       { return dupFile(self.f) }
+
+func (self *sysListenFD) SyscallConn() (syscall.RawConn, error) { return self.f.SyscallConn() }
 
 // A connectionFD is a type that wraps a file descriptor used to implement net.Conn.
 type connFD interface {
 	io.ReadWriteCloser
 	EarlyClose() error
+	Bind(socketAddress unix.Sockaddr) error
 	Connect(socketAddress unix.Sockaddr) error
 	Getsockname() (unix.Sockaddr, error)
 	Shutdown(how int) error
 	SetNonblocking(name string) error
 	SetDeadline(t time.Time, typ deadlineType) error
 	SyscallConn() (syscall.RawConn, error)
+	File() (*os.File, error)
 }
 
 var _ connFD = &sysConnFD{}
 
-func newConnFD() (*sysConnFD, error) {
-	if fd, err := socket(); err != nil {
+func newConnFD(typ SocketType) (*sysConnFD, error) {
+	if fd, err := socket(typ); err != nil {
 		return nil, err
 	} else {
 		return &sysConnFD{
@@ -102,15 +129,26 @@ type sysConnFD struct {
 	f  *os.File
 }
 
+func (self *sysConnFD) Bind(socketAddress unix.Sockaddr) error {
+	return unix.Bind(self.fd, socketAddress)
+}
 func (self *sysConnFD) Connect(socketAddress unix.Sockaddr) error {
 	return unix.Connect(self.fd, socketAddress)
 }
 func (self *sysConnFD) Getsockname() (unix.Sockaddr, error) { return unix.Getsockname(self.fd) }
-func (self *sysConnFD) EarlyClose() error                   { return unix.Close(self.fd) }
-func (self *sysConnFD) SetNonblocking(name string) error    { return self.setNonblocking(name) }
-func (self *sysConnFD) Close() error                        { return self.f.Close() }
-func (self *sysConnFD) Read(b []byte) (int, error)          { return self.f.Read(b) }
-func (self *sysConnFD) Write(b []byte) (int, error)         { return self.f.Write(b) }
+
+// EarlyClose closes a descriptor not yet handed to a Conn, through its file
+// if it has one, so the file does not close it again.
+func (self *sysConnFD) EarlyClose() error {
+	if self.f != nil {
+		return self.f.Close()
+	}
+	return unix.Close(self.fd)
+}
+func (self *sysConnFD) SetNonblocking(name string) error { return self.setNonblocking(name) }
+func (self *sysConnFD) Close() error                     { return self.f.Close() }
+func (self *sysConnFD) Read(b []byte) (int, error)       { return self.f.Read(b) }
+func (self *sysConnFD) Write(b []byte) (int, error)      { return self.f.Write(b) }
 
 func (self *sysConnFD) Shutdown(how int) error {
 	switch how {
@@ -126,9 +164,26 @@ func (self *sysConnFD) SetDeadline(t time.Time, typ deadlineType) error {
 }
 
 func (self *sysConnFD) SyscallConn() (syscall.RawConn, error) { return self.syscallConn() }
+func (self *sysConnFD) File() (*os.File, error)               { return dupFile(self.f) }
+
+func (self SocketType) sysType() int {
+	switch self {
+	case Seqpacket:
+		return unix.SOCK_SEQPACKET
+	case Datagram:
+		return unix.SOCK_DGRAM
+	default:
+		return unix.SOCK_STREAM
+	}
+}
+
+func socket(typ SocketType) (int, error) {
+	fd, err := rawSocket(typ.sysType())
+	return fd, diagnose(err)
+}
 
-func socket() (int, error) {
-	fd, err := unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, 0)
+func rawSocket(typ int) (int, error) {
+	fd, err := unix.Socket(unix.AF_VSOCK, typ|unix.SOCK_CLOEXEC, 0)
 	switch err {
 	case nil:
 		return fd, nil
@@ -136,7 +191,7 @@ func socket() (int, error) {
 		syscall.ForkLock.RLock()
 		defer syscall.ForkLock.RUnlock()
 
-		fd, err = unix.Socket(unix.AF_VSOCK, unix.SOCK_STREAM, 0)
+		fd, err = unix.Socket(unix.AF_VSOCK, typ, 0)
 		if err != nil {
 			return 0, err
 		}
@@ -148,6 +203,45 @@ func socket() (int, error) {
 	}
 }
 
+func setLinger(fd, sec int) error {
+	var l unix.Linger
+	if sec >= 0 {
+		l.Onoff = 1
+		l.Linger = int32(sec)
+	}
+	return unix.SetsockoptLinger(fd, unix.SOL_SOCKET, unix.SO_LINGER, &l)
+}
+
+const (
+	soRcvbuf = unix.SO_RCVBUF
+	soSndbuf = unix.SO_SNDBUF
+)
+
+func getsockoptInt(fd, opt int) (int, error) {
+	return unix.GetsockoptInt(fd, unix.SOL_SOCKET, opt)
+}
+
+func setsockoptInt(fd, opt, value int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, value)
+}
+
+func setBufferSizes(fd int, size, max uint64) error {
+	if max > 0 {
+		if err := unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, max); err != nil {
+			return err
+		}
+	}
+	if size > 0 {
+		return unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE, size)
+	}
+	return nil
+}
+
+func setConnectTimeout(fd int, timeout time.Duration) error {
+	tv := unix.NsecToTimeval(timeout.Nanoseconds())
+	return unix.SetsockoptTimeval(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_CONNECT_TIMEOUT, &tv)
+}
+
 func isErrno(err error, errno int) bool {
 	switch errno {
 	case ebadf:
@@ -155,7 +249,7 @@ func isErrno(err error, errno int) bool {
 	case enotconn:
 		return err == unix.ENOTCONN
 	default:
-		fmt.Errorf("vsock: isErrno called with unhandled error number parameter: %d", errno)
+		panicf("vsock: isErrno called with unhandled error number parameter: %d", errno)
 		return false
 	}
 }
@@ -172,7 +266,7 @@ func (self *sysListenFD) accept4(flags int) (newFD int, socketAddress unix.Socka
 		return 0, nil, err
 	}
 
-	rawConn.Read(func(fd uintptr) bool {
+	doErr := rawConn.Read(func(fd uintptr) bool {
 		newFD, socketAddress, err = unix.Accept4(int(fd), flags)
 		switch err {
 		case unix.EAGAIN, unix.ECONNABORTED:
@@ -181,8 +275,12 @@ func (self *sysListenFD) accept4(flags int) (newFD int, socketAddress unix.Socka
 			return true
 		}
 	})
+	if doErr != nil {
+		// The listener was closed or its deadline passed.
+		return 0, nil, doErr
+	}
 
-	return newFD, socketAddress, nil
+	return newFD, socketAddress, err
 }
 
 func (self *sysListenFD) setDeadline(t time.Time) error { return self.f.SetDeadline(t) }
@@ -216,6 +314,10 @@ func (self *sysConnFD) shutdown(how int) error {
 func (self *sysConnFD) syscallConn() (syscall.RawConn, error) { return self.f.SyscallConn() }
 
 func (self *sysConnFD) setNonblocking(name string) error {
+	if self.f != nil {
+		// Dialed connections are made non-blocking before connecting.
+		return nil
+	}
 	if err := unix.SetNonblock(self.fd, true); err != nil {
 		return err
 	}
@@ -236,3 +338,25 @@ func (self *sysConnFD) setDeadline(t time.Time, typ deadlineType) error {
 	}
 	return fmt.Errorf("vsock: sysConnFD.SetDeadline method invoked with invalid deadline type constant: %d", typ)
 }
+
+// dupFile duplicates the descriptor behind f, so the copy stays valid after
+// f is closed and can be handed to another process.
+func dupFile(f *os.File) (*os.File, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var newFD int
+	doErr := rc.Control(func(fd uintptr) {
+		newFD, err = unix.FcntlInt(fd, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if doErr != nil {
+		return nil, doErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return os.NewFile(uintptr(newFD), f.Name()), nil
+}
@@ -0,0 +1,86 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// A ConnHandler serves a connection until it is done or ctx is cancelled,
+// returning why it stopped early, if it did.
+type ConnHandler func(ctx context.Context, conn net.Conn) error
+
+// ServeGroup accepts connections on l until ctx is done, serving each with
+// handle in its own goroutine of an errgroup. At most limit connections are
+// served at once, when limit is positive; while at the limit, accepting
+// pauses. A panicking handler is recovered and reported as an error
+// without affecting the others.
+//
+// On return, l is closed and every handler has returned. The error joins
+// the errors of all handlers and of the final accept, if it failed for a
+// reason other than ctx being done.
+func ServeGroup(ctx context.Context, l net.Listener, limit int, handle ConnHandler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	var (
+		group errgroup.Group
+		mutex sync.Mutex
+		errs  []error
+	)
+	if limit > 0 {
+		group.SetLimit(limit)
+	}
+	report := func(err error) {
+		mutex.Lock()
+		errs = append(errs, err)
+		mutex.Unlock()
+	}
+
+	var attempt int
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				attempt++
+				time.Sleep(defaultBackoff(attempt))
+				continue
+			}
+			report(err)
+			break
+		}
+		attempt = 0
+
+		group.Go(func() error {
+			defer conn.Close()
+			defer func() {
+				if v := recover(); v != nil {
+					buf := make([]byte, 64<<10)
+					buf = buf[:runtime.Stack(buf, false)]
+					report(fmt.Errorf("vsock: panic serving %v: %v\n%s", conn.RemoteAddr(), v, buf))
+				}
+			}()
+			if err := handle(ctx, conn); err != nil && !errors.Is(err, context.Canceled) {
+				report(fmt.Errorf("vsock: serving %v: %w", conn.RemoteAddr(), err))
+			}
+			return nil
+		})
+	}
+
+	cancel()
+	group.Wait()
+	return errors.Join(errs...)
+}
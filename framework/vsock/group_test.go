@@ -0,0 +1,51 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestServeGroupRecoversPanics(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan struct{}, 2)
+	var calls int32
+	done := make(chan error)
+	go func() {
+		done <- ServeGroup(ctx, l, 1, func(ctx context.Context, conn net.Conn) error {
+			defer func() { served <- struct{}{} }()
+			if atomic.AddInt32(&calls, 1) == 1 {
+				panic("boom")
+			}
+			return errors.New("failed")
+		})
+	}()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer c.Close()
+		select {
+		case <-served:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for handler")
+		}
+	}
+
+	cancel()
+	err = <-done
+	if err == nil || !strings.Contains(err.Error(), "boom") || !strings.Contains(err.Error(), "failed") {
+		t.Fatalf("expected panic and handler errors to be reported, got %v", err)
+	}
+}
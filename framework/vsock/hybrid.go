@@ -0,0 +1,163 @@
+//go:build linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Hybrid is the host side of a hybrid vsock device, as Firecracker and
+// cloud-hypervisor provide in place of vhost-vsock: the Unix socket at
+// Path reaches the ports of the guest behind a "CONNECT <port>" handshake,
+// and connections the guest makes to port P of the host arrive at the Unix
+// socket Path_P, which the host listens on.
+//
+// Connections are *Conns as over AF_VSOCK, though the device does not tell
+// the ports of the guest end.
+type Hybrid struct {
+	// Path is the Unix socket of the device, its uds_path.
+	Path string
+	// ContextID is the context ID of the guest, given to the addresses of
+	// its connections. Defaults to Any, as the device does not tell.
+	ContextID uint32
+}
+
+// DialHybrid dials port of the guest behind the hybrid vsock device at path.
+func DialHybrid(path string, port uint32) (*Conn, error) {
+	return Hybrid{Path: path}.Dial(port)
+}
+
+// ListenHybrid listens for the connections the guest behind the hybrid
+// vsock device at path makes to port of the host.
+func ListenHybrid(path string, port uint32) (*VsockListener, error) {
+	return Hybrid{Path: path}.Listen(port)
+}
+
+func (self Hybrid) guest() uint32 {
+	if self.ContextID == 0 {
+		return Any
+	}
+	return self.ContextID
+}
+
+// Dial dials port of the guest.
+func (self Hybrid) Dial(port uint32) (*Conn, error) {
+	return self.DialContext(context.Background(), port)
+}
+
+// DialContext dials port of the guest, abandoning the handshake if ctx is
+// done first. A guest not listening on port shows as syscall.ECONNREFUSED.
+func (self Hybrid) DialContext(ctx context.Context, port uint32) (*Conn, error) {
+	remote := &Addr{ContextID: self.guest(), Port: port}
+	c, err := self.dial(ctx, port, remote)
+	if err != nil {
+		return nil, opError(opDial, err, nil, remote)
+	}
+	return c, nil
+}
+
+func (self Hybrid) dial(ctx context.Context, port uint32, remote *Addr) (*Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", self.Path)
+	if err != nil {
+		return nil, err
+	}
+	stop := BindContext(ctx, conn)
+	hostPort, err := handshake(conn, port)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	local := &Addr{ContextID: Host, Port: hostPort}
+	return newConn(&netConnFD{c: conn, local: local}, local, remote)
+}
+
+// handshake asks the device to connect conn to port, and returns the port
+// the device gave the host end.
+func handshake(conn net.Conn, port uint32) (uint32, error) {
+	if _, err := fmt.Fprintf(conn, "CONNECT %d\n", port); err != nil {
+		return 0, err
+	}
+	// Read the reply a byte at a time so nothing past it is consumed.
+	var (
+		line []byte
+		b    [1]byte
+	)
+	for len(line) < 64 {
+		if _, err := conn.Read(b[:]); err != nil {
+			if err == io.EOF {
+				// The device hangs up when nothing listens on port.
+				return 0, syscall.ECONNREFUSED
+			}
+			return 0, err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	reply := string(line)
+	if !strings.HasPrefix(reply, "OK ") {
+		return 0, fmt.Errorf("vsock: hybrid handshake refused: %q", reply)
+	}
+	hostPort, err := strconv.ParseUint(strings.TrimPrefix(reply, "OK "), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("vsock: invalid hybrid handshake reply: %q", reply)
+	}
+	return uint32(hostPort), nil
+}
+
+// Listen listens on port of the host for the connections of the guest,
+// replacing a stale socket left at Path_port.
+func (self Hybrid) Listen(port uint32) (*VsockListener, error) {
+	addr := &Addr{ContextID: Host, Port: port}
+	path := fmt.Sprintf("%s_%d", self.Path, port)
+	if err := removeStale(path); err != nil {
+		return nil, opError(opListen, err, addr, nil)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, opError(opListen, err, addr, nil)
+	}
+	return &VsockListener{
+		listener: &listener{
+			fd: &netListenFD{
+				l:    l,
+				addr: addr,
+				peer: &Addr{ContextID: self.guest(), Port: Any},
+			},
+			addr: addr,
+		},
+	}, nil
+}
+
+// removeStale removes the Unix socket at path if nothing listens on it.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("vsock: %s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return syscall.EADDRINUSE
+	}
+	return os.Remove(path)
+}
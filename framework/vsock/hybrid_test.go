@@ -0,0 +1,109 @@
+//go:build linux
+
+package vsock
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeDevice serves the Unix socket of a hybrid vsock device at path,
+// connecting only to port 52, where it echoes.
+func fakeDevice(t *testing.T, path string) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(io.LimitReader(conn, 12)).ReadString('\n')
+				if err != nil || line != "CONNECT 52\n" {
+					return
+				}
+				io.WriteString(conn, "OK 1073741824\n")
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+}
+
+func TestDialHybrid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	fakeDevice(t, path)
+
+	c, err := Hybrid{Path: path, ContextID: 3}.Dial(52)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	got := []net.Addr{c.LocalAddr(), c.RemoteAddr()}
+	want := []net.Addr{&Addr{ContextID: Host, Port: 1 << 30}, &Addr{ContextID: 3, Port: 52}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+	if _, err := c.Write([]byte("echo")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	c.CloseWrite()
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("echo", string(b)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+
+	if _, err := DialHybrid(path, 53); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected ECONNREFUSED dialing a port nothing listens on, got %v", err)
+	}
+}
+
+func TestListenHybrid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "v.sock")
+	l, err := Hybrid{Path: path, ContextID: 3}.Listen(1234)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// The device connects to the socket of the port the guest dialed.
+	go func() {
+		conn, err := net.Dial("unix", path+"_1234")
+		if err != nil {
+			return
+		}
+		io.WriteString(conn, "hello")
+		conn.Close()
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer c.Close()
+	got := []net.Addr{c.LocalAddr(), c.RemoteAddr()}
+	want := []net.Addr{&Addr{ContextID: Host, Port: 1234}, &Addr{ContextID: 3, Port: Any}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("hello", string(b)); diff != "" {
+		t.Fatalf("unexpected message (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,622 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// On Windows, vsock is carried by Hyper-V sockets (AF_HYPERV). A port is
+// the service ID made from the vsock template, with the port as its first
+// field, which is how the hv_sock transport of Linux guests addresses the
+// host. Guests may only connect to services registered under
+// HKLM\SOFTWARE\Microsoft\Windows NT\CurrentVersion\Virtualization\GuestCommunicationServices.
+//
+// Hyper-V addresses guests by the ID of their virtual machine rather than a
+// context ID; see RegisterVM.
+
+const (
+	afHyperV      = 34
+	hvProtocolRaw = 1
+
+	// hvsocketConnectTimeout is the connect timeout of a Hyper-V socket,
+	// in milliseconds, at level hvProtocolRaw.
+	hvsocketConnectTimeout = 1
+
+	fionbio = 0x8004667e
+	soError = 0x1007
+
+	pollRdNorm = 0x0100
+	pollWrNorm = 0x0010
+
+	// pollSlice bounds each wait for a socket to become ready, so that a
+	// deadline set or a Close made during the wait takes effect.
+	pollSlice = 100 * time.Millisecond
+)
+
+var (
+	modws2_32       = windows.NewLazySystemDLL("ws2_32.dll")
+	procBind        = modws2_32.NewProc("bind")
+	procConnect     = modws2_32.NewProc("connect")
+	procAccept      = modws2_32.NewProc("accept")
+	procIoctlsocket = modws2_32.NewProc("ioctlsocket")
+	procWSAPoll     = modws2_32.NewProc("WSAPoll")
+
+	startupOnce sync.Once
+	startupErr  error
+)
+
+// Partition IDs with a fixed meaning.
+var (
+	hvGUIDWildcard = windows.GUID{}
+	hvGUIDLoopback = mustGUID("{e0e16197-dd56-4a10-9195-5ee7a155a838}")
+	hvGUIDParent   = mustGUID("{a42e7cda-d03f-480c-9cc2-a4de20abb878}")
+	// vsockTemplate is the service ID of vsock port 0.
+	vsockTemplate = mustGUID("{00000000-facb-11e6-bd58-64006a7986d3}")
+)
+
+func mustGUID(s string) windows.GUID {
+	g, err := windows.GUIDFromString(s)
+	if err != nil {
+		panic(err)
+	}
+	return g
+}
+
+var vms struct {
+	sync.Mutex
+	ids map[uint32]windows.GUID
+}
+
+// RegisterVM maps contextID to the ID of a Hyper-V virtual machine, so the
+// guest can be dialed by context ID and its connections are accepted from
+// it. Connections from guests which are not registered have the context ID
+// Any. A guest registering LocalVM takes contextID as its own.
+func RegisterVM(contextID uint32, vmID windows.GUID) {
+	vms.Lock()
+	defer vms.Unlock()
+	if vms.ids == nil {
+		vms.ids = make(map[uint32]windows.GUID)
+	}
+	vms.ids[contextID] = vmID
+}
+
+func vmIDOf(cid uint32) (windows.GUID, error) {
+	switch cid {
+	case Host:
+		return hvGUIDParent, nil
+	case Local:
+		return hvGUIDLoopback, nil
+	case Any:
+		return hvGUIDWildcard, nil
+	}
+	vms.Lock()
+	defer vms.Unlock()
+	if id, ok := vms.ids[cid]; ok {
+		return id, nil
+	}
+	return windows.GUID{}, fmt.Errorf("vsock: no Hyper-V virtual machine registered for context ID %d", cid)
+}
+
+func contextIDOf(vmID windows.GUID) uint32 {
+	switch vmID {
+	case hvGUIDParent:
+		return Host
+	case hvGUIDLoopback:
+		return Local
+	}
+	vms.Lock()
+	defer vms.Unlock()
+	for cid, id := range vms.ids {
+		if id == vmID {
+			return cid
+		}
+	}
+	return Any
+}
+
+// sockaddrHV is SOCKADDR_HV.
+type sockaddrHV struct {
+	Family    uint16
+	Reserved  uint16
+	VMID      windows.GUID
+	ServiceID windows.GUID
+}
+
+func newSockaddrHV(vmID windows.GUID, port uint32) *sockaddrHV {
+	service := vsockTemplate
+	service.Data1 = port
+	return &sockaddrHV{Family: afHyperV, VMID: vmID, ServiceID: service}
+}
+
+// guestParameters is the registry key in which Hyper-V integration services
+// record, inside a guest, the ID of its virtual machine.
+const guestParameters = `SOFTWARE\Microsoft\Virtual Machine\Guest\Parameters`
+
+// LocalVM returns the ID of the Hyper-V virtual machine this guest runs in.
+// It fails on hosts, and in guests without integration services.
+func LocalVM() (windows.GUID, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, guestParameters, registry.QUERY_VALUE)
+	if err != nil {
+		return windows.GUID{}, fmt.Errorf("vsock: not a Hyper-V guest: %v", err)
+	}
+	defer key.Close()
+	id, _, err := key.GetStringValue("VirtualMachineId")
+	if err != nil {
+		return windows.GUID{}, fmt.Errorf("vsock: Hyper-V guest has no virtual machine ID: %v", err)
+	}
+	if !strings.HasPrefix(id, "{") {
+		id = "{" + id + "}"
+	}
+	return windows.GUIDFromString(id)
+}
+
+// contextID returns Host on hosts. Hyper-V addresses guests by virtual
+// machine ID alone, so a guest has the context ID registered for its own
+// with RegisterVM, or else Any, as Linux guests of Hyper-V report.
+func contextID() (uint32, error) {
+	vmID, err := LocalVM()
+	if err != nil {
+		return Host, nil
+	}
+	return contextIDOf(vmID), nil
+}
+
+func startup() error {
+	startupOnce.Do(func() {
+		var data windows.WSAData
+		startupErr = windows.WSAStartup(uint32(0x202), &data)
+	})
+	return startupErr
+}
+
+// hvSocket is a non-blocking Hyper-V socket. Winsock has no poller shared
+// with the runtime, so waits poll the socket in slices of pollSlice.
+type hvSocket struct {
+	fd windows.Handle
+
+	mutex         sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+var _ connFD = &hvSocket{}
+
+// connFD is the socket of a Conn.
+type connFD interface {
+	io.ReadWriteCloser
+	Shutdown(how int) error
+	SetDeadline(t time.Time, typ deadlineType) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+func newHVSocket() (*hvSocket, error) {
+	if err := startup(); err != nil {
+		return nil, err
+	}
+	fd, err := windows.Socket(afHyperV, windows.SOCK_STREAM, hvProtocolRaw)
+	if err != nil {
+		return nil, diagnose(err)
+	}
+	return newHVSocketFD(fd)
+}
+
+func newHVSocketFD(fd windows.Handle) (*hvSocket, error) {
+	on := uint32(1)
+	r, _, err := procIoctlsocket.Call(uintptr(fd), fionbio, uintptr(unsafe.Pointer(&on)))
+	if int32(r) != 0 {
+		windows.Closesocket(fd)
+		return nil, err
+	}
+	return &hvSocket{fd: fd}, nil
+}
+
+func (self *hvSocket) bind(sa *sockaddrHV) error {
+	r, _, err := procBind.Call(uintptr(self.fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
+	if int32(r) != 0 {
+		return err
+	}
+	return nil
+}
+
+func (self *hvSocket) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	for {
+		if err := self.expired(readDeadline); err != nil {
+			return 0, err
+		}
+		var n, flags uint32
+		buf := windows.WSABuf{Len: uint32(len(b)), Buf: &b[0]}
+		err := windows.WSARecv(self.fd, &buf, 1, &n, &flags, nil, nil)
+		switch {
+		case err == windows.WSAEWOULDBLOCK:
+			if err := self.wait(pollRdNorm, readDeadline); err != nil {
+				return 0, err
+			}
+		case err != nil:
+			return 0, err
+		case n == 0:
+			return 0, io.EOF
+		default:
+			return int(n), nil
+		}
+	}
+}
+
+func (self *hvSocket) Write(b []byte) (int, error) {
+	var written int
+	for written < len(b) {
+		if err := self.expired(writeDeadline); err != nil {
+			return written, err
+		}
+		var n uint32
+		buf := windows.WSABuf{Len: uint32(len(b) - written), Buf: &b[written]}
+		err := windows.WSASend(self.fd, &buf, 1, &n, 0, nil, nil)
+		switch {
+		case err == windows.WSAEWOULDBLOCK:
+			if err := self.wait(pollWrNorm, writeDeadline); err != nil {
+				return written, err
+			}
+		case err != nil:
+			return written, err
+		default:
+			written += int(n)
+		}
+	}
+	return written, nil
+}
+
+func (self *hvSocket) Close() error {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return os.ErrClosed
+	}
+	self.closed = true
+	self.mutex.Unlock()
+	return windows.Closesocket(self.fd)
+}
+
+func (self *hvSocket) Shutdown(how int) error { return windows.Shutdown(self.fd, how) }
+
+func (self *hvSocket) SetDeadline(t time.Time, typ deadlineType) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	switch typ {
+	case deadline:
+		self.readDeadline, self.writeDeadline = t, t
+	case readDeadline:
+		self.readDeadline = t
+	case writeDeadline:
+		self.writeDeadline = t
+	default:
+		return fmt.Errorf("vsock: hvSocket.SetDeadline method invoked with invalid deadline type constant: %d", typ)
+	}
+	return nil
+}
+
+func (self *hvSocket) SyscallConn() (syscall.RawConn, error) { return &hvRawConn{self}, nil }
+
+// expired reports a closed socket, or a deadline of typ which has passed.
+func (self *hvSocket) expired(typ deadlineType) error {
+	_, err := self.timeout(typ)
+	return err
+}
+
+// timeout returns how long to poll for before checking again.
+func (self *hvSocket) timeout(typ deadlineType) (time.Duration, error) {
+	self.mutex.Lock()
+	closed := self.closed
+	t := self.readDeadline
+	if typ == writeDeadline {
+		t = self.writeDeadline
+	}
+	self.mutex.Unlock()
+
+	if closed {
+		return 0, os.ErrClosed
+	}
+	timeout := pollSlice
+	if !t.IsZero() {
+		d := time.Until(t)
+		if d <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		if d < timeout {
+			timeout = d
+		}
+	}
+	return timeout, nil
+}
+
+// wait blocks until the socket is ready for events, the deadline of typ
+// passes or the socket is closed.
+func (self *hvSocket) wait(events int16, typ deadlineType) error {
+	for {
+		timeout, err := self.timeout(typ)
+		if err != nil {
+			return err
+		}
+		fds := [1]struct {
+			fd      windows.Handle
+			events  int16
+			revents int16
+		}{{fd: self.fd, events: events}}
+		r, _, err := procWSAPoll.Call(uintptr(unsafe.Pointer(&fds[0])), 1, uintptr(timeout.Milliseconds()))
+		switch n := int32(r); {
+		case n < 0:
+			return err
+		case n > 0:
+			// Ready, or failed; the retried call tells which.
+			return nil
+		}
+	}
+}
+
+var _ syscall.RawConn = &hvRawConn{}
+
+type hvRawConn struct {
+	s *hvSocket
+}
+
+func (self *hvRawConn) Control(fn func(fd uintptr)) error {
+	self.s.mutex.Lock()
+	closed := self.s.closed
+	self.s.mutex.Unlock()
+	if closed {
+		return os.ErrClosed
+	}
+	fn(uintptr(self.s.fd))
+	return nil
+}
+
+func (self *hvRawConn) Read(fn func(fd uintptr) (done bool)) error {
+	for !fn(uintptr(self.s.fd)) {
+		if err := self.s.wait(pollRdNorm, readDeadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *hvRawConn) Write(fn func(fd uintptr) (done bool)) error {
+	for !fn(uintptr(self.s.fd)) {
+		if err := self.s.wait(pollWrNorm, writeDeadline); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ net.Listener = &listener{}
+
+type listener struct {
+	fd     *hvSocket
+	addr   *Addr
+	config ListenConfig
+}
+
+func (self *listener) Addr() net.Addr                { return self.addr }
+func (self *listener) Close() error                  { return self.fd.Close() }
+func (self *listener) SetDeadline(t time.Time) error { return self.fd.SetDeadline(t, deadline) }
+
+func (self *listener) Accept() (net.Conn, error) {
+	for {
+		var sa sockaddrHV
+		size := int32(unsafe.Sizeof(sa))
+		r, _, err := procAccept.Call(uintptr(self.fd.fd), uintptr(unsafe.Pointer(&sa)), uintptr(unsafe.Pointer(&size)))
+		fd := windows.Handle(r)
+		if fd == windows.InvalidHandle {
+			if err != windows.WSAEWOULDBLOCK {
+				return nil, err
+			}
+			if err := self.fd.wait(pollRdNorm, readDeadline); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		remote := &Addr{ContextID: contextIDOf(sa.VMID), Port: sa.ServiceID.Data1}
+		if !self.config.allows(remote.ContextID) {
+			// A peer outside the approved ranges.
+			windows.Closesocket(fd)
+			continue
+		}
+		s, err := newHVSocketFD(fd)
+		if err != nil {
+			return nil, err
+		}
+		c := &Conn{fd: s, local: self.addr, remote: remote, opened: time.Now()}
+		if err := self.config.apply(c); err != nil {
+			c.Close()
+			return nil, err
+		}
+		return c, nil
+	}
+}
+
+func listen(cid, port uint32, config *ListenConfig) (*VsockListener, error) {
+	if config.Type != Stream {
+		return nil, fmt.Errorf("vsock: Hyper-V sockets are %s sockets only, not %s", Stream, config.Type)
+	}
+	if port == 0 {
+		return nil, errors.New("vsock: Hyper-V sockets cannot listen on an ephemeral port")
+	}
+	s, err := newHVSocket()
+	if err != nil {
+		return nil, err
+	}
+	addr := &Addr{ContextID: cid, Port: port}
+	if err := config.prepare(&hvRawConn{s}, addr.String()); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.bind(newSockaddrHV(hvGUIDWildcard, port)); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := windows.Listen(s.fd, windows.SOMAXCONN); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &VsockListener{
+		listener: &listener{
+			fd:   s,
+			addr: addr,
+		},
+	}, nil
+}
+
+func dial(ctx context.Context, d *Dialer, cid, port uint32) (c *Conn, err error) {
+	if d.Type != Stream {
+		return nil, fmt.Errorf("vsock: Hyper-V sockets are %s sockets only, not %s", Stream, d.Type)
+	}
+	vmID, err := vmIDOf(cid)
+	if err != nil {
+		return nil, err
+	}
+	s, err := newHVSocket()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			s.Close()
+		}
+	}()
+
+	remote := &Addr{ContextID: cid, Port: port}
+	local := &Addr{ContextID: Host}
+	if d.LocalAddr != nil {
+		local = d.LocalAddr
+		if err := s.bind(newSockaddrHV(hvGUIDWildcard, local.Port)); err != nil {
+			return nil, err
+		}
+	}
+	if err := d.prepare(&hvRawConn{s}, remote.String()); err != nil {
+		return nil, err
+	}
+	if err := connect(ctx, s, newSockaddrHV(vmID, port)); err != nil {
+		return nil, err
+	}
+	return &Conn{fd: s, local: local, remote: remote, opened: time.Now()}, nil
+}
+
+// connect connects the non-blocking s to sa, waiting for the connection to
+// complete until ctx is done.
+func connect(ctx context.Context, s *hvSocket, sa *sockaddrHV) error {
+	r, _, err := procConnect.Call(uintptr(s.fd), uintptr(unsafe.Pointer(sa)), unsafe.Sizeof(*sa))
+	if int32(r) == 0 {
+		return nil
+	}
+	if err != windows.WSAEWOULDBLOCK {
+		return diagnose(err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline, writeDeadline)
+		defer s.SetDeadline(time.Time{}, writeDeadline)
+	}
+	if ctx.Done() != nil {
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			select {
+			case <-ctx.Done():
+				// A deadline in the past ends the wait.
+				s.SetDeadline(time.Unix(1, 0), writeDeadline)
+			case <-done:
+			}
+		}()
+	}
+
+	if err := s.wait(pollWrNorm, writeDeadline); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if os.IsTimeout(err) {
+			return context.DeadlineExceeded
+		}
+		return err
+	}
+	var serr int32
+	size := int32(unsafe.Sizeof(serr))
+	if err := windows.Getsockopt(s.fd, windows.SOL_SOCKET, soError, (*byte)(unsafe.Pointer(&serr)), &size); err != nil {
+		return err
+	}
+	if serr != 0 {
+		return diagnose(syscall.Errno(serr))
+	}
+	return nil
+}
+
+// diagnose turns an error showing Hyper-V sockets are unavailable into an
+// UnavailableError, and returns other errors unchanged.
+func diagnose(err error) error {
+	if errors.Is(err, windows.WSAEAFNOSUPPORT) || errors.Is(err, windows.WSAEPROTONOSUPPORT) {
+		return &UnavailableError{
+			Cause: CauseNoTransport,
+			Hint:  "enable Hyper-V, e.g. with Enable-WindowsOptionalFeature -Online -FeatureName Microsoft-Hyper-V",
+			Err:   err,
+		}
+	}
+	return err
+}
+
+func setLinger(fd, sec int) error {
+	var l windows.Linger
+	if sec >= 0 {
+		l.Onoff = 1
+		l.Linger = int32(sec)
+	}
+	return windows.SetsockoptLinger(windows.Handle(fd), windows.SOL_SOCKET, windows.SO_LINGER, &l)
+}
+
+const (
+	soRcvbuf = windows.SO_RCVBUF
+	soSndbuf = windows.SO_SNDBUF
+)
+
+func getsockoptInt(fd, opt int) (int, error) {
+	return windows.GetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, opt)
+}
+
+func setsockoptInt(fd, opt, value int) error {
+	return windows.SetsockoptInt(windows.Handle(fd), windows.SOL_SOCKET, opt, value)
+}
+
+func setBufferSizes(fd int, size, max uint64) error {
+	return errors.New("vsock: Hyper-V sockets have no vsock buffer sizes")
+}
+
+func setConnectTimeout(fd int, timeout time.Duration) error {
+	return windows.SetsockoptInt(windows.Handle(fd), hvProtocolRaw, hvsocketConnectTimeout, int(timeout.Milliseconds()))
+}
+
+// splice leaves relays to the pooled copy; Windows has no splice(2).
+func splice(dst io.Writer, src io.Reader) (int64, bool, error) { return 0, false, nil }
+
+func isErrno(err error, errno int) bool {
+	switch errno {
+	case ebadf:
+		return err == windows.WSAEBADF || err == windows.WSAENOTSOCK
+	case enotconn:
+		return err == windows.WSAENOTCONN
+	default:
+		return false
+	}
+}
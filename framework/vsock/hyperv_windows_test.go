@@ -0,0 +1,47 @@
+package vsock
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/windows"
+)
+
+func TestSockaddrHV(t *testing.T) {
+	if size := unsafe.Sizeof(sockaddrHV{}); size != 36 {
+		t.Fatalf("expected SOCKADDR_HV to be 36 bytes, got %d", size)
+	}
+	sa := newSockaddrHV(hvGUIDParent, 5200)
+	if diff := cmp.Diff("{00001450-FACB-11E6-BD58-64006A7986D3}", sa.ServiceID.String()); diff != "" {
+		t.Fatalf("unexpected service ID (-want +got):\n%s", diff)
+	}
+
+	vm := mustGUID("{5f2c4b3e-1d2a-4c8e-9b7a-0e1f2a3b4c5d}")
+	RegisterVM(3, vm)
+	for _, test := range []struct {
+		cid  uint32
+		vmID windows.GUID
+	}{
+		{Host, hvGUIDParent},
+		{Local, hvGUIDLoopback},
+		{3, vm},
+	} {
+		got, err := vmIDOf(test.cid)
+		if err != nil {
+			t.Fatalf("failed to map %d: %v", test.cid, err)
+		}
+		if got != test.vmID {
+			t.Errorf("unexpected VM ID for %d: %v", test.cid, got)
+		}
+		if cid := contextIDOf(got); cid != test.cid {
+			t.Errorf("unexpected context ID for %v: %d", got, cid)
+		}
+	}
+	if _, err := vmIDOf(4); err == nil {
+		t.Error("expected an unregistered context ID to have no VM ID")
+	}
+	if cid := contextIDOf(mustGUID("{00000000-0000-0000-0000-000000000001}")); cid != Any {
+		t.Errorf("expected an unregistered VM to have context ID Any, got %d", cid)
+	}
+}
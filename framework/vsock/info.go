@@ -0,0 +1,112 @@
+//go:build linux
+
+package vsock
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// BufferSizes are the vsock buffer sizes of a connection, in bytes. On the
+// virtio transport Size is the receive buffer advertised to the peer as its
+// send credit, so it bounds how much the peer can have in flight.
+type BufferSizes struct {
+	Size uint64
+	Min  uint64
+	Max  uint64
+}
+
+// Transport identifies the kernel transport carrying a connection.
+type Transport string
+
+const (
+	TransportUnknown  Transport = "unknown"
+	TransportVirtio   Transport = "virtio"   // guest side of virtio-vsock
+	TransportVhost    Transport = "vhost"    // host side of virtio-vsock
+	TransportVMCI     Transport = "vmci"     // VMware
+	TransportHyperV   Transport = "hyperv"   // Hyper-V sockets
+	TransportLoopback Transport = "loopback" // local CID, no virtual machine
+)
+
+// transportModules maps transports to the kernel modules that provide them,
+// as listed under /sys/module.
+var transportModules = []struct {
+	transport Transport
+	module    string
+}{
+	{TransportVirtio, "vmw_vsock_virtio_transport"},
+	{TransportVMCI, "vmw_vsock_vmci_transport"},
+	{TransportHyperV, "hv_sock"},
+}
+
+// BufferSizes returns the buffer sizes of the connection.
+func (self *Conn) BufferSizes() (BufferSizes, error) {
+	var sizes BufferSizes
+	err := self.control(func(fd int) error {
+		var err error
+		if sizes.Size, err = unix.GetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE); err != nil {
+			return err
+		}
+		if sizes.Min, err = unix.GetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_MIN_SIZE); err != nil {
+			return err
+		}
+		sizes.Max, err = unix.GetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE)
+		return err
+	})
+	return sizes, err
+}
+
+// SetBufferSize sets the receive buffer of the connection, within the
+// minimum and maximum reported by BufferSizes.
+func (self *Conn) SetBufferSize(size uint64) error {
+	return self.control(func(fd int) error {
+		return unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_SIZE, size)
+	})
+}
+
+// SetBufferMaxSize sets the largest receive buffer SetBufferSize allows,
+// shrinking the buffer if it is larger.
+func (self *Conn) SetBufferMaxSize(size uint64) error {
+	return self.control(func(fd int) error {
+		return unix.SetsockoptUint64(fd, unix.AF_VSOCK, unix.SO_VM_SOCKETS_BUFFER_MAX_SIZE, size)
+	})
+}
+
+// Transport reports which kernel transport carries the connection. It is
+// inferred from the context IDs of both ends and the transport modules
+// loaded, so it is TransportUnknown where that is ambiguous.
+func (self *Conn) Transport() Transport {
+	return transportFor(self.local.ContextID, self.remote.ContextID)
+}
+
+func transportFor(local, remote uint32) Transport {
+	switch {
+	case remote == cidReserved || (local == remote && local != Host):
+		return TransportLoopback
+	case local == Host:
+		if moduleLoaded("vhost_vsock") {
+			return TransportVhost
+		}
+		if moduleLoaded("vmw_vsock_vmci_transport") {
+			return TransportVMCI
+		}
+		return TransportUnknown
+	}
+
+	var found Transport = TransportUnknown
+	for _, tm := range transportModules {
+		if moduleLoaded(tm.module) {
+			if found != TransportUnknown {
+				return TransportUnknown
+			}
+			found = tm.transport
+		}
+	}
+	return found
+}
+
+func moduleLoaded(name string) bool {
+	_, err := os.Stat("/sys/module/" + name)
+	return err == nil
+}
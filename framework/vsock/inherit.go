@@ -0,0 +1,266 @@
+//go:build linux
+
+package vsock
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// The environment protocol used to hand listeners to a re-executed process.
+// VCABLE_LISTEN_PARENT holds the PID of the process that passed the
+// descriptors, guarding against a grandchild that inherits the environment
+// but not the descriptors.
+const (
+	envListenFDs    = "VCABLE_LISTEN_FDS"
+	envListenPorts  = "VCABLE_LISTEN_PORTS"
+	envListenParent = "VCABLE_LISTEN_PARENT"
+
+	// listenFDsStart is the first inherited descriptor, following stdin,
+	// stdout and stderr.
+	listenFDsStart = 3
+)
+
+var (
+	inheritOnce sync.Once
+	inheritErr  error
+	inherited   map[uint32]*VsockListener
+)
+
+// File returns a duplicate of the listening socket. Closing the listener
+// does not affect the file, and vice versa.
+func (self *VsockListener) File() (*os.File, error) {
+	f, err := self.listener.fd.File()
+	if err != nil {
+		return nil, self.opError(opSyscallConn, err)
+	}
+	return f, nil
+}
+
+// FileListener returns a listener for the vsock listening socket open in f.
+// The descriptor is duplicated, so f may be closed afterwards.
+func FileListener(f *os.File) (*VsockListener, error) {
+	newFD, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, opError(opListen, err, nil, nil)
+	}
+	lfd := &sysListenFD{fd: newFD}
+
+	l, err := fileListener(lfd)
+	if err != nil {
+		_ = lfd.EarlyClose()
+		return nil, opError(opListen, err, nil, nil)
+	}
+	return l, nil
+}
+
+func fileListener(lfd *sysListenFD) (*VsockListener, error) {
+	accepting, err := unix.GetsockoptInt(lfd.fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, err
+	}
+	if accepting == 0 {
+		return nil, fmt.Errorf("vsock: file is not a listening socket")
+	}
+
+	lsa, err := lfd.Getsockname()
+	if err != nil {
+		return nil, err
+	}
+	lsavm, ok := lsa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, fmt.Errorf("vsock: file is not a vsock socket")
+	}
+
+	if err := lfd.SetNonblocking("vsock-listen"); err != nil {
+		return nil, err
+	}
+
+	return &VsockListener{
+		listener: &listener{
+			fd: lfd,
+			addr: &Addr{
+				ContextID: lsavm.CID,
+				Port:      lsavm.Port,
+			},
+		},
+	}, nil
+}
+
+// Inherited returns the listeners passed to this process by Restart, keyed
+// by port. The environment variables of the protocol are cleared so they
+// do not leak into children of this process.
+func Inherited() (map[uint32]*VsockListener, error) {
+	inheritOnce.Do(func() {
+		inherited, inheritErr = inherit()
+	})
+	return inherited, inheritErr
+}
+
+func inherit() (map[uint32]*VsockListener, error) {
+	count, ports, parent := os.Getenv(envListenFDs), os.Getenv(envListenPorts), os.Getenv(envListenParent)
+	os.Unsetenv(envListenFDs)
+	os.Unsetenv(envListenPorts)
+	os.Unsetenv(envListenParent)
+
+	listeners := make(map[uint32]*VsockListener)
+	if count == "" || parent != strconv.Itoa(os.Getppid()) {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("vsock: invalid %s %q", envListenFDs, count)
+	}
+	if n == 0 {
+		return listeners, nil
+	}
+	fields := strings.Split(ports, ",")
+	if len(fields) != n {
+		return nil, fmt.Errorf("vsock: %s lists %d ports for %d descriptors", envListenPorts, len(fields), n)
+	}
+
+	for i := 0; i < n; i++ {
+		fd := listenFDsStart + i
+		unix.CloseOnExec(fd)
+
+		l, err := fileListener(&sysListenFD{fd: fd})
+		if err != nil {
+			return nil, fmt.Errorf("vsock: inherited descriptor %d: %v", fd, err)
+		}
+		if fields[i] != strconv.FormatUint(uint64(l.listener.addr.Port), 10) {
+			return nil, fmt.Errorf("vsock: inherited descriptor %d is bound to port %d, not %s", fd, l.listener.addr.Port, fields[i])
+		}
+		listeners[l.listener.addr.Port] = l
+	}
+	return listeners, nil
+}
+
+// ListenInherited returns the listener for port passed to this process by
+// Restart, or opens a new one if there is none.
+func ListenInherited(port uint32) (*VsockListener, error) {
+	listeners, err := Inherited()
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := listeners[port]; ok {
+		delete(listeners, port)
+		return l, nil
+	}
+	return Listen(port)
+}
+
+// Restart starts a new copy of the running executable with the same
+// arguments, handing it listeners so it can keep accepting on their ports
+// without a gap. The caller remains responsible for its own listeners, and
+// typically shuts its servers down once the new process is ready.
+func Restart(listeners ...*VsockListener) (*os.Process, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		files []*os.File
+		ports []string
+	)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+		ports = append(ports, strconv.FormatUint(uint64(l.listener.addr.Port), 10))
+	}
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(environWithout(envListenFDs, envListenPorts, envListenParent),
+		envListenFDs+"="+strconv.Itoa(len(files)),
+		envListenPorts+"="+strings.Join(ports, ","),
+		envListenParent+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cmd.Process, nil
+}
+
+func environWithout(keys ...string) []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		var skip bool
+		for _, key := range keys {
+			if strings.HasPrefix(kv, key+"=") {
+				skip = true
+			}
+		}
+		if !skip {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+// File returns a duplicate of the connected socket, for handing to another
+// process. Closing the connection does not affect the file, and vice versa.
+func (self *Conn) File() (*os.File, error) {
+	f, err := self.fd.File()
+	if err != nil {
+		return nil, self.opError(opSyscallConn, err)
+	}
+	return f, nil
+}
+
+// FileConn returns a connection for the connected vsock socket open in f.
+// The descriptor is duplicated, so f may be closed afterwards.
+func FileConn(f *os.File) (*Conn, error) {
+	newFD, err := unix.FcntlInt(f.Fd(), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, opError(opDial, err, nil, nil)
+	}
+	cfd := &sysConnFD{fd: newFD}
+
+	c, err := fileConn(cfd)
+	if err != nil {
+		_ = cfd.EarlyClose()
+		return nil, opError(opDial, err, nil, nil)
+	}
+	return c, nil
+}
+
+func fileConn(cfd *sysConnFD) (*Conn, error) {
+	lsa, err := cfd.Getsockname()
+	if err != nil {
+		return nil, err
+	}
+	lsavm, ok := lsa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, fmt.Errorf("vsock: file is not a vsock socket")
+	}
+	rsa, err := unix.Getpeername(cfd.fd)
+	if err != nil {
+		return nil, err
+	}
+	rsavm, ok := rsa.(*unix.SockaddrVM)
+	if !ok {
+		return nil, fmt.Errorf("vsock: file is not a vsock socket")
+	}
+
+	local := &Addr{ContextID: lsavm.CID, Port: lsavm.Port}
+	remote := &Addr{ContextID: rsavm.CID, Port: rsavm.Port}
+	return newConn(cfd, local, remote)
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package vsock
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// The role TestRestart plays when re-executed, and the file its copies
+// report to.
+const (
+	envTestRole   = "VCABLE_TEST_INHERIT"
+	envTestReport = "VCABLE_TEST_INHERIT_REPORT"
+)
+
+// report appends the ports of the listeners this process inherited, as
+// role, to the report file.
+func report(t *testing.T, role string) {
+	listeners, err := Inherited()
+	if err != nil {
+		t.Fatalf("%s: failed to inherit: %v", role, err)
+	}
+	var ports []string
+	for port, l := range listeners {
+		if got := l.Addr().(*Addr).Port; got != port {
+			t.Fatalf("%s: listener of port %d is bound to %d", role, port, got)
+		}
+		ports = append(ports, fmt.Sprint(port))
+		l.Close()
+	}
+	sort.Strings(ports)
+	if env := os.Getenv(envListenFDs); env != "" {
+		t.Fatalf("%s: %s left in the environment: %q", role, envListenFDs, env)
+	}
+
+	f, err := os.OpenFile(os.Getenv(envTestReport), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("%s: failed to open report: %v", role, err)
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%s %s\n", role, strings.Join(ports, ","))
+}
+
+func TestRestart(t *testing.T) {
+	switch os.Getenv(envTestRole) {
+	case "child":
+		// A grandchild started before the environment is cleared sees it,
+		// but not the descriptors.
+		cmd := exec.Command(os.Args[0], os.Args[1:]...)
+		cmd.Env = append(os.Environ(), envTestRole+"=grandchild")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("grandchild failed: %v\n%s", err, out)
+		}
+		report(t, "child")
+		return
+	case "grandchild":
+		report(t, "grandchild")
+		return
+	}
+
+	l, err := Listen(0)
+	if err != nil {
+		t.Skipf("vsock unavailable: %v", err)
+	}
+	defer l.Close()
+
+	path := filepath.Join(t.TempDir(), "report")
+	if err := os.WriteFile(path, nil, 0600); err != nil {
+		t.Fatalf("failed to create report: %v", err)
+	}
+	t.Setenv(envTestRole, "child")
+	t.Setenv(envTestReport, path)
+	defer func(args []string) { os.Args = args }(os.Args)
+	os.Args = []string{os.Args[0], "-test.run=^TestRestart$"}
+
+	p, err := Restart(l)
+	if err != nil {
+		t.Fatalf("failed to restart: %v", err)
+	}
+	state, err := p.Wait()
+	if err != nil || !state.Success() {
+		t.Fatalf("restarted process failed: %v %v", state, err)
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read report: %v", err)
+	}
+	want := fmt.Sprintf("grandchild \nchild %d\n", l.Addr().(*Addr).Port)
+	if diff := cmp.Diff(want, string(b)); diff != "" {
+		t.Fatalf("unexpected listeners inherited (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,44 @@
+package vsock
+
+import (
+	"io"
+	"time"
+)
+
+// SetLinger sets the behavior of Close on a connection which still has data
+// waiting to be sent, with the semantics of net.TCPConn.SetLinger.
+//
+// If sec < 0 (the default), Close returns at once and the kernel sends the
+// remaining data in the background.
+//
+// If sec == 0, Close discards any unsent data and resets the connection.
+//
+// If sec > 0, Close blocks until the data is sent or sec seconds elapse, after
+// which any data still unsent is discarded. Transports which do not support
+// lingering treat this as the default.
+func (self *Conn) SetLinger(sec int) error {
+	return self.control(func(fd int) error { return setLinger(fd, sec) })
+}
+
+// CloseWithTimeout closes the connection gracefully: it shuts down the write
+// side, so the peer reads io.EOF after all data written so far, and waits up
+// to timeout for the peer to close its own side. Anything the peer sends in
+// the meantime is discarded. If the timeout expires first, pending data is
+// discarded and the connection reset, and the deadline error is returned.
+func (self *Conn) CloseWithTimeout(timeout time.Duration) error {
+	if err := self.CloseWrite(); err != nil {
+		self.Close()
+		return err
+	}
+	if err := self.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		self.Close()
+		return err
+	}
+
+	if _, err := io.Copy(io.Discard, self); err != nil {
+		self.SetLinger(0)
+		self.Close()
+		return err
+	}
+	return self.Close()
+}
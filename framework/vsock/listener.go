@@ -1,3 +1,5 @@
+//go:build linux
+
 package vsock
 
 import (
@@ -10,8 +12,9 @@ import (
 var _ net.Listener = &listener{}
 
 type listener struct {
-	fd   listenFD
-	addr *Addr
+	fd     listenFD
+	addr   *Addr
+	config ListenConfig
 }
 
 func (self *listener) Addr() net.Addr                { return self.addr }
@@ -22,31 +25,55 @@ func (self *listener) Accept() (net.Conn, error) {
 	// TODO(mdlayher): acquire syscall.ForkLock.RLock here once the Go 1.11
 	// code can be removed and we're fully using the runtime network poller in
 	// non-blocking mode.
-	cfd, sa, err := self.fd.Accept4(unix.SOCK_CLOEXEC)
-	if err != nil {
-		return nil, err
+	var (
+		cfd  connFD
+		savm *unix.SockaddrVM
+	)
+	for {
+		fd, sa, err := self.fd.Accept4(unix.SOCK_CLOEXEC)
+		if err != nil {
+			return nil, err
+		}
+		cfd, savm = fd, sa.(*unix.SockaddrVM)
+		if self.config.allows(savm.CID) {
+			break
+		}
+		// A peer outside the approved ranges.
+		cfd.EarlyClose()
 	}
 
-	savm := sa.(*unix.SockaddrVM)
-
 	remote := &Addr{
 		ContextID: savm.CID,
 		Port:      savm.Port,
 	}
 
-	return newConn(cfd, self.addr, remote)
+	c, err := newConn(cfd, self.addr, remote)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.config.apply(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
 }
 
-func listen(cid, port uint32) (*VsockListener, error) {
-	lfd, err := newListenFD()
+func listen(cid, port uint32, config *ListenConfig) (*VsockListener, error) {
+	if config.Type == Datagram {
+		return nil, errDatagram
+	}
+	if b := currentBackend(); b != nil {
+		return listenBackend(b, port, config.Type)
+	}
+	lfd, err := newListenFD(config.Type)
 	if err != nil {
 		return nil, err
 	}
 
-	return listenLinux(lfd, cid, port)
+	return listenLinux(lfd, cid, port, config)
 }
 
-func listenLinux(lfd listenFD, cid, port uint32) (*VsockListener, error) {
+func listenLinux(lfd listenFD, cid, port uint32, config *ListenConfig) (*VsockListener, error) {
 	var err error
 	defer func() {
 		if err != nil {
@@ -63,20 +90,29 @@ func listenLinux(lfd listenFD, cid, port uint32) (*VsockListener, error) {
 		Port: port,
 	}
 
-	if err := lfd.Bind(sa); err != nil {
+	// The socket is made non-blocking first, so options can be set
+	// through its syscall.RawConn before it binds.
+	if err = lfd.SetNonblocking("vsock-listen"); err != nil {
+		return nil, err
+	}
+	rc, err := lfd.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	if err = config.prepare(rc, (&Addr{ContextID: cid, Port: port}).String()); err != nil {
 		return nil, err
 	}
 
-	if err := lfd.Listen(unix.SOMAXCONN); err != nil {
+	if err = lfd.Bind(sa); err != nil {
 		return nil, err
 	}
 
-	lsa, err := lfd.Getsockname()
-	if err != nil {
+	if err = lfd.Listen(unix.SOMAXCONN); err != nil {
 		return nil, err
 	}
 
-	if err := lfd.SetNonblocking("vsock-listen"); err != nil {
+	lsa, err := lfd.Getsockname()
+	if err != nil {
 		return nil, err
 	}
 
@@ -88,7 +124,7 @@ func listenLinux(lfd listenFD, cid, port uint32) (*VsockListener, error) {
 	}
 
 	return &VsockListener{
-		&listener{
+		listener: &listener{
 			fd:   lfd,
 			addr: addr,
 		},
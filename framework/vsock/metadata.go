@@ -0,0 +1,143 @@
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Metadata are key/value tags describing a connection, such as the name of
+// the virtual machine, its tenant or the purpose of the connection. They
+// appear in logs and label metrics.
+type Metadata map[string]string
+
+// String formats the metadata as space separated key=value pairs, ordered
+// by key.
+func (self Metadata) String() string {
+	keys := make([]string, 0, len(self))
+	for key := range self {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key + "=" + self[key]
+	}
+	return strings.Join(pairs, " ")
+}
+
+// Merge returns a copy of the metadata with the entries of other added,
+// replacing those with the same keys.
+func (self Metadata) Merge(other Metadata) Metadata {
+	merged := make(Metadata, len(self)+len(other))
+	for key, value := range self {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+	return merged
+}
+
+// MetadataOf returns the metadata attached to conn with WithMetadata, or nil.
+func MetadataOf(conn net.Conn) Metadata {
+	if tagged, ok := conn.(interface{ Metadata() Metadata }); ok {
+		return tagged.Metadata()
+	}
+	return nil
+}
+
+// WithMetadata attaches md to conn, on top of any metadata it already has.
+func WithMetadata(conn net.Conn, md Metadata) net.Conn {
+	if tagged, ok := conn.(*taggedConn); ok {
+		return &taggedConn{Conn: tagged.Conn, md: tagged.md.Merge(md)}
+	}
+	return &taggedConn{Conn: conn, md: MetadataOf(conn).Merge(md)}
+}
+
+type taggedConn struct {
+	net.Conn
+	md Metadata
+}
+
+func (self *taggedConn) Metadata() Metadata { return self.md }
+
+func (self *taggedConn) CloseWrite() error {
+	if cw, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("vsock: %T does not support CloseWrite", self.Conn)
+}
+
+// Tag attaches md to every connection served by the handler.
+func Tag(md Metadata) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			next.ServeVsock(WithMetadata(conn, md))
+		})
+	}
+}
+
+// DialTag attaches md to every dialed connection.
+func DialTag(md Metadata) DialMiddleware {
+	return func(next DialFunc) DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			conn, err := next(contextID, port)
+			if err != nil {
+				return nil, err
+			}
+			return WithMetadata(conn, md), nil
+		}
+	}
+}
+
+// LabeledMetrics counts connections separately for each value of the
+// metadata key Key. Connections without the key count under "".
+type LabeledMetrics struct {
+	Key string
+
+	mutex   sync.Mutex
+	metrics map[string]*ConnMetrics
+}
+
+// Middleware counts the connections served by the handler.
+func (self *LabeledMetrics) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			Metrics(self.get(MetadataOf(conn)[self.Key]))(next).ServeVsock(conn)
+		})
+	}
+}
+
+// Snapshot returns a copy of the counters of every label seen so far.
+func (self *LabeledMetrics) Snapshot() map[string]ConnMetrics {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	snapshot := make(map[string]ConnMetrics, len(self.metrics))
+	for label, m := range self.metrics {
+		snapshot[label] = ConnMetrics{
+			Active: atomic.LoadInt64(&m.Active),
+			Total:  atomic.LoadInt64(&m.Total),
+			Failed: atomic.LoadInt64(&m.Failed),
+		}
+	}
+	return snapshot
+}
+
+func (self *LabeledMetrics) get(label string) *ConnMetrics {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.metrics == nil {
+		self.metrics = make(map[string]*ConnMetrics)
+	}
+	m, ok := self.metrics[label]
+	if !ok {
+		m = &ConnMetrics{}
+		self.metrics[label] = m
+	}
+	return m
+}
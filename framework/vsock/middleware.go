@@ -0,0 +1,197 @@
+package vsock
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middleware wraps a Handler with behavior that applies to every
+// connection, such as authentication, logging or rate limiting.
+type Middleware func(next Handler) Handler
+
+// Chain wraps handler with middleware. The first middleware is the
+// outermost, and so sees each connection first.
+func Chain(handler Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// DialFunc opens a connection to a context ID and port, like Dial.
+type DialFunc func(contextID, port uint32) (net.Conn, error)
+
+// DialMiddleware wraps a DialFunc with behavior that applies to every
+// outgoing connection.
+type DialMiddleware func(next DialFunc) DialFunc
+
+// ChainDial wraps dial with middleware, the first being the outermost.
+// A nil dial uses Dial.
+func ChainDial(dial DialFunc, middleware ...DialMiddleware) DialFunc {
+	if dial == nil {
+		dial = func(contextID, port uint32) (net.Conn, error) { return Dial(contextID, port) }
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		dial = middleware[i](dial)
+	}
+	return dial
+}
+
+// AllowContextIDs closes connections from any peer whose context ID is not
+// listed, before the handler sees them.
+func AllowContextIDs(contextIDs ...uint32) Middleware {
+	allowed := make(map[uint32]bool, len(contextIDs))
+	for _, cid := range contextIDs {
+		allowed[cid] = true
+	}
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			if addr, ok := conn.RemoteAddr().(*Addr); ok && allowed[addr.ContextID] {
+				next.ServeVsock(conn)
+			}
+		})
+	}
+}
+
+// Logging logs the peer, metadata and duration of every connection.
+func Logging(logger *log.Logger) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			start := time.Now()
+			peer := conn.RemoteAddr().String()
+			if md := MetadataOf(conn); len(md) > 0 {
+				peer += " [" + md.String() + "]"
+			}
+			logger.Printf("vsock: %s: connected", peer)
+			defer func() {
+				logger.Printf("vsock: %s: closed after %v", peer, time.Since(start))
+			}()
+			next.ServeVsock(conn)
+		})
+	}
+}
+
+// DialLogging logs every dial and its outcome.
+func DialLogging(logger *log.Logger) DialMiddleware {
+	return func(next DialFunc) DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			start := time.Now()
+			conn, err := next(contextID, port)
+			addr := &Addr{ContextID: contextID, Port: port}
+			if err != nil {
+				logger.Printf("vsock: dial %s: failed after %v: %v", addr, time.Since(start), err)
+			} else {
+				logger.Printf("vsock: dial %s: connected in %v", addr, time.Since(start))
+			}
+			return conn, err
+		}
+	}
+}
+
+// RateLimit closes connections that arrive faster than perSecond, allowing
+// bursts of up to burst connections.
+func RateLimit(perSecond float64, burst int) Middleware {
+	bucket := newTokenBucket(perSecond, burst)
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			if bucket.take() {
+				next.ServeVsock(conn)
+			}
+		})
+	}
+}
+
+// DialRateLimit fails dials made faster than perSecond, allowing bursts of
+// up to burst dials, so a reconnect loop cannot hammer a peer.
+func DialRateLimit(perSecond float64, burst int) DialMiddleware {
+	bucket := newTokenBucket(perSecond, burst)
+	return func(next DialFunc) DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			if !bucket.take() {
+				return nil, opError(opDial, fmt.Errorf("rate limit exceeded"), nil, &Addr{ContextID: contextID, Port: port})
+			}
+			return next(contextID, port)
+		}
+	}
+}
+
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (self *tokenBucket) take() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	now := time.Now()
+	self.tokens += now.Sub(self.last).Seconds() * self.rate
+	if self.tokens > self.burst {
+		self.tokens = self.burst
+	}
+	self.last = now
+
+	if self.tokens < 1 {
+		return false
+	}
+	self.tokens--
+	return true
+}
+
+// ConnMetrics counts connections. It is safe for concurrent use, and its
+// fields may be read at any time with the sync/atomic functions.
+type ConnMetrics struct {
+	Active int64
+	Total  int64
+	Failed int64
+}
+
+// Metrics counts connections served by the handler in m.
+func Metrics(m *ConnMetrics) Middleware {
+	return func(next Handler) Handler {
+		return HandlerFunc(func(conn net.Conn) {
+			atomic.AddInt64(&m.Total, 1)
+			atomic.AddInt64(&m.Active, 1)
+			defer atomic.AddInt64(&m.Active, -1)
+			next.ServeVsock(conn)
+		})
+	}
+}
+
+// DialMetrics counts dials in m. Active tracks connections that are open.
+func DialMetrics(m *ConnMetrics) DialMiddleware {
+	return func(next DialFunc) DialFunc {
+		return func(contextID, port uint32) (net.Conn, error) {
+			atomic.AddInt64(&m.Total, 1)
+			conn, err := next(contextID, port)
+			if err != nil {
+				atomic.AddInt64(&m.Failed, 1)
+				return nil, err
+			}
+			atomic.AddInt64(&m.Active, 1)
+			return &countedConn{Conn: conn, metrics: m}, nil
+		}
+	}
+}
+
+type countedConn struct {
+	net.Conn
+	metrics *ConnMetrics
+	once    sync.Once
+}
+
+func (self *countedConn) Close() error {
+	self.once.Do(func() { atomic.AddInt64(&self.metrics.Active, -1) })
+	return self.Conn.Close()
+}
@@ -0,0 +1,57 @@
+package vsock
+
+import (
+	"net"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return HandlerFunc(func(conn net.Conn) {
+				calls = append(calls, name)
+				next.ServeVsock(conn)
+			})
+		}
+	}
+
+	h := Chain(HandlerFunc(func(net.Conn) { calls = append(calls, "handler") }), trace("a"), trace("b"))
+	h.ServeVsock(nil)
+
+	if diff := cmp.Diff([]string{"a", "b", "handler"}, calls); diff != "" {
+		t.Fatalf("unexpected call order (-want +got):\n%s", diff)
+	}
+}
+
+func TestDialRateLimit(t *testing.T) {
+	var dials int
+	dial := ChainDial(func(contextID, port uint32) (net.Conn, error) {
+		dials++
+		return nil, nil
+	}, DialRateLimit(0, 2))
+
+	for i := 0; i < 3; i++ {
+		dial(Host, 1024)
+	}
+	if dials != 2 {
+		t.Fatalf("expected 2 dials within burst, got %d", dials)
+	}
+}
+
+func TestLabeledMetrics(t *testing.T) {
+	m := &LabeledMetrics{Key: "vm"}
+	h := Chain(HandlerFunc(func(net.Conn) {}), Tag(Metadata{"vm": "web"}), m.Middleware())
+
+	a, b := net.Pipe()
+	defer b.Close()
+	h.ServeVsock(a)
+	h.ServeVsock(a)
+
+	want := map[string]ConnMetrics{"web": {Total: 2}}
+	if diff := cmp.Diff(want, m.Snapshot()); diff != "" {
+		t.Fatalf("unexpected metrics (-want +got):\n%s", diff)
+	}
+}
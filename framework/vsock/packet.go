@@ -0,0 +1,205 @@
+//go:build linux
+
+package vsock
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+var _ net.PacketConn = &PacketConn{}
+var _ syscall.Conn = &PacketConn{}
+
+// PacketConn is a Datagram socket. Each read returns one datagram,
+// truncated to the buffer if it is longer.
+type PacketConn struct {
+	f      *os.File
+	local  *Addr
+	remote *Addr
+}
+
+// ListenDatagram receives datagrams sent to port of the local context ID,
+// from any peer.
+func ListenDatagram(port uint32) (*PacketConn, error) {
+	cid, err := ContextID()
+	if err != nil {
+		return nil, opError(opListen, err, nil, nil)
+	}
+	local := &Addr{ContextID: cid, Port: port}
+	c, err := newPacketConn(local, nil)
+	if err != nil {
+		return nil, opError(opListen, err, local, nil)
+	}
+	return c, nil
+}
+
+// DialDatagram makes a Datagram socket which sends to port on contextID
+// with Write, and only receives from it.
+func DialDatagram(contextID, port uint32) (*PacketConn, error) {
+	remote := &Addr{ContextID: contextID, Port: port}
+	c, err := newPacketConn(nil, remote)
+	if err != nil {
+		return nil, opError(opDial, err, nil, remote)
+	}
+	return c, nil
+}
+
+// newPacketConn binds the socket to local and connects it to remote, each
+// if set.
+func newPacketConn(local, remote *Addr) (c *PacketConn, err error) {
+	fd, err := socket(Datagram)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+		}
+	}()
+
+	if local != nil {
+		port := local.Port
+		if port == 0 {
+			port = unix.VMADDR_PORT_ANY
+		}
+		if err := unix.Bind(fd, &unix.SockaddrVM{CID: local.ContextID, Port: port}); err != nil {
+			return nil, err
+		}
+	}
+	if remote != nil {
+		if err := unix.Connect(fd, &unix.SockaddrVM{CID: remote.ContextID, Port: remote.Port}); err != nil {
+			return nil, diagnose(err)
+		}
+	}
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, err
+	}
+	savm := sa.(*unix.SockaddrVM)
+	local = &Addr{ContextID: savm.CID, Port: savm.Port}
+
+	if err := unix.SetNonblock(fd, true); err != nil {
+		return nil, err
+	}
+	return &PacketConn{
+		f:      os.NewFile(uintptr(fd), local.fileName()),
+		local:  local,
+		remote: remote,
+	}, nil
+}
+
+// ReadFrom reads a datagram, returning the address it came from.
+func (self *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	rc, err := self.f.SyscallConn()
+	if err != nil {
+		return 0, nil, self.opError(opRead, err)
+	}
+	var (
+		n  int
+		sa unix.Sockaddr
+	)
+	doErr := rc.Read(func(fd uintptr) bool {
+		n, sa, err = unix.Recvfrom(int(fd), b, 0)
+		return err != unix.EAGAIN
+	})
+	if doErr != nil {
+		return 0, nil, self.opError(opRead, doErr)
+	}
+	if err != nil {
+		return 0, nil, self.opError(opRead, err)
+	}
+	var from net.Addr
+	if savm, ok := sa.(*unix.SockaddrVM); ok {
+		from = &Addr{ContextID: savm.CID, Port: savm.Port}
+	} else if self.remote != nil {
+		from = self.remote
+	}
+	return n, from, nil
+}
+
+// WriteTo sends b as one datagram to addr, which must be an *Addr.
+func (self *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*Addr)
+	if !ok {
+		return 0, self.opError(opWrite, fmt.Errorf("vsock: cannot send to %s address %v", addr.Network(), addr))
+	}
+	return self.send(b, &unix.SockaddrVM{CID: to.ContextID, Port: to.Port})
+}
+
+// Read reads a datagram, as ReadFrom does.
+func (self *PacketConn) Read(b []byte) (int, error) {
+	n, _, err := self.ReadFrom(b)
+	return n, err
+}
+
+// Write sends b as one datagram to the address the socket was dialed to.
+func (self *PacketConn) Write(b []byte) (int, error) {
+	if self.remote == nil {
+		return 0, self.opError(opWrite, fmt.Errorf("vsock: write to an unconnected datagram socket; use WriteTo"))
+	}
+	return self.send(b, nil)
+}
+
+func (self *PacketConn) send(b []byte, to unix.Sockaddr) (int, error) {
+	rc, err := self.f.SyscallConn()
+	if err != nil {
+		return 0, self.opError(opWrite, err)
+	}
+	doErr := rc.Write(func(fd uintptr) bool {
+		err = unix.Sendto(int(fd), b, 0, to)
+		return err != unix.EAGAIN
+	})
+	if doErr != nil {
+		return 0, self.opError(opWrite, doErr)
+	}
+	if err != nil {
+		return 0, self.opError(opWrite, err)
+	}
+	return len(b), nil
+}
+
+func (self *PacketConn) Close() error        { return self.opError(opClose, self.f.Close()) }
+func (self *PacketConn) LocalAddr() net.Addr { return self.local }
+
+// RemoteAddr returns the address the socket was dialed to, or nil.
+func (self *PacketConn) RemoteAddr() net.Addr {
+	if self.remote == nil {
+		return nil
+	}
+	return self.remote
+}
+
+func (self *PacketConn) SetDeadline(t time.Time) error {
+	return self.opError(opSet, self.f.SetDeadline(t))
+}
+
+func (self *PacketConn) SetReadDeadline(t time.Time) error {
+	return self.opError(opSet, self.f.SetReadDeadline(t))
+}
+
+func (self *PacketConn) SetWriteDeadline(t time.Time) error {
+	return self.opError(opSet, self.f.SetWriteDeadline(t))
+}
+
+// SyscallConn returns a raw network connection. This implements the
+// syscall.Conn interface.
+func (self *PacketConn) SyscallConn() (syscall.RawConn, error) {
+	rc, err := self.f.SyscallConn()
+	if err != nil {
+		return nil, self.opError(opSyscallConn, err)
+	}
+	return rc, nil
+}
+
+func (self *PacketConn) opError(op errOp, err error) error {
+	var remote net.Addr
+	if self.remote != nil {
+		remote = self.remote
+	}
+	return opError(op, err, self.local, remote)
+}
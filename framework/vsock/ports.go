@@ -0,0 +1,163 @@
+package vsock
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Ports fall in three ranges. Binding a system port needs
+// CAP_NET_BIND_SERVICE; registered ports are assigned to services, such as
+// those below; dynamic ports are left to ephemeral and ad hoc use.
+const (
+	SystemPortMax     = 1023
+	RegisteredPortMin = 1024
+	RegisteredPortMax = 49151
+	DynamicPortMin    = 49152
+)
+
+type PortClass int
+
+const (
+	PortSystem PortClass = iota
+	PortRegistered
+	PortDynamic
+)
+
+func (self PortClass) String() string {
+	switch self {
+	case PortSystem:
+		return "system"
+	case PortRegistered:
+		return "registered"
+	default:
+		return "dynamic"
+	}
+}
+
+// ClassOf returns the range port falls in.
+func ClassOf(port uint32) PortClass {
+	switch {
+	case port <= SystemPortMax:
+		return PortSystem
+	case port <= RegisteredPortMax:
+		return PortRegistered
+	default:
+		return PortDynamic
+	}
+}
+
+// Well-known ports of the built-in services. Bridged host services keep
+// their usual TCP port numbers.
+const (
+	PortContainer = 2375
+	PortPulse     = 4713
+	PortPipeWire  = 4714
+	PortCable     = 5200
+	PortPressure  = 5201
+	PortCrashdump = 5202
+	PortConsole   = 5203
+	PortNotify    = 5204
+	PortDBus      = 5205
+	PortQGA       = 5206
+	PortClipboard = 5207
+	PortCloudInit = 5208
+	PortBench     = 5209
+	PortTransfer  = 5210
+	PortShare     = 5211
+	PortDiscovery = 5212
+	// PortX11 is display 0; display n is on PortX11 + n.
+	PortX11     = 6000
+	PortWayland = 6100
+)
+
+var wellKnown = map[uint32]string{
+	PortContainer: "container",
+	PortPulse:     "pulse",
+	PortPipeWire:  "pipewire",
+	PortCable:     "cable",
+	PortPressure:  "pressure",
+	PortCrashdump: "crashdump",
+	PortConsole:   "console",
+	PortNotify:    "notify",
+	PortDBus:      "dbus",
+	PortQGA:       "qga",
+	PortClipboard: "clipboard",
+	PortCloudInit: "cloudinit",
+	PortBench:     "bench",
+	PortTransfer:  "transfer",
+	PortShare:     "share",
+	PortDiscovery: "discovery",
+	PortX11:       "x11",
+	PortWayland:   "wayland",
+}
+
+// PortName returns the name of the built-in service on port, if any.
+func PortName(port uint32) (string, bool) {
+	if port > PortX11 && port < PortX11+100 {
+		return fmt.Sprintf("x11:%d", port-PortX11), true
+	}
+	name, ok := wellKnown[port]
+	return name, ok
+}
+
+// PortClaim records which part of a process uses a port.
+type PortClaim struct {
+	Port  uint32
+	Owner string
+}
+
+// PortRegistry tracks the ports the parts of a process intend to use, so
+// collisions between them are reported at startup rather than as a failure
+// to listen, or worse, one service answering for another.
+type PortRegistry struct {
+	mutex  sync.Mutex
+	claims map[uint32]string
+}
+
+// Ports is the registry of the process.
+var Ports = &PortRegistry{}
+
+// Claim reserves port for owner. Claiming a port again for the same owner
+// succeeds.
+func (self *PortRegistry) Claim(port uint32, owner string) error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if other, ok := self.claims[port]; ok && other != owner {
+		return fmt.Errorf("vsock: port %d claimed by both %s and %s", port, other, owner)
+	}
+	if self.claims == nil {
+		self.claims = make(map[uint32]string)
+	}
+	self.claims[port] = owner
+	return nil
+}
+
+// Release gives up the claim of owner on port.
+func (self *PortRegistry) Release(port uint32, owner string) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if self.claims[port] == owner {
+		delete(self.claims, port)
+	}
+}
+
+// Owner returns who claimed port.
+func (self *PortRegistry) Owner(port uint32) (string, bool) {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	owner, ok := self.claims[port]
+	return owner, ok
+}
+
+// Claims returns every claim, ordered by port.
+func (self *PortRegistry) Claims() []PortClaim {
+	self.mutex.Lock()
+	claims := make([]PortClaim, 0, len(self.claims))
+	for port, owner := range self.claims {
+		claims = append(claims, PortClaim{port, owner})
+	}
+	self.mutex.Unlock()
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Port < claims[j].Port })
+	return claims
+}
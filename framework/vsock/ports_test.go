@@ -0,0 +1,34 @@
+package vsock
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPortRegistry(t *testing.T) {
+	registry := &PortRegistry{}
+	if err := registry.Claim(PortCable, "cable"); err != nil {
+		t.Fatalf("failed to claim: %v", err)
+	}
+	if err := registry.Claim(PortCable, "cable"); err != nil {
+		t.Fatalf("failed to claim again for the same owner: %v", err)
+	}
+	if err := registry.Claim(PortCable, "other"); err == nil {
+		t.Fatal("expected a collision")
+	}
+	registry.Claim(PortBench, "bench")
+	registry.Release(PortCable, "other")
+
+	want := []PortClaim{{PortCable, "cable"}, {PortBench, "bench"}}
+	if diff := cmp.Diff(want, registry.Claims()); diff != "" {
+		t.Fatalf("unexpected claims (-want +got):\n%s", diff)
+	}
+}
+
+func TestClassOf(t *testing.T) {
+	got := []PortClass{ClassOf(22), ClassOf(PortCable), ClassOf(DynamicPortMin)}
+	if diff := cmp.Diff([]PortClass{PortSystem, PortRegistered, PortDynamic}, got); diff != "" {
+		t.Fatalf("unexpected classes (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,56 @@
+package vsock
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// relayBufferSize is the size of the buffers of relays which cannot splice,
+// that of the largest virtio vsock packet.
+const relayBufferSize = 64 << 10
+
+var relayBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, relayBufferSize)
+	return &b
+}}
+
+// RelayStats reports what a relay moved.
+type RelayStats struct {
+	Bytes    int64
+	Duration time.Duration
+	// Spliced reports whether the data moved within the kernel with
+	// splice(2), never copied through user space.
+	Spliced bool
+}
+
+// Throughput returns the bytes relayed per second.
+func (self RelayStats) Throughput() float64 {
+	if self.Duration <= 0 {
+		return 0
+	}
+	return float64(self.Bytes) / self.Duration.Seconds()
+}
+
+// Relay copies from src to dst until src ends, as io.Copy does. When both
+// expose their file descriptors with syscall.Conn, as vsock, TCP and Unix
+// connections and files do, the data is spliced through a pipe on Linux
+// rather than copied through user space; otherwise it is copied through a
+// pooled buffer. Deadlines of both apply either way. Relay is for streams:
+// it does not keep the boundaries of messages.
+func Relay(dst io.Writer, src io.Reader) (RelayStats, error) {
+	start := time.Now()
+	written, handled, err := splice(dst, src)
+	stats := RelayStats{Bytes: written, Spliced: handled}
+	if !handled && err == nil {
+		b := relayBuffers.Get().(*[]byte)
+		// Hiding io.ReaderFrom and io.WriterTo keeps the copy on the
+		// pooled buffer.
+		var n int64
+		n, err = io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *b)
+		relayBuffers.Put(b)
+		stats.Bytes += n
+	}
+	stats.Duration = time.Since(start)
+	return stats, err
+}
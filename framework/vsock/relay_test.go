@@ -0,0 +1,109 @@
+//go:build linux
+
+package vsock
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// relayPair returns the two ends of a TCP connection over loopback.
+func relayPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close(); b.Close() })
+	return a, b
+}
+
+func TestRelay(t *testing.T) {
+	data := make([]byte, 3<<20+17)
+	rand.New(rand.NewSource(1)).Read(data)
+	path := filepath.Join(t.TempDir(), "data")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		src     func(t *testing.T) io.Reader
+		spliced bool
+	}{
+		{
+			name: "socket",
+			src: func(t *testing.T) io.Reader {
+				a, b := relayPair(t)
+				go func() {
+					a.Write(data)
+					a.Close()
+				}()
+				return b
+			},
+			spliced: true,
+		},
+		{
+			name: "file",
+			src: func(t *testing.T) io.Reader {
+				f, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { f.Close() })
+				return f
+			},
+			spliced: true,
+		},
+		{
+			name:    "buffer",
+			src:     func(t *testing.T) io.Reader { return bytes.NewReader(data) },
+			spliced: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := tt.src(t)
+			dst, peer := relayPair(t)
+			got := make(chan []byte, 1)
+			go func() {
+				b, _ := io.ReadAll(peer)
+				got <- b
+			}()
+
+			stats, err := Relay(dst, src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst.Close()
+			if !bytes.Equal(data, <-got) {
+				t.Fatal("relayed data differs")
+			}
+			if diff := cmp.Diff(int64(len(data)), stats.Bytes); diff != "" {
+				t.Fatalf("unexpected byte count (-want +got):\n%s", diff)
+			}
+			if stats.Spliced != tt.spliced {
+				t.Fatalf("Spliced = %v, want %v", stats.Spliced, tt.spliced)
+			}
+			if stats.Throughput() <= 0 {
+				t.Fatalf("Throughput() = %v", stats.Throughput())
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package vsock
+
+import "fmt"
+
+// Local is the context ID which loops back to the local machine, for
+// kernels with the vsock loopback transport. It reuses the reserved ID.
+const Local = cidReserved
+
+// Role is the part this machine plays in vsock communication.
+type Role int
+
+const (
+	RoleUnknown Role = iota
+	// RoleHost is the hypervisor host, whose context ID is Host.
+	RoleHost
+	// RoleGuest is a virtual machine with its own context ID.
+	RoleGuest
+)
+
+func (self Role) String() string {
+	switch self {
+	case RoleHost:
+		return "host"
+	case RoleGuest:
+		return "guest"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectRole determines the role of this machine from its context ID. It
+// returns RoleUnknown with the error when vsock is unavailable.
+func DetectRole() (Role, error) {
+	cid, err := ContextID()
+	if err != nil {
+		return RoleUnknown, err
+	}
+	return roleOf(cid), nil
+}
+
+func roleOf(cid uint32) Role {
+	switch cid {
+	case Host:
+		return RoleHost
+	case Hypervisor, cidReserved:
+		return RoleUnknown
+	default:
+		return RoleGuest
+	}
+}
+
+// RoleError reports a topology helper used on the wrong side of the
+// host/guest boundary.
+type RoleError struct {
+	Op   string
+	Want Role
+	Have Role
+}
+
+func (self *RoleError) Error() string {
+	return fmt.Sprintf("vsock: %s must be used on a %s, but this machine is a %s", self.Op, self.Want, self.Have)
+}
+
+// requireRole fails unless this machine plays role.
+func requireRole(op string, role Role) error {
+	have, err := DetectRole()
+	if err != nil {
+		return err
+	}
+	if have != role {
+		return &RoleError{Op: op, Want: role, Have: have}
+	}
+	return nil
+}
+
+// DialHost dials port on the host. From a guest this reaches the host
+// through the hypervisor; on the host itself it uses the loopback transport.
+func DialHost(port uint32) (*Conn, error) {
+	role, err := DetectRole()
+	if err != nil {
+		return nil, opError(opDial, err, nil, &Addr{ContextID: Host, Port: port})
+	}
+	if role == RoleHost {
+		return Dial(Local, port)
+	}
+	return Dial(Host, port)
+}
+
+// DialGuest dials port on the guest with context ID cid. It refuses the
+// well-known IDs of the host and hypervisor, which DialHost and
+// DialHypervisor reach.
+func DialGuest(cid, port uint32) (*Conn, error) {
+	if roleOf(cid) != RoleGuest {
+		return nil, opError(opDial, fmt.Errorf("vsock: context ID %d is not a guest", cid), nil, &Addr{ContextID: cid, Port: port})
+	}
+	return Dial(cid, port)
+}
+
+// DialHypervisor dials port on the hypervisor process itself, which is only
+// reachable from a guest.
+func DialHypervisor(port uint32) (*Conn, error) {
+	if err := requireRole("DialHypervisor", RoleGuest); err != nil {
+		return nil, opError(opDial, err, nil, &Addr{ContextID: Hypervisor, Port: port})
+	}
+	return Dial(Hypervisor, port)
+}
+
+// ListenHost listens on port of the host for connections from guests, the
+// only peers it accepts. On a machine which is both a guest and a host to
+// guests of its own, under nested virtualization, use Listen instead.
+func ListenHost(port uint32) (*VsockListener, error) {
+	if err := requireRole("ListenHost", RoleHost); err != nil {
+		return nil, opError(opListen, err, &Addr{ContextID: Host, Port: port}, nil)
+	}
+	config := &ListenConfig{ContextIDs: CIDRanges{GuestCIDs}}
+	return config.Listen(port)
+}
+
+// ListenGuest listens on port of a guest for connections from the host,
+// the only peer it accepts.
+func ListenGuest(port uint32) (*VsockListener, error) {
+	if err := requireRole("ListenGuest", RoleGuest); err != nil {
+		return nil, opError(opListen, err, nil, nil)
+	}
+	config := &ListenConfig{ContextIDs: CIDRanges{{Name: "host", Min: Host, Max: Host}}}
+	return config.Listen(port)
+}
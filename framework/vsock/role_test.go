@@ -0,0 +1,32 @@
+package vsock
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRoleError(t *testing.T) {
+	err := &RoleError{Op: "DialHypervisor", Want: RoleGuest, Have: RoleHost}
+	want := "vsock: DialHypervisor must be used on a guest, but this machine is a host"
+	if diff := cmp.Diff(want, err.Error()); diff != "" {
+		t.Fatalf("unexpected message (-want +got):\n%s", diff)
+	}
+}
+
+func TestRoleOf(t *testing.T) {
+	want := map[uint32]Role{
+		Hypervisor:  RoleUnknown,
+		cidReserved: RoleUnknown,
+		Host:        RoleHost,
+		3:           RoleGuest,
+		1 << 20:     RoleGuest,
+	}
+	got := make(map[uint32]Role)
+	for cid := range want {
+		got[cid] = roleOf(cid)
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected roles (-want +got):\n%s", diff)
+	}
+}
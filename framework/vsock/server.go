@@ -0,0 +1,254 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Server.Serve after a call to Shutdown or
+// Close.
+var ErrServerClosed = errors.New("vsock: Server closed")
+
+// A Handler serves a single accepted connection. The connection is closed
+// when ServeVsock returns.
+type Handler interface {
+	ServeVsock(conn net.Conn)
+}
+
+type HandlerFunc func(conn net.Conn)
+
+func (self HandlerFunc) ServeVsock(conn net.Conn) { self(conn) }
+
+// Server accepts connections and serves each one with Handler in its own
+// goroutine, in the manner of http.Server.
+type Server struct {
+	Handler Handler
+	// Middleware wraps Handler, the first entry being the outermost.
+	Middleware []Middleware
+	// MaxConns limits the number of connections served at once. While the
+	// limit is reached the server stops accepting, leaving new connections
+	// in the listen backlog. Zero means no limit.
+	MaxConns int
+	// ErrorLog receives handler panics and accept errors. Defaults to the
+	// standard logger.
+	ErrorLog *log.Logger
+
+	mutex     sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	slots     chan struct{}
+	done      chan struct{}
+	active    sync.WaitGroup
+	closed    bool
+}
+
+// ListenAndServe listens on port of the local context ID and serves
+// connections on it.
+func (self *Server) ListenAndServe(port uint32) error {
+	l, err := Listen(port)
+	if err != nil {
+		return err
+	}
+	return self.Serve(l)
+}
+
+// Serve accepts connections on l until it fails or the server is shut
+// down, in which case ErrServerClosed is returned. l is closed on return.
+func (self *Server) Serve(l net.Listener) error {
+	if !self.trackListener(l, true) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer self.trackListener(l, false)
+	defer l.Close()
+
+	var attempt int
+	for {
+		if !self.acquire() {
+			return ErrServerClosed
+		}
+
+		conn, err := l.Accept()
+		if err != nil {
+			self.release()
+			if self.shuttingDown() {
+				return ErrServerClosed
+			}
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				attempt++
+				delay := defaultBackoff(attempt)
+				self.logf("vsock: accept error: %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		attempt = 0
+
+		if !self.trackConn(conn, true) {
+			self.release()
+			conn.Close()
+			return ErrServerClosed
+		}
+		go self.serve(conn)
+	}
+}
+
+func (self *Server) serve(conn net.Conn) {
+	defer self.active.Done()
+	defer self.release()
+	defer self.trackConn(conn, false)
+	defer conn.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			buf := make([]byte, 64<<10)
+			buf = buf[:runtime.Stack(buf, false)]
+			self.logf("vsock: panic serving %v: %v\n%s", conn.RemoteAddr(), err, buf)
+		}
+	}()
+
+	Chain(self.Handler, self.Middleware...).ServeVsock(conn)
+}
+
+// Shutdown stops accepting connections and waits for active handlers to
+// return, or for ctx to be done. Connections are not closed; handlers
+// should watch for their own reasons to return.
+func (self *Server) Shutdown(ctx context.Context) error {
+	err := self.closeListeners()
+
+	done := make(chan struct{})
+	go func() {
+		self.active.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting connections and closes all active ones.
+func (self *Server) Close() error {
+	err := self.closeListeners()
+
+	self.mutex.Lock()
+	for conn := range self.conns {
+		if cerr := conn.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	self.mutex.Unlock()
+	return err
+}
+
+func (self *Server) closeListeners() error {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+
+	if !self.closed {
+		self.closed = true
+		if self.done != nil {
+			close(self.done)
+		}
+	}
+	var err error
+	for l := range self.listeners {
+		if cerr := l.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (self *Server) acquire() bool {
+	self.mutex.Lock()
+	if self.closed {
+		self.mutex.Unlock()
+		return false
+	}
+	if self.slots == nil && self.MaxConns > 0 {
+		self.slots = make(chan struct{}, self.MaxConns)
+	}
+	if self.done == nil {
+		self.done = make(chan struct{})
+	}
+	slots, done := self.slots, self.done
+	self.mutex.Unlock()
+
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+func (self *Server) release() {
+	self.mutex.Lock()
+	slots := self.slots
+	self.mutex.Unlock()
+	if slots != nil {
+		<-slots
+	}
+}
+
+func (self *Server) trackListener(l net.Listener, add bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !add {
+		delete(self.listeners, l)
+		return true
+	}
+	if self.closed {
+		return false
+	}
+	if self.listeners == nil {
+		self.listeners = make(map[net.Listener]struct{})
+	}
+	self.listeners[l] = struct{}{}
+	return true
+}
+
+func (self *Server) trackConn(conn net.Conn, add bool) bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	if !add {
+		delete(self.conns, conn)
+		return true
+	}
+	if self.closed {
+		return false
+	}
+	if self.conns == nil {
+		self.conns = make(map[net.Conn]struct{})
+	}
+	self.conns[conn] = struct{}{}
+	self.active.Add(1)
+	return true
+}
+
+func (self *Server) shuttingDown() bool {
+	self.mutex.Lock()
+	defer self.mutex.Unlock()
+	return self.closed
+}
+
+func (self *Server) logf(format string, args ...interface{}) {
+	if self.ErrorLog != nil {
+		self.ErrorLog.Printf(format, args...)
+		return
+	}
+	log.New(os.Stderr, "", log.LstdFlags).Printf(format, args...)
+}
@@ -0,0 +1,69 @@
+package vsock
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServerRecoversPanicAndShutsDown(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+
+	s := &Server{
+		Handler: HandlerFunc(func(conn net.Conn) {
+			var b [1]byte
+			if _, err := conn.Read(b[:]); err != nil {
+				return
+			}
+			if b[0] == 'p' {
+				panic("boom")
+			}
+			conn.Write(b[:])
+		}),
+		MaxConns: 1,
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+
+	served := make(chan error)
+	go func() { served <- s.Serve(l) }()
+
+	// A panicking handler must not take the server down, and must release
+	// its connection slot.
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	c.Write([]byte("p"))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after panic, got: %v", err)
+	}
+	c.Close()
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("x"))
+	b := make([]byte, 1)
+	if _, err := io.ReadFull(c, b); err != nil || b[0] != 'x' {
+		t.Fatalf("expected echo after panic, got %q: %v", b, err)
+	}
+	c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Fatalf("expected ErrServerClosed, got: %v", err)
+	}
+}
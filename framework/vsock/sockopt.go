@@ -0,0 +1,141 @@
+package vsock
+
+import (
+	"syscall"
+	"time"
+)
+
+// SocketOptions are options set on a socket before it binds or connects.
+// Zero fields leave the defaults of the system.
+type SocketOptions struct {
+	// BufferSize is the vsock buffer of the socket,
+	// SO_VM_SOCKETS_BUFFER_SIZE. On virtio it is the credit advertised to
+	// the peer, so it bounds how much the peer can have in flight. It is
+	// clamped to BufferMaxSize, 256KiB by default on Linux. Hyper-V
+	// sockets have no vsock buffers.
+	BufferSize uint64
+	// BufferMaxSize is the largest BufferSize allowed,
+	// SO_VM_SOCKETS_BUFFER_MAX_SIZE.
+	BufferMaxSize uint64
+	// ReadBuffer and WriteBuffer are the sizes of the receive and send
+	// buffers of the socket, SO_RCVBUF and SO_SNDBUF.
+	ReadBuffer  int
+	WriteBuffer int
+}
+
+// set sets the options on fd, the maximum buffer size before the size it
+// bounds.
+func (self *SocketOptions) set(fd int) error {
+	if self.BufferMaxSize > 0 || self.BufferSize > 0 {
+		if err := setBufferSizes(fd, self.BufferSize, self.BufferMaxSize); err != nil {
+			return err
+		}
+	}
+	if self.ReadBuffer > 0 {
+		if err := setsockoptInt(fd, soRcvbuf, self.ReadBuffer); err != nil {
+			return err
+		}
+	}
+	if self.WriteBuffer > 0 {
+		return setsockoptInt(fd, soSndbuf, self.WriteBuffer)
+	}
+	return nil
+}
+
+// prepare sets the options of the dialer on the socket rc, then calls its
+// Control hook with address.
+func (self *Dialer) prepare(rc syscall.RawConn, address string) error {
+	err := rawControl(rc, func(fd int) error {
+		if err := self.SocketOptions.set(fd); err != nil {
+			return err
+		}
+		if self.ConnectTimeout > 0 {
+			return setConnectTimeout(fd, self.ConnectTimeout)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if self.Control != nil {
+		return self.Control(network, address, rc)
+	}
+	return nil
+}
+
+// prepare sets the options of the configuration on the listening socket
+// rc, then calls its Control hook with address.
+func (self *ListenConfig) prepare(rc syscall.RawConn, address string) error {
+	if err := rawControl(rc, self.SocketOptions.set); err != nil {
+		return err
+	}
+	if self.Control != nil {
+		return self.Control(network, address, rc)
+	}
+	return nil
+}
+
+func rawControl(rc syscall.RawConn, fn func(fd int) error) error {
+	var err error
+	if doErr := rc.Control(func(fd uintptr) { err = fn(int(fd)) }); doErr != nil {
+		return doErr
+	}
+	return err
+}
+
+// WithBufferSize sets the BufferSize of a dialer.
+func WithBufferSize(size uint64) DialOption {
+	return func(d *Dialer) { d.BufferSize = size }
+}
+
+// WithBufferMaxSize sets the BufferMaxSize of a dialer.
+func WithBufferMaxSize(size uint64) DialOption {
+	return func(d *Dialer) { d.BufferMaxSize = size }
+}
+
+// WithReadBuffer sets the ReadBuffer of a dialer.
+func WithReadBuffer(bytes int) DialOption {
+	return func(d *Dialer) { d.ReadBuffer = bytes }
+}
+
+// WithWriteBuffer sets the WriteBuffer of a dialer.
+func WithWriteBuffer(bytes int) DialOption {
+	return func(d *Dialer) { d.WriteBuffer = bytes }
+}
+
+// WithConnectTimeout sets the ConnectTimeout of a dialer.
+func WithConnectTimeout(timeout time.Duration) DialOption {
+	return func(d *Dialer) { d.ConnectTimeout = timeout }
+}
+
+// ReadBuffer returns the size of the receive buffer of the connection. Linux
+// reports double the size set, the kernel keeping the rest for bookkeeping.
+func (self *Conn) ReadBuffer() (int, error) {
+	return self.sockoptInt(soRcvbuf)
+}
+
+// SetReadBuffer sets the size of the receive buffer of the connection.
+func (self *Conn) SetReadBuffer(bytes int) error {
+	return self.control(func(fd int) error { return setsockoptInt(fd, soRcvbuf, bytes) })
+}
+
+// WriteBuffer returns the size of the send buffer of the connection; see
+// ReadBuffer.
+func (self *Conn) WriteBuffer() (int, error) {
+	return self.sockoptInt(soSndbuf)
+}
+
+// SetWriteBuffer sets the size of the send buffer of the connection.
+func (self *Conn) SetWriteBuffer(bytes int) error {
+	return self.control(func(fd int) error { return setsockoptInt(fd, soSndbuf, bytes) })
+}
+
+func (self *Conn) sockoptInt(opt int) (int, error) {
+	var value int
+	err := self.control(func(fd int) error {
+		var err error
+		value, err = getsockoptInt(fd, opt)
+		return err
+	})
+	return value, err
+}
@@ -0,0 +1,227 @@
+//go:build linux
+
+package vsock
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"golang.org/x/sys/unix"
+)
+
+func TestDialOptions(t *testing.T) {
+	var d Dialer
+	for _, option := range []DialOption{
+		WithBufferSize(1 << 20),
+		WithBufferMaxSize(2 << 20),
+		WithReadBuffer(4096),
+		WithWriteBuffer(8192),
+		WithConnectTimeout(10 * time.Second),
+	} {
+		option(&d)
+	}
+	want := Dialer{
+		ConnectTimeout: 10 * time.Second,
+		SocketOptions: SocketOptions{
+			BufferSize:    1 << 20,
+			BufferMaxSize: 2 << 20,
+			ReadBuffer:    4096,
+			WriteBuffer:   8192,
+		},
+	}
+	if diff := cmp.Diff(want, d); diff != "" {
+		t.Fatalf("unexpected dialer (-want +got):\n%s", diff)
+	}
+}
+
+// unixConn returns a Conn over one end of a Unix socket connection, whose
+// socket options are set as those of vsock sockets are.
+func unixConn(t *testing.T) (*Conn, syscall.RawConn) {
+	c, rc, _ := unixPeer(t)
+	return c, rc
+}
+
+// unixPeer is unixConn also returning the other end of the connection.
+func unixPeer(t *testing.T) (*Conn, syscall.RawConn, net.Conn) {
+	l, err := net.Listen("unix", filepath.Join(t.TempDir(), "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("unix", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(); peer.Close() })
+
+	addr := &Addr{ContextID: Host, Port: 1024}
+	c, err := newConn(&netConnFD{c: conn}, addr, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := conn.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, rc, peer
+}
+
+func TestSetLinger(t *testing.T) {
+	c, rc := unixConn(t)
+	linger := func() unix.Linger {
+		var l *unix.Linger
+		rc.Control(func(fd uintptr) {
+			l, _ = unix.GetsockoptLinger(int(fd), unix.SOL_SOCKET, unix.SO_LINGER)
+		})
+		return *l
+	}
+	for _, tt := range []struct {
+		sec  int
+		want unix.Linger
+	}{
+		{5, unix.Linger{Onoff: 1, Linger: 5}},
+		{0, unix.Linger{Onoff: 1}},
+		{-1, unix.Linger{}},
+	} {
+		if err := c.SetLinger(tt.sec); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(tt.want, linger()); diff != "" {
+			t.Errorf("unexpected linger after SetLinger(%d) (-want +got):\n%s", tt.sec, diff)
+		}
+	}
+}
+
+func TestCloseWithTimeout(t *testing.T) {
+	// A peer reading to the end and closing gets all the data.
+	c, _, peer := unixPeer(t)
+	received := make(chan string, 1)
+	go func() {
+		b, _ := io.ReadAll(peer)
+		peer.Close()
+		received <- string(b)
+	}()
+	if _, err := c.Write([]byte("goodbye")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CloseWithTimeout(time.Second); err != nil {
+		t.Fatalf("CloseWithTimeout() = %v, want nil", err)
+	}
+	if diff := cmp.Diff("goodbye", <-received); diff != "" {
+		t.Errorf("unexpected data received (-want +got):\n%s", diff)
+	}
+
+	// A peer keeping its side open is given up on after the timeout.
+	c, _, _ = unixPeer(t)
+	start := time.Now()
+	if err := c.CloseWithTimeout(50 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("CloseWithTimeout() = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("CloseWithTimeout() returned after %v, want about 50ms", elapsed)
+	}
+}
+
+func TestConnBuffers(t *testing.T) {
+	c, _ := unixConn(t)
+	if err := c.SetReadBuffer(16 << 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetWriteBuffer(32 << 10); err != nil {
+		t.Fatal(err)
+	}
+	// Linux doubles the sizes set.
+	if n, err := c.ReadBuffer(); err != nil || n != 32<<10 {
+		t.Errorf("ReadBuffer() = %d, %v, want %d", n, err, 32<<10)
+	}
+	if n, err := c.WriteBuffer(); err != nil || n != 64<<10 {
+		t.Errorf("WriteBuffer() = %d, %v, want %d", n, err, 64<<10)
+	}
+}
+
+func TestBufferSizes(t *testing.T) {
+	cfd, err := newConnFD(Stream)
+	if err != nil {
+		t.Skipf("vsock unavailable: %v", err)
+	}
+	addr := &Addr{ContextID: Host, Port: 1024}
+	c, err := newConn(cfd, addr, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.SetBufferSize(128 << 10); err != nil {
+		t.Fatal(err)
+	}
+	sizes, err := c.BufferSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes.Size != 128<<10 || sizes.Min > sizes.Size || sizes.Max < sizes.Size {
+		t.Fatalf("BufferSizes() = %+v, want a size of %d within the bounds", sizes, 128<<10)
+	}
+	// Lowering the maximum shrinks the buffer with it.
+	if err := c.SetBufferMaxSize(64 << 10); err != nil {
+		t.Fatal(err)
+	}
+	sizes, err = c.BufferSizes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]uint64{64 << 10, 64 << 10}, []uint64{sizes.Size, sizes.Max}); diff != "" {
+		t.Fatalf("unexpected size and maximum (-want +got):\n%s", diff)
+	}
+
+	// The accessors fail on sockets of another family.
+	u, _ := unixConn(t)
+	if _, err := u.BufferSizes(); err == nil {
+		t.Error("expected the buffer sizes of a Unix socket to be unavailable")
+	}
+}
+
+func TestTransportLoopback(t *testing.T) {
+	for _, ends := range [][2]uint32{{Local, Local}, {3, 3}, {3, cidReserved}} {
+		if diff := cmp.Diff(TransportLoopback, transportFor(ends[0], ends[1])); diff != "" {
+			t.Errorf("unexpected transport from %d to %d (-want +got):\n%s", ends[0], ends[1], diff)
+		}
+	}
+}
+
+func TestDialerPrepare(t *testing.T) {
+	c, rc := unixConn(t)
+	var network, address string
+	d := &Dialer{
+		SocketOptions: SocketOptions{ReadBuffer: 8 << 10},
+		Control: func(n, a string, _ syscall.RawConn) error {
+			network, address = n, a
+			return nil
+		},
+	}
+	if err := d.prepare(rc, "vm(3):1024"); err != nil {
+		t.Fatal(err)
+	}
+	if network != "vsock" || address != "vm(3):1024" {
+		t.Errorf("control called with %q, %q", network, address)
+	}
+	if n, err := c.ReadBuffer(); err != nil || n != 16<<10 {
+		t.Errorf("ReadBuffer() = %d, %v, want %d", n, err, 16<<10)
+	}
+
+	// The vsock options fail on a socket of another family.
+	d = &Dialer{SocketOptions: SocketOptions{BufferSize: 1 << 20}}
+	if err := d.prepare(rc, "vm(3):1024"); err == nil {
+		t.Error("expected setting a vsock buffer size on a Unix socket to fail")
+	}
+}
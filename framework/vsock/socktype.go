@@ -0,0 +1,49 @@
+package vsock
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// SocketType is the type of a vsock socket.
+type SocketType int
+
+const (
+	// Stream is a connected byte stream, and the default.
+	Stream SocketType = iota
+	// Seqpacket is connected like Stream, but keeps the boundaries of
+	// messages: each Write sends one message, and each Read returns one,
+	// truncated to the buffer and the rest discarded if it is longer.
+	// Supported since Linux 5.16, by the virtio transport.
+	Seqpacket
+	// Datagram is connectionless and unreliable; see ListenDatagram.
+	// Few transports support it.
+	Datagram
+)
+
+func (self SocketType) String() string {
+	switch self {
+	case Stream:
+		return "stream"
+	case Seqpacket:
+		return "seqpacket"
+	case Datagram:
+		return "datagram"
+	default:
+		return fmt.Sprintf("SocketType(%d)", int(self))
+	}
+}
+
+var errDatagram = errors.New("vsock: datagram sockets are unconnected; use ListenDatagram or DialDatagram")
+
+// ListenSeqpacket listens on port of the local context ID for Seqpacket
+// connections.
+func ListenSeqpacket(port uint32) (*VsockListener, error) {
+	return listenPort(port, &ListenConfig{Type: Seqpacket})
+}
+
+// DialSeqpacket dials a Seqpacket connection to port on contextID.
+func DialSeqpacket(contextID, port uint32) (*Conn, error) {
+	return DialContext(context.Background(), contextID, port, WithType(Seqpacket))
+}
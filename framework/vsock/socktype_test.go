@@ -0,0 +1,99 @@
+//go:build linux
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSeqpacket(t *testing.T) {
+	if _, err := socket(Seqpacket); err != nil {
+		t.Skipf("seqpacket unavailable: %v", err)
+	}
+	l, err := ListenSeqpacket(0)
+	if err != nil {
+		t.Skipf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	local := l.Addr().(*Addr)
+	c, err := DialContext(context.Background(), local.ContextID, local.Port, WithType(Seqpacket), WithTimeout(200*time.Millisecond))
+	if err != nil {
+		t.Skipf("no loopback transport: %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer s.Close()
+
+	for _, msg := range []string{"first", "second message", "third"} {
+		if _, err := c.Write([]byte(msg)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	// Each read returns one message, the second truncated to the buffer.
+	var got []string
+	for i := 0; i < 3; i++ {
+		b := make([]byte, 6)
+		n, err := s.Read(b)
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		got = append(got, string(b[:n]))
+	}
+	if diff := cmp.Diff([]string{"first", "second", "third"}, got); diff != "" {
+		t.Fatalf("unexpected messages (-want +got):\n%s", diff)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	if _, err := (&Dialer{Type: Datagram}).Dial(Local, 1024); !errors.Is(err, errDatagram) {
+		t.Fatalf("expected dialing a datagram socket to be refused, got %v", err)
+	}
+	if _, err := (&ListenConfig{Type: Datagram}).Listen(0); err == nil {
+		t.Fatal("expected listening on a datagram socket to be refused")
+	}
+
+	if _, err := socket(Datagram); err != nil {
+		t.Skipf("datagram unavailable: %v", err)
+	}
+	server, err := ListenDatagram(0)
+	if err != nil {
+		t.Skipf("failed to listen: %v", err)
+	}
+	defer server.Close()
+	local := server.LocalAddr().(*Addr)
+	client, err := DialDatagram(local.ContextID, local.Port)
+	if err != nil {
+		t.Skipf("no loopback transport: %v", err)
+	}
+	defer client.Close()
+
+	server.SetDeadline(time.Now().Add(time.Second))
+	client.SetDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Skipf("no loopback transport: %v", err)
+	}
+	b := make([]byte, 16)
+	n, from, err := server.ReadFrom(b)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if _, err := server.WriteTo([]byte("pong"), from); err != nil {
+		t.Fatalf("failed to reply: %v", err)
+	}
+	m, err := client.Read(b[n:])
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+	if diff := cmp.Diff("pingpong", string(b[:n+m])); diff != "" {
+		t.Fatalf("unexpected datagrams (-want +got):\n%s", diff)
+	}
+}
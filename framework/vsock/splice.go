@@ -0,0 +1,143 @@
+//go:build linux
+
+package vsock
+
+import (
+	"errors"
+	"io"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// spliceMax is the most one splice moves, and the size asked of the pipe.
+const spliceMax = 1 << 20
+
+// splice moves src to dst through a pipe, if both have file descriptors.
+// handled is false if they have not, or the kernel cannot splice them; the
+// written bytes, if any, were moved before the kernel refused, and the
+// caller copies the rest.
+func splice(dst io.Writer, src io.Reader) (written int64, handled bool, err error) {
+	dc, ok := dst.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	sc, ok := src.(syscall.Conn)
+	if !ok {
+		return 0, false, nil
+	}
+	dstRaw, err := dc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+	srcRaw, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false, nil
+	}
+
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return 0, false, nil
+	}
+	defer unix.Close(p[0])
+	defer unix.Close(p[1])
+	// A larger pipe moves more with each call; the default of 64KiB works
+	// too, if the limit of the system is lower.
+	unix.FcntlInt(uintptr(p[1]), unix.F_SETPIPE_SZ, spliceMax)
+
+	for {
+		n, err := spliceDrain(p[1], srcRaw)
+		if err != nil {
+			if written == 0 && cannotSplice(err) {
+				return 0, false, nil
+			}
+			return written, true, err
+		}
+		if n == 0 {
+			return written, true, nil
+		}
+		m, err := splicePump(dstRaw, p[0], n)
+		written += m
+		if err != nil {
+			if written == 0 && cannotSplice(err) {
+				// The data is in the pipe; hand it over and let the
+				// caller copy the rest.
+				m, err := pipeTo(dst, p[0], n)
+				return m, false, err
+			}
+			return written, true, err
+		}
+	}
+}
+
+// spliceDrain moves what src has to read, up to spliceMax, into the pipe.
+func spliceDrain(pipe int, src syscall.RawConn) (int, error) {
+	var (
+		n    int64
+		serr error
+	)
+	err := src.Read(func(fd uintptr) bool {
+		for {
+			n, serr = unix.Splice(int(fd), nil, pipe, nil, spliceMax, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+			if serr != unix.EINTR {
+				return serr != unix.EAGAIN
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	if serr != nil {
+		return 0, os.NewSyscallError("splice", serr)
+	}
+	return int(n), nil
+}
+
+// splicePump moves the n bytes in the pipe to dst.
+func splicePump(dst syscall.RawConn, pipe int, n int) (int64, error) {
+	var written int64
+	for n > 0 {
+		var (
+			m    int64
+			serr error
+		)
+		err := dst.Write(func(fd uintptr) bool {
+			for {
+				m, serr = unix.Splice(pipe, nil, int(fd), nil, n, unix.SPLICE_F_MOVE|unix.SPLICE_F_NONBLOCK)
+				if serr != unix.EINTR {
+					return serr != unix.EAGAIN
+				}
+			}
+		})
+		if err != nil {
+			return written, err
+		}
+		if serr != nil {
+			return written, os.NewSyscallError("splice", serr)
+		}
+		if m == 0 {
+			return written, io.ErrShortWrite
+		}
+		written += m
+		n -= int(m)
+	}
+	return written, nil
+}
+
+// pipeTo writes the n bytes in the pipe to dst.
+func pipeTo(dst io.Writer, pipe int, n int) (int64, error) {
+	b := make([]byte, n)
+	m, err := unix.Read(pipe, b)
+	if err != nil {
+		return 0, os.NewSyscallError("read", err)
+	}
+	written, err := dst.Write(b[:m])
+	return int64(written), err
+}
+
+// cannotSplice reports whether err is the kernel refusing to splice the
+// descriptors, as for sockets of families without splice support.
+func cannotSplice(err error) bool {
+	return errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP)
+}
@@ -0,0 +1,164 @@
+package vsock
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Tracer is told of the events of the connections of a Dialer or
+// ListenConfig, to feed a metrics or tracing system. Its methods are called
+// from the goroutines dialing, accepting, reading and writing, so they must
+// be safe for concurrent use and return quickly. Embed NopTracer to handle
+// only some events.
+type Tracer interface {
+	// DialStart is called as a dial of addr starts, and DialDone as it
+	// ends, with the connection or the error.
+	DialStart(addr *Addr)
+	DialDone(addr *Addr, conn *Conn, err error)
+	// Accept is called with each connection accepted, and AcceptError
+	// with each error Accept returns.
+	Accept(conn *Conn)
+	AcceptError(err error)
+	// ReadError and WriteError are called with each error of a read or
+	// write, but io.EOF.
+	ReadError(conn *Conn, err error)
+	WriteError(conn *Conn, err error)
+	// Close is called once, as the connection is first closed; its Stats
+	// are final.
+	Close(conn *Conn)
+}
+
+// NopTracer ignores every event.
+type NopTracer struct{}
+
+func (NopTracer) DialStart(*Addr)              {}
+func (NopTracer) DialDone(*Addr, *Conn, error) {}
+func (NopTracer) Accept(*Conn)                 {}
+func (NopTracer) AcceptError(error)            {}
+func (NopTracer) ReadError(*Conn, error)       {}
+func (NopTracer) WriteError(*Conn, error)      {}
+func (NopTracer) Close(*Conn)                  {}
+
+// TraceCounters is a Tracer counting events. It is safe for concurrent use,
+// and its fields may be read at any time with the sync/atomic functions,
+// to export them.
+type TraceCounters struct {
+	Dials        int64
+	DialErrors   int64
+	Accepts      int64
+	AcceptErrors int64
+	// Active counts the connections open, and Closed those closed.
+	Active       int64
+	Closed       int64
+	ReadErrors   int64
+	WriteErrors  int64
+	BytesRead    int64
+	BytesWritten int64
+}
+
+var _ Tracer = &TraceCounters{}
+
+func (self *TraceCounters) DialStart(*Addr) { atomic.AddInt64(&self.Dials, 1) }
+
+func (self *TraceCounters) DialDone(_ *Addr, _ *Conn, err error) {
+	if err != nil {
+		atomic.AddInt64(&self.DialErrors, 1)
+		return
+	}
+	atomic.AddInt64(&self.Active, 1)
+}
+
+func (self *TraceCounters) Accept(*Conn) {
+	atomic.AddInt64(&self.Accepts, 1)
+	atomic.AddInt64(&self.Active, 1)
+}
+
+func (self *TraceCounters) AcceptError(error)       { atomic.AddInt64(&self.AcceptErrors, 1) }
+func (self *TraceCounters) ReadError(*Conn, error)  { atomic.AddInt64(&self.ReadErrors, 1) }
+func (self *TraceCounters) WriteError(*Conn, error) { atomic.AddInt64(&self.WriteErrors, 1) }
+
+func (self *TraceCounters) Close(conn *Conn) {
+	stats := conn.Stats()
+	atomic.AddInt64(&self.Active, -1)
+	atomic.AddInt64(&self.Closed, 1)
+	atomic.AddInt64(&self.BytesRead, stats.BytesRead)
+	atomic.AddInt64(&self.BytesWritten, stats.BytesWritten)
+}
+
+// ConnStats are the counters of a connection.
+type ConnStats struct {
+	BytesRead    int64
+	BytesWritten int64
+	ReadErrors   int64
+	WriteErrors  int64
+	// Opened is when the connection was dialed or accepted, and Duration
+	// how long it has been open, or was until closed.
+	Opened   time.Time
+	Duration time.Duration
+}
+
+// connCounters are the counters of a Conn, and what it reports to.
+type connCounters struct {
+	bytesRead    atomic.Int64
+	bytesWritten atomic.Int64
+	readErrors   atomic.Int64
+	writeErrors  atomic.Int64
+	// closed is when the connection was first closed, in Unix nanoseconds.
+	closed atomic.Int64
+
+	tracer   Tracer
+	listener *listenerConns
+}
+
+// Stats returns the counters of the connection.
+func (self *Conn) Stats() ConnStats {
+	stats := ConnStats{
+		BytesRead:    self.counters.bytesRead.Load(),
+		BytesWritten: self.counters.bytesWritten.Load(),
+		ReadErrors:   self.counters.readErrors.Load(),
+		WriteErrors:  self.counters.writeErrors.Load(),
+		Opened:       self.opened,
+	}
+	if !self.opened.IsZero() {
+		end := time.Now()
+		if closed := self.counters.closed.Load(); closed != 0 {
+			end = time.Unix(0, closed)
+		}
+		stats.Duration = end.Sub(self.opened)
+	}
+	return stats
+}
+
+func (self *Conn) countRead(n int, err error) {
+	self.counters.bytesRead.Add(int64(n))
+	if err != nil && err != io.EOF {
+		self.counters.readErrors.Add(1)
+		if self.counters.tracer != nil {
+			self.counters.tracer.ReadError(self, err)
+		}
+	}
+}
+
+func (self *Conn) countWrite(n int, err error) {
+	self.counters.bytesWritten.Add(int64(n))
+	if err != nil {
+		self.counters.writeErrors.Add(1)
+		if self.counters.tracer != nil {
+			self.counters.tracer.WriteError(self, err)
+		}
+	}
+}
+
+// countClose reports the connection closed, the first time it is.
+func (self *Conn) countClose() {
+	if !self.counters.closed.CompareAndSwap(0, time.Now().UnixNano()) {
+		return
+	}
+	if self.counters.listener != nil {
+		self.counters.listener.remove(self)
+	}
+	if self.counters.tracer != nil {
+		self.counters.tracer.Close(self)
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package vsock_test
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+// eventTracer records the events it is told of.
+type eventTracer struct {
+	vsock.NopTracer
+	mutex  sync.Mutex
+	events []string
+}
+
+func (self *eventTracer) record(event string) {
+	self.mutex.Lock()
+	self.events = append(self.events, event)
+	self.mutex.Unlock()
+}
+
+func (self *eventTracer) DialStart(addr *vsock.Addr) { self.record("dial " + addr.String()) }
+func (self *eventTracer) DialDone(addr *vsock.Addr, conn *vsock.Conn, err error) {
+	if err != nil {
+		self.record("dial failed")
+		return
+	}
+	self.record("dialed")
+}
+func (self *eventTracer) Accept(conn *vsock.Conn) {
+	self.record("accepted " + conn.RemoteAddr().String())
+}
+func (self *eventTracer) Close(conn *vsock.Conn) { self.record("closed") }
+
+func TestTracer(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	var counters vsock.TraceCounters
+	l, err := (&vsock.ListenConfig{Tracer: &counters}).Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *vsock.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- c.(*vsock.Conn)
+	}()
+
+	tracer := &eventTracer{}
+	d := &vsock.Dialer{Tracer: tracer}
+	c, err := d.DialContext(context.Background(), vsock.Host, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.DialContext(context.Background(), vsock.Host, 1025); err == nil {
+		t.Fatal("expected dialing a port nobody listens on to fail")
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("failed to accept")
+	}
+
+	if _, err := c.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	c.CloseWrite()
+	if b, err := io.ReadAll(server); err != nil || string(b) != "hello" {
+		t.Fatalf("read %q, %v", b, err)
+	}
+	if diff := cmp.Diff(vsock.ListenerStats{Accepted: 1, Active: 1}, l.Stats()); diff != "" {
+		t.Fatalf("unexpected listener stats (-want +got):\n%s", diff)
+	}
+	server.Close()
+	c.Close()
+	c.Close()
+
+	stats := server.Stats()
+	if stats.BytesRead != 5 || stats.Opened.IsZero() || stats.Duration <= 0 {
+		t.Fatalf("unexpected stats of the accepted connection: %+v", stats)
+	}
+	if diff := cmp.Diff(int64(5), c.Stats().BytesWritten); diff != "" {
+		t.Fatalf("unexpected bytes written (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(vsock.ListenerStats{Accepted: 1}, l.Stats()); diff != "" {
+		t.Fatalf("unexpected listener stats (-want +got):\n%s", diff)
+	}
+
+	want := []string{"dial host(2):1024", "dialed", "dial host(2):1025", "dial failed", "closed"}
+	if diff := cmp.Diff(want, tracer.events); diff != "" {
+		t.Fatalf("unexpected events (-want +got):\n%s", diff)
+	}
+	got := vsock.TraceCounters{
+		Accepts:   atomic.LoadInt64(&counters.Accepts),
+		Active:    atomic.LoadInt64(&counters.Active),
+		Closed:    atomic.LoadInt64(&counters.Closed),
+		BytesRead: atomic.LoadInt64(&counters.BytesRead),
+	}
+	if diff := cmp.Diff(vsock.TraceCounters{Accepts: 1, Closed: 1, BytesRead: 5}, got); diff != "" {
+		t.Fatalf("unexpected counters (-want +got):\n%s", diff)
+	}
+}
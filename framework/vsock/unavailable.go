@@ -0,0 +1,60 @@
+package vsock
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Cause is the likely reason vsock is unavailable.
+type Cause int
+
+const (
+	CauseUnknown Cause = iota
+	// CauseModuleNotLoaded: the kernel has no vsock support loaded.
+	CauseModuleNotLoaded
+	// CauseNoTransport: vsock is loaded, but no transport to carry it.
+	CauseNoTransport
+	// CauseDeviceNotAttached: the guest transport is loaded, but the
+	// virtual machine has no vsock device.
+	CauseDeviceNotAttached
+	// CausePermission: the process may not use vsock.
+	CausePermission
+)
+
+func (self Cause) String() string {
+	switch self {
+	case CauseModuleNotLoaded:
+		return "module not loaded"
+	case CauseNoTransport:
+		return "no transport"
+	case CauseDeviceNotAttached:
+		return "device not attached"
+	case CausePermission:
+		return "permission denied"
+	default:
+		return "unknown"
+	}
+}
+
+// UnavailableError reports that vsock cannot be used on this machine, with
+// its likely cause and a hint at the remedy. It unwraps to the underlying
+// error, such as EAFNOSUPPORT.
+type UnavailableError struct {
+	Cause Cause
+	Hint  string
+	Err   error
+}
+
+func (self *UnavailableError) Error() string {
+	return fmt.Sprintf("vsock unavailable (%s): %v; %s", self.Cause, self.Err, self.Hint)
+}
+
+func (self *UnavailableError) Unwrap() error { return self.Err }
+
+// IsUnavailable reports whether err shows vsock is unavailable on this
+// machine, returning the detailed error if so.
+func IsUnavailable(err error) (*UnavailableError, bool) {
+	var uerr *UnavailableError
+	ok := errors.As(err, &uerr)
+	return uerr, ok
+}
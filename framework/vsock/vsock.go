@@ -1,6 +1,7 @@
 package vsock
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -86,13 +87,17 @@ func (self errOp) String() string {
 }
 
 func Listen(port uint32) (*VsockListener, error) {
+	return listenPort(port, &ListenConfig{})
+}
+
+func listenPort(port uint32, config *ListenConfig) (*VsockListener, error) {
 	cid, err := ContextID()
 	if err != nil {
 		// No addresses available.
 		return nil, opError(opListen, err, nil, nil)
 	}
 
-	l, err := listen(cid, port)
+	l, err := listen(cid, port, config)
 	if err != nil {
 		// No remote address available.
 		return nil, opError(opListen, err, &Addr{
@@ -108,22 +113,13 @@ var _ net.Listener = &VsockListener{}
 
 type VsockListener struct {
 	listener *listener
-}
-
-func (self *VsockListener) Accept() (net.Conn, error) {
-	c, err := self.listener.Accept()
-	if err != nil {
-		return nil, self.opError(opAccept, err)
-	}
-
-	return c, nil
+	conns    listenerConns
 }
 
 func (self *VsockListener) Addr() net.Addr {
 	return self.listener.Addr()
 }
 
-func (self *VsockListener) Close() error { return self.opError(opClose, self.listener.Close()) }
 func (self *VsockListener) SetDeadline(t time.Time) error {
 	return self.opError(opSet, self.listener.SetDeadline(t))
 }
@@ -131,28 +127,29 @@ func (self *VsockListener) opError(op errOp, err error) error {
 	return opError(op, err, self.Addr(), nil)
 }
 
+// Dial dials port on contextID. Use DialContext to bound how long the
+// connect may take.
 func Dial(contextID, port uint32) (*Conn, error) {
-	c, err := dial(contextID, port)
-	if err != nil {
-		return nil, opError(opDial, err, nil, &Addr{
-			ContextID: contextID,
-			Port:      port,
-		})
-	}
-
-	return c, nil
+	return DialContext(context.Background(), contextID, port)
 }
 
 var _ net.Conn = &Conn{}
 var _ syscall.Conn = &Conn{}
 
 type Conn struct {
-	fd     connFD
-	local  *Addr
-	remote *Addr
+	fd       connFD
+	local    *Addr
+	remote   *Addr
+	opened   time.Time
+	counters connCounters
+}
+
+func (self *Conn) Close() error {
+	err := self.fd.Close()
+	self.countClose()
+	return self.opError(opClose, err)
 }
 
-func (self *Conn) Close() error         { return self.opError(opClose, self.fd.Close()) }
 func (self *Conn) CloseRead() error     { return self.opError(opClose, self.fd.Shutdown(shutRd)) }
 func (self *Conn) CloseWrite() error    { return self.opError(opClose, self.fd.Shutdown(shutWr)) }
 func (self *Conn) LocalAddr() net.Addr  { return self.local }
@@ -161,19 +158,19 @@ func (self *Conn) RemoteAddr() net.Addr { return self.remote }
 func (self *Conn) Read(b []byte) (int, error) {
 	n, err := self.fd.Read(b)
 	if err != nil {
-		return n, self.opError(opRead, err)
+		err = self.opError(opRead, err)
 	}
-
-	return n, nil
+	self.countRead(n, err)
+	return n, err
 }
 
 func (self *Conn) Write(b []byte) (int, error) {
 	n, err := self.fd.Write(b)
 	if err != nil {
-		return n, self.opError(opWrite, err)
+		err = self.opError(opWrite, err)
 	}
-
-	return n, nil
+	self.countWrite(n, err)
+	return n, err
 }
 
 // A deadlineType specifies the type of deadline to set for a Conn.
@@ -212,6 +209,20 @@ func (self *Conn) SyscallConn() (syscall.RawConn, error) {
 	}, nil
 }
 
+func (self *Conn) control(fn func(fd int) error) error {
+	rc, err := self.fd.SyscallConn()
+	if err != nil {
+		return self.opError(opSyscallConn, err)
+	}
+	doErr := rc.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	})
+	if doErr != nil {
+		return self.opError(opRawControl, doErr)
+	}
+	return self.opError(opRawControl, err)
+}
+
 func (c *Conn) opError(op errOp, err error) error { return opError(op, err, c.local, c.remote) }
 
 var _ syscall.RawConn = &rawConn{}
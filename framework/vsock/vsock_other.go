@@ -0,0 +1,72 @@
+//go:build !linux && !windows
+
+package vsock
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+// On platforms other than Linux and Windows there is no vsock: dials,
+// listens and ContextID fail with an UnavailableError, so transports which
+// fall back on others, such as TCP for development on macOS, move on.
+
+var errUnsupported = errors.New("vsock: not supported on this platform")
+
+func unavailable() error {
+	return &UnavailableError{
+		Cause: CauseNoTransport,
+		Hint:  "run in a Linux or Windows virtual machine or host, or use the TCP transport for development",
+		Err:   errUnsupported,
+	}
+}
+
+func contextID() (uint32, error) { return 0, unavailable() }
+
+// connFD is the socket of a Conn.
+type connFD interface {
+	io.ReadWriteCloser
+	Shutdown(how int) error
+	SetDeadline(t time.Time, typ deadlineType) error
+	SyscallConn() (syscall.RawConn, error)
+}
+
+type listener struct {
+	addr   *Addr
+	config ListenConfig
+}
+
+func (self *listener) Addr() net.Addr                { return self.addr }
+func (self *listener) Close() error                  { return errUnsupported }
+func (self *listener) SetDeadline(t time.Time) error { return errUnsupported }
+func (self *listener) Accept() (net.Conn, error)     { return nil, errUnsupported }
+
+func listen(cid, port uint32, config *ListenConfig) (*VsockListener, error) {
+	return nil, unavailable()
+}
+
+func dial(ctx context.Context, d *Dialer, cid, port uint32) (*Conn, error) {
+	return nil, unavailable()
+}
+
+func diagnose(err error) error { return err }
+
+func setLinger(fd, sec int) error { return errUnsupported }
+
+const (
+	soRcvbuf = syscall.SO_RCVBUF
+	soSndbuf = syscall.SO_SNDBUF
+)
+
+func getsockoptInt(fd, opt int) (int, error)                { return 0, errUnsupported }
+func setsockoptInt(fd, opt, value int) error                { return errUnsupported }
+func setBufferSizes(fd int, size, max uint64) error         { return errUnsupported }
+func setConnectTimeout(fd int, timeout time.Duration) error { return errUnsupported }
+
+func splice(dst io.Writer, src io.Reader) (int64, bool, error) { return 0, false, nil }
+
+func isErrno(err error, errno int) bool { return false }
@@ -5,7 +5,27 @@ import (
 	"time"
 )
 
+// Accept accepts a connection from l, giving up after timeout if it is not
+// zero. Temporary errors are retried with exponential backoff from 5ms to
+// 1s.
 func Accept(l net.Listener, timeout time.Duration) (net.Conn, error) {
+	return AcceptWith(l, AcceptOptions{Timeout: timeout})
+}
+
+// AcceptOptions control how AcceptWith waits and retries.
+type AcceptOptions struct {
+	// Timeout, if not zero, bounds the whole call. On expiry l is closed.
+	Timeout time.Duration
+	// Backoff spaces retries after temporary errors. Defaults to
+	// exponential backoff from 5ms to 1s.
+	Backoff Backoff
+	// MaxRetryTime, if not zero, bounds the total time spent retrying
+	// temporary errors, after which the last one is returned.
+	MaxRetryTime time.Duration
+}
+
+// AcceptWith accepts a connection from l as configured by options.
+func AcceptWith(l net.Listener, options AcceptOptions) (net.Conn, error) {
 	// This function accommodates both Go1.12+ and Go1.11 functionality to allow
 	// net.Listener.Accept to be canceled by net.Listener.Close.
 	//
@@ -16,24 +36,39 @@ func Accept(l net.Listener, timeout time.Duration) (net.Conn, error) {
 	// For Go 1.12+, we could use vsock.Listener.SetDeadline, but this approach
 	// using a timer works for Go 1.11 as well.
 	cancel := func() {}
-	if timeout != 0 {
-		timer := time.AfterFunc(timeout, func() { _ = l.Close() })
+	if options.Timeout != 0 {
+		timer := time.AfterFunc(options.Timeout, func() { _ = l.Close() })
 		cancel = func() { timer.Stop() }
 	}
+	defer cancel()
+
+	backoff := options.Backoff
+	if backoff == nil {
+		backoff = defaultBackoff
+	}
 
+	var (
+		attempt int
+		first   time.Time
+	)
 	for {
 		c, err := l.Accept()
 		if err != nil {
 			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				time.Sleep(250 * time.Millisecond)
+				if attempt == 0 {
+					first = time.Now()
+				}
+				attempt++
+				if options.MaxRetryTime != 0 && time.Since(first) >= options.MaxRetryTime {
+					return nil, err
+				}
+				time.Sleep(backoff(attempt))
 				continue
 			}
 
 			return nil, err
 		}
 
-		// Got a connection, stop the timer.
-		cancel()
 		return c, nil
 	}
 }
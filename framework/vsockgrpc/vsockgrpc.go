@@ -0,0 +1,99 @@
+// Package vsockgrpc runs gRPC over vsock. Clients dial targets such as
+// vsock:3:1024 or vsock://host:1024, with the host and port as
+// vsock.ParseAddr reads them, given DialOptions:
+//
+//	conn, err := grpc.NewClient("vsock:3:1024", append(vsockgrpc.DialOptions(),
+//		grpc.WithTransportCredentials(insecure.NewCredentials()))...)
+//
+// Servers serve on a vsock listener as on any other, and tell the context
+// ID of their peer with PeerAddr.
+package vsockgrpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/resolver"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Scheme is the scheme of vsock targets.
+const Scheme = "vsock"
+
+// ContextDialer returns a dialer of the addresses of vsock targets, as
+// grpc.WithContextDialer takes it.
+func ContextDialer(options ...vsock.DialOption) func(ctx context.Context, address string) (net.Conn, error) {
+	var d vsock.Dialer
+	for _, option := range options {
+		option(&d)
+	}
+	return func(ctx context.Context, address string) (net.Conn, error) {
+		return d.DialNetwork(ctx, "", address)
+	}
+}
+
+// WithContextDialer dials with options; see ContextDialer.
+func WithContextDialer(options ...vsock.DialOption) grpc.DialOption {
+	return grpc.WithContextDialer(ContextDialer(options...))
+}
+
+// WithResolver resolves vsock targets, without registering Builder for
+// every client of the process.
+func WithResolver() grpc.DialOption {
+	return grpc.WithResolvers(Builder{})
+}
+
+// DialOptions are the options a client of vsock targets needs, the dialer
+// given options and the resolver. Transport credentials are left to the
+// caller.
+func DialOptions(options ...vsock.DialOption) []grpc.DialOption {
+	return []grpc.DialOption{WithResolver(), WithContextDialer(options...)}
+}
+
+// Builder resolves vsock targets to the one address they name. Register it
+// with resolver.Register to resolve them in every client.
+type Builder struct{}
+
+func (Builder) Scheme() string { return Scheme }
+
+func (Builder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	// vsock:3:1024 and vsock:///3:1024 name the address in the endpoint,
+	// vsock://3:1024 in the authority.
+	endpoint := target.Endpoint()
+	if endpoint == "" {
+		endpoint = target.URL.Host
+	}
+	addr, err := vsock.ParseAddr(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("vsockgrpc: target %q: %v", target.URL.String(), err)
+	}
+	state := resolver.State{Addresses: []resolver.Address{{
+		Addr: fmt.Sprintf("%d:%d", addr.ContextID, addr.Port),
+	}}}
+	if err := cc.UpdateState(state); err != nil {
+		return nil, err
+	}
+	return nopResolver{}, nil
+}
+
+// nopResolver has nothing to resolve again, the address being fixed.
+type nopResolver struct{}
+
+func (nopResolver) ResolveNow(resolver.ResolveNowOptions) {}
+func (nopResolver) Close()                                {}
+
+// PeerAddr returns the vsock address of the peer of the call of ctx, if it
+// came over vsock. The context ID cannot be forged by the peer, so it may
+// authorize the call.
+func PeerAddr(ctx context.Context) (*vsock.Addr, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil, false
+	}
+	addr, ok := p.Addr.(*vsock.Addr)
+	return addr, ok
+}
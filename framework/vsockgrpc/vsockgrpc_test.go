@@ -0,0 +1,66 @@
+//go:build linux
+
+package vsockgrpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+func TestClient(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	l, err := network.Machine(3).Listen(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := make(chan uint32, 4)
+	server := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if addr, ok := PeerAddr(ctx); ok {
+			peers <- addr.ContextID
+		}
+		return handler(ctx, req)
+	}))
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(l)
+	defer server.Stop()
+
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	for _, target := range []string{"vsock:3:1024", "vsock://3:1024", "vsock:///vm(3):1024"} {
+		t.Run(target, func(t *testing.T) {
+			options := append(DialOptions(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+			conn, err := grpc.NewClient(target, options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(healthpb.HealthCheckResponse_SERVING, resp.Status); diff != "" {
+				t.Fatalf("unexpected status (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(uint32(vsock.Host), <-peers); diff != "" {
+				t.Fatalf("unexpected peer (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	if _, err := grpc.NewClient("vsock:3", DialOptions()...); err == nil {
+		t.Fatal("expected a target without a port to fail")
+	}
+}
@@ -0,0 +1,94 @@
+// Package vsockhttp runs HTTP over vsock: a Transport and Client which dial
+// the context ID and port of request URLs, such as http://3:8080/, and a
+// server helper which tells handlers the context ID of their peer.
+//
+// gRPC has its own glue, in package vsockgrpc, so HTTP users need not
+// depend on it.
+package vsockhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Transport returns a transport dialing the host and port of request URLs,
+// as vsock.ParseAddr reads them, with d, or a zero Dialer if d is nil.
+// Proxies from the environment, which would be dialed over vsock too, are
+// ignored.
+func Transport(d *vsock.Dialer) *http.Transport {
+	if d == nil {
+		d = &vsock.Dialer{}
+	}
+	return newTransport(d.DialNetwork)
+}
+
+// TransportTo returns a transport dialing port on contextID for every
+// request, whatever its URL, with d, or a zero Dialer if d is nil. The URL
+// host then only names the peer in the Host header, as in http://vsock/.
+func TransportTo(contextID, port uint32, d *vsock.Dialer) *http.Transport {
+	if d == nil {
+		d = &vsock.Dialer{}
+	}
+	return newTransport(func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return d.DialContext(ctx, contextID, port)
+	})
+}
+
+func newTransport(dial func(ctx context.Context, network, address string) (net.Conn, error)) *http.Transport {
+	// The timeouts are those of http.DefaultTransport; connect timeouts are
+	// the business of the dialer.
+	return &http.Transport{
+		DialContext:           dial,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Client returns a client over Transport(d).
+func Client(d *vsock.Dialer) *http.Client {
+	return &http.Client{Transport: Transport(d)}
+}
+
+type peerKey struct{}
+
+// NewServer returns a server of handler whose requests carry the address of
+// their peer, for PeerAddr. Its ReadHeaderTimeout, unset, would let a guest
+// hold a connection forever.
+func NewServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			return context.WithValue(ctx, peerKey{}, conn.RemoteAddr())
+		},
+	}
+}
+
+// Serve serves handler on l with NewServer until l fails.
+func Serve(l net.Listener, handler http.Handler) error {
+	return NewServer(handler).Serve(l)
+}
+
+// ListenAndServe serves handler on port of every local context ID.
+func ListenAndServe(port uint32, handler http.Handler) error {
+	l, err := vsock.Listen(port)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return Serve(l, handler)
+}
+
+// PeerAddr returns the vsock address of the peer of r, if r came over vsock
+// to a server from NewServer. Unlike r.RemoteAddr, the context ID cannot be
+// forged by the peer, so it may authorize the request.
+func PeerAddr(r *http.Request) (*vsock.Addr, bool) {
+	addr, ok := r.Context().Value(peerKey{}).(*vsock.Addr)
+	return addr, ok
+}
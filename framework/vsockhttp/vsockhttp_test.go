@@ -0,0 +1,71 @@
+//go:build linux
+
+package vsockhttp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	vsock "github.com/multiverse-os/vcable/framework/vsock"
+	"github.com/multiverse-os/vcable/framework/vsocktest"
+)
+
+func TestClient(t *testing.T) {
+	network := vsocktest.NewNetwork()
+	l, err := network.Machine(3).Listen(8080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := PeerAddr(r)
+		if !ok {
+			http.Error(w, "not a vsock connection", http.StatusForbidden)
+			return
+		}
+		fmt.Fprintf(w, "%s from %d", r.URL.Path, addr.ContextID)
+	}))
+	go server.Serve(l)
+	defer server.Close()
+
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	for _, tt := range []struct {
+		name   string
+		client *http.Client
+		url    string
+	}{
+		{"Client", Client(nil), "http://3:8080/a"},
+		{"TransportTo", &http.Client{Transport: TransportTo(3, 8080, nil)}, "http://vsock/a"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.client.CloseIdleConnections()
+			resp, err := tt.client.Get(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			b, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff("/a from 2", string(b)); diff != "" {
+				t.Fatalf("unexpected body (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// A port nobody listens on fails the request, not hangs it.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://3:8081/", nil)
+	if _, err := Client(nil).Do(req); err == nil {
+		t.Fatal("expected a request to a closed port to fail")
+	}
+}
@@ -0,0 +1,13 @@
+//go:build linux
+
+package vsocktest
+
+import "github.com/multiverse-os/vcable/framework/vsock"
+
+// Install makes the machine the backend of package vsock until restore is
+// called: vsock.Listen, vsock.Dial and vsock.ContextID then act on the
+// network as this machine. It is meant for tests, which must not run in
+// parallel with others using vsock.
+func (self *Machine) Install() (restore func()) {
+	return vsock.SetBackend(self)
+}
@@ -0,0 +1,60 @@
+//go:build linux
+
+package vsocktest
+
+import (
+	"io"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestInstall(t *testing.T) {
+	network := NewNetwork()
+	restore := network.Machine(vsock.Host).Install()
+	defer restore()
+
+	cid, err := vsock.ContextID()
+	if err != nil {
+		t.Fatalf("failed to get the context ID: %v", err)
+	}
+	if diff := cmp.Diff(uint32(vsock.Host), cid); diff != "" {
+		t.Fatalf("unexpected context ID (-want +got):\n%s", diff)
+	}
+
+	l, err := vsock.Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := network.Machine(3).Dial(vsock.Host, 1024)
+		if err != nil {
+			return
+		}
+		c.Write([]byte("hello"))
+		c.Close()
+	}()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept: %v", err)
+	}
+	defer c.Close()
+	if diff := cmp.Diff(uint32(3), c.RemoteAddr().(*vsock.Addr).ContextID); diff != "" {
+		t.Fatalf("unexpected peer (-want +got):\n%s", diff)
+	}
+	b, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("hello", string(b)); diff != "" {
+		t.Fatalf("unexpected message (-want +got):\n%s", diff)
+	}
+
+	// Dials from the machine go through the network too.
+	if _, err := vsock.Dial(3, 1024); err == nil {
+		t.Fatal("expected dialing a port nobody listens on to fail")
+	}
+}
@@ -0,0 +1,230 @@
+// Package vsocktest runs vsock connections in memory, so code built on
+// package vsock can be tested on machines without /dev/vsock. A Network
+// stands in for the hypervisor, routing connections between the Machines
+// on it by context ID and port; Install makes a Machine the backend of
+// package vsock itself.
+package vsocktest
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Backlog is how many connections a Listener queues before dials to it
+// block.
+const Backlog = 16
+
+// Network routes connections between the listeners of its machines.
+type Network struct {
+	mu        sync.Mutex
+	listeners map[vsock.Addr]*Listener
+	// nextPort is the next dynamic port tried.
+	nextPort uint32
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		listeners: make(map[vsock.Addr]*Listener),
+		nextPort:  vsock.DynamicPortMin,
+	}
+}
+
+// Machine returns the machine with contextID on the network, such as
+// vsock.Host or a guest's context ID.
+func (self *Network) Machine(contextID uint32) *Machine {
+	return &Machine{network: self, contextID: contextID}
+}
+
+// dynamicPort returns a port of contextID no listener is bound to; self.mu
+// must be held. Ports of dialing ends are drawn from the same sequence, so
+// they are unique too.
+func (self *Network) dynamicPort(contextID uint32) uint32 {
+	for {
+		port := self.nextPort
+		if self.nextPort++; self.nextPort == vsock.Any {
+			self.nextPort = vsock.DynamicPortMin
+		}
+		if _, ok := self.listeners[vsock.Addr{ContextID: contextID, Port: port}]; !ok {
+			return port
+		}
+	}
+}
+
+// Machine is a machine on a Network. It satisfies vsock.Backend.
+type Machine struct {
+	network   *Network
+	contextID uint32
+}
+
+func (self *Machine) ContextID() uint32 { return self.contextID }
+
+// Listen listens on port of the machine, or on a dynamic port if port is
+// zero; the listener is a *Listener. It fails with syscall.EADDRINUSE if
+// the port is taken.
+func (self *Machine) Listen(port uint32) (net.Listener, error) {
+	n := self.network
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if port == 0 || port == vsock.Any {
+		port = n.dynamicPort(self.contextID)
+	}
+	addr := vsock.Addr{ContextID: self.contextID, Port: port}
+	if _, ok := n.listeners[addr]; ok {
+		return nil, syscall.EADDRINUSE
+	}
+	l := &Listener{
+		network: n,
+		addr:    &addr,
+		backlog: make(chan *Conn, Backlog),
+		done:    make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial dials port on contextID; the connection is a *Conn.
+func (self *Machine) Dial(contextID, port uint32) (net.Conn, error) {
+	return self.DialContext(context.Background(), contextID, port)
+}
+
+// DialContext dials port on contextID, where vsock.Local is the machine
+// itself. It fails with syscall.ECONNREFUSED when nothing listens there,
+// and blocks while the listener's backlog is full.
+func (self *Machine) DialContext(ctx context.Context, contextID, port uint32) (net.Conn, error) {
+	if contextID == vsock.Local {
+		contextID = self.contextID
+	}
+	n := self.network
+	n.mu.Lock()
+	l, ok := n.listeners[vsock.Addr{ContextID: contextID, Port: port}]
+	local := &vsock.Addr{ContextID: self.contextID, Port: n.dynamicPort(self.contextID)}
+	n.mu.Unlock()
+	if !ok {
+		return nil, syscall.ECONNREFUSED
+	}
+
+	client, server := pipe(local, l.addr)
+	select {
+	case l.backlog <- server:
+		select {
+		case <-l.done:
+			// Closed meanwhile, perhaps after draining the backlog.
+			l.drain()
+		default:
+		}
+		return client, nil
+	case <-l.done:
+		return nil, syscall.ECONNREFUSED
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+var _ net.Listener = &Listener{}
+
+// Listener accepts the connections dialed to its address.
+type Listener struct {
+	network *Network
+	addr    *vsock.Addr
+	backlog chan *Conn
+	done    chan struct{}
+
+	mu       sync.Mutex
+	closed   bool
+	deadline time.Time
+	// changed is closed, and replaced, when the deadline is set.
+	changed chan struct{}
+}
+
+func (self *Listener) Addr() net.Addr { return self.addr }
+
+func (self *Listener) Accept() (net.Conn, error) {
+	for {
+		self.mu.Lock()
+		if self.closed {
+			self.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		deadline, changed := self.deadline, self.changed
+		self.mu.Unlock()
+
+		if c, err, ok := self.accept(deadline, changed); ok {
+			return c, err
+		}
+	}
+}
+
+// accept waits for a connection until deadline, returning ok false if the
+// deadline changed first.
+func (self *Listener) accept(deadline time.Time, changed <-chan struct{}) (c net.Conn, err error, ok bool) {
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, os.ErrDeadlineExceeded, true
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case c := <-self.backlog:
+		return c, nil, true
+	case <-self.done:
+		return nil, net.ErrClosed, true
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded, true
+	case <-changed:
+		return nil, nil, false
+	}
+}
+
+// SetDeadline sets the deadline of Accept.
+func (self *Listener) SetDeadline(t time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return net.ErrClosed
+	}
+	self.deadline = t
+	close(self.changed)
+	self.changed = make(chan struct{})
+	return nil
+}
+
+// Close stops listening, refusing the connections not yet accepted.
+func (self *Listener) Close() error {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return net.ErrClosed
+	}
+	self.closed = true
+	close(self.done)
+	self.mu.Unlock()
+
+	self.network.mu.Lock()
+	delete(self.network.listeners, *self.addr)
+	self.network.mu.Unlock()
+	self.drain()
+	return nil
+}
+
+// drain closes the connections queued on the backlog.
+func (self *Listener) drain() {
+	for {
+		select {
+		case c := <-self.backlog:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package vsocktest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/multiverse-os/vcable/framework/vsock"
+)
+
+func TestNetwork(t *testing.T) {
+	network := NewNetwork()
+	host, guest := network.Machine(vsock.Host), network.Machine(3)
+
+	l, err := host.Listen(1024)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer l.Close()
+	if _, err := host.Listen(1024); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected EADDRINUSE listening twice, got %v", err)
+	}
+	if _, err := guest.Dial(vsock.Host, 1025); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("expected ECONNREFUSED dialing a port nobody listens on, got %v", err)
+	}
+
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.Copy(c, c)
+	}()
+	c, err := guest.Dial(vsock.Host, 1024)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+
+	local := c.LocalAddr().(*vsock.Addr)
+	got := []*vsock.Addr{{ContextID: local.ContextID}, c.RemoteAddr().(*vsock.Addr)}
+	want := []*vsock.Addr{{ContextID: 3}, {ContextID: vsock.Host, Port: 1024}}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("unexpected addresses (-want +got):\n%s", diff)
+	}
+
+	if _, err := c.Write([]byte("echo")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(c, b); err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if diff := cmp.Diff("echo", string(b)); diff != "" {
+		t.Fatalf("unexpected echo (-want +got):\n%s", diff)
+	}
+}
+
+func TestNetworkBacklog(t *testing.T) {
+	network := NewNetwork()
+	m := network.Machine(3)
+	l, err := m.Listen(0)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	port := l.Addr().(*vsock.Addr).Port
+
+	// Dials to the machine itself block once the backlog is full.
+	var queued []net.Conn
+	for i := 0; i < Backlog; i++ {
+		c, err := m.Dial(vsock.Local, port)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		queued = append(queued, c)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := m.DialContext(ctx, vsock.Local, port); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the dial to time out on a full backlog, got %v", err)
+	}
+
+	// Closing the listener resets what it had not accepted.
+	l.Close()
+	if _, err := queued[0].Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF from a refused connection, got %v", err)
+	}
+	if _, err := l.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected ErrClosed accepting on a closed listener, got %v", err)
+	}
+}
@@ -0,0 +1,257 @@
+package vsocktest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/multiverse-os/vcable/framework/vsock"
+)
+
+// Window is how many bytes each direction of a connection buffers before
+// writes block, as a socket's send and receive buffers would.
+const Window = 64 << 10
+
+var _ net.Conn = &Conn{}
+
+// Conn is one end of an in-memory vsock connection. Unlike net.Pipe its
+// writes are buffered, up to Window bytes, and either direction can be
+// shut down on its own.
+type Conn struct {
+	local, remote *vsock.Addr
+	in, out       *half
+
+	mu            sync.Mutex
+	closed        bool
+	readDeadline  time.Time
+	writeDeadline time.Time
+	// changed is closed, and replaced, when a deadline is set or the
+	// connection closed, to wake blocked reads and writes.
+	changed chan struct{}
+}
+
+// half is one direction of a connection.
+type half struct {
+	mu   sync.Mutex
+	buf  []byte
+	eof  bool // the writer shut down
+	gone bool // the reader shut down; writes fail
+	// changed is closed, and replaced, on any change to the above.
+	changed chan struct{}
+}
+
+func newHalf() *half { return &half{changed: make(chan struct{})} }
+
+// notify wakes the waiters on self; self.mu must be held.
+func (self *half) notify() {
+	close(self.changed)
+	self.changed = make(chan struct{})
+}
+
+// Pipe returns both ends of a connection between port 1024 of the host
+// and a dynamic port of the guest with context ID 3: the first end is the
+// guest's, the second the host's.
+func Pipe() (*Conn, *Conn) {
+	return pipe(
+		&vsock.Addr{ContextID: 3, Port: vsock.DynamicPortMin},
+		&vsock.Addr{ContextID: vsock.Host, Port: 1024},
+	)
+}
+
+func pipe(a, b *vsock.Addr) (*Conn, *Conn) {
+	ab, ba := newHalf(), newHalf()
+	return &Conn{local: a, remote: b, in: ba, out: ab, changed: make(chan struct{})},
+		&Conn{local: b, remote: a, in: ab, out: ba, changed: make(chan struct{})}
+}
+
+func (self *Conn) LocalAddr() net.Addr  { return self.local }
+func (self *Conn) RemoteAddr() net.Addr { return self.remote }
+
+// Read reads buffered data, blocking until some arrives. It returns io.EOF
+// once the peer has shut down writing and everything was read.
+func (self *Conn) Read(b []byte) (int, error) {
+	for {
+		if err := self.check(&self.readDeadline); err != nil {
+			return 0, err
+		}
+		h := self.in
+		h.mu.Lock()
+		if len(h.buf) > 0 {
+			n := copy(b, h.buf)
+			h.buf = h.buf[n:]
+			h.notify()
+			h.mu.Unlock()
+			return n, nil
+		}
+		if h.eof || h.gone {
+			h.mu.Unlock()
+			return 0, io.EOF
+		}
+		wait := h.changed
+		h.mu.Unlock()
+		if err := self.wait(wait, &self.readDeadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write buffers b for the peer, blocking while its buffer is full. Writes
+// fail with syscall.EPIPE once either side has shut the direction down.
+func (self *Conn) Write(b []byte) (int, error) {
+	var n int
+	for {
+		if err := self.check(&self.writeDeadline); err != nil {
+			return n, err
+		}
+		h := self.out
+		h.mu.Lock()
+		if h.eof || h.gone {
+			h.mu.Unlock()
+			return n, syscall.EPIPE
+		}
+		if space := Window - len(h.buf); space > 0 {
+			m := len(b)
+			if m > space {
+				m = space
+			}
+			h.buf = append(h.buf, b[:m]...)
+			h.notify()
+			h.mu.Unlock()
+			n, b = n+m, b[m:]
+			if len(b) == 0 {
+				return n, nil
+			}
+			continue
+		}
+		wait := h.changed
+		h.mu.Unlock()
+		if err := self.wait(wait, &self.writeDeadline); err != nil {
+			return n, err
+		}
+	}
+}
+
+// CloseWrite shuts down writing; the peer reads io.EOF after the data
+// already written.
+func (self *Conn) CloseWrite() error {
+	if err := self.check(nil); err != nil {
+		return err
+	}
+	self.out.mu.Lock()
+	defer self.out.mu.Unlock()
+	self.out.eof = true
+	self.out.notify()
+	return nil
+}
+
+// CloseRead shuts down reading, discarding anything buffered; the peer's
+// writes fail from then on.
+func (self *Conn) CloseRead() error {
+	if err := self.check(nil); err != nil {
+		return err
+	}
+	self.in.mu.Lock()
+	defer self.in.mu.Unlock()
+	self.in.gone = true
+	self.in.buf = nil
+	self.in.notify()
+	return nil
+}
+
+// Close shuts down both directions and fails blocked reads and writes with
+// net.ErrClosed.
+func (self *Conn) Close() error {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return net.ErrClosed
+	}
+	self.closed = true
+	close(self.changed)
+	self.mu.Unlock()
+
+	self.shutdown()
+	return nil
+}
+
+// shutdown shuts both directions down.
+func (self *Conn) shutdown() {
+	self.out.mu.Lock()
+	self.out.eof = true
+	self.out.notify()
+	self.out.mu.Unlock()
+
+	self.in.mu.Lock()
+	self.in.gone = true
+	self.in.buf = nil
+	self.in.notify()
+	self.in.mu.Unlock()
+}
+
+func (self *Conn) SetDeadline(t time.Time) error {
+	return self.setDeadline(t, &self.readDeadline, &self.writeDeadline)
+}
+
+func (self *Conn) SetReadDeadline(t time.Time) error {
+	return self.setDeadline(t, &self.readDeadline)
+}
+
+func (self *Conn) SetWriteDeadline(t time.Time) error {
+	return self.setDeadline(t, &self.writeDeadline)
+}
+
+func (self *Conn) setDeadline(t time.Time, deadlines ...*time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return net.ErrClosed
+	}
+	for _, d := range deadlines {
+		*d = t
+	}
+	close(self.changed)
+	self.changed = make(chan struct{})
+	return nil
+}
+
+// check fails once the connection is closed or, unless deadline is nil,
+// once *deadline has passed.
+func (self *Conn) check(deadline *time.Time) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return net.ErrClosed
+	}
+	if deadline != nil && !deadline.IsZero() && !time.Now().Before(*deadline) {
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+// wait blocks until wake is closed, *deadline passes or is set, or the
+// connection is closed; the caller then checks again.
+func (self *Conn) wait(wake <-chan struct{}, deadline *time.Time) error {
+	self.mu.Lock()
+	if self.closed {
+		self.mu.Unlock()
+		return net.ErrClosed
+	}
+	d, changed := *deadline, self.changed
+	self.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-wake:
+	case <-changed:
+	case <-expired:
+	}
+	return nil
+}
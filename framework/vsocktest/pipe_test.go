@@ -0,0 +1,84 @@
+package vsocktest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPipe(t *testing.T) {
+	guest, host := Pipe()
+	defer guest.Close()
+	defer host.Close()
+
+	// Writes larger than the window complete once the peer reads.
+	want := bytes.Repeat([]byte("vsock"), Window)
+	go func() {
+		guest.Write(want)
+		guest.CloseWrite()
+	}()
+	got, err := io.ReadAll(host)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	if !bytes.Equal(want, got) {
+		t.Fatalf("read %d bytes, want the %d written", len(got), len(want))
+	}
+
+	// The other direction stays open after the half close.
+	if _, err := host.Write([]byte("reply")); err != nil {
+		t.Fatalf("failed to reply: %v", err)
+	}
+	b := make([]byte, 8)
+	n, err := guest.Read(b)
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+	if diff := cmp.Diff("reply", string(b[:n])); diff != "" {
+		t.Fatalf("unexpected reply (-want +got):\n%s", diff)
+	}
+
+	if _, err := guest.Write([]byte("more")); !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected EPIPE writing after CloseWrite, got %v", err)
+	}
+	if err := guest.CloseRead(); err != nil {
+		t.Fatalf("failed to close reading: %v", err)
+	}
+	if _, err := host.Write([]byte("more")); !errors.Is(err, syscall.EPIPE) {
+		t.Fatalf("expected EPIPE writing to a peer which closed reading, got %v", err)
+	}
+}
+
+func TestPipeDeadline(t *testing.T) {
+	guest, host := Pipe()
+	defer guest.Close()
+	defer host.Close()
+
+	guest.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := guest.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+
+	// Clearing the deadline and closing wake a blocked read.
+	guest.SetReadDeadline(time.Time{})
+	done := make(chan error)
+	go func() {
+		_, err := guest.Read(make([]byte, 1))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	guest.Close()
+	if err := <-done; !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected the read to fail with ErrClosed, got %v", err)
+	}
+	if _, err := host.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the peer to read EOF, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+module github.com/multiverse-os/vcable
+
+go 1.25.0
+
+require (
+	github.com/fxamacker/cbor/v2 v2.9.4
+	github.com/google/go-cmp v0.7.0
+	github.com/mdlayher/vsock v1.3.0
+	github.com/tidwall/redcon v1.6.4
+	golang.org/x/net v0.57.0
+	golang.org/x/sync v0.22.0
+	golang.org/x/sys v0.47.0
+	google.golang.org/grpc v1.84.0
+)
+
+require (
+	github.com/mdlayher/socket v0.6.0 // indirect
+	github.com/tidwall/btree v1.1.0 // indirect
+	github.com/tidwall/match v1.1.1 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+	google.golang.org/protobuf v1.36.11 // indirect
+)